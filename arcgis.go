@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ArcGISError is the error envelope ArcGIS returns, frequently with a 200 status
+type ArcGISError struct {
+	Code    int      `json:"code"`
+	Message string   `json:"message"`
+	Details []string `json:"details"`
+}
+
+func (e *ArcGISError) Error() string {
+	if len(e.Details) > 0 {
+		return fmt.Sprintf("ArcGIS error %d: %s (%s)", e.Code, e.Message, strings.Join(e.Details, "; "))
+	}
+	return fmt.Sprintf("ArcGIS error %d: %s", e.Code, e.Message)
+}
+
+// The client used for every call to ArcGIS, its metadata cache, and the
+// transport underneath its retries and caching
+var (
+	arcgisCache                           = newCacheTransport(http.DefaultTransport)
+	arcgisClient                          = &http.Client{Transport: newRetryTransport(arcgisCache)}
+	arcgisBaseTransport http.RoundTripper = http.DefaultTransport
+)
+
+// Send ArcGIS requests through a different transport, like one that trusts the fake portal
+func useBaseTransport(base http.RoundTripper) {
+	arcgisBaseTransport = base
+	arcgisCache = newCacheTransport(base)
+	arcgisClient.Transport = newRetryTransport(arcgisCache)
+}
+
+// Make a GET request against an ArcGIS REST endpoint and decode the JSON response into result
+func arcgisGet(ctx context.Context, access string, baseURL string, params url.Values, result any) error {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("f", "json")
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+"?"+params.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("Failed to create request: %v", err)
+	}
+	return arcgisDo(req, access, result)
+}
+
+// Make a form-encoded POST request against an ArcGIS REST endpoint and decode the JSON response into result
+func arcgisPost(ctx context.Context, access string, baseURL string, form url.Values, result any) error {
+	if form == nil {
+		form = url.Values{}
+	}
+	form.Set("f", "json")
+	req, err := http.NewRequestWithContext(ctx, "POST", baseURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("Failed to create request: %v", err)
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	return arcgisDo(req, access, result)
+}
+
+func arcgisDo(req *http.Request, access string, result any) error {
+	bodyBytes, err := arcgisDoRaw(req, access)
+	if err != nil {
+		return err
+	}
+	var envelope struct {
+		Error *ArcGISError `json:"error"`
+	}
+	if err := json.Unmarshal(bodyBytes, &envelope); err == nil && envelope.Error != nil {
+		return envelope.Error
+	}
+	if result == nil {
+		return nil
+	}
+	err = json.Unmarshal(bodyBytes, result)
+	if err != nil {
+		return fmt.Errorf("Failed to unmarshal JSON: %v", err)
+	}
+	return nil
+}
+
+func arcgisDoRaw(req *http.Request, access string) ([]byte, error) {
+	resp, err := arcgisOpen(req, access)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read response body: %v", err)
+	}
+	return bodyBytes, nil
+}
+
+// Send a request and hand back the response for the caller to read, and close,
+// as long as the status isn't an error
+func arcgisOpen(req *http.Request, access string) (*http.Response, error) {
+	if access != "" {
+		req.Header.Add("X-ESRI-Authorization", "Bearer "+access)
+	}
+	log.Printf("%s %s", req.Method, req.URL.Path)
+	resp, err := arcgisClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to do request: %v", err)
+	}
+	log.Printf("Response %d", resp.StatusCode)
+	if resp.StatusCode < http.StatusBadRequest {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Got status code %d and failed to read response body: %v", resp.StatusCode, err)
+	}
+	bodyString := string(bodyBytes)
+	var errorResp map[string]interface{}
+	if err := json.Unmarshal(bodyBytes, &errorResp); err == nil {
+		return nil, fmt.Errorf("API response JSON error: %d: %v", resp.StatusCode, errorResp)
+	}
+	return nil, fmt.Errorf("API returned error status %d: %s", resp.StatusCode, bodyString)
+}
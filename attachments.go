@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type ArcGISAttachment struct {
+	ID          int64  `json:"id"`
+	GlobalID    string `json:"globalId"`
+	ParentID    int64  `json:"parentObjectId"`
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	Keywords    string `json:"keywords"`
+	URL         string `json:"url"`
+}
+
+type ArcGISAttachmentGroup struct {
+	ParentObjectID int64              `json:"parentObjectId"`
+	ParentGlobalID string             `json:"parentGlobalId"`
+	Attachments    []ArcGISAttachment `json:"attachmentInfos"`
+}
+
+// List the attachments of the features with the given object IDs, or of the
+// features matching the where clause if there are no IDs.
+func queryAttachments(ctx context.Context, access string, layer *ArcGISLayer, objectIDs []int64, where string) ([]ArcGISAttachmentGroup, error) {
+	if !layer.HasAttachments {
+		return nil, fmt.Errorf("Layer %s doesn't have attachments", layer.URL)
+	}
+	params := url.Values{}
+	if len(objectIDs) > 0 {
+		params.Set("objectIds", joinObjectIDs(objectIDs))
+	}
+	if where != "" {
+		params.Set("definitionExpression", where)
+	}
+	if len(objectIDs) == 0 && where == "" {
+		params.Set("definitionExpression", "1=1")
+	}
+	var response struct {
+		AttachmentGroups []ArcGISAttachmentGroup `json:"attachmentGroups"`
+	}
+	err := arcgisPost(ctx, access, layer.URL+"/queryAttachments", params, &response)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query attachments of %s: %w", layer.URL, err)
+	}
+	for i := range response.AttachmentGroups {
+		for j := range response.AttachmentGroups[i].Attachments {
+			a := &response.AttachmentGroups[i].Attachments[j]
+			a.ParentID = response.AttachmentGroups[i].ParentObjectID
+		}
+	}
+	return response.AttachmentGroups, nil
+}
+
+// Open the content of an attachment. The caller must close the body.
+func openAttachment(ctx context.Context, access string, layerURL string, objectID int64, attachmentID int64) (*http.Response, error) {
+	u := layerURL + "/" + strconv.FormatInt(objectID, 10) + "/attachments/" + strconv.FormatInt(attachmentID, 10)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create request: %v", err)
+	}
+	resp, err := arcgisOpen(req, access)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get attachment %d of %d: %w", attachmentID, objectID, err)
+	}
+	return resp, nil
+}
+
+// Copy the attachment to the response so the browser never needs the user's token
+func proxyAttachment(ctx context.Context, w http.ResponseWriter, access string, layerURL string, objectID int64, attachmentID int64) error {
+	resp, err := openAttachment(ctx, access, layerURL, objectID, attachmentID)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	for _, h := range []string{"Content-Length", "Content-Disposition", "Last-Modified", "ETag"} {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	// Anything but an image gets downloaded rather than rendered on our origin
+	contentType := resp.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "image/") && !strings.Contains(contentType, "svg") {
+		w.Header().Set("Content-Type", contentType)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
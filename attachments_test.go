@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A layer whose attachments are served by a stub server
+func attachmentServer(t *testing.T) *ArcGISLayer {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /FeatureServer/0/queryAttachments", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("objectIds") != "1,2" {
+			http.Error(w, "unexpected objectIds "+r.FormValue("objectIds"), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"attachmentGroups": [
+			{"parentObjectId": 1, "parentGlobalId": "{A}", "attachmentInfos": [
+				{"id": 10, "name": "basin.jpg", "contentType": "image/jpeg", "size": 4},
+				{"id": 11, "name": "notes.html", "contentType": "text/html", "size": 13}
+			]},
+			{"parentObjectId": 2, "parentGlobalId": "{B}", "attachmentInfos": [
+				{"id": 12, "name": "map.svg", "contentType": "image/svg+xml", "size": 6}
+			]}
+		]}`)
+	})
+	serve := func(contentType string, body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Disposition", `inline; filename="upstream"`)
+			fmt.Fprint(w, body)
+		}
+	}
+	mux.HandleFunc("GET /FeatureServer/0/1/attachments/10", serve("image/jpeg", "jpeg"))
+	mux.HandleFunc("GET /FeatureServer/0/1/attachments/11", serve("text/html", "<script></script>"))
+	mux.HandleFunc("GET /FeatureServer/0/2/attachments/12", serve("image/svg+xml", "<svg/>"))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return &ArcGISLayer{URL: server.URL + "/FeatureServer/0", HasAttachments: true}
+}
+
+func TestQueryAttachments(t *testing.T) {
+	layer := attachmentServer(t)
+	groups, err := queryAttachments(context.Background(), "", layer, []int64{1, 2}, "")
+	if err != nil {
+		t.Fatalf("Failed to query attachments: %v", err)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("Got %d attachment groups, want 2", len(groups))
+	}
+	if n := len(groups[0].Attachments); n != 2 {
+		t.Fatalf("Feature 1 has %d attachments, want 2", n)
+	}
+	for _, group := range groups {
+		for _, a := range group.Attachments {
+			if a.ParentID != group.ParentObjectID {
+				t.Errorf("Attachment %d has parent %d, want %d", a.ID, a.ParentID, group.ParentObjectID)
+			}
+		}
+	}
+
+	layer.HasAttachments = false
+	_, err = queryAttachments(context.Background(), "", layer, []int64{1, 2}, "")
+	if err == nil {
+		t.Error("Queried attachments of a layer without them")
+	}
+}
+
+func TestProxyAttachment(t *testing.T) {
+	layer := attachmentServer(t)
+	tests := []struct {
+		objectID     int64
+		attachmentID int64
+		contentType  string
+		disposition  string
+	}{
+		// Images are shown inline, with the upstream disposition
+		{1, 10, "image/jpeg", `inline; filename="upstream"`},
+		// Anything that could run script on our origin is downloaded instead
+		{1, 11, "application/octet-stream", "attachment"},
+		{2, 12, "application/octet-stream", "attachment"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		err := proxyAttachment(context.Background(), w, "", layer.URL, test.objectID, test.attachmentID)
+		if err != nil {
+			t.Fatalf("Failed to proxy attachment %d: %v", test.attachmentID, err)
+		}
+		if got := w.Header().Get("Content-Type"); got != test.contentType {
+			t.Errorf("Attachment %d has content type %s, want %s", test.attachmentID, got, test.contentType)
+		}
+		if got := w.Header().Get("Content-Disposition"); got != test.disposition {
+			t.Errorf("Attachment %d has disposition %s, want %s", test.attachmentID, got, test.disposition)
+		}
+		if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+			t.Errorf("Attachment %d has X-Content-Type-Options %s, want nosniff", test.attachmentID, got)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	err := proxyAttachment(context.Background(), w, "", layer.URL, 1, 99)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Got %v for a missing attachment, want a 404", err)
+	}
+}
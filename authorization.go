@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
@@ -14,6 +15,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 var CodeVerifier string = "random_secure_string_min_43_chars_long_should_be_stored_in_session"
@@ -26,9 +28,38 @@ type OAuthTokenResponse struct {
 }
 
 var TokenDatabase map[string]OAuthTokenResponse
+var tokenDatabaseLock sync.Mutex
+
+// Get the token of a user
+func getToken(username string) (OAuthTokenResponse, bool) {
+	tokenDatabaseLock.Lock()
+	defer tokenDatabaseLock.Unlock()
+	token, ok := TokenDatabase[username]
+	return token, ok
+}
+
+// Find the user whose current access token this is
+func findTokenByAccess(access string) (OAuthTokenResponse, bool) {
+	tokenDatabaseLock.Lock()
+	defer tokenDatabaseLock.Unlock()
+	for _, token := range TokenDatabase {
+		if token.AccessToken == access {
+			return token, true
+		}
+	}
+	return OAuthTokenResponse{}, false
+}
+
+// Store a user's token and save the database
+func putToken(token OAuthTokenResponse) error {
+	tokenDatabaseLock.Lock()
+	defer tokenDatabaseLock.Unlock()
+	TokenDatabase[token.Username] = token
+	return saveTokenDatabase()
+}
 
 func handleAccessCode(code string) (*OAuthTokenResponse, error) {
-	baseURL := "https://www.arcgis.com/sharing/rest/oauth2/token/"
+	baseURL := PortalURL + "/sharing/rest/oauth2/token/"
 
 	//params.Add("code_verifier", "S256")
 
@@ -44,9 +75,8 @@ func handleAccessCode(code string) (*OAuthTokenResponse, error) {
 		return nil, fmt.Errorf("Failed to create request: %v", err)
 	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	client := http.Client{}
 	log.Printf("POST %s", baseURL)
-	resp, err := client.Do(req)
+	resp, err := arcgisClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to do request: %v", err)
 	}
@@ -70,15 +100,66 @@ func handleAccessCode(code string) (*OAuthTokenResponse, error) {
 		return nil, fmt.Errorf("Failed to unmarshal JSON: %v", err)
 	}
 	log.Printf("Refresh token '%s'", tokenResponse.RefreshToken)
-	TokenDatabase[tokenResponse.Username] = tokenResponse
-
-	err = saveTokenDatabase()
+	err = putToken(tokenResponse)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to save token database: %v", err)
 	}
 	return &tokenResponse, nil
 }
 
+// Get a new access token for a user with their refresh token
+func refreshAccessToken(ctx context.Context, client *http.Client, token OAuthTokenResponse) (*OAuthTokenResponse, error) {
+	baseURL := PortalURL + "/sharing/rest/oauth2/token/"
+	form := url.Values{
+		"grant_type":    []string{"refresh_token"},
+		"client_id":     []string{ClientID},
+		"refresh_token": []string{token.RefreshToken},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", baseURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create request: %v", err)
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	log.Printf("POST %s", baseURL)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to do request: %v", err)
+	}
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	log.Printf("Response %d", resp.StatusCode)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read response body: %v", err)
+	}
+	var refreshed struct {
+		OAuthTokenResponse
+		Error *ArcGISError `json:"error"`
+	}
+	err = json.Unmarshal(bodyBytes, &refreshed)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal JSON: %v", err)
+	}
+	if refreshed.Error != nil {
+		return nil, refreshed.Error
+	}
+	if resp.StatusCode >= http.StatusBadRequest || refreshed.AccessToken == "" {
+		return nil, fmt.Errorf("API returned error status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+	// The refresh token and username only come back when they change
+	result := token
+	result.AccessToken = refreshed.AccessToken
+	result.ExpiresIn = refreshed.ExpiresIn
+	if refreshed.RefreshToken != "" {
+		result.RefreshToken = refreshed.RefreshToken
+	}
+	err = putToken(result)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to save token database: %v", err)
+	}
+	log.Printf("Refreshed the access token of '%s'", result.Username)
+	return &result, nil
+}
+
 // Helper function to generate code challenge from code verifier
 func generateCodeChallenge(codeVerifier string) string {
 	hash := sha256.Sum256([]byte(codeVerifier))
@@ -94,7 +175,7 @@ func generateCodeVerifier() string {
 
 // Build the ArcGIS authorization URL with PKCE
 func buildArcGISAuthURL(clientID string, redirectURI string, expiration int) string {
-	baseURL := "https://www.arcgis.com/sharing/rest/oauth2/authorize/"
+	baseURL := PortalURL + "/sharing/rest/oauth2/authorize/"
 
 	params := url.Values{}
 	params.Add("client_id", clientID)
@@ -111,6 +192,19 @@ func initTokenDatabase() {
 	TokenDatabase = make(map[string]OAuthTokenResponse, 0)
 }
 
+// Load the tokens saved by a previous run, for the command line tools
+func loadTokenDatabase() error {
+	content, err := os.ReadFile("token.database")
+	if err != nil {
+		return fmt.Errorf("Failed to read token file: %v", err)
+	}
+	err = json.Unmarshal(content, &TokenDatabase)
+	if err != nil {
+		return fmt.Errorf("Failed to unmarshal token database: %v", err)
+	}
+	return nil
+}
+
 func redirectURL() string {
 	return BaseURL + "/oauth-callback"
 }
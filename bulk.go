@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BulkFetchOptions controls how fetchAllFeatures splits up the work
+type BulkFetchOptions struct {
+	// Number of object IDs per request, defaults to the layer's maxRecordCount
+	BatchSize int
+	// Number of requests in flight at once, defaults to 4
+	Concurrency int
+	// Number of times a failed batch is retried before giving up, defaults to 3
+	Retries int
+	// Called after each batch with the number of features fetched so far and the total
+	Progress func(done int, total int)
+}
+
+type bulkBatchResult struct {
+	features []ArcGISFeature
+	err      error
+}
+
+// Get the object IDs of every feature matching the query
+func queryObjectIDs(ctx context.Context, access string, layer *ArcGISLayer, q ArcGISQuery) ([]int64, error) {
+	params := q.params()
+	params.Set("returnIdsOnly", "true")
+	params.Del("outFields")
+	params.Del("orderByFields")
+	var response struct {
+		ObjectIDFieldName string  `json:"objectIdFieldName"`
+		ObjectIDs         []int64 `json:"objectIds"`
+	}
+	err := arcgisPost(ctx, access, layer.URL+"/query", params, &response)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query object IDs of %s: %w", layer.URL, err)
+	}
+	sort.Slice(response.ObjectIDs, func(i, j int) bool {
+		return response.ObjectIDs[i] < response.ObjectIDs[j]
+	})
+	return response.ObjectIDs, nil
+}
+
+// Fetch every feature matching the query by first getting all the object IDs
+// and then pulling the features in batches of IDs. This is much more reliable
+// than offset paging on large layers, but the features don't come back in any
+// particular order.
+func fetchAllFeatures(ctx context.Context, access string, layer *ArcGISLayer, q ArcGISQuery, opts BulkFetchOptions) iter.Seq2[ArcGISFeature, error] {
+	return func(yield func(ArcGISFeature, error) bool) {
+		ids, err := queryObjectIDs(ctx, access, layer, q)
+		if err != nil {
+			yield(ArcGISFeature{}, err)
+			return
+		}
+		batchSize := opts.BatchSize
+		if batchSize <= 0 {
+			batchSize = layer.MaxRecordCount
+		}
+		if batchSize <= 0 {
+			batchSize = 1000
+		}
+		concurrency := opts.Concurrency
+		if concurrency <= 0 {
+			concurrency = 4
+		}
+		retries := opts.Retries
+		if retries <= 0 {
+			retries = 3
+		}
+
+		batches := make(chan []int64)
+		results := make(chan bulkBatchResult)
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		var wg sync.WaitGroup
+		for range concurrency {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for batch := range batches {
+					features, err := fetchBatch(ctx, access, layer, q, batch, retries)
+					select {
+					case results <- bulkBatchResult{features: features, err: err}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+		}
+		go func() {
+			defer close(batches)
+			for start := 0; start < len(ids); start += batchSize {
+				end := min(start+batchSize, len(ids))
+				select {
+				case batches <- ids[start:end]:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
+
+		done := 0
+		for result := range results {
+			if result.err != nil {
+				yield(ArcGISFeature{}, result.err)
+				return
+			}
+			for _, f := range result.features {
+				if !yield(f, nil) {
+					return
+				}
+			}
+			done += len(result.features)
+			if opts.Progress != nil {
+				opts.Progress(done, len(ids))
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			yield(ArcGISFeature{}, err)
+		}
+	}
+}
+
+// Fetch a single batch of features by object ID, retrying with a growing delay
+func fetchBatch(ctx context.Context, access string, layer *ArcGISLayer, q ArcGISQuery, ids []int64, retries int) ([]ArcGISFeature, error) {
+	params := q.params()
+	params.Set("where", "1=1")
+	params.Del("orderByFields")
+	params.Set("objectIds", joinObjectIDs(ids))
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			delay := time.Duration(attempt) * time.Second
+			log.Printf("Retrying batch of %d features from %s in %s: %v", len(ids), layer.URL, delay, err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		var page *ArcGISQueryResponse
+		page, err = queryPage(ctx, access, layer, params)
+		if err == nil {
+			err = q.project(page)
+			if err != nil {
+				return nil, err
+			}
+			return page.Features, nil
+		}
+	}
+	return nil, fmt.Errorf("Failed to fetch batch of %d features after %d attempts: %w", len(ids), retries+1, err)
+}
+
+// Log the progress of a bulk fetch every tenth of the way through
+func logBulkProgress(layerURL string) func(done int, total int) {
+	logged := 0
+	return func(done int, total int) {
+		if done < total && done*10/total == logged*10/total {
+			return
+		}
+		logged = done
+		log.Printf("Fetched %d of %d features from %s", done, total, layerURL)
+	}
+}
+
+func joinObjectIDs(ids []int64) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestFetchAllFeaturesInBatches(t *testing.T) {
+	portal, counter := startFakePortal(t)
+	token := signIn(t, portal, "fake.technician")
+	ctx := context.Background()
+	layer, err := fetchLayer(ctx, token.AccessToken, fakeServiceURL(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	done := make([]int, 0)
+	opts := BulkFetchOptions{BatchSize: 1, Concurrency: 2, Progress: func(n int, total int) {
+		lock.Lock()
+		defer lock.Unlock()
+		if total != 4 {
+			t.Errorf("Progress has a total of %d, want 4", total)
+		}
+		done = append(done, n)
+	}}
+	names := make(map[string]bool)
+	for f, err := range fetchAllFeatures(ctx, token.AccessToken, layer, ArcGISQuery{}, opts) {
+		if err != nil {
+			t.Fatalf("Bulk fetch failed: %v", err)
+		}
+		names[f.Attributes["NAME"].(string)] = true
+	}
+	if len(names) != 4 {
+		t.Errorf("Got features %v, want all 4", names)
+	}
+	// One request for the IDs and then one for each feature
+	if n := counter.count("POST /arcgis/rest/services/FieldseekerGIS/FeatureServer/0/query"); n != 5 {
+		t.Errorf("Made %d queries, want 5", n)
+	}
+	if len(done) != 4 || done[len(done)-1] != 4 {
+		t.Errorf("Progress went %v, want four steps ending at 4", done)
+	}
+}
+
+func TestQueryFeaturesWithoutPagination(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	token := signIn(t, portal, "fake.technician")
+	limitFakeLayer(portal, 0, 3, false)
+	ctx := context.Background()
+	layer, err := fetchLayer(ctx, token.AccessToken, fakeServiceURL(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layer.MaxRecordCount != 3 || layer.AdvancedQueryCapabilities.SupportsPagination {
+		t.Fatalf("Layer has a maxRecordCount of %d and pagination %v", layer.MaxRecordCount, layer.AdvancedQueryCapabilities.SupportsPagination)
+	}
+
+	// The first response stops at 3, and the last feature is fetched by its ID
+	names := make(map[string]int)
+	for f, err := range queryFeatures(ctx, token.AccessToken, layer, ArcGISQuery{OutFields: []string{"NAME"}}) {
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		names[f.Attributes["NAME"].(string)]++
+	}
+	if len(names) != 4 {
+		t.Errorf("Got features %v, want all 4", names)
+	}
+	for name, n := range names {
+		if n != 1 {
+			t.Errorf("Got %s %d times", name, n)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits on what the metadata cache holds
+const (
+	maxCacheEntryBytes = 1 << 20
+	maxCacheBytes      = 32 << 20
+)
+
+// How long each kind of metadata stays fresh before it's revalidated
+var cacheTTLs = []struct {
+	pattern *regexp.Regexp
+	ttl     time.Duration
+}{
+	{regexp.MustCompile(`/sharing/rest/portals/self$`), 10 * time.Minute},
+	{regexp.MustCompile(`/sharing/rest/community/self$`), 10 * time.Minute},
+	{regexp.MustCompile(`/sharing/rest/content/items/[^/]+(/data)?$`), 5 * time.Minute},
+	{regexp.MustCompile(`/sharing/rest/content/groups/[^/]+$`), 5 * time.Minute},
+	{regexp.MustCompile(`/sharing/rest/community/groups/[^/]+$`), 10 * time.Minute},
+	{regexp.MustCompile(`/sharing/rest/search$`), time.Minute},
+	// Not the service itself, its change tracking info has to be current
+	{regexp.MustCompile(`/FeatureServer/(layers|\d+)$`), 5 * time.Minute},
+}
+
+// Get how long a response from this path can be cached, 0 when it can't be
+func cacheTTL(path string) time.Duration {
+	for _, c := range cacheTTLs {
+		if c.pattern.MatchString(path) {
+			return c.ttl
+		}
+	}
+	return 0
+}
+
+type skipCacheKey struct{}
+
+// Make requests with the context go to the server rather than the cache. What
+// comes back still replaces what's cached.
+func skipCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipCacheKey{}, true)
+}
+
+type cacheEntry struct {
+	key          string
+	status       int
+	header       http.Header
+	body         []byte
+	expires      time.Time
+	etag         string
+	lastModified string
+}
+
+// cacheTransport caches GET responses for portal and service metadata for each user
+type cacheTransport struct {
+	next    http.RoundTripper
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	// Most recently used at the front
+	order *list.List
+	size  int
+}
+
+func newCacheTransport(next http.RoundTripper) *cacheTransport {
+	return &cacheTransport{
+		next:    next,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ttl := cacheTTL(req.URL.Path)
+	if req.Method != http.MethodGet || ttl == 0 {
+		return t.next.RoundTrip(req)
+	}
+	key := cacheKey(req)
+	if skip, _ := req.Context().Value(skipCacheKey{}).(bool); skip {
+		t.invalidate(key)
+	}
+	entry := t.get(key)
+	if entry != nil && time.Now().Before(entry.expires) {
+		return entry.response(req), nil
+	}
+	if entry != nil && (entry.etag != "" || entry.lastModified != "") {
+		req = req.Clone(req.Context())
+		if entry.etag != "" {
+			req.Header.Set("If-None-Match", entry.etag)
+		}
+		if entry.lastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.lastModified)
+		}
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		resp.Body.Close()
+		t.lock.Lock()
+		entry.expires = time.Now().Add(ttl)
+		t.lock.Unlock()
+		log.Printf("Revalidated %s", req.URL.Path)
+		return entry.response(req), nil
+	}
+	if resp.StatusCode != http.StatusOK || strings.Contains(resp.Header.Get("Cache-Control"), "no-store") {
+		return resp, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCacheEntryBytes+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if len(body) > maxCacheEntryBytes {
+		// Too big to keep, hand back what we read followed by the rest
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	// ArcGIS reports errors, including bad tokens, with a 200 status
+	if arcgisErrorCode.Match(body) {
+		return resp, nil
+	}
+	t.put(&cacheEntry{
+		key:          key,
+		status:       resp.StatusCode,
+		header:       resp.Header.Clone(),
+		body:         body,
+		expires:      time.Now().Add(ttl),
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	})
+	return resp, nil
+}
+
+// Key a request by who is asking as well as what they asked for, so one user
+// never sees another's results
+func cacheKey(req *http.Request) string {
+	owner := ""
+	access := bearerToken(req)
+	if token, ok := findTokenByAccess(access); ok {
+		owner = "user:" + token.Username
+	} else if access != "" {
+		sum := sha256.Sum256([]byte(access))
+		owner = "token:" + hex.EncodeToString(sum[:])
+	}
+	return owner + " " + req.URL.String()
+}
+
+func (t *cacheTransport) get(key string) *cacheEntry {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	element, ok := t.entries[key]
+	if !ok {
+		return nil
+	}
+	t.order.MoveToFront(element)
+	return element.Value.(*cacheEntry)
+}
+
+func (t *cacheTransport) put(entry *cacheEntry) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if element, ok := t.entries[entry.key]; ok {
+		t.remove(element)
+	}
+	t.entries[entry.key] = t.order.PushFront(entry)
+	t.size += len(entry.body)
+	for t.size > maxCacheBytes {
+		t.remove(t.order.Back())
+	}
+}
+
+func (t *cacheTransport) invalidate(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if element, ok := t.entries[key]; ok {
+		t.remove(element)
+	}
+}
+
+// Drop what's cached for a service and its layers, for every user
+func (t *cacheTransport) invalidateService(serviceURL string) {
+	serviceURL = strings.TrimRight(serviceURL, "/")
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for key, element := range t.entries {
+		_, u, _ := strings.Cut(key, " ")
+		path, _, _ := strings.Cut(u, "?")
+		if path == serviceURL || strings.HasPrefix(path, serviceURL+"/") {
+			t.remove(element)
+		}
+	}
+}
+
+func (t *cacheTransport) remove(element *list.Element) {
+	entry := t.order.Remove(element).(*cacheEntry)
+	delete(t.entries, entry.key)
+	t.size -= len(entry.body)
+}
+
+func (e *cacheEntry) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        http.StatusText(e.status),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
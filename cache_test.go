@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Make every cached response stale, as if their TTLs had passed
+func expireCache() {
+	arcgisCache.lock.Lock()
+	defer arcgisCache.lock.Unlock()
+	for _, element := range arcgisCache.entries {
+		element.Value.(*cacheEntry).expires = time.Now().Add(-time.Second)
+	}
+}
+
+func TestCacheLayerMetadata(t *testing.T) {
+	portal, counter := startFakePortal(t)
+	technician := signIn(t, portal, "fake.technician")
+	admin := signIn(t, portal, "fake.admin")
+	ctx := context.Background()
+	const path = "GET /arcgis/rest/services/FieldseekerGIS/FeatureServer/0"
+	fetch := func(ctx context.Context, access string) {
+		t.Helper()
+		var layer ArcGISLayer
+		if err := arcgisGet(ctx, access, fakeServiceURL()+"/0", nil, &layer); err != nil {
+			t.Fatal(err)
+		}
+		if layer.Name != "PointLocation" {
+			t.Errorf("Got layer %s from the cache, want PointLocation", layer.Name)
+		}
+	}
+
+	fetch(ctx, technician.AccessToken)
+	fetch(ctx, technician.AccessToken)
+	if n := counter.count(path); n != 1 {
+		t.Errorf("Fetched the layer %d times, want once with the second from the cache", n)
+	}
+
+	// Once stale it's revalidated, and the server says it hasn't changed
+	expireCache()
+	fetch(ctx, technician.AccessToken)
+	if n, revalidated := counter.count(path), counter.count("304 "+path); n != 2 || revalidated != 1 {
+		t.Errorf("Made %d requests with %d not modified, want 2 with 1", n, revalidated)
+	}
+	fetch(ctx, technician.AccessToken)
+	if n := counter.count(path); n != 2 {
+		t.Errorf("Made %d requests after revalidating, want it fresh again", n)
+	}
+
+	// Another user doesn't get the technician's copy
+	fetch(ctx, admin.AccessToken)
+	if n := counter.count(path); n != 3 {
+		t.Errorf("Made %d requests, want another one for a different user", n)
+	}
+
+	// A request that skips the cache always goes to the server
+	fetch(skipCache(ctx), technician.AccessToken)
+	if n := counter.count(path); n != 4 {
+		t.Errorf("Made %d requests, want one more when skipping the cache", n)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Cassette is a recording of requests made to ArcGIS and the responses they
+// got, with tokens and other secrets scrubbed out
+type Cassette struct {
+	Recorded     time.Time             `json:"recorded"`
+	Interactions []CassetteInteraction `json:"interactions"`
+}
+
+type CassetteInteraction struct {
+	Request  CassetteRequest  `json:"request"`
+	Response CassetteResponse `json:"response"`
+}
+
+type CassetteRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Body   string `json:"body,omitempty"`
+}
+
+type CassetteResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+	// 'base64' when the body isn't text
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// ErrNotRecorded means a request being replayed isn't in the cassette
+var ErrNotRecorded = errors.New("No recorded response")
+
+// What secrets are replaced with
+const scrubbed = "REDACTED"
+
+// Parameters and JSON keys that hold secrets
+var (
+	secretParams = []string{"token", "access_token", "refresh_token", "client_secret", "password"}
+	secretKeys   = []string{"token", "access_token", "refresh_token"}
+)
+
+// Response headers worth keeping, the rest change from one run to the next
+var cassetteHeaders = []string{"Content-Type", "Content-Disposition", "ETag", "Last-Modified", "Retry-After"}
+
+// The recording setupCassette started, which stopCassette writes out
+var activeRecorder *recordTransport
+
+// Turn on recording or replaying from the ARCGIS_RECORD or ARCGIS_REPLAY environment variables
+func setupCassette() error {
+	if os.Getenv("ARCGIS_RECORD") != "" && os.Getenv("ARCGIS_REPLAY") != "" {
+		// Recording a replay would only save a copy of the cassette
+		return fmt.Errorf("Set ARCGIS_RECORD or ARCGIS_REPLAY, not both")
+	}
+	if path := os.Getenv("ARCGIS_RECORD"); path != "" {
+		activeRecorder = newRecordTransport(path, arcgisBaseTransport)
+		useBaseTransport(activeRecorder)
+		log.Printf("Recording ArcGIS requests to %s", path)
+	}
+	if path := os.Getenv("ARCGIS_REPLAY"); path != "" {
+		replay, err := newReplayTransport(path)
+		if err != nil {
+			return err
+		}
+		useBaseTransport(replay)
+		log.Printf("Replaying ArcGIS requests from %s", path)
+	}
+	return nil
+}
+
+// Write out what has been recorded, if anything is being. Call it once the
+// program is done making requests.
+func stopCassette() {
+	if activeRecorder == nil {
+		return
+	}
+	err := activeRecorder.Save()
+	if err != nil {
+		log.Printf("Failed to save cassette %s: %v", activeRecorder.path, err)
+		return
+	}
+	log.Printf("Saved recording of ArcGIS requests to %s", activeRecorder.path)
+}
+
+func loadCassette(path string) (*Cassette, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read cassette: %v", err)
+	}
+	var cassette Cassette
+	err = json.Unmarshal(content, &cassette)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal cassette %s: %v", path, err)
+	}
+	return &cassette, nil
+}
+
+func saveCassette(path string, cassette *Cassette) error {
+	content, err := json.MarshalIndent(cassette, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to marshal cassette: %v", err)
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, content, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write cassette: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// Describe a request the same way whether it's being recorded or replayed,
+// without anything secret in it
+func cassetteRequest(req *http.Request) (CassetteRequest, error) {
+	u := *req.URL
+	oauth := strings.Contains(u.Path, "/oauth2/")
+	u.RawQuery = scrubParams(u.Query(), oauth).Encode()
+	result := CassetteRequest{Method: req.Method, URL: u.String()}
+	if req.Body == nil || req.Body == http.NoBody {
+		return result, nil
+	}
+	if req.GetBody == nil {
+		return result, fmt.Errorf("Can't read the body of %s %s", req.Method, req.URL.Path)
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return result, fmt.Errorf("Failed to get request body: %v", err)
+	}
+	defer body.Close()
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return result, fmt.Errorf("Failed to read request body: %v", err)
+	}
+	result.Body = string(content)
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		form, err := url.ParseQuery(result.Body)
+		if err == nil {
+			result.Body = scrubParams(form, oauth).Encode()
+		}
+	}
+	return result, nil
+}
+
+// Replace secret parameters. OAuth requests also carry a one-time code.
+func scrubParams(params url.Values, oauth bool) url.Values {
+	for name := range params {
+		secret := oauth && name == "code"
+		for _, s := range secretParams {
+			secret = secret || strings.EqualFold(name, s)
+		}
+		if secret {
+			params.Set(name, scrubbed)
+		}
+	}
+	return params
+}
+
+// Replace secrets anywhere in a JSON document
+func scrubJSON(v any) any {
+	switch value := v.(type) {
+	case map[string]any:
+		for k, child := range value {
+			secret := false
+			for _, s := range secretKeys {
+				secret = secret || strings.EqualFold(k, s)
+			}
+			if secret {
+				value[k] = scrubbed
+			} else {
+				value[k] = scrubJSON(child)
+			}
+		}
+	case []any:
+		for i, child := range value {
+			value[i] = scrubJSON(child)
+		}
+	}
+	return v
+}
+
+// recordTransport passes requests on and keeps each exchange, until Save
+// writes them all to a cassette file
+type recordTransport struct {
+	path     string
+	next     http.RoundTripper
+	lock     sync.Mutex
+	cassette Cassette
+}
+
+func newRecordTransport(path string, next http.RoundTripper) *recordTransport {
+	return &recordTransport{
+		path:     path,
+		next:     next,
+		cassette: Cassette{Recorded: time.Now(), Interactions: make([]CassetteInteraction, 0)},
+	}
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	request, err := cassetteRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read response body: %v", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	response := CassetteResponse{Status: resp.StatusCode, Header: make(http.Header)}
+	for _, name := range cassetteHeaders {
+		if values := resp.Header.Values(name); len(values) > 0 {
+			response.Header[name] = values
+		}
+	}
+	var document any
+	switch {
+	case json.Unmarshal(body, &document) == nil:
+		scrubbedBody, err := json.Marshal(scrubJSON(document))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal response body: %v", err)
+		}
+		response.Body = string(scrubbedBody)
+	case utf8.Valid(body):
+		response.Body = string(body)
+	default:
+		response.Body = base64.StdEncoding.EncodeToString(body)
+		response.Encoding = "base64"
+	}
+
+	t.lock.Lock()
+	t.cassette.Interactions = append(t.cassette.Interactions, CassetteInteraction{Request: request, Response: response})
+	t.lock.Unlock()
+	return resp, nil
+}
+
+func (t *recordTransport) Save() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return saveCassette(t.path, &t.cassette)
+}
+
+// replayTransport answers requests from a cassette without touching the network.
+// Identical requests get the recorded responses in order, and the last one once
+// those run out.
+type replayTransport struct {
+	lock         sync.Mutex
+	interactions map[CassetteRequest][]CassetteResponse
+	played       map[CassetteRequest]int
+}
+
+func newReplayTransport(path string) (*replayTransport, error) {
+	cassette, err := loadCassette(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &replayTransport{
+		interactions: make(map[CassetteRequest][]CassetteResponse),
+		played:       make(map[CassetteRequest]int),
+	}
+	for _, interaction := range cassette.Interactions {
+		t.interactions[interaction.Request] = append(t.interactions[interaction.Request], interaction.Response)
+	}
+	return t, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	request, err := cassetteRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	t.lock.Lock()
+	responses, ok := t.interactions[request]
+	played := t.played[request]
+	t.played[request]++
+	t.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w for %s %s", ErrNotRecorded, request.Method, request.URL)
+	}
+	response := responses[min(played, len(responses)-1)]
+	body := []byte(response.Body)
+	if response.Encoding == "base64" {
+		body, err = base64.StdEncoding.DecodeString(response.Body)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode recorded body: %v", err)
+		}
+	}
+	return &http.Response{
+		Status:        http.StatusText(response.Status),
+		StatusCode:    response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        response.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
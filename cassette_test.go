@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Recorded from the fake portal, with its address replaced by www.arcgis.com
+const fieldSeekerCassette = "fixtures/cassettes/fieldseeker.json"
+
+// Answer ArcGIS requests from a cassette for the rest of the test
+func replayCassette(t *testing.T, path string) {
+	t.Helper()
+	replay, err := newReplayTransport(path)
+	if err != nil {
+		t.Fatalf("Failed to load cassette: %v", err)
+	}
+	previousPortal, previousBase := PortalURL, arcgisBaseTransport
+	t.Cleanup(func() {
+		PortalURL = previousPortal
+		useBaseTransport(previousBase)
+	})
+	PortalURL = "https://www.arcgis.com"
+	useBaseTransport(replay)
+	initTokenDatabase()
+}
+
+func TestReplayFieldSeekerCassette(t *testing.T) {
+	replayCassette(t, fieldSeekerCassette)
+	ctx := context.Background()
+	// The token isn't part of what's recorded, so any will do
+	access := "replayed"
+
+	search, err := findFieldseeker(ctx, access)
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	services := discoverFeatureServices(ctx, access, search)
+	if len(services) != 1 {
+		t.Fatalf("Found %d feature services, want 1", len(services))
+	}
+	serviceURL := "https://www.arcgis.com/arcgis/rest/services/FieldseekerGIS/FeatureServer"
+	if services[0].URL != serviceURL {
+		t.Errorf("Service is at %s, want %s", services[0].URL, serviceURL)
+	}
+
+	layer, err := fetchLayer(ctx, access, serviceURL, 0)
+	if err != nil {
+		t.Fatalf("Failed to fetch layer: %v", err)
+	}
+	if layer.Name != "PointLocation" {
+		t.Errorf("Layer 0 is %s, want PointLocation", layer.Name)
+	}
+	feature, err := fetchFeature(ctx, access, layer, 1)
+	if err != nil {
+		t.Fatalf("Failed to fetch feature: %v", err)
+	}
+	if feature.Attributes["NAME"] != "Elm Street catch basin" {
+		t.Errorf("Feature 1 is named %v, want 'Elm Street catch basin'", feature.Attributes["NAME"])
+	}
+
+	_, err = fetchFeature(ctx, access, layer, 2)
+	if err == nil || !strings.Contains(err.Error(), ErrNotRecorded.Error()) {
+		t.Errorf("Got %v for a request that wasn't recorded, want no recorded response", err)
+	}
+}
+
+func TestRecordTransportSavesOnStop(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	token := signIn(t, portal, "fake.technician")
+	path := filepath.Join(t.TempDir(), "recording.json")
+	recorder := newRecordTransport(path, arcgisBaseTransport)
+	useBaseTransport(recorder)
+
+	ctx := context.Background()
+	layer, err := fetchLayer(ctx, token.AccessToken, fakeServiceURL(), 0)
+	if err != nil {
+		t.Fatalf("Failed to fetch layer: %v", err)
+	}
+	recorded, err := fetchFeature(ctx, token.AccessToken, layer, 1)
+	if err != nil {
+		t.Fatalf("Failed to fetch feature: %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Cassette was written before recording stopped: %v", err)
+	}
+
+	err = recorder.Save()
+	if err != nil {
+		t.Fatalf("Failed to save cassette: %v", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), token.AccessToken) {
+		t.Error("Cassette contains the access token")
+	}
+	cassette, err := loadCassette(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cassette.Interactions); n != 3 {
+		t.Errorf("Recorded %d interactions, want 3: the service, the layer and the query", n)
+	}
+
+	replay, err := newReplayTransport(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useBaseTransport(replay)
+	replayed, err := fetchFeature(ctx, "replayed", layer, 1)
+	if err != nil {
+		t.Fatalf("Failed to replay the query: %v", err)
+	}
+	if replayed.Attributes["NAME"] != recorded.Attributes["NAME"] {
+		t.Errorf("Replayed feature is named %v, recorded %v", replayed.Attributes["NAME"], recorded.Attributes["NAME"])
+	}
+}
+
+func TestSetupCassetteRecordOrReplay(t *testing.T) {
+	previousBase := arcgisBaseTransport
+	t.Cleanup(func() {
+		activeRecorder = nil
+		useBaseTransport(previousBase)
+	})
+	t.Setenv("ARCGIS_RECORD", filepath.Join(t.TempDir(), "recording.json"))
+	t.Setenv("ARCGIS_REPLAY", fieldSeekerCassette)
+	if err := setupCassette(); err == nil {
+		t.Fatal("Set up recording and replaying at once")
+	}
+	if activeRecorder != nil || arcgisBaseTransport != previousBase {
+		t.Error("Changed the transport while refusing the settings")
+	}
+	if code := runCommand("export", nil); code != 1 {
+		t.Errorf("Command exited with %d, want 1", code)
+	}
+
+	t.Setenv("ARCGIS_REPLAY", "")
+	if err := setupCassette(); err != nil {
+		t.Fatalf("Failed to set up recording: %v", err)
+	}
+	if activeRecorder == nil || arcgisBaseTransport != activeRecorder {
+		t.Error("Recording isn't in use")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type ArcGISLayerServerGen struct {
+	ID           int   `json:"id"`
+	MinServerGen int64 `json:"minServerGen"`
+	ServerGen    int64 `json:"serverGen"`
+}
+
+type ArcGISLayerChanges struct {
+	ID       int `json:"id"`
+	Features struct {
+		Adds      []ArcGISFeature `json:"adds"`
+		Updates   []ArcGISFeature `json:"updates"`
+		DeleteIDs []int64         `json:"deleteIds"`
+	} `json:"features"`
+}
+
+type ArcGISExtractChangesResponse struct {
+	LayerServerGens []ArcGISLayerServerGen `json:"layerServerGens"`
+	Edits           []ArcGISLayerChanges   `json:"edits"`
+}
+
+// SyncResult describes what a sync of a layer did
+type SyncResult struct {
+	FullResync bool
+	Inserts    int
+	Updates    int
+	Deletes    int
+	ServerGen  int64
+}
+
+// errGenerationsUnavailable means the server can no longer tell us what changed since our generation
+var errGenerationsUnavailable = errors.New("Server generations are no longer available")
+
+// Get the current server generation of every layer in a service
+func fetchServerGens(ctx context.Context, access string, serviceURL string) ([]ArcGISLayerServerGen, error) {
+	var root struct {
+		ChangeTrackingInfo struct {
+			LayerServerGens []ArcGISLayerServerGen `json:"layerServerGens"`
+		} `json:"changeTrackingInfo"`
+	}
+	err := arcgisGet(ctx, access, serviceURL, nil, &root)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get change tracking info of %s: %w", serviceURL, err)
+	}
+	return root.ChangeTrackingInfo.LayerServerGens, nil
+}
+
+func findServerGen(gens []ArcGISLayerServerGen, layerID int) (ArcGISLayerServerGen, bool) {
+	for _, g := range gens {
+		if g.ID == layerID {
+			return g, true
+		}
+	}
+	return ArcGISLayerServerGen{}, false
+}
+
+// Ask the service for everything that changed in a layer since the given generation
+func extractChanges(ctx context.Context, access string, serviceURL string, layerID int, serverGen int64) (*ArcGISExtractChangesResponse, error) {
+	layerServerGens, _ := json.Marshal([]map[string]int64{{"id": int64(layerID), "serverGen": serverGen}})
+	form := url.Values{
+		"layers":          []string{fmt.Sprintf("[%d]", layerID)},
+		"layerServerGens": []string{string(layerServerGens)},
+		"returnInserts":   []string{"true"},
+		"returnUpdates":   []string{"true"},
+		"returnDeletes":   []string{"true"},
+		"returnIdsOnly":   []string{"false"},
+		"dataFormat":      []string{"json"},
+	}
+	var response ArcGISExtractChangesResponse
+	err := arcgisPost(ctx, access, serviceURL+"/extractChanges", form, &response)
+	if err != nil {
+		var arcgisErr *ArcGISError
+		if errors.As(err, &arcgisErr) && isGenerationError(arcgisErr) {
+			return nil, errGenerationsUnavailable
+		}
+		return nil, fmt.Errorf("Failed to extract changes of %s/%d: %w", serviceURL, layerID, err)
+	}
+	return &response, nil
+}
+
+// ArcGIS doesn't have a dedicated code for expired generations, so look at the message
+func isGenerationError(err *ArcGISError) bool {
+	message := strings.ToLower(err.Message + " " + strings.Join(err.Details, " "))
+	return strings.Contains(message, "servergen") || strings.Contains(message, "generation")
+}
+
+// Bring the local mirror of a layer up to date, pulling only what changed when we can
+func syncLayer(ctx context.Context, access string, serviceURL string, layerID int) (*SyncResult, error) {
+	serviceURL = strings.TrimRight(serviceURL, "/")
+	layer, err := fetchLayer(ctx, access, serviceURL, layerID)
+	if err != nil {
+		return nil, err
+	}
+	gens, err := fetchServerGens(ctx, access, serviceURL)
+	if err != nil {
+		return nil, err
+	}
+	current, ok := findServerGen(gens, layerID)
+	if !ok {
+		log.Printf("%s/%d doesn't report a server generation, doing a full pull", serviceURL, layerID)
+	}
+
+	mirror, err := loadLayerMirror(serviceURL, layerID)
+	if err != nil {
+		return nil, err
+	}
+	if mirror == nil || !ok || mirror.ServerGen < current.MinServerGen {
+		return fullResync(ctx, access, layer, serviceURL, current.ServerGen)
+	}
+	if mirror.ServerGen == current.ServerGen {
+		return &SyncResult{ServerGen: current.ServerGen}, nil
+	}
+
+	changes, err := extractChanges(ctx, access, serviceURL, layerID, mirror.ServerGen)
+	if errors.Is(err, errGenerationsUnavailable) {
+		log.Printf("Generation %d of %s/%d is no longer available, doing a full pull", mirror.ServerGen, serviceURL, layerID)
+		return fullResync(ctx, access, layer, serviceURL, current.ServerGen)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := SyncResult{ServerGen: current.ServerGen}
+	for _, edits := range changes.Edits {
+		if edits.ID != layerID {
+			continue
+		}
+		for _, f := range edits.Features.Adds {
+			if err := mirror.Put(f); err != nil {
+				return nil, err
+			}
+			result.Inserts++
+		}
+		for _, f := range edits.Features.Updates {
+			if err := mirror.Put(f); err != nil {
+				return nil, err
+			}
+			result.Updates++
+		}
+		for _, id := range edits.Features.DeleteIDs {
+			mirror.Delete(id)
+			result.Deletes++
+		}
+	}
+	if g, ok := findServerGen(changes.LayerServerGens, layerID); ok {
+		result.ServerGen = g.ServerGen
+	}
+	mirror.ServerGen = result.ServerGen
+	mirror.Updated = time.Now()
+	err = saveLayerMirror(mirror)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Synced %s/%d to generation %d: %d inserts, %d updates, %d deletes", serviceURL, layerID, result.ServerGen, result.Inserts, result.Updates, result.Deletes)
+	return &result, nil
+}
+
+// Replace the mirror with a fresh copy of the whole layer. The generation is
+// read before the pull, so anything edited during the pull is picked up again
+// by the next sync.
+func fullResync(ctx context.Context, access string, layer *ArcGISLayer, serviceURL string, serverGen int64) (*SyncResult, error) {
+	mirror := newLayerMirror(serviceURL, layer.ID, layer.ObjectIDField)
+	q := ArcGISQuery{ReturnGeometry: true}
+	opts := BulkFetchOptions{Progress: logBulkProgress(layer.URL)}
+	for f, err := range fetchAllFeatures(ctx, access, layer, q, opts) {
+		if err != nil {
+			return nil, err
+		}
+		if err := mirror.Put(f); err != nil {
+			return nil, err
+		}
+	}
+	mirror.ServerGen = serverGen
+	mirror.Updated = time.Now()
+	err := saveLayerMirror(mirror)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Pulled all %d features of %s to generation %d", len(mirror.Features), layer.URL, serverGen)
+	return &SyncResult{FullResync: true, Inserts: len(mirror.Features), ServerGen: serverGen}, nil
+}
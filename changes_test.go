@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestSyncLayer(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	token := signIn(t, portal, "fake.technician")
+	ctx := context.Background()
+	layer, err := fetchLayer(ctx, token.AccessToken, fakeServiceURL(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync := func() *SyncResult {
+		t.Helper()
+		result, err := syncLayer(ctx, token.AccessToken, fakeServiceURL(), 0)
+		if err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
+		return result
+	}
+	mirrorHas := func(objectID int64, name string) {
+		t.Helper()
+		mirror, err := loadLayerMirror(fakeServiceURL(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, ok := mirror.Features[objectID]
+		if name == "" && ok {
+			t.Errorf("Mirror still has deleted feature %d", objectID)
+		} else if name != "" && (!ok || f.Attributes["NAME"] != name) {
+			t.Errorf("Mirror has feature %d as %v, want %s", objectID, f.Attributes["NAME"], name)
+		}
+	}
+
+	// The first sync has nothing to go on, so it pulls everything
+	result := sync()
+	if !result.FullResync || result.Inserts != 4 {
+		t.Fatalf("First sync was %+v, want a full pull of 4", result)
+	}
+
+	edits := ArcGISEdits{
+		Adds:    []ArcGISFeature{{Attributes: map[string]any{"NAME": "New ditch"}, Geometry: []byte(`{"x":-119.7,"y":36.7}`)}},
+		Updates: []ArcGISFeature{{Attributes: map[string]any{"OBJECTID": int64(2), "NAME": "Mill pond north"}}},
+		Deletes: []int64{3},
+	}
+	results, err := applyEdits(ctx, token.AccessToken, layer, edits, true)
+	if err != nil || results.Err() != nil {
+		t.Fatalf("Failed to edit: %v %v", err, results.Err())
+	}
+	added := results.AddResults[0].ObjectID
+	result = sync()
+	if result.FullResync || result.Inserts != 1 || result.Updates != 1 || result.Deletes != 1 {
+		t.Errorf("Sync after edits was %+v, want one of each", result)
+	}
+	mirrorHas(added, "New ditch")
+	mirrorHas(2, "Mill pond north")
+	mirrorHas(3, "")
+
+	if result = sync(); result.FullResync || result.Inserts+result.Updates+result.Deletes != 0 {
+		t.Errorf("Sync without changes was %+v, want nothing", result)
+	}
+
+	// Once the server has forgotten our generation it has to start over
+	stale := result.ServerGen
+	edits = ArcGISEdits{Updates: []ArcGISFeature{{Attributes: map[string]any{"OBJECTID": int64(4), "NAME": "Levee road ditch east"}}}}
+	if _, err := applyEdits(ctx, token.AccessToken, layer, edits, true); err != nil {
+		t.Fatal(err)
+	}
+	portal.ForgetChanges()
+	if _, err := extractChanges(ctx, token.AccessToken, fakeServiceURL(), 0, stale); !errors.Is(err, errGenerationsUnavailable) {
+		t.Errorf("Got %v for a forgotten generation, want errGenerationsUnavailable", err)
+	}
+	if result = sync(); !result.FullResync || result.Inserts != 4 {
+		t.Errorf("Sync after the server forgot was %+v, want a full pull of 4", result)
+	}
+	mirrorHas(4, "Levee road ditch east")
+
+	w := callAs(t, "fake.technician", http.MethodPost, "/sync", postSync, "/sync?service="+fakeServiceURL()+"&layer=0", nil)
+	if w.Code != http.StatusFound {
+		t.Errorf("Got status %d from the sync form: %s", w.Code, w.Body)
+	}
+}
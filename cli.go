@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Run one of the command line tools, returning the exit code
+func runCommand(name string, args []string) int {
+	err := setupCassette()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer stopCassette()
+	// Exports reproject to WGS84 locally, which needs the same projections as the web app
+	err = loadProjections(projectionsFile())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	switch name {
+	case "export":
+		return runExport(args)
+	case "usage":
+		return runUsage(args)
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command '%s'. Commands are: export, usage\n", name)
+	return 2
+}
+
+// Get the access token of a user that logged in through the web app before
+func commandToken(username string) (string, error) {
+	initTokenDatabase()
+	err := loadTokenDatabase()
+	if err != nil {
+		return "", err
+	}
+	token, ok := getToken(username)
+	if !ok {
+		return "", fmt.Errorf("No token for '%s', log in through the web app first", username)
+	}
+	return token.AccessToken, nil
+}
+
+func runExport(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	username := flags.String("user", "", "User whose token to use")
+	serviceURL := flags.String("service", "", "URL of the feature service")
+	layerID := flags.Int("layer", 0, "ID of the layer to export")
+	format := flags.String("format", ExportGeoJSON, "One of geojson, csv, kml, shapefile or gpkg")
+	where := flags.String("where", "", "Where clause to filter the features with")
+	output := flags.String("out", "", "File to write to, defaults to stdout")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *username == "" || *serviceURL == "" {
+		fmt.Fprintln(os.Stderr, "-user and -service are required")
+		return 2
+	}
+	// Log lines would end up in the export on stdout
+	log.SetOutput(os.Stderr)
+
+	ctx := context.Background()
+	access, err := commandToken(*username)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	layer, err := fetchLayer(ctx, access, *serviceURL, *layerID)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	dest := os.Stdout
+	if *output != "" {
+		dest, err = os.Create(*output)
+		if err != nil {
+			log.Printf("Failed to create output file: %v", err)
+			return 1
+		}
+		defer dest.Close()
+	}
+	err = exportLayer(ctx, dest, access, layer, *format, ArcGISQuery{Where: *where})
+	if err != nil {
+		log.Printf("Failed to export: %v", err)
+		return 1
+	}
+	return 0
+}
+
+func runUsage(args []string) int {
+	flags := flag.NewFlagSet("usage", flag.ContinueOnError)
+	username := flags.String("user", "", "User whose token to use, who has to be an organization administrator")
+	start := flags.String("start", "", "First day to report on as YYYY-MM-DD, defaults to 30 days before the end")
+	end := flags.String("end", "", "Last day to report on as YYYY-MM-DD, defaults to today")
+	by := flags.String("by", UsageByItem, "Add usage up by item, type or user")
+	output := flags.String("out", "", "File to write CSV to, defaults to stdout")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *username == "" {
+		fmt.Fprintln(os.Stderr, "-user is required")
+		return 2
+	}
+	if *by != UsageByItem && *by != UsageByType && *by != UsageByUser {
+		fmt.Fprintln(os.Stderr, "-by must be item, type or user")
+		return 2
+	}
+	startDate, endDate, err := parseUsageRange(*start, *end)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	log.SetOutput(os.Stderr)
+
+	ctx := context.Background()
+	access, err := commandToken(*username)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	report, err := usageReport(ctx, access, startDate, endDate)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	dest := os.Stdout
+	if *output != "" {
+		dest, err = os.Create(*output)
+		if err != nil {
+			log.Printf("Failed to create output file: %v", err)
+			return 1
+		}
+		defer dest.Close()
+	}
+	err = writeUsageCSV(dest, report, *by)
+	if err != nil {
+		log.Printf("Failed to write usage: %v", err)
+		return 1
+	}
+	return 0
+}
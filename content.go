@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ArcGISFolder is one of the folders a user keeps their items in
+type ArcGISFolder struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Username string `json:"username"`
+	Created  int64  `json:"created"`
+}
+
+type ArcGISUserContent struct {
+	Username      string         `json:"username"`
+	CurrentFolder *ArcGISFolder  `json:"currentFolder"`
+	Total         int            `json:"total"`
+	Start         int            `json:"start"`
+	Num           int            `json:"num"`
+	NextStart     int            `json:"nextStart"`
+	Items         []ArcGISItem   `json:"items"`
+	Folders       []ArcGISFolder `json:"folders"`
+}
+
+// ContentFolder holds the items in one folder, the root folder having no ID
+type ContentFolder struct {
+	Folder ArcGISFolder
+	Items  []ArcGISItem
+}
+
+// How many items to ask for at a time, which is the most ArcGIS allows
+const contentPageSize = 100
+
+// Fetch every item in one of a user's folders, or their root folder if folderID
+// is empty, along with the list of their folders
+func fetchUserContent(ctx context.Context, access string, username string, folderID string) ([]ArcGISItem, []ArcGISFolder, error) {
+	baseURL := PortalURL + "/sharing/rest/content/users/" + url.PathEscape(username)
+	if folderID != "" {
+		baseURL += "/" + url.PathEscape(folderID)
+	}
+	items := make([]ArcGISItem, 0)
+	var folders []ArcGISFolder
+	start := 1
+	for {
+		params := url.Values{
+			"start": []string{strconv.Itoa(start)},
+			"num":   []string{strconv.Itoa(contentPageSize)},
+		}
+		var content ArcGISUserContent
+		err := arcgisGet(ctx, access, baseURL, params, &content)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to get content of %s: %w", username, err)
+		}
+		items = append(items, content.Items...)
+		if folders == nil {
+			folders = content.Folders
+		}
+		if content.NextStart <= 0 || len(content.Items) == 0 {
+			break
+		}
+		start = content.NextStart
+	}
+	return items, folders, nil
+}
+
+// Fetch everything a user owns, folder by folder, starting with the root folder
+func fetchAllUserContent(ctx context.Context, access string, username string) ([]ContentFolder, error) {
+	items, folders, err := fetchUserContent(ctx, access, username, "")
+	if err != nil {
+		return nil, err
+	}
+	result := []ContentFolder{{Folder: ArcGISFolder{Username: username}, Items: items}}
+	for _, folder := range folders {
+		items, _, err := fetchUserContent(ctx, access, username, folder.ID)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ContentFolder{Folder: folder, Items: items})
+	}
+	return result, nil
+}
+
+// Format an ArcGIS timestamp, which is milliseconds since the epoch
+func formatEpoch(ms int64) string {
+	if ms <= 0 {
+		return ""
+	}
+	return time.UnixMilli(ms).UTC().Format("2006-01-02 15:04")
+}
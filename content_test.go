@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFetchAllUserContent(t *testing.T) {
+	portal, counter := startFakePortal(t)
+	token := signIn(t, portal, "fake.technician")
+	ctx := context.Background()
+
+	folders, err := fetchAllUserContent(ctx, token.AccessToken, "fake.technician")
+	if err != nil {
+		t.Fatalf("Failed to get content: %v", err)
+	}
+	if len(folders) != 2 || folders[0].Folder.ID != "" || folders[1].Folder.Title != "Field maps" {
+		t.Fatalf("Got folders %+v, want the root folder and Field maps", folders)
+	}
+	if len(folders[0].Items) != 1 || folders[0].Items[0].Title != "Trap counts 2024" {
+		t.Errorf("Root folder has %+v, want the trap counts", folders[0].Items)
+	}
+	if len(folders[1].Items) != 1 || folders[1].Items[0].Title != "Treatment Areas Map" {
+		t.Errorf("Field maps has %+v, want the treatment areas map", folders[1].Items)
+	}
+
+	// More items than fit in one response are fetched a page at a time
+	portal.lock.Lock()
+	for i := 0; i < contentPageSize+50; i++ {
+		var item fakePortalItem
+		item.ID = fmt.Sprintf("%032x", i+100)
+		item.Title = fmt.Sprintf("Inspection photos %d", i)
+		item.Owner = "fake.technician"
+		portal.items = append(portal.items, item)
+	}
+	portal.lock.Unlock()
+	before := counter.count("GET /sharing/rest/content/users/fake.technician")
+	items, _, err := fetchUserContent(ctx, token.AccessToken, "fake.technician", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != contentPageSize+51 {
+		t.Errorf("Got %d items, want %d", len(items), contentPageSize+51)
+	}
+	if n := counter.count("GET /sharing/rest/content/users/fake.technician") - before; n != 2 {
+		t.Errorf("Made %d requests, want 2 pages", n)
+	}
+
+	// Only administrators can look at someone else's content
+	if _, err := fetchAllUserContent(ctx, token.AccessToken, "fake.admin"); err == nil {
+		t.Error("A technician got the administrator's content")
+	}
+}
+
+func TestContentPage(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	signIn(t, portal, "fake.technician")
+
+	w := callAs(t, "fake.technician", http.MethodGet, "/content", getContent, "/content", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d: %s", w.Code, w.Body)
+	}
+	for _, s := range []string{"Root folder", "Trap counts 2024", "Field maps", "Treatment Areas Map"} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("Content page doesn't have %s", s)
+		}
+	}
+
+	w = callAs(t, "", http.MethodGet, "/content", getContent, "/content", nil)
+	if w.Code != http.StatusFound {
+		t.Errorf("Got status %d without signing in, want a redirect", w.Code)
+	}
+}
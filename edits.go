@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArcGISEdits is a set of edits to apply to a single layer in one request
+type ArcGISEdits struct {
+	Adds    []ArcGISFeature
+	Updates []ArcGISFeature
+	Deletes []int64
+}
+
+type ArcGISEditResult struct {
+	ObjectID int64        `json:"objectId"`
+	GlobalID string       `json:"globalId"`
+	Success  bool         `json:"success"`
+	Error    *ArcGISError `json:"error"`
+}
+
+type ArcGISEditResults struct {
+	AddResults    []ArcGISEditResult `json:"addResults"`
+	UpdateResults []ArcGISEditResult `json:"updateResults"`
+	DeleteResults []ArcGISEditResult `json:"deleteResults"`
+}
+
+// Get the first failed edit, if there was one
+func (r *ArcGISEditResults) Err() error {
+	for _, results := range [][]ArcGISEditResult{r.AddResults, r.UpdateResults, r.DeleteResults} {
+		for _, result := range results {
+			if !result.Success {
+				if result.Error != nil {
+					return fmt.Errorf("Edit of feature %d failed: %w", result.ObjectID, result.Error)
+				}
+				return fmt.Errorf("Edit of feature %d failed", result.ObjectID)
+			}
+		}
+	}
+	return nil
+}
+
+// ErrEditConflict means the feature was changed by someone else since it was read
+var ErrEditConflict = errors.New("The feature was edited by someone else since it was loaded")
+
+// Apply adds, updates and deletes to a layer. With rollbackOnFailure the
+// server applies either all of the edits or none of them.
+func applyEdits(ctx context.Context, access string, layer *ArcGISLayer, edits ArcGISEdits, rollbackOnFailure bool) (*ArcGISEditResults, error) {
+	if !layer.HasCapability("Update") && !layer.HasCapability("Editing") && len(edits.Updates) > 0 {
+		return nil, fmt.Errorf("Layer %s doesn't allow updates", layer.URL)
+	}
+	form := url.Values{}
+	if len(edits.Adds) > 0 {
+		adds, err := json.Marshal(edits.Adds)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal adds: %v", err)
+		}
+		form.Set("adds", string(adds))
+	}
+	if len(edits.Updates) > 0 {
+		updates, err := json.Marshal(edits.Updates)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal updates: %v", err)
+		}
+		form.Set("updates", string(updates))
+	}
+	if len(edits.Deletes) > 0 {
+		form.Set("deletes", joinObjectIDs(edits.Deletes))
+	}
+	form.Set("rollbackOnFailure", strconv.FormatBool(rollbackOnFailure))
+	var results ArcGISEditResults
+	err := arcgisPost(ctx, access, layer.URL+"/applyEdits", form, &results)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to apply edits to %s: %w", layer.URL, err)
+	}
+	return &results, nil
+}
+
+// Fetch a single feature by object ID
+func fetchFeature(ctx context.Context, access string, layer *ArcGISLayer, objectID int64) (*ArcGISFeature, error) {
+	params := (&ArcGISQuery{ReturnGeometry: layer.GeometryType != ""}).params()
+	params.Set("objectIds", strconv.FormatInt(objectID, 10))
+	page, err := queryPage(ctx, access, layer, params)
+	if err != nil {
+		return nil, err
+	}
+	if len(page.Features) == 0 {
+		return nil, fmt.Errorf("Feature %d not found in %s", objectID, layer.URL)
+	}
+	return &page.Features[0], nil
+}
+
+// Update the attributes of a feature, and its geometry if that isn't nil, but
+// only if the layer's edit date field
+// still has the value it had when the feature was read. Layers without edit
+// tracking are updated unconditionally. The check is best-effort: the feature
+// is read and then updated in separate requests, so an edit that lands between
+// the two is still overwritten.
+func updateFeatureIfUnchanged(ctx context.Context, access string, layer *ArcGISLayer, objectID int64, expectedEditDate any, attributes map[string]any, geometry json.RawMessage) (*ArcGISEditResult, error) {
+	if layer.EditFieldsInfo != nil && layer.EditFieldsInfo.EditDateField != "" {
+		current, err := fetchFeature(ctx, access, layer, objectID)
+		if err != nil {
+			return nil, err
+		}
+		editDateField := layer.EditFieldsInfo.EditDateField
+		if formatAttribute(current.Attributes[editDateField]) != formatAttribute(expectedEditDate) {
+			return nil, ErrEditConflict
+		}
+	}
+	update := ArcGISFeature{Attributes: make(map[string]any, len(attributes)+1), Geometry: geometry}
+	for k, v := range attributes {
+		update.Attributes[k] = v
+	}
+	update.Attributes[layer.ObjectIDField] = objectID
+	results, err := applyEdits(ctx, access, layer, ArcGISEdits{Updates: []ArcGISFeature{update}}, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := results.Err(); err != nil {
+		return nil, err
+	}
+	if len(results.UpdateResults) != 1 {
+		return nil, fmt.Errorf("Expected 1 update result, got %d", len(results.UpdateResults))
+	}
+	return &results.UpdateResults[0], nil
+}
+
+// Check if a field can be edited by a person, as opposed to IDs and edit tracking
+func (l *ArcGISLayer) IsUserEditable(f *ArcGISField) bool {
+	if !f.Editable || f.Type == "esriFieldTypeOID" || f.Type == "esriFieldTypeGlobalID" || f.Type == "esriFieldTypeGeometry" {
+		return false
+	}
+	if strings.EqualFold(f.Name, l.ObjectIDField) || strings.EqualFold(f.Name, l.GlobalIDField) {
+		return false
+	}
+	if e := l.EditFieldsInfo; e != nil {
+		for _, name := range []string{e.CreationDateField, e.CreatorField, e.EditDateField, e.EditorField} {
+			if strings.EqualFold(f.Name, name) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// The format of datetime-local inputs
+const formDateLayout = "2006-01-02T15:04"
+
+// Format an attribute for an HTML form input
+func formValue(f *ArcGISField, v any) string {
+	if f.Type == "esriFieldTypeDate" {
+		if ms, ok := v.(float64); ok {
+			return time.UnixMilli(int64(ms)).UTC().Format(formDateLayout)
+		}
+		return ""
+	}
+	return formatAttribute(v)
+}
+
+// Parse a value from an HTML form according to the field's type and domain
+func parseFormValue(f *ArcGISField, domain *ArcGISDomain, s string) (any, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		if f.Type == "esriFieldTypeString" && !f.Nullable {
+			return "", nil
+		}
+		if !f.Nullable {
+			return nil, fmt.Errorf("%s can't be empty", f.Alias)
+		}
+		return nil, nil
+	}
+	var v any
+	switch f.Type {
+	case "esriFieldTypeSmallInteger", "esriFieldTypeInteger", "esriFieldTypeBigInteger":
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a whole number", f.Alias)
+		}
+		v = float64(i)
+	case "esriFieldTypeSingle", "esriFieldTypeDouble":
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a number", f.Alias)
+		}
+		v = n
+	case "esriFieldTypeDate":
+		t, err := time.Parse(formDateLayout, s)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a date", f.Alias)
+		}
+		return t.UnixMilli(), nil
+	case "esriFieldTypeString", "esriFieldTypeGUID":
+		if f.Length > 0 && len(s) > f.Length {
+			return nil, fmt.Errorf("%s can be at most %d characters", f.Alias, f.Length)
+		}
+		v = s
+	default:
+		return nil, fmt.Errorf("Editing fields of type %s isn't supported", f.Type)
+	}
+	if domain.IsCodedValue() {
+		found := false
+		for _, cv := range domain.CodedValues {
+			if formatAttribute(cv.Code) == formatAttribute(v) {
+				v = cv.Code
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("'%s' isn't a valid value for %s", s, f.Alias)
+		}
+	}
+	if n, ok := v.(float64); ok && domain.IsRange() {
+		if n < domain.Range[0] || n > domain.Range[1] {
+			return nil, fmt.Errorf("%s must be between %v and %v", f.Alias, domain.Range[0], domain.Range[1])
+		}
+	}
+	return v, nil
+}
+
+type FormOption struct {
+	Value    string
+	Label    string
+	Selected bool
+}
+
+// FormField is one editable attribute of a feature as rendered in the edit form
+type FormField struct {
+	Name    string
+	Label   string
+	Type    string
+	Value   string
+	Options []FormOption
+	Min     string
+	Max     string
+}
+
+// Build the form fields for the user-editable attributes of a feature
+func featureFormFields(layer *ArcGISLayer, feature *ArcGISFeature) []FormField {
+	result := make([]FormField, 0)
+	for i := range layer.Fields {
+		f := &layer.Fields[i]
+		if !layer.IsUserEditable(f) {
+			continue
+		}
+		field := FormField{
+			Name:  f.Name,
+			Label: f.Alias,
+			Type:  "text",
+			Value: formValue(f, feature.Attributes[f.Name]),
+		}
+		switch f.Type {
+		case "esriFieldTypeSmallInteger", "esriFieldTypeInteger", "esriFieldTypeBigInteger", "esriFieldTypeSingle", "esriFieldTypeDouble":
+			field.Type = "number"
+		case "esriFieldTypeDate":
+			field.Type = "datetime-local"
+		}
+		domain := layer.Domain(f.Name, feature.Attributes)
+		if domain.IsCodedValue() {
+			field.Type = "select"
+			if f.Nullable {
+				field.Options = append(field.Options, FormOption{Selected: field.Value == ""})
+			}
+			for _, cv := range domain.CodedValues {
+				code := formatAttribute(cv.Code)
+				field.Options = append(field.Options, FormOption{
+					Value:    code,
+					Label:    cv.Name,
+					Selected: code == field.Value,
+				})
+			}
+		} else if domain.IsRange() {
+			field.Min = formatAttribute(domain.Range[0])
+			field.Max = formatAttribute(domain.Range[1])
+		}
+		result = append(result, field)
+	}
+	return result
+}
+
+// Get the attributes the user changed in the edit form, parsed according to the layer's schema
+func changedFormAttributes(layer *ArcGISLayer, feature *ArcGISFeature, form url.Values) (map[string]any, error) {
+	result := make(map[string]any)
+	for _, field := range featureFormFields(layer, feature) {
+		if _, ok := form[field.Name]; !ok {
+			continue
+		}
+		value := form.Get(field.Name)
+		if value == field.Value {
+			continue
+		}
+		f := layer.Field(field.Name)
+		v, err := parseFormValue(f, layer.Domain(f.Name, feature.Attributes), value)
+		if err != nil {
+			return nil, err
+		}
+		result[f.Name] = v
+	}
+	return result, nil
+}
+
+// Check if the geometry of a layer's features can be edited as GeoJSON in the
+// edit form. GeoJSON has no M without Z, so M-only layers would lose their Ms.
+func canEditGeometry(layer *ArcGISLayer) bool {
+	return layer.GeometryType != "" && layer.GeometryType != GeometryTypeEnvelope && (layer.HasZ || !layer.HasM)
+}
+
+// Format the geometry of a feature as GeoJSON for the edit form. The
+// coordinates stay in the layer's spatial reference.
+func formGeometry(layer *ArcGISLayer, feature *ArcGISFeature) (string, error) {
+	if !canEditGeometry(layer) {
+		return "", nil
+	}
+	gj, err := feature.ToGeoJSON(layer.GeometryType, "")
+	if err != nil {
+		return "", err
+	}
+	if gj.Geometry == nil {
+		return "", nil
+	}
+	content, err := json.Marshal(gj.Geometry)
+	if err != nil {
+		return "", fmt.Errorf("Failed to marshal geometry: %v", err)
+	}
+	return string(content), nil
+}
+
+// Get the geometry from the edit form as Esri JSON, or nil if the user didn't change it
+func changedFormGeometry(layer *ArcGISLayer, form url.Values) (json.RawMessage, error) {
+	if !canEditGeometry(layer) {
+		return nil, nil
+	}
+	value := strings.TrimSpace(form.Get("geometry"))
+	if value == strings.TrimSpace(form.Get("originalGeometry")) {
+		return nil, nil
+	}
+	if value == "" {
+		return nil, errors.New("Geometry can't be removed")
+	}
+	var gj GeoJSONGeometry
+	err := json.Unmarshal([]byte(value), &gj)
+	if err != nil {
+		return nil, fmt.Errorf("Geometry isn't valid GeoJSON: %v", err)
+	}
+	g, err := geometryFromGeoJSON(&gj, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	if g.Type != layer.GeometryType {
+		return nil, fmt.Errorf("Geometry is a %s, the layer needs a %s", gj.Type, layer.GeometryType)
+	}
+	content, err := json.Marshal(g)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal geometry: %v", err)
+	}
+	return content, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// A layer with a coded-value field whose domain depends on the subtype and a range field
+func editTestLayer() *ArcGISLayer {
+	status := &ArcGISDomain{Type: "codedValue", Name: "Status", CodedValues: []ArcGISCodedValue{
+		{Name: "Open", Code: "O"},
+		{Name: "Closed", Code: "C"},
+	}}
+	larval := &ArcGISDomain{Type: "codedValue", Name: "LarvalStatus", CodedValues: []ArcGISCodedValue{
+		{Name: "Breeding", Code: "B"},
+		{Name: "Dry", Code: "D"},
+	}}
+	layer := &ArcGISLayer{
+		ObjectIDField: "OBJECTID",
+		GlobalIDField: "GlobalID",
+		SubtypeField:  "SITETYPE",
+		Fields: []ArcGISField{
+			{Name: "OBJECTID", Type: "esriFieldTypeOID", Alias: "Object ID"},
+			{Name: "GlobalID", Type: "esriFieldTypeGlobalID", Alias: "Global ID", Editable: true},
+			{Name: "SITETYPE", Type: "esriFieldTypeSmallInteger", Alias: "Site type", Editable: true},
+			{Name: "NAME", Type: "esriFieldTypeString", Alias: "Name", Length: 10, Editable: true},
+			{Name: "STATUS", Type: "esriFieldTypeString", Alias: "Status", Length: 1, Editable: true, Nullable: true, Domain: status},
+			{Name: "ACRES", Type: "esriFieldTypeDouble", Alias: "Acres", Editable: true, Nullable: true,
+				Domain: &ArcGISDomain{Type: "range", Name: "Acres", Range: []float64{0, 100}}},
+			{Name: "INSPECTED", Type: "esriFieldTypeDate", Alias: "Inspected", Editable: true, Nullable: true},
+			{Name: "EditDate", Type: "esriFieldTypeDate", Alias: "Edit date", Editable: true},
+		},
+		Subtypes: []ArcGISSubtype{
+			{Code: float64(1), Name: "Pond", Domains: map[string]*ArcGISDomain{"STATUS": {Type: "inherited"}}},
+			{Code: float64(2), Name: "Catch basin", Domains: map[string]*ArcGISDomain{"STATUS": larval}},
+		},
+		EditFieldsInfo: &ArcGISEditFieldsInfo{EditDateField: "EditDate"},
+	}
+	layer.URL = "https://example.com/arcgis/rest/services/Test/FeatureServer/0"
+	return layer
+}
+
+func TestParseFormValue(t *testing.T) {
+	layer := editTestLayer()
+	tests := []struct {
+		field string
+		input string
+		want  any
+		err   string
+	}{
+		{"SITETYPE", "2", float64(2), ""},
+		{"SITETYPE", "2.5", nil, "whole number"},
+		{"SITETYPE", "", nil, "can't be empty"},
+		{"NAME", "  Elm  ", "Elm", ""},
+		{"NAME", "", "", ""},
+		{"NAME", "Much too long", nil, "at most 10"},
+		{"STATUS", "", nil, ""},
+		{"STATUS", "C", "C", ""},
+		{"STATUS", "X", nil, "isn't a valid value"},
+		{"ACRES", "12.5", 12.5, ""},
+		{"ACRES", "101", nil, "between 0 and 100"},
+		{"ACRES", "lots", nil, "must be a number"},
+		{"INSPECTED", "2026-05-01T08:30", int64(1777624200000), ""},
+		{"INSPECTED", "yesterday", nil, "must be a date"},
+	}
+	for _, test := range tests {
+		f := layer.Field(test.field)
+		got, err := parseFormValue(f, layer.Domain(f.Name, nil), test.input)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Parsing '%s' for %s gave %v, want an error containing '%s'", test.input, test.field, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Failed to parse '%s' for %s: %v", test.input, test.field, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Parsing '%s' for %s gave %#v, want %#v", test.input, test.field, got, test.want)
+		}
+	}
+}
+
+func TestSubtypeDomain(t *testing.T) {
+	layer := editTestLayer()
+	f := layer.Field("STATUS")
+	// An inherited domain falls back to the field's own
+	pond := map[string]any{"SITETYPE": float64(1)}
+	if _, err := parseFormValue(f, layer.Domain(f.Name, pond), "O"); err != nil {
+		t.Errorf("Open isn't valid for a pond: %v", err)
+	}
+	basin := map[string]any{"SITETYPE": float64(2)}
+	if _, err := parseFormValue(f, layer.Domain(f.Name, basin), "O"); err == nil {
+		t.Error("Open is valid for a catch basin, which has its own domain")
+	}
+	if v, err := parseFormValue(f, layer.Domain(f.Name, basin), "D"); err != nil || v != "D" {
+		t.Errorf("Parsing Dry for a catch basin gave %v, %v", v, err)
+	}
+}
+
+func TestChangedFormAttributes(t *testing.T) {
+	layer := editTestLayer()
+	feature := &ArcGISFeature{Attributes: map[string]any{
+		"OBJECTID": float64(7),
+		"GlobalID": "{7}",
+		"SITETYPE": float64(1),
+		"NAME":     "Elm",
+		"STATUS":   "O",
+		"ACRES":    float64(3),
+		"EditDate": float64(1700000000000),
+	}}
+	form := url.Values{
+		"OBJECTID": []string{"8"},
+		"GlobalID": []string{"{8}"},
+		"EditDate": []string{"2026-05-01T08:30"},
+		"NAME":     []string{"Elm"},
+		"STATUS":   []string{"C"},
+		"ACRES":    []string{"3.5"},
+	}
+	changed, err := changedFormAttributes(layer, feature, form)
+	if err != nil {
+		t.Fatalf("Failed to get changed attributes: %v", err)
+	}
+	want := map[string]any{"STATUS": "C", "ACRES": 3.5}
+	if len(changed) != len(want) {
+		t.Errorf("Changed %v, want %v", changed, want)
+	}
+	for k, v := range want {
+		if changed[k] != v {
+			t.Errorf("Changed %s to %#v, want %#v", k, changed[k], v)
+		}
+	}
+
+	form.Set("ACRES", "500")
+	_, err = changedFormAttributes(layer, feature, form)
+	if err == nil {
+		t.Error("Accepted a value outside the range domain")
+	}
+}
+
+func TestUpdateFeatureEditConflict(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	token := signIn(t, portal, "fake.technician")
+	ctx := context.Background()
+	layer, err := fetchLayer(ctx, token.AccessToken, fakeServiceURL(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := fetchFeature(ctx, token.AccessToken, layer, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := loaded.Attributes["EditDate"]
+
+	// Someone else saves the feature after we loaded it
+	_, err = updateFeatureIfUnchanged(ctx, token.AccessToken, layer, 1, stale, map[string]any{"ZONE": "Z2"}, nil)
+	if err != nil {
+		t.Fatalf("First update failed: %v", err)
+	}
+	_, err = updateFeatureIfUnchanged(ctx, token.AccessToken, layer, 1, stale, map[string]any{"ZONE": "Z3"}, nil)
+	if !errors.Is(err, ErrEditConflict) {
+		t.Fatalf("Got %v for a stale edit date, want ErrEditConflict", err)
+	}
+	current, err := fetchFeature(ctx, token.AccessToken, layer, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Attributes["ZONE"] != "Z2" {
+		t.Errorf("Zone is %v after the conflict, want Z2", current.Attributes["ZONE"])
+	}
+
+	// The form shows the conflict rather than overwriting
+	original, _ := json.Marshal(loaded.Attributes)
+	form := url.Values{"original": []string{string(original)}, "ZONE": []string{"Z4"}}
+	target := "/feature?service=" + fakeServiceURL() + "&layer=0&object=1"
+	w := callAs(t, "fake.technician", http.MethodPost, "/feature", postFeature, target, form)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "edited by someone else") {
+		t.Errorf("Got status %d without the conflict for a stale form", w.Code)
+	}
+
+	// Loading it again gets the current edit date, which saves
+	_, err = updateFeatureIfUnchanged(ctx, token.AccessToken, layer, 1, current.Attributes["EditDate"], map[string]any{"ZONE": "Z5"}, nil)
+	if err != nil {
+		t.Errorf("Update with the current edit date failed: %v", err)
+	}
+}
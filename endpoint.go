@@ -1,34 +1,487 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
 )
 
+func getAttachment(w http.ResponseWriter, r *http.Request) {
+	_, token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	serviceURL, layerID, err := serviceLayerParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	objectID, err := strconv.ParseInt(r.URL.Query().Get("object"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid object ID", http.StatusBadRequest)
+		return
+	}
+	attachmentID, err := strconv.ParseInt(r.URL.Query().Get("attachment"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid attachment ID", http.StatusBadRequest)
+		return
+	}
+	layerURL := fmt.Sprintf("%s/%d", strings.TrimRight(serviceURL, "/"), layerID)
+	err = proxyAttachment(r.Context(), w, token.AccessToken, layerURL, objectID, attachmentID)
+	if err != nil {
+		log.Printf("Failed to proxy attachment %d of %s/%d: %v", attachmentID, layerURL, objectID, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+func getAttachments(w http.ResponseWriter, r *http.Request) {
+	username, token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	serviceURL, layerID, err := serviceLayerParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	objectIDs, err := parseObjectIDs(r.URL.Query().Get("objectIds"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	layer, err := fetchLayer(r.Context(), token.AccessToken, serviceURL, layerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	groups, err := queryAttachments(r.Context(), token.AccessToken, layer, objectIDs, r.URL.Query().Get("where"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = htmlAttachments(w, r.URL.Path, username, serviceURL, layer, groups)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func getContent(w http.ResponseWriter, r *http.Request) {
+	username, token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	folders, err := fetchAllUserContent(r.Context(), token.AccessToken, username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = htmlContent(w, r.URL.Path, username, folders)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func getDashboard(w http.ResponseWriter, r *http.Request) {
-	username := sessionManager.GetString(r.Context(), "username")
-	if username == "" {
-		log.Println("Redirecting from dashboard since we don't have a username in this session")
-		http.Redirect(w, r, BaseURL+"/", http.StatusFound)
+	username, token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	tryPortal(r.Context(), token.AccessToken)
+	search, err := findFieldseeker(r.Context(), token.AccessToken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	token, ok := TokenDatabase[username]
+	services := discoverFeatureServices(r.Context(), token.AccessToken, search)
+	groups, err := fetchUserGroups(r.Context(), token.AccessToken)
+	if err == nil {
+		err = assignServiceGroups(r.Context(), token.AccessToken, services, groups)
+	}
+	if err != nil {
+		log.Printf("Not showing groups: %v", err)
+		groups = nil
+	}
+	groupID := r.URL.Query().Get("group")
+	if groupID != "" {
+		services = filterServicesByGroup(services, groupID)
+	}
+
+	var tables []*FieldSeekerTable
+	mapping, err := resolveFieldSeekerMapping(r.Context(), token.AccessToken)
+	if err != nil {
+		log.Printf("Not showing FieldSeeker data: %v", err)
+		mapping = nil
+	}
+	if mapping != nil {
+		tables, err = loadFieldSeekerTables(r.Context(), token.AccessToken, mapping)
+		if err != nil {
+			log.Printf("Not showing FieldSeeker data: %v", err)
+		}
+	}
+
+	err = htmlDashboard(w, r.URL.Path, username, services, groups, groupID, mapping, tables)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func getFieldSeeker(w http.ResponseWriter, r *http.Request) {
+	username, token, ok := sessionToken(w, r)
 	if !ok {
-		log.Printf("Redirecting from dashboard since we don't have a session for '%s'\n", username)
-		http.Redirect(w, r, BaseURL+"/", http.StatusFound)
 		return
 	}
-	tryPortal(token.AccessToken)
-	search, err := findFieldseeker(token.AccessToken)
+	user, err := fetchCommunitySelf(r.Context(), token.AccessToken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	search, err := findFieldseeker(r.Context(), token.AccessToken)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	log.Printf("Search: %s", search)
+	candidates := detectFieldSeeker(r.Context(), token.AccessToken, search)
+	mapping, err := getFieldSeekerMapping(user.OrgID)
+	if err == nil && mapping == nil {
+		mapping, err = detectedFieldSeekerMapping(user, candidates)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serviceURL := r.URL.Query().Get("service")
+	if serviceURL == "" && mapping != nil {
+		serviceURL = mapping.ServiceURL
+	}
+	candidate := findFieldSeekerCandidate(candidates, serviceURL)
+	if candidate == nil && len(candidates) > 0 {
+		candidate = &candidates[0]
+	}
+	err = htmlFieldSeeker(w, r.URL.Path, username, candidates, candidate, mapping, user.Role == "org_admin")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
 
-	err = htmlDashboard(w, r.URL.Path, username)
+func postFieldSeeker(w http.ResponseWriter, r *http.Request) {
+	username, token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	orgID, err := requireOrgAdmin(r.Context(), token.AccessToken)
+	if errors.Is(err, ErrNotAdmin) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	r.ParseForm()
+	search, err := findFieldseeker(r.Context(), token.AccessToken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	candidate := findFieldSeekerCandidate(detectFieldSeeker(r.Context(), token.AccessToken, search), r.Form.Get("service"))
+	if candidate == nil {
+		http.Error(w, fmt.Sprintf("'%s' isn't a FieldSeeker service we found", r.Form.Get("service")), http.StatusBadRequest)
+		return
+	}
+	layerIDs := make(map[int]bool)
+	for _, l := range append(append([]ArcGISLayerSummary(nil), candidate.Service.LayerDetails...), candidate.Service.TableDetails...) {
+		layerIDs[l.ID] = true
+	}
+	mapping := newFieldSeekerMapping(orgID, *candidate)
+	mapping.Layers = make(map[FieldSeekerLayerName]int)
+	for _, name := range FieldSeekerLayerNames {
+		id, err := strconv.Atoi(r.Form.Get(string(name)))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid layer for %s: %v", name, err), http.StatusBadRequest)
+			return
+		}
+		if id < 0 {
+			continue
+		}
+		if !layerIDs[id] {
+			http.Error(w, fmt.Sprintf("The service has no layer %d for %s", id, name), http.StatusBadRequest)
+			return
+		}
+		mapping.Layers[name] = id
+	}
+	mapping.Confirmed = true
+	mapping.ConfirmedBy = username
+	err = putFieldSeekerMapping(mapping)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, BaseURL+"/fieldseeker", http.StatusFound)
+}
+
+func getFieldSeekerData(w http.ResponseWriter, r *http.Request) {
+	username, token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	q, err := parseFieldSeekerQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mapping, err := resolveFieldSeekerMapping(r.Context(), token.AccessToken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var tables []*FieldSeekerTable
+	var table *FieldSeekerTable
+	var results []FieldSeekerResult
+	if mapping != nil {
+		tables, err = loadFieldSeekerTables(r.Context(), token.AccessToken, mapping)
+		var arcgisErr *ArcGISError
+		if errors.As(err, &arcgisErr) && arcgisErr.Code == http.StatusForbidden {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	for _, t := range tables {
+		if t.Name == q.Layer || (q.Layer == "" && table == nil) {
+			table = t
+		}
+	}
+	if table != nil {
+		q.Layer = table.Name
+		results = table.Query(q)
+	}
+	err = htmlMirrorData(w, r.URL.Path, username, mapping, tables, table, q, results)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func postFieldSeekerSync(w http.ResponseWriter, r *http.Request) {
+	_, token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	mapping, err := resolveFieldSeekerMapping(r.Context(), token.AccessToken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if mapping == nil {
+		http.Error(w, "We didn't find a FieldSeeker service to copy", http.StatusNotFound)
+		return
+	}
+	_, err = syncFieldSeeker(r.Context(), token.AccessToken, mapping)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, BaseURL+"/fieldseeker/data", http.StatusFound)
+}
+
+func getGroup(w http.ResponseWriter, r *http.Request) {
+	username, token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	group, err := fetchGroup(r.Context(), token.AccessToken, chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	items, err := fetchGroupContent(r.Context(), token.AccessToken, group.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = htmlGroup(w, r.URL.Path, username, group, items)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func getItem(w http.ResponseWriter, r *http.Request) {
+	username, token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	item, err := fetchItem(r.Context(), token.AccessToken, chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := fetchItemData(r.Context(), token.AccessToken, item.ID)
+	if err != nil {
+		// Plenty of items, like services, have no data
+		log.Printf("No data for item %s: %v", item.ID, err)
+		data = nil
+	}
+	var webMap *ArcGISWebMap
+	if item.Type == "Web Map" && data != nil {
+		webMap, err = decodeWebMap(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	err = htmlItem(w, r.URL.Path, username, item, webMap, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func getLayer(w http.ResponseWriter, r *http.Request) {
+	username, token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	serviceURL, layerID, err := serviceLayerParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	layer, err := fetchLayer(r.Context(), token.AccessToken, serviceURL, layerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var statistics *LayerStatistics
+	if r.URL.Query().Get("statistic") != "" {
+		statistics, err = layerStatistics(r.Context(), token.AccessToken, layer, r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	err = htmlLayer(w, r.URL.Path, username, serviceURL, layer, statistics)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Run the statistic asked for by the form on the layer page
+func layerStatistics(ctx context.Context, access string, layer *ArcGISLayer, params url.Values) (*LayerStatistics, error) {
+	statistic := ArcGISStatistic{
+		StatisticType:    params.Get("statistic"),
+		OnStatisticField: params.Get("field"),
+	}
+	if layer.Field(statistic.OnStatisticField) == nil {
+		return nil, fmt.Errorf("Layer %s has no field '%s'", layer.Name, statistic.OnStatisticField)
+	}
+	groupBy := make([]string, 0)
+	for _, name := range strings.Split(params.Get("groupBy"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if layer.Field(name) == nil {
+			return nil, fmt.Errorf("Layer %s has no field '%s'", layer.Name, name)
+		}
+		groupBy = append(groupBy, name)
+	}
+	q := ArcGISQuery{
+		Where:                      params.Get("where"),
+		OutStatistics:              []ArcGISStatistic{statistic},
+		GroupByFieldsForStatistics: groupBy,
+	}
+	rows, err := queryStatistics(ctx, access, layer, q)
+	if err != nil {
+		return nil, err
+	}
+	return &LayerStatistics{
+		GroupBy:   groupBy,
+		Name:      statistic.StatisticType + "_" + statistic.OnStatisticField,
+		Rows:      rows,
+		Statistic: statistic,
+		Where:     q.Where,
+	}, nil
+}
+
+func getFeature(w http.ResponseWriter, r *http.Request) {
+	username, token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	serviceURL, layerID, err := serviceLayerParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	objectID, err := strconv.ParseInt(r.URL.Query().Get("object"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid object ID", http.StatusBadRequest)
+		return
+	}
+	layer, err := fetchLayer(r.Context(), token.AccessToken, serviceURL, layerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	feature, err := fetchFeature(r.Context(), token.AccessToken, layer, objectID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = htmlFeature(w, r.URL.Path, username, serviceURL, layer, objectID, feature, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// The user's own recent ArcGIS requests. Other users' URLs would show what they've been looking at.
+func getDiagnostics(w http.ResponseWriter, r *http.Request) {
+	username, _, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, requestAttempts(username))
+}
+
+func getExport(w http.ResponseWriter, r *http.Request) {
+	_, token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	serviceURL, layerID, err := serviceLayerParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if _, err := newFeatureWriter(format, io.Discard, ArcGISSpatialReference{}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	layer, err := fetchLayer(r.Context(), token.AccessToken, serviceURL, layerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", exportContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", exportFilename(layer.Name), exportExtension(format)))
+	q := ArcGISQuery{Where: r.URL.Query().Get("where")}
+	err = exportLayer(r.Context(), w, token.AccessToken, layer, format, q)
+	if err != nil {
+		// Part of the file has likely been sent already, so all we can do is log it
+		log.Printf("Failed to export %s: %v", layer.URL, err)
 	}
 }
 
@@ -70,6 +523,360 @@ func getRoot(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func getUsage(w http.ResponseWriter, r *http.Request) {
+	username, token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	start, end, err := parseUsageRange(r.URL.Query().Get("start"), r.URL.Query().Get("end"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report, err := usageReport(r.Context(), token.AccessToken, start, end)
+	if errors.Is(err, ErrNotAdmin) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = htmlUsage(w, r.URL.Path, username, report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func getUsageCSV(w http.ResponseWriter, r *http.Request) {
+	_, token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	start, end, err := parseUsageRange(r.URL.Query().Get("start"), r.URL.Query().Get("end"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	by := r.URL.Query().Get("by")
+	if by != UsageByItem && by != UsageByType && by != UsageByUser {
+		http.Error(w, "'by' must be item, type or user", http.StatusBadRequest)
+		return
+	}
+	report, err := usageReport(r.Context(), token.AccessToken, start, end)
+	if errors.Is(err, ErrNotAdmin) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	filename := fmt.Sprintf("usage-by-%s-%s-%s.csv", by, start.Format(time.DateOnly), end.Format(time.DateOnly))
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	err = writeUsageCSV(w, report, by)
+	if err != nil {
+		log.Printf("Failed to write usage: %v", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("Failed to write JSON response: %v", err)
+	}
+}
+
+// Get the token of the user in this session, redirecting to the root if there isn't one
+func sessionToken(w http.ResponseWriter, r *http.Request) (string, OAuthTokenResponse, bool) {
+	username := sessionManager.GetString(r.Context(), "username")
+	if username == "" {
+		log.Printf("Redirecting from %s since we don't have a username in this session", r.URL.Path)
+		http.Redirect(w, r, BaseURL+"/", http.StatusFound)
+		return "", OAuthTokenResponse{}, false
+	}
+	token, ok := getToken(username)
+	if !ok {
+		log.Printf("Redirecting from %s since we don't have a session for '%s'\n", r.URL.Path, username)
+		http.Redirect(w, r, BaseURL+"/", http.StatusFound)
+		return "", OAuthTokenResponse{}, false
+	}
+	return username, token, true
+}
+
+// Parse a comma-separated list of object IDs
+func parseObjectIDs(s string) ([]int64, error) {
+	result := make([]int64, 0)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid object ID '%s'", part)
+		}
+		result = append(result, id)
+	}
+	return result, nil
+}
+
+// Hosts of the organization's own ArcGIS servers, from ARCGIS_SERVER_HOSTS
+var ServerHosts []string
+
+// Read a comma separated list of hosts, like 'gis.example.org,gis2.example.org:6443'
+func parseServerHosts(value string) []string {
+	hosts := make([]string, 0)
+	for _, host := range strings.Split(value, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// Whether a URL is on the portal, ArcGIS Online or one of the configured servers
+func isArcGISHost(u *url.URL) bool {
+	host := strings.ToLower(u.Host)
+	portal, err := url.Parse(PortalURL)
+	if err == nil && host == strings.ToLower(portal.Host) {
+		return true
+	}
+	if slices.Contains(ServerHosts, host) {
+		return true
+	}
+	hostname := strings.ToLower(u.Hostname())
+	if u.Port() != "" && u.Port() != "443" {
+		return false
+	}
+	return hostname == "arcgis.com" || strings.HasSuffix(hostname, ".arcgis.com")
+}
+
+// The service URL must be an https feature service on a host we trust, since we send the user's token to it
+func validateServiceURL(serviceURL string) error {
+	u, err := url.Parse(serviceURL)
+	if err != nil || u.Scheme != "https" || !strings.HasSuffix(strings.TrimRight(u.Path, "/"), "/FeatureServer") {
+		return fmt.Errorf("'%s' is not a feature service URL", serviceURL)
+	}
+	if u.User != nil || !isArcGISHost(u) {
+		return fmt.Errorf("'%s' isn't on ArcGIS Online or one of your organization's servers", serviceURL)
+	}
+	return nil
+}
+
+// Read the 'service' and 'layer' query parameters
+func serviceLayerParams(r *http.Request) (string, int, error) {
+	serviceURL := r.URL.Query().Get("service")
+	if err := validateServiceURL(serviceURL); err != nil {
+		return "", 0, err
+	}
+	layerID, err := strconv.Atoi(r.URL.Query().Get("layer"))
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid layer: %v", err)
+	}
+	return serviceURL, layerID, nil
+}
+
+func postFeature(w http.ResponseWriter, r *http.Request) {
+	username, token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	serviceURL, layerID, err := serviceLayerParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	objectID, err := strconv.ParseInt(r.URL.Query().Get("object"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid object ID", http.StatusBadRequest)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	layer, err := fetchLayer(r.Context(), token.AccessToken, serviceURL, layerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The form was built from this version of the feature
+	var original ArcGISFeature
+	err = json.Unmarshal([]byte(r.PostForm.Get("original")), &original.Attributes)
+	if err != nil {
+		http.Error(w, "Invalid original attributes", http.StatusBadRequest)
+		return
+	}
+	attributes, err := changedFormAttributes(layer, &original, r.PostForm)
+	var geometry json.RawMessage
+	if err == nil {
+		geometry, err = changedFormGeometry(layer, r.PostForm)
+	}
+	changed := len(attributes) > 0 || geometry != nil
+	if err == nil && changed {
+		var expectedEditDate any
+		if layer.EditFieldsInfo != nil {
+			expectedEditDate = original.Attributes[layer.EditFieldsInfo.EditDateField]
+		}
+		_, err = updateFeatureIfUnchanged(r.Context(), token.AccessToken, layer, objectID, expectedEditDate, attributes, geometry)
+	}
+	message := "Saved"
+	if err != nil {
+		log.Printf("Failed to update feature %d of %s: %v", objectID, layer.URL, err)
+		message = err.Error()
+	} else if !changed {
+		message = "Nothing changed"
+	}
+	feature, err := fetchFeature(r.Context(), token.AccessToken, layer, objectID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = htmlFeature(w, r.URL.Path, username, serviceURL, layer, objectID, feature, message)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func getReplica(w http.ResponseWriter, r *http.Request) {
+	username, _, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	replica, err := loadOwnedReplica(chi.URLParam(r, "id"), username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, replica)
+}
+
+func postReplica(w http.ResponseWriter, r *http.Request) {
+	username, token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	serviceURL := r.FormValue("service")
+	if err := validateServiceURL(serviceURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	layerIDs := make([]int, 0)
+	for _, part := range strings.Split(r.FormValue("layers"), ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid layer '%s'", part), http.StatusBadRequest)
+			return
+		}
+		layerIDs = append(layerIDs, id)
+	}
+	replica, err := createReplica(r.Context(), token.AccessToken, username, serviceURL, r.FormValue("name"), layerIDs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, replica)
+}
+
+// The body of a request to record offline edits to a replica
+type replicaEditsRequest struct {
+	Layer   int             `json:"layer"`
+	Adds    []ArcGISFeature `json:"adds"`
+	Updates []ArcGISFeature `json:"updates"`
+	Deletes []string        `json:"deletes"`
+}
+
+func postReplicaEdits(w http.ResponseWriter, r *http.Request) {
+	username, _, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	var body replicaEditsRequest
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid edits: %v", err), http.StatusBadRequest)
+		return
+	}
+	edits := ArcGISEdits{Adds: body.Adds, Updates: body.Updates}
+	err = recordReplicaEdits(username, chi.URLParam(r, "id"), body.Layer, edits, body.Deletes)
+	if errors.Is(err, ErrNoReplica) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func postReplicaSync(w http.ResponseWriter, r *http.Request) {
+	username, token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	replica, err := synchronizeReplica(r.Context(), token.AccessToken, username, chi.URLParam(r, "id"))
+	if errors.Is(err, ErrNoReplica) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, replica)
+}
+
+func postReplicaConflict(w http.ResponseWriter, r *http.Request) {
+	username, _, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	layerID, err := strconv.Atoi(chi.URLParam(r, "layer"))
+	if err != nil {
+		http.Error(w, "Invalid layer", http.StatusBadRequest)
+		return
+	}
+	keep := r.FormValue("keep")
+	if keep != "local" && keep != "server" {
+		http.Error(w, "keep must be 'local' or 'server'", http.StatusBadRequest)
+		return
+	}
+	err = resolveReplicaConflict(username, chi.URLParam(r, "id"), layerID, chi.URLParam(r, "globalID"), keep == "local")
+	if errors.Is(err, ErrNoReplica) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func postSync(w http.ResponseWriter, r *http.Request) {
+	_, token, ok := sessionToken(w, r)
+	if !ok {
+		return
+	}
+	serviceURL, layerID, err := serviceLayerParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, err = syncLayer(r.Context(), token.AccessToken, serviceURL, layerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("%s/layer?service=%s&layer=%d", BaseURL, url.QueryEscape(serviceURL), layerID), http.StatusFound)
+}
+
 func postAuthenticate(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	username := r.Form.Get("username")
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats we can export a layer to
+const (
+	ExportGeoJSON    = "geojson"
+	ExportCSV        = "csv"
+	ExportKML        = "kml"
+	ExportShapefile  = "shapefile"
+	ExportGeoPackage = "gpkg"
+)
+
+// FeatureWriter streams features in some file format. Close releases anything
+// the writer holds on to, like temporary files, whether or not it got to End.
+type FeatureWriter interface {
+	Begin(layer *ArcGISLayer) error
+	Write(f ArcGISFeature) error
+	End() error
+	Close() error
+}
+
+// Make a writer for a format. sr is the spatial reference the features will be in.
+func newFeatureWriter(format string, w io.Writer, sr ArcGISSpatialReference) (FeatureWriter, error) {
+	switch format {
+	case ExportGeoJSON:
+		return &geoJSONWriter{w: w}, nil
+	case ExportCSV:
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	case ExportKML:
+		return &kmlWriter{w: w}, nil
+	case ExportShapefile:
+		return newShapefileWriter(w, sr), nil
+	case ExportGeoPackage:
+		return newGeoPackageWriter(w, sr), nil
+	}
+	return nil, fmt.Errorf("Unknown export format '%s'", format)
+}
+
+func exportContentType(format string) string {
+	switch format {
+	case ExportGeoJSON:
+		return "application/geo+json"
+	case ExportCSV:
+		return "text/csv"
+	case ExportKML:
+		return "application/vnd.google-earth.kml+xml"
+	case ExportShapefile:
+		return "application/zip"
+	case ExportGeoPackage:
+		return "application/geopackage+sqlite3"
+	}
+	return "application/octet-stream"
+}
+
+// The file extension for a format
+func exportExtension(format string) string {
+	switch format {
+	case ExportShapefile:
+		return "zip"
+	}
+	return format
+}
+
+// Make a layer name safe to use as a file name
+func exportFilename(name string) string {
+	result := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+	if result == "" {
+		return "export"
+	}
+	return result
+}
+
+// Query a layer and write every matching feature to w as the feature comes in
+func exportLayer(ctx context.Context, w io.Writer, access string, layer *ArcGISLayer, format string, q ArcGISQuery) error {
+	q.ReturnGeometry = layer.GeometryType != ""
+	if q.ProjectTo == nil {
+		// GeoJSON and KML are WGS84 by definition, and it's the friendliest for the rest too
+		q.ProjectTo = &ArcGISSpatialReference{WKID: WKIDWGS84}
+	}
+	writer, err := newFeatureWriter(format, w, *q.ProjectTo)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	err = writer.Begin(layer)
+	if err != nil {
+		return err
+	}
+	for f, err := range queryFeatures(ctx, access, layer, q) {
+		if err != nil {
+			return err
+		}
+		err = writer.Write(f)
+		if err != nil {
+			return err
+		}
+	}
+	return writer.End()
+}
+
+type geoJSONWriter struct {
+	w     io.Writer
+	layer *ArcGISLayer
+	count int
+}
+
+func (g *geoJSONWriter) Begin(layer *ArcGISLayer) error {
+	g.layer = layer
+	_, err := io.WriteString(g.w, `{"type":"FeatureCollection","features":[`)
+	return err
+}
+
+func (g *geoJSONWriter) Write(f ArcGISFeature) error {
+	feature, err := f.ToGeoJSON(g.layer.GeometryType, g.layer.ObjectIDField)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(feature)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal feature: %v", err)
+	}
+	if g.count > 0 {
+		content = append([]byte(",\n"), content...)
+	}
+	g.count++
+	_, err = g.w.Write(content)
+	return err
+}
+
+func (g *geoJSONWriter) End() error {
+	_, err := io.WriteString(g.w, "]}\n")
+	return err
+}
+
+func (g *geoJSONWriter) Close() error {
+	return nil
+}
+
+type csvWriter struct {
+	w      *csv.Writer
+	layer  *ArcGISLayer
+	fields []ArcGISField
+	points bool
+}
+
+func (c *csvWriter) Begin(layer *ArcGISLayer) error {
+	c.layer = layer
+	c.points = layer.GeometryType == GeometryTypePoint
+	header := make([]string, 0)
+	for _, f := range layer.Fields {
+		if f.Type == "esriFieldTypeGeometry" || f.Type == "esriFieldTypeBlob" || f.Type == "esriFieldTypeRaster" {
+			continue
+		}
+		c.fields = append(c.fields, f)
+		header = append(header, f.Name)
+	}
+	if c.points {
+		header = append(header, "longitude", "latitude")
+	}
+	return c.w.Write(header)
+}
+
+func (c *csvWriter) Write(f ArcGISFeature) error {
+	row := make([]string, 0, len(c.fields)+2)
+	for _, field := range c.fields {
+		row = append(row, displayAttribute(c.layer, &field, f.Attributes))
+	}
+	if c.points {
+		lon, lat := "", ""
+		g, err := f.DecodeGeometry(GeometryTypePoint)
+		if err != nil {
+			return err
+		}
+		if g != nil && !g.IsEmpty() {
+			lon = strconv.FormatFloat(*g.X, 'f', -1, 64)
+			lat = strconv.FormatFloat(*g.Y, 'f', -1, 64)
+		}
+		row = append(row, lon, lat)
+	}
+	return c.w.Write(row)
+}
+
+func (c *csvWriter) End() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) Close() error {
+	return nil
+}
+
+// Format an attribute for people: coded values become their labels and dates become dates
+func displayAttribute(layer *ArcGISLayer, field *ArcGISField, attributes map[string]any) string {
+	v := attributes[field.Name]
+	if v == nil {
+		return ""
+	}
+	if domain := layer.Domain(field.Name, attributes); domain.IsCodedValue() {
+		return domain.Label(v)
+	}
+	if field.Type == "esriFieldTypeDate" {
+		if ms, ok := v.(float64); ok {
+			return time.UnixMilli(int64(ms)).UTC().Format(time.RFC3339)
+		}
+	}
+	return formatAttribute(v)
+}
+
+type kmlWriter struct {
+	w     io.Writer
+	layer *ArcGISLayer
+}
+
+func (k *kmlWriter) Begin(layer *ArcGISLayer) error {
+	k.layer = layer
+	_, err := fmt.Fprintf(k.w, "%s<kml xmlns=\"http://www.opengis.net/kml/2.2\"><Document><name>%s</name>\n", xml.Header, xmlEscape(layer.Name))
+	return err
+}
+
+func (k *kmlWriter) Write(f ArcGISFeature) error {
+	g, err := f.DecodeGeometry(k.layer.GeometryType)
+	if err != nil {
+		return err
+	}
+	gj, err := g.ToGeoJSON()
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	b.WriteString("<Placemark>")
+	if k.layer.DisplayField != "" {
+		fmt.Fprintf(&b, "<name>%s</name>", xmlEscape(formatAttribute(f.Attributes[k.layer.DisplayField])))
+	}
+	b.WriteString("<ExtendedData>")
+	for _, field := range k.layer.Fields {
+		if field.Type == "esriFieldTypeGeometry" {
+			continue
+		}
+		fmt.Fprintf(&b, "<Data name=\"%s\"><value>%s</value></Data>", xmlEscape(field.Name), xmlEscape(displayAttribute(k.layer, &field, f.Attributes)))
+	}
+	b.WriteString("</ExtendedData>")
+	if gj != nil {
+		writeKMLGeometry(&b, gj.Type, gj.Coordinates)
+	}
+	b.WriteString("</Placemark>\n")
+	_, err = io.WriteString(k.w, b.String())
+	return err
+}
+
+func (k *kmlWriter) End() error {
+	_, err := io.WriteString(k.w, "</Document></kml>\n")
+	return err
+}
+
+func (k *kmlWriter) Close() error {
+	return nil
+}
+
+func writeKMLGeometry(b *strings.Builder, geometryType string, coordinates any) {
+	switch geometryType {
+	case "Point":
+		fmt.Fprintf(b, "<Point><coordinates>%s</coordinates></Point>", kmlCoordinate(coordinates.(Coordinate)))
+	case "MultiPoint":
+		b.WriteString("<MultiGeometry>")
+		for _, c := range coordinates.([]Coordinate) {
+			writeKMLGeometry(b, "Point", c)
+		}
+		b.WriteString("</MultiGeometry>")
+	case "LineString":
+		fmt.Fprintf(b, "<LineString><coordinates>%s</coordinates></LineString>", kmlCoordinates(coordinates.([]Coordinate)))
+	case "MultiLineString":
+		b.WriteString("<MultiGeometry>")
+		for _, path := range coordinates.([][]Coordinate) {
+			writeKMLGeometry(b, "LineString", path)
+		}
+		b.WriteString("</MultiGeometry>")
+	case "Polygon":
+		rings := coordinates.([][]Coordinate)
+		b.WriteString("<Polygon>")
+		for i, ring := range rings {
+			boundary := "innerBoundaryIs"
+			if i == 0 {
+				boundary = "outerBoundaryIs"
+			}
+			fmt.Fprintf(b, "<%s><LinearRing><coordinates>%s</coordinates></LinearRing></%s>", boundary, kmlCoordinates(ring), boundary)
+		}
+		b.WriteString("</Polygon>")
+	case "MultiPolygon":
+		b.WriteString("<MultiGeometry>")
+		for _, polygon := range coordinates.([][][]Coordinate) {
+			writeKMLGeometry(b, "Polygon", polygon)
+		}
+		b.WriteString("</MultiGeometry>")
+	}
+}
+
+// KML coordinates are lon,lat[,alt] so any M value is dropped
+func kmlCoordinate(c Coordinate) string {
+	parts := make([]string, 0, 3)
+	for i := 0; i < len(c) && i < 3; i++ {
+		parts = append(parts, strconv.FormatFloat(c[i], 'f', -1, 64))
+	}
+	return strings.Join(parts, ",")
+}
+
+func kmlCoordinates(cs []Coordinate) string {
+	parts := make([]string, len(cs))
+	for i, c := range cs {
+		parts[i] = kmlCoordinate(c)
+	}
+	return strings.Join(parts, " ")
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Read an exported CSV, checking it has a header with the given columns
+func readExportCSV(t *testing.T, data string, columns ...string) [][]string {
+	t.Helper()
+	records, err := csv.NewReader(strings.NewReader(data)).ReadAll()
+	if err != nil {
+		t.Fatalf("Export isn't CSV: %v", err)
+	}
+	if len(records) == 0 {
+		t.Fatal("Export has no header")
+	}
+	for _, c := range columns {
+		if !slices.Contains(records[0], c) {
+			t.Errorf("Header %v has no %s", records[0], c)
+		}
+	}
+	return records
+}
+
+func TestExportEndpoint(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	signIn(t, portal, "fake.technician")
+	target := func(format string, where string) string {
+		return "/export?" + url.Values{
+			"service": []string{fakeServiceURL()},
+			"layer":   []string{"0"},
+			"format":  []string{format},
+			"where":   []string{where},
+		}.Encode()
+	}
+
+	w := callAs(t, "fake.technician", http.MethodGet, "/export", getExport, target(ExportCSV, ""), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d: %s", w.Code, w.Body)
+	}
+	if disposition := w.Header().Get("Content-Disposition"); !strings.Contains(disposition, `filename="PointLocation.csv"`) {
+		t.Errorf("Got Content-Disposition %s", disposition)
+	}
+	if records := readExportCSV(t, w.Body.String(), "NAME", "longitude", "latitude"); len(records) != 5 {
+		t.Errorf("Got %d rows, want a header and 4 features", len(records))
+	}
+
+	w = callAs(t, "fake.technician", http.MethodGet, "/export", getExport, target(ExportGeoJSON, "NAME = 'Mill pond'"), nil)
+	var collection struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Properties map[string]any `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &collection); err != nil {
+		t.Fatalf("Export isn't JSON: %v", err)
+	}
+	if collection.Type != "FeatureCollection" || len(collection.Features) != 1 || collection.Features[0].Properties["NAME"] != "Mill pond" {
+		t.Errorf("Got %+v, want just the Mill pond", collection)
+	}
+
+	w = callAs(t, "fake.technician", http.MethodGet, "/export", getExport, target("xls", ""), nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d for an unknown format, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestExportCommand(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	signIn(t, portal, "fake.technician")
+
+	code := runCommand("export", []string{"-user", "fake.technician", "-service", fakeServiceURL(), "-layer", "0", "-format", ExportCSV, "-where", "NAME LIKE '%pond%'", "-out", "ponds.csv"})
+	if code != 0 {
+		t.Fatalf("Export exited with %d", code)
+	}
+	content, err := os.ReadFile("ponds.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := readExportCSV(t, string(content), "NAME"); len(records) != 2 {
+		t.Errorf("Got %d rows, want a header and the Mill pond", len(records))
+	}
+
+	if code := runCommand("export", []string{"-user", "someone.else", "-service", fakeServiceURL()}); code != 1 {
+		t.Errorf("Export for a user without a token exited with %d, want 1", code)
+	}
+	if code := runCommand("export", []string{"-service", fakeServiceURL()}); code != 2 {
+		t.Errorf("Export without a user exited with %d, want 2", code)
+	}
+}
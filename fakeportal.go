@@ -0,0 +1,779 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Where the fake portal's fixtures are when FAKE_PORTAL is set to 'true'
+const FakePortalFixtures = "fixtures/fakeportal"
+
+// The text in fixture files that gets replaced with the fake portal's URL
+const fakePortalPlaceholder = "{portal}"
+
+// FakePortal is an in-process stand-in for ArcGIS Online, seeded from fixture
+// files, so the app can run and be tested without the internet or an account.
+type FakePortal struct {
+	Server *httptest.Server
+	// Where the fixtures are
+	dir string
+	// How long the access tokens it hands out stay valid
+	TokenLifetime time.Duration
+
+	lock          sync.Mutex
+	portal        map[string]any
+	users         []fakePortalUser
+	items         []fakePortalItem
+	folders       []ArcGISFolder
+	groups        []fakePortalGroup
+	usage         []fakePortalUsage
+	services      map[string]*fakeService
+	codes         map[string]string
+	tokens        map[string]fakePortalToken
+	refreshTokens map[string]string
+}
+
+type fakePortalUser struct {
+	Username   string   `json:"username"`
+	Password   string   `json:"password,omitempty"`
+	FullName   string   `json:"fullName"`
+	FirstName  string   `json:"firstName"`
+	LastName   string   `json:"lastName"`
+	Email      string   `json:"email"`
+	Role       string   `json:"role"`
+	Privileges []string `json:"privileges"`
+	OrgID      string   `json:"orgId"`
+}
+
+type fakePortalItem struct {
+	ArcGISItemDetails
+}
+
+// A group, with who is in it and what is shared with it
+type fakePortalGroup struct {
+	ArcGISGroup
+	Members []string `json:"members"`
+	Items   []string `json:"items"`
+}
+
+func (g *fakePortalGroup) visibleTo(user *fakePortalUser) bool {
+	return g.Access != "private" || slices.Contains(g.Members, user.Username)
+}
+
+// What something costs each day, which the fake reports for every day asked about
+type fakePortalUsage struct {
+	EType    string  `json:"etype"`
+	SType    string  `json:"stype"`
+	Username string  `json:"username"`
+	ItemID   string  `json:"itemid"`
+	Credits  float64 `json:"credits"`
+	Num      float64 `json:"num"`
+}
+
+type fakePortalToken struct {
+	username string
+	expires  time.Time
+}
+
+// Start a fake portal serving the fixtures in a directory
+func newFakePortal(dir string) (*FakePortal, error) {
+	p := &FakePortal{
+		dir:           dir,
+		TokenLifetime: 30 * time.Minute,
+		services:      make(map[string]*fakeService),
+		codes:         make(map[string]string),
+		tokens:        make(map[string]fakePortalToken),
+		refreshTokens: make(map[string]string),
+	}
+	p.Server = httptest.NewUnstartedServer(p.router())
+	p.Server.StartTLS()
+	err := p.load(dir)
+	if err != nil {
+		p.Server.Close()
+		return nil, err
+	}
+	log.Printf("Fake portal serving %s on %s", dir, p.Server.URL)
+	return p, nil
+}
+
+func (p *FakePortal) Close() {
+	p.Server.Close()
+}
+
+// Make every token handed out so far expire, to exercise refreshing
+func (p *FakePortal) ExpireTokens() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for access, token := range p.tokens {
+		token.expires = time.Now()
+		p.tokens[access] = token
+	}
+}
+
+func (p *FakePortal) router() http.Handler {
+	r := chi.NewRouter()
+	r.Use(middleware.StripSlashes)
+	r.Get("/sharing/rest/oauth2/authorize", p.getAuthorize)
+	r.Post("/sharing/rest/oauth2/authorize", p.postAuthorize)
+	r.Post("/sharing/rest/oauth2/token", p.postToken)
+	r.Post("/sharing/rest/oauth2/revokeToken", p.postRevokeToken)
+	r.Post("/sharing/rest/generateToken", p.postGenerateToken)
+	r.Get("/sharing/rest/portals/self", p.getPortalSelf)
+	r.Get("/sharing/rest/portals/{id}/usage", p.getUsage)
+	r.Get("/sharing/rest/community/self", p.getCommunitySelf)
+	r.Get("/sharing/rest/community/groups/{id}", p.getGroup)
+	r.Get("/sharing/rest/search", p.getSearch)
+	r.Get("/sharing/rest/content/groups/{id}", p.getGroupContent)
+	r.Get("/sharing/rest/content/items/{id}", p.getItem)
+	r.Get("/sharing/rest/content/items/{id}/data", p.getItemData)
+	r.Get("/sharing/rest/content/users/{username}", p.getUserContent)
+	r.Get("/sharing/rest/content/users/{username}/{folder}", p.getUserContent)
+	r.Get("/arcgis/rest/services/{service}/FeatureServer", p.getService)
+	r.Get("/arcgis/rest/services/{service}/FeatureServer/layers", p.getServiceLayers)
+	r.Get("/arcgis/rest/services/{service}/FeatureServer/{layer}", p.getServiceLayer)
+	r.Get("/arcgis/rest/services/{service}/FeatureServer/{layer}/query", p.queryServiceLayer)
+	r.Post("/arcgis/rest/services/{service}/FeatureServer/{layer}/query", p.queryServiceLayer)
+	r.Post("/arcgis/rest/services/{service}/FeatureServer/extractChanges", p.postExtractChanges)
+	r.Post("/arcgis/rest/services/{service}/FeatureServer/{layer}/applyEdits", p.postApplyEdits)
+	return r
+}
+
+func (p *FakePortal) load(dir string) error {
+	err := p.readFixture(filepath.Join(dir, "portal.json"), &p.portal)
+	if err != nil {
+		return err
+	}
+	err = p.readFixture(filepath.Join(dir, "users.json"), &p.users)
+	if err != nil {
+		return err
+	}
+	orgID, _ := p.portal["id"].(string)
+	for i := range p.users {
+		p.users[i].OrgID = orgID
+	}
+	err = p.readFixture(filepath.Join(dir, "items.json"), &p.items)
+	if err != nil {
+		return err
+	}
+	err = p.readFixture(filepath.Join(dir, "folders.json"), &p.folders)
+	if err != nil {
+		return err
+	}
+	err = p.readFixture(filepath.Join(dir, "groups.json"), &p.groups)
+	if err != nil {
+		return err
+	}
+	err = p.readFixture(filepath.Join(dir, "usage.json"), &p.usage)
+	if err != nil {
+		return err
+	}
+	services, err := os.ReadDir(filepath.Join(dir, "services"))
+	if err != nil {
+		return fmt.Errorf("Failed to read fake services: %v", err)
+	}
+	for _, entry := range services {
+		if !entry.IsDir() {
+			continue
+		}
+		service, err := p.loadService(filepath.Join(dir, "services", entry.Name()))
+		if err != nil {
+			return err
+		}
+		p.services[entry.Name()] = service
+	}
+	return nil
+}
+
+// Read a JSON fixture, pointing any URLs in it at the fake portal
+func (p *FakePortal) readFixture(path string, v any) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read fixture: %v", err)
+	}
+	content = []byte(strings.ReplaceAll(string(content), fakePortalPlaceholder, p.Server.URL))
+	err = json.Unmarshal(content, v)
+	if err != nil {
+		return fmt.Errorf("Failed to unmarshal fixture %s: %v", path, err)
+	}
+	return nil
+}
+
+func fakeSecret() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Write the error envelope ArcGIS uses, which comes with a 200 status
+func fakeError(w http.ResponseWriter, code int, message string, details ...string) {
+	if details == nil {
+		details = []string{}
+	}
+	writeJSON(w, map[string]any{
+		"error": map[string]any{"code": code, "message": message, "details": details},
+	})
+}
+
+// Write the error the OAuth endpoints use
+func fakeOAuthError(w http.ResponseWriter, kind string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"code":              http.StatusBadRequest,
+			"error":             kind,
+			"error_description": message,
+			"message":           message,
+			"details":           []string{},
+		},
+	})
+}
+
+// Find the user making a request from their token, writing the error ArcGIS
+// would if there isn't a valid one. Application tokens have no user.
+func (p *FakePortal) authenticate(w http.ResponseWriter, r *http.Request) (*fakePortalUser, bool) {
+	access := strings.TrimPrefix(r.Header.Get("X-ESRI-Authorization"), "Bearer ")
+	if access == "" {
+		access = r.FormValue("token")
+	}
+	if access == "" {
+		fakeError(w, arcgisTokenRequired, "Token Required")
+		return nil, false
+	}
+	p.lock.Lock()
+	token, ok := p.tokens[access]
+	p.lock.Unlock()
+	if !ok || time.Now().After(token.expires) {
+		fakeError(w, arcgisInvalidToken, "Invalid token.")
+		return nil, false
+	}
+	user := p.user(token.username)
+	if user == nil {
+		return &fakePortalUser{}, true
+	}
+	return user, true
+}
+
+func (p *FakePortal) user(username string) *fakePortalUser {
+	for i := range p.users {
+		if p.users[i].Username == username {
+			return &p.users[i]
+		}
+	}
+	return nil
+}
+
+// Hand out a new access token, with a refresh token when asked for one
+func (p *FakePortal) issueToken(username string, refresh bool) map[string]any {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	access := fakeSecret()
+	p.tokens[access] = fakePortalToken{username: username, expires: time.Now().Add(p.TokenLifetime)}
+	result := map[string]any{
+		"access_token": access,
+		"expires_in":   int(p.TokenLifetime.Seconds()),
+		"username":     username,
+		"ssl":          true,
+	}
+	if refresh {
+		refreshToken := fakeSecret()
+		p.refreshTokens[refreshToken] = username
+		result["refresh_token"] = refreshToken
+		result["refresh_token_expires_in"] = 1209600
+	}
+	return result
+}
+
+var fakeAuthorizeTemplate = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html><head><title>Fake ArcGIS sign in</title></head>
+<body>
+<h1>Sign in to the fake portal</h1>
+<form method="post">
+<input type="hidden" name="client_id" value="{{.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+<input type="hidden" name="state" value="{{.State}}">
+<label>Username <select name="username">{{range .Users}}<option>{{.Username}}</option>{{end}}</select></label>
+<label>Password <input type="password" name="password"></label>
+<button type="submit">Sign in</button>
+</form>
+</body></html>`))
+
+func (p *FakePortal) getAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("response_type") != "code" || query.Get("redirect_uri") == "" {
+		http.Error(w, "Only the authorization code flow is supported", http.StatusBadRequest)
+		return
+	}
+	err := fakeAuthorizeTemplate.Execute(w, map[string]any{
+		"ClientID":    query.Get("client_id"),
+		"RedirectURI": query.Get("redirect_uri"),
+		"State":       query.Get("state"),
+		"Users":       p.users,
+	})
+	if err != nil {
+		log.Printf("Failed to render fake sign in: %v", err)
+	}
+}
+
+func (p *FakePortal) postAuthorize(w http.ResponseWriter, r *http.Request) {
+	user := p.user(r.FormValue("username"))
+	if user == nil || user.Password != r.FormValue("password") {
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	redirect, err := url.Parse(r.FormValue("redirect_uri"))
+	if err != nil || redirect.Scheme == "" {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	code := fakeSecret()
+	p.lock.Lock()
+	p.codes[code] = user.Username
+	p.lock.Unlock()
+	params := redirect.Query()
+	params.Set("code", code)
+	if state := r.FormValue("state"); state != "" {
+		params.Set("state", state)
+	}
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (p *FakePortal) postToken(w http.ResponseWriter, r *http.Request) {
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		p.lock.Lock()
+		username, ok := p.codes[r.FormValue("code")]
+		delete(p.codes, r.FormValue("code"))
+		p.lock.Unlock()
+		if !ok {
+			fakeOAuthError(w, "invalid_grant", "Invalid authorization code")
+			return
+		}
+		writeJSON(w, p.issueToken(username, true))
+	case "refresh_token":
+		p.lock.Lock()
+		username, ok := p.refreshTokens[r.FormValue("refresh_token")]
+		p.lock.Unlock()
+		if !ok {
+			fakeOAuthError(w, "invalid_grant", "Invalid refresh_token")
+			return
+		}
+		writeJSON(w, p.issueToken(username, false))
+	case "client_credentials":
+		if r.FormValue("client_secret") == "" {
+			fakeOAuthError(w, "invalid_client", "Invalid client_secret")
+			return
+		}
+		token := p.issueToken("", false)
+		delete(token, "username")
+		writeJSON(w, token)
+	default:
+		fakeOAuthError(w, "unsupported_grant_type", "Unsupported grant_type")
+	}
+}
+
+func (p *FakePortal) postRevokeToken(w http.ResponseWriter, r *http.Request) {
+	p.lock.Lock()
+	for _, name := range []string{"token", "auth_token"} {
+		if token := r.FormValue(name); token != "" {
+			delete(p.tokens, token)
+			delete(p.refreshTokens, token)
+		}
+	}
+	p.lock.Unlock()
+	writeJSON(w, map[string]any{"success": true})
+}
+
+func (p *FakePortal) postGenerateToken(w http.ResponseWriter, r *http.Request) {
+	user := p.user(r.FormValue("username"))
+	if user == nil || user.Password != r.FormValue("password") {
+		fakeError(w, http.StatusBadRequest, "Unable to generate token.", "Invalid username or password.")
+		return
+	}
+	minutes, err := strconv.Atoi(r.FormValue("expiration"))
+	if err != nil || minutes <= 0 {
+		minutes = 60
+	}
+	access := fakeSecret()
+	expires := time.Now().Add(time.Duration(minutes) * time.Minute)
+	p.lock.Lock()
+	p.tokens[access] = fakePortalToken{username: user.Username, expires: expires}
+	p.lock.Unlock()
+	writeJSON(w, map[string]any{"token": access, "expires": expires.UnixMilli(), "ssl": true})
+}
+
+// The user as the portal describes them, without their password
+func (u *fakePortalUser) public() fakePortalUser {
+	result := *u
+	result.Password = ""
+	return result
+}
+
+func (p *FakePortal) getPortalSelf(w http.ResponseWriter, r *http.Request) {
+	user, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+	result := make(map[string]any, len(p.portal)+1)
+	for k, v := range p.portal {
+		result[k] = v
+	}
+	if user.Username != "" {
+		result["user"] = user.public()
+	}
+	writeJSON(w, result)
+}
+
+func (p *FakePortal) getCommunitySelf(w http.ResponseWriter, r *http.Request) {
+	user, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+	if user.Username == "" {
+		fakeError(w, http.StatusForbidden, "You do not have permissions to access this resource or perform this operation.")
+		return
+	}
+	groups := make([]ArcGISGroup, 0)
+	for _, group := range p.groups {
+		if slices.Contains(group.Members, user.Username) {
+			groups = append(groups, group.ArcGISGroup)
+		}
+	}
+	writeJSON(w, struct {
+		fakePortalUser
+		Groups []ArcGISGroup `json:"groups"`
+	}{user.public(), groups})
+}
+
+// Find a group the user can see, writing an error if there isn't one
+func (p *FakePortal) group(w http.ResponseWriter, r *http.Request, user *fakePortalUser) (*fakePortalGroup, bool) {
+	for i := range p.groups {
+		if p.groups[i].ID == chi.URLParam(r, "id") && p.groups[i].visibleTo(user) {
+			return &p.groups[i], true
+		}
+	}
+	fakeError(w, http.StatusBadRequest, "Group does not exist or is inaccessible.")
+	return nil, false
+}
+
+func (p *FakePortal) getGroup(w http.ResponseWriter, r *http.Request) {
+	user, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+	group, ok := p.group(w, r, user)
+	if !ok {
+		return
+	}
+	writeJSON(w, group.ArcGISGroup)
+}
+
+func (p *FakePortal) getGroupContent(w http.ResponseWriter, r *http.Request) {
+	user, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+	group, ok := p.group(w, r, user)
+	if !ok {
+		return
+	}
+	items := make([]fakePortalItem, 0)
+	for _, item := range p.items {
+		if slices.Contains(group.Items, item.ID) {
+			items = append(items, item)
+		}
+	}
+	writeJSON(w, map[string]any{
+		"total":     len(items),
+		"start":     1,
+		"num":       len(items),
+		"nextStart": -1,
+		"items":     items,
+	})
+}
+
+// Check if a user can see an item, private items being visible only to their owner
+func (item *fakePortalItem) visibleTo(user *fakePortalUser) bool {
+	return item.Access != "private" || item.Owner == user.Username
+}
+
+// Check an item against a search like 'FieldseekerGIS owner:someone type:"Feature Service"'.
+// Every term has to match.
+func (item *fakePortalItem) matches(q string) bool {
+	for _, term := range searchTerms(q) {
+		field, value, ok := strings.Cut(term, ":")
+		if !ok {
+			value = term
+			field = ""
+		}
+		value = strings.ToLower(strings.Trim(value, `"`))
+		switch strings.ToLower(field) {
+		case "owner":
+			if !strings.EqualFold(item.Owner, value) {
+				return false
+			}
+		case "type":
+			if !strings.EqualFold(item.Type, value) {
+				return false
+			}
+		case "id":
+			if !strings.EqualFold(item.ID, value) {
+				return false
+			}
+		case "title":
+			if !strings.Contains(strings.ToLower(item.Title), value) {
+				return false
+			}
+		default:
+			text := strings.ToLower(strings.Join(append([]string{item.Title, item.Name, item.Snippet, item.Description, item.TypeKeywords}, item.Tags...), " "))
+			if !strings.Contains(text, value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Split a search into terms, keeping quoted phrases together and dropping AND
+func searchTerms(q string) []string {
+	terms := make([]string, 0)
+	var current strings.Builder
+	quoted := false
+	for _, c := range q {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			current.WriteRune(c)
+		case c == ' ' && !quoted:
+			if current.Len() > 0 {
+				terms = append(terms, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(c)
+		}
+	}
+	if current.Len() > 0 {
+		terms = append(terms, current.String())
+	}
+	result := make([]string, 0, len(terms))
+	for _, term := range terms {
+		if term != "AND" {
+			result = append(result, term)
+		}
+	}
+	return result
+}
+
+func (p *FakePortal) getSearch(w http.ResponseWriter, r *http.Request) {
+	user, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+	num, err := strconv.Atoi(r.FormValue("num"))
+	if err != nil || num <= 0 {
+		num = 10
+	}
+	num = min(num, 100)
+	start, err := strconv.Atoi(r.FormValue("start"))
+	if err != nil || start <= 0 {
+		start = 1
+	}
+	matches := make([]fakePortalItem, 0)
+	for _, item := range p.items {
+		if item.visibleTo(user) && item.matches(r.FormValue("q")) {
+			matches = append(matches, item)
+		}
+	}
+	results := make([]fakePortalItem, 0)
+	if start <= len(matches) {
+		results = matches[start-1 : min(start-1+num, len(matches))]
+	}
+	nextStart := start + len(results)
+	if nextStart > len(matches) {
+		nextStart = -1
+	}
+	writeJSON(w, map[string]any{
+		"query":     r.FormValue("q"),
+		"total":     len(matches),
+		"start":     start,
+		"num":       num,
+		"nextStart": nextStart,
+		"results":   results,
+	})
+}
+
+// Find an item the user can see, writing an error if there isn't one
+func (p *FakePortal) item(w http.ResponseWriter, r *http.Request, user *fakePortalUser) (*fakePortalItem, bool) {
+	for i := range p.items {
+		if p.items[i].ID == chi.URLParam(r, "id") && p.items[i].visibleTo(user) {
+			return &p.items[i], true
+		}
+	}
+	fakeError(w, http.StatusBadRequest, "Item does not exist or is inaccessible.")
+	return nil, false
+}
+
+func (p *FakePortal) getItem(w http.ResponseWriter, r *http.Request) {
+	user, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+	item, ok := p.item(w, r, user)
+	if !ok {
+		return
+	}
+	writeJSON(w, item)
+}
+
+// Serve the data of an item from data/<id>.json, or data/<id>.<anything> for
+// files. Items without a data file have empty data, like services in ArcGIS.
+func (p *FakePortal) getItemData(w http.ResponseWriter, r *http.Request) {
+	user, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+	item, ok := p.item(w, r, user)
+	if !ok {
+		return
+	}
+	paths, _ := filepath.Glob(filepath.Join(p.dir, "data", item.ID+".*"))
+	if len(paths) == 0 {
+		return
+	}
+	content, err := os.ReadFile(paths[0])
+	if err != nil {
+		fakeError(w, http.StatusInternalServerError, "Unable to read item data.", err.Error())
+		return
+	}
+	content = []byte(strings.ReplaceAll(string(content), fakePortalPlaceholder, p.Server.URL))
+	if contentType := mime.TypeByExtension(filepath.Ext(paths[0])); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Write(content)
+}
+
+// List the items in one of a user's folders. Only they and administrators can.
+func (p *FakePortal) getUserContent(w http.ResponseWriter, r *http.Request) {
+	user, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+	username := chi.URLParam(r, "username")
+	if user.Username != username && user.Role != "org_admin" {
+		fakeError(w, http.StatusForbidden, "You do not have permissions to access this resource or perform this operation.")
+		return
+	}
+	folders := make([]ArcGISFolder, 0)
+	var current *ArcGISFolder
+	for _, folder := range p.folders {
+		if folder.Username != username {
+			continue
+		}
+		folders = append(folders, folder)
+		if folder.ID == chi.URLParam(r, "folder") {
+			current = &folder
+		}
+	}
+	folderID := chi.URLParam(r, "folder")
+	if folderID != "" && current == nil {
+		fakeError(w, http.StatusBadRequest, "Folder does not exist or is inaccessible.")
+		return
+	}
+	items := make([]fakePortalItem, 0)
+	for _, item := range p.items {
+		if item.Owner == username && item.OwnerFolder == folderID {
+			items = append(items, item)
+		}
+	}
+	num, err := strconv.Atoi(r.FormValue("num"))
+	if err != nil || num <= 0 {
+		num = 10
+	}
+	start, err := strconv.Atoi(r.FormValue("start"))
+	if err != nil || start <= 0 {
+		start = 1
+	}
+	page := make([]fakePortalItem, 0)
+	if start <= len(items) {
+		page = items[start-1 : min(start-1+num, len(items))]
+	}
+	nextStart := start + len(page)
+	if nextStart > len(items) {
+		nextStart = -1
+	}
+	writeJSON(w, map[string]any{
+		"username":      username,
+		"currentFolder": current,
+		"total":         len(items),
+		"start":         start,
+		"num":           num,
+		"nextStart":     nextStart,
+		"items":         page,
+		"folders":       folders,
+	})
+}
+
+func (p *FakePortal) getUsage(w http.ResponseWriter, r *http.Request) {
+	user, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+	if user.Role != "org_admin" || chi.URLParam(r, "id") != p.portal["id"] {
+		fakeError(w, http.StatusForbidden, "You do not have permissions to access this resource or perform this operation.")
+		return
+	}
+	startTime, err := strconv.ParseInt(r.FormValue("startTime"), 10, 64)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "Invalid startTime")
+		return
+	}
+	endTime, err := strconv.ParseInt(r.FormValue("endTime"), 10, 64)
+	if err != nil || endTime < startTime {
+		fakeError(w, http.StatusBadRequest, "Invalid endTime")
+		return
+	}
+	day := int64(24 * time.Hour / time.Millisecond)
+	data := make([]map[string]any, 0, len(p.usage))
+	for _, usage := range p.usage {
+		credits := make([][]any, 0)
+		num := make([][]any, 0)
+		for t := startTime; t < endTime; t += day {
+			credits = append(credits, []any{t, strconv.FormatFloat(usage.Credits, 'f', -1, 64)})
+			num = append(num, []any{t, strconv.FormatFloat(usage.Num, 'f', -1, 64)})
+		}
+		data = append(data, map[string]any{
+			"etype":    usage.EType,
+			"stype":    usage.SType,
+			"username": usage.Username,
+			"itemid":   usage.ItemID,
+			"credits":  credits,
+			"num":      num,
+		})
+	}
+	writeJSON(w, map[string]any{
+		"startTime": startTime,
+		"endTime":   endTime,
+		"period":    r.FormValue("period"),
+		"data":      data,
+	})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/go-chi/chi/v5"
+)
+
+const fakePortalPassword = "fieldseeker"
+
+// countingTransport counts the requests made to each path, and separately
+// those answered with 304 Not Modified
+type countingTransport struct {
+	next   http.RoundTripper
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := req.Method + " " + strings.TrimRight(req.URL.Path, "/")
+	t.lock.Lock()
+	t.counts[key]++
+	t.lock.Unlock()
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusNotModified {
+		t.lock.Lock()
+		t.counts["304 "+key]++
+		t.lock.Unlock()
+	}
+	return resp, err
+}
+
+func (t *countingTransport) count(key string) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.counts[key]
+}
+
+// Start a fake portal with the standard fixtures and point the app at it. The
+// test runs in a temporary directory so the token database doesn't end up in
+// the repository, with the templates linked in for the pages.
+func startFakePortal(t *testing.T) (*FakePortal, *countingTransport) {
+	t.Helper()
+	fixtures, err := filepath.Abs(FakePortalFixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, err := filepath.Abs("templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(t.TempDir())
+	if err := os.Symlink(templates, "templates"); err != nil {
+		t.Fatal(err)
+	}
+	portal, err := newFakePortal(fixtures)
+	if err != nil {
+		t.Fatalf("Failed to start fake portal: %v", err)
+	}
+	t.Cleanup(portal.Close)
+
+	previousPortal, previousBase := PortalURL, arcgisBaseTransport
+	previousBaseURL, previousClientID := BaseURL, ClientID
+	previousSessions := sessionManager
+	t.Cleanup(func() {
+		PortalURL, BaseURL, ClientID = previousPortal, previousBaseURL, previousClientID
+		sessionManager = previousSessions
+		useBaseTransport(previousBase)
+	})
+	sessionManager = scs.New()
+	PortalURL = portal.Server.URL
+	BaseURL = "http://localhost:9001"
+	ClientID = "fake-client"
+	counter := &countingTransport{next: portal.Server.Client().Transport, counts: make(map[string]int)}
+	useBaseTransport(counter)
+	initTokenDatabase()
+	return portal, counter
+}
+
+// Sign in through the fake portal's authorize form and trade the code for a token
+func signIn(t *testing.T, portal *FakePortal, username string) OAuthTokenResponse {
+	t.Helper()
+	client := portal.Server.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	form := url.Values{
+		"client_id":     []string{ClientID},
+		"redirect_uri":  []string{redirectURL()},
+		"response_type": []string{"code"},
+		"username":      []string{username},
+		"password":      []string{fakePortalPassword},
+	}
+	resp, err := client.PostForm(PortalURL+"/sharing/rest/oauth2/authorize", form)
+	if err != nil {
+		t.Fatalf("Failed to authorize: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Authorize returned %d, want a redirect", resp.StatusCode)
+	}
+	location, err := resp.Location()
+	if err != nil {
+		t.Fatalf("Authorize redirect has no location: %v", err)
+	}
+	if !strings.HasPrefix(location.String(), redirectURL()) {
+		t.Fatalf("Redirected to %s, want %s", location, redirectURL())
+	}
+	token, err := handleAccessCode(location.Query().Get("code"))
+	if err != nil {
+		t.Fatalf("Failed to trade the code for a token: %v", err)
+	}
+	return *token
+}
+
+// Call a handler as a signed in user, routed by pattern like main does
+func callAs(t *testing.T, username string, method string, pattern string, handler http.HandlerFunc, target string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	r := chi.NewRouter()
+	r.Use(sessionManager.LoadAndSave)
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if username != "" {
+				sessionManager.Put(r.Context(), "username", username)
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	r.Method(method, pattern, handler)
+	var req *http.Request
+	if form != nil {
+		req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func fakeServiceURL() string {
+	return PortalURL + "/arcgis/rest/services/FieldseekerGIS/FeatureServer"
+}
+
+func TestFakePortalOAuth(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	token := signIn(t, portal, "fake.technician")
+	if token.Username != "fake.technician" {
+		t.Errorf("Token is for '%s', want fake.technician", token.Username)
+	}
+	if token.AccessToken == "" || token.RefreshToken == "" {
+		t.Errorf("Token is missing the access or refresh token: %+v", token)
+	}
+	stored, ok := getToken("fake.technician")
+	if !ok || stored.AccessToken != token.AccessToken {
+		t.Errorf("Token database has %+v, want %+v", stored, token)
+	}
+}
+
+func TestFakePortalWrongPassword(t *testing.T) {
+	startFakePortal(t)
+	form := url.Values{
+		"redirect_uri": []string{redirectURL()},
+		"username":     []string{"fake.technician"},
+		"password":     []string{"wrong"},
+	}
+	resp, err := arcgisClient.PostForm(PortalURL+"/sharing/rest/oauth2/authorize", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Got status %d for a wrong password, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestFakePortalSearchAndFeatureService(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	token := signIn(t, portal, "fake.technician")
+
+	search, err := findFieldseeker(context.Background(), token.AccessToken)
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	services := discoverFeatureServices(context.Background(), token.AccessToken, search)
+	if len(services) != 1 {
+		t.Fatalf("Found %d feature services, want 1", len(services))
+	}
+	service := services[0]
+	if service.URL != fakeServiceURL() {
+		t.Errorf("Service is at %s, want %s", service.URL, fakeServiceURL())
+	}
+	if len(service.LayerDetails) == 0 {
+		t.Errorf("Service %s has no layers", service.URL)
+	}
+
+	layer, err := fetchLayer(context.Background(), token.AccessToken, service.URL, 0)
+	if err != nil {
+		t.Fatalf("Failed to fetch layer: %v", err)
+	}
+	if layer.Name != "PointLocation" || layer.GeometryType != GeometryTypePoint {
+		t.Errorf("Layer 0 is %s (%s), want PointLocation (%s)", layer.Name, layer.GeometryType, GeometryTypePoint)
+	}
+}
+
+func TestFakePortalApplyEdits(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	token := signIn(t, portal, "fake.technician")
+	ctx := context.Background()
+	layer, err := fetchLayer(ctx, token.AccessToken, fakeServiceURL(), 0)
+	if err != nil {
+		t.Fatalf("Failed to fetch layer: %v", err)
+	}
+
+	add := ArcGISFeature{
+		Attributes: map[string]any{"NAME": "Test pond", "ZONE": "Z9"},
+		Geometry:   []byte(`{"x":-119.7,"y":36.7,"spatialReference":{"wkid":4326}}`),
+	}
+	results, err := applyEdits(ctx, token.AccessToken, layer, ArcGISEdits{Adds: []ArcGISFeature{add}}, true)
+	if err != nil {
+		t.Fatalf("Failed to apply edits: %v", err)
+	}
+	if err := results.Err(); err != nil {
+		t.Fatalf("Edit failed: %v", err)
+	}
+	if len(results.AddResults) != 1 {
+		t.Fatalf("Got %d add results, want 1", len(results.AddResults))
+	}
+	objectID := results.AddResults[0].ObjectID
+
+	feature, err := fetchFeature(ctx, token.AccessToken, layer, objectID)
+	if err != nil {
+		t.Fatalf("Failed to fetch the added feature: %v", err)
+	}
+	if feature.Attributes["NAME"] != "Test pond" {
+		t.Errorf("Added feature is named %v, want 'Test pond'", feature.Attributes["NAME"])
+	}
+
+	update := ArcGISFeature{Attributes: map[string]any{layer.ObjectIDField: objectID, "ZONE": "Z10"}}
+	results, err = applyEdits(ctx, token.AccessToken, layer, ArcGISEdits{Updates: []ArcGISFeature{update}}, true)
+	if err != nil || results.Err() != nil {
+		t.Fatalf("Failed to update the feature: %v %v", err, results.Err())
+	}
+	feature, err = fetchFeature(ctx, token.AccessToken, layer, objectID)
+	if err != nil {
+		t.Fatalf("Failed to fetch the updated feature: %v", err)
+	}
+	if feature.Attributes["ZONE"] != "Z10" {
+		t.Errorf("Updated feature is in zone %v, want Z10", feature.Attributes["ZONE"])
+	}
+}
+
+func TestFakePortalRefreshesExpiredToken(t *testing.T) {
+	portal, counter := startFakePortal(t)
+	token := signIn(t, portal, "fake.technician")
+	portal.ExpireTokens()
+
+	service, err := fetchFeatureService(context.Background(), token.AccessToken, fakeServiceURL())
+	if err != nil {
+		t.Fatalf("Request with an expired token failed: %v", err)
+	}
+	if service.URL != fakeServiceURL() {
+		t.Errorf("Got service %s, want %s", service.URL, fakeServiceURL())
+	}
+	refreshed, _ := getToken("fake.technician")
+	if refreshed.AccessToken == token.AccessToken {
+		t.Error("The access token wasn't replaced")
+	}
+	if refreshed.RefreshToken != token.RefreshToken {
+		t.Error("The refresh token was lost when refreshing")
+	}
+	if n := counter.count("POST /sharing/rest/oauth2/token"); n != 2 {
+		t.Errorf("Made %d token requests, want 2: sign in and one refresh", n)
+	}
+}
+
+func TestFakePortalConcurrentRefreshesOnce(t *testing.T) {
+	portal, counter := startFakePortal(t)
+	token := signIn(t, portal, "fake.technician")
+	portal.ExpireTokens()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var root map[string]any
+			errs <- arcgisGet(context.Background(), token.AccessToken, fakeServiceURL(), nil, &root)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Request with an expired token failed: %v", err)
+		}
+	}
+	if n := counter.count("POST /sharing/rest/oauth2/token"); n != 2 {
+		t.Errorf("Made %d token requests, want 2: sign in and one refresh", n)
+	}
+}
+
+// Lower the maxRecordCount of a layer of the fake service and say whether it can page
+func limitFakeLayer(portal *FakePortal, layerID int, maxRecordCount int, pagination bool) {
+	portal.lock.Lock()
+	defer portal.lock.Unlock()
+	layer := portal.services["FieldseekerGIS"].layers[layerID]
+	layer.schema.MaxRecordCount = maxRecordCount
+	layer.schema.AdvancedQueryCapabilities.SupportsPagination = pagination
+	layer.definition["maxRecordCount"] = maxRecordCount
+	capabilities := make(map[string]any)
+	for k, v := range layer.definition["advancedQueryCapabilities"].(map[string]any) {
+		capabilities[k] = v
+	}
+	capabilities["supportsPagination"] = pagination
+	layer.definition["advancedQueryCapabilities"] = capabilities
+}
@@ -0,0 +1,879 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// A feature service in the fake portal, with its features in memory
+type fakeService struct {
+	root         map[string]any
+	layers       map[int]*fakeLayer
+	lastEditDate int64
+	// Every applyEdits is a new generation. Changes from before minServerGen
+	// have been forgotten, like a real service does after a while.
+	serverGen    int64
+	minServerGen int64
+}
+
+type fakeLayer struct {
+	definition map[string]any
+	// The parts of the definition the fake needs to act on
+	schema       ArcGISLayer
+	features     []ArcGISFeature
+	nextObjectID int64
+	changes      []fakeChange
+}
+
+// A feature added, updated or deleted in a generation, for extractChanges
+type fakeChange struct {
+	serverGen int64
+	objectID  int64
+	added     bool
+	deleted   bool
+}
+
+// Load a service from its directory, with service.json describing the root,
+// <id>.json each layer and <id>.features.json the features in it
+func (p *FakePortal) loadService(dir string) (*fakeService, error) {
+	service := &fakeService{layers: make(map[int]*fakeLayer), serverGen: 1, minServerGen: 1}
+	err := p.readFixture(filepath.Join(dir, "service.json"), &service.root)
+	if err != nil {
+		return nil, err
+	}
+	var root ArcGISFeatureService
+	err = p.readFixture(filepath.Join(dir, "service.json"), &root)
+	if err != nil {
+		return nil, err
+	}
+	for _, reference := range append(root.Layers, root.Tables...) {
+		layer := &fakeLayer{features: make([]ArcGISFeature, 0)}
+		path := filepath.Join(dir, fmt.Sprintf("%d.json", reference.ID))
+		err = p.readFixture(path, &layer.definition)
+		if err != nil {
+			return nil, err
+		}
+		err = p.readFixture(path, &layer.schema)
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%d.features.json", reference.ID))
+		if _, err := os.Stat(path); err == nil {
+			err = p.readFixture(path, &layer.features)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, f := range layer.features {
+			if id, ok := toFloat(f.Attributes[layer.schema.ObjectIDField]); ok {
+				layer.nextObjectID = max(layer.nextObjectID, int64(id))
+			}
+		}
+		layer.nextObjectID++
+		service.layers[reference.ID] = layer
+	}
+	if info, ok := service.root["editingInfo"].(map[string]any); ok {
+		if date, ok := toFloat(info["lastEditDate"]); ok {
+			service.lastEditDate = int64(date)
+		}
+	}
+	return service, nil
+}
+
+// Find the service and layer a request is for, writing an error if there isn't one
+func (p *FakePortal) serviceLayer(w http.ResponseWriter, r *http.Request, user *fakePortalUser) (*fakeService, *fakeLayer, bool) {
+	name := chi.URLParam(r, "service")
+	service, ok := p.services[name]
+	if !ok {
+		fakeError(w, http.StatusBadRequest, "Invalid URL", "Service not found")
+		return nil, nil, false
+	}
+	// Services are shared through their item, like in ArcGIS
+	for _, item := range p.items {
+		if strings.HasSuffix(item.URL, "/services/"+name+"/FeatureServer") && !item.visibleTo(user) {
+			fakeError(w, http.StatusForbidden, "You do not have permissions to access this resource or perform this operation.")
+			return nil, nil, false
+		}
+	}
+	layerParam := chi.URLParam(r, "layer")
+	if layerParam == "" {
+		return service, nil, true
+	}
+	layerID, err := strconv.Atoi(layerParam)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "Invalid URL")
+		return nil, nil, false
+	}
+	layer, ok := service.layers[layerID]
+	if !ok {
+		fakeError(w, http.StatusBadRequest, "Invalid URL", "Layer not found")
+		return nil, nil, false
+	}
+	return service, layer, true
+}
+
+// Write metadata with an ETag, answering If-None-Match with a 304 when it hasn't changed
+func writeCacheableJSON(w http.ResponseWriter, r *http.Request, v any) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		fakeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sum := sha256.Sum256(content)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(content)
+}
+
+// Copy a definition with the current lastEditDate in its editingInfo
+func withLastEditDate(definition map[string]any, lastEditDate int64) map[string]any {
+	result := make(map[string]any, len(definition))
+	for k, v := range definition {
+		result[k] = v
+	}
+	result["editingInfo"] = map[string]any{"lastEditDate": lastEditDate}
+	return result
+}
+
+func (p *FakePortal) getService(w http.ResponseWriter, r *http.Request) {
+	user, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+	service, _, ok := p.serviceLayer(w, r, user)
+	if !ok {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	root := withLastEditDate(service.root, service.lastEditDate)
+	gens := make([]ArcGISLayerServerGen, 0, len(service.layers))
+	for id := range service.layers {
+		gens = append(gens, ArcGISLayerServerGen{ID: id, MinServerGen: service.minServerGen, ServerGen: service.serverGen})
+	}
+	slices.SortFunc(gens, func(a, b ArcGISLayerServerGen) int { return a.ID - b.ID })
+	root["changeTrackingInfo"] = map[string]any{"layerServerGens": gens}
+	writeJSON(w, root)
+}
+
+func (p *FakePortal) getServiceLayers(w http.ResponseWriter, r *http.Request) {
+	user, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+	service, _, ok := p.serviceLayer(w, r, user)
+	if !ok {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	layers := make([]map[string]any, 0)
+	tables := make([]map[string]any, 0)
+	ids := make([]int, 0, len(service.layers))
+	for id := range service.layers {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		layer := service.layers[id]
+		definition := withLastEditDate(layer.definition, service.lastEditDate)
+		if layer.schema.Type == "Table" {
+			tables = append(tables, definition)
+		} else {
+			layers = append(layers, definition)
+		}
+	}
+	writeCacheableJSON(w, r, map[string]any{"layers": layers, "tables": tables})
+}
+
+func (p *FakePortal) getServiceLayer(w http.ResponseWriter, r *http.Request) {
+	user, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+	service, layer, ok := p.serviceLayer(w, r, user)
+	if !ok {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	writeCacheableJSON(w, r, withLastEditDate(layer.definition, service.lastEditDate))
+}
+
+func (p *FakePortal) queryServiceLayer(w http.ResponseWriter, r *http.Request) {
+	user, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+	_, layer, ok := p.serviceLayer(w, r, user)
+	if !ok {
+		return
+	}
+	for _, unsupported := range []string{"geometry", "having", "time"} {
+		if r.FormValue(unsupported) != "" {
+			fakeError(w, http.StatusBadRequest, "Unable to complete operation.", fmt.Sprintf("The fake portal doesn't support '%s'", unsupported))
+			return
+		}
+	}
+	where := r.FormValue("where")
+	if where == "" {
+		where = "1=1"
+	}
+	match, err := fakeWhere(where)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "Unable to complete operation.", err.Error())
+		return
+	}
+	var objectIDs []int64
+	if r.FormValue("objectIds") != "" {
+		objectIDs, err = parseObjectIDs(r.FormValue("objectIds"))
+		if err != nil {
+			fakeError(w, http.StatusBadRequest, "Unable to complete operation.", err.Error())
+			return
+		}
+	}
+
+	p.lock.Lock()
+	matches := make([]ArcGISFeature, 0)
+	for _, f := range layer.features {
+		if objectIDs != nil && !slices.Contains(objectIDs, layer.objectID(f)) {
+			continue
+		}
+		if match(f.Attributes) {
+			matches = append(matches, f)
+		}
+	}
+	p.lock.Unlock()
+
+	schema := &layer.schema
+	if r.FormValue("outStatistics") != "" {
+		var statistics []ArcGISStatistic
+		if err := json.Unmarshal([]byte(r.FormValue("outStatistics")), &statistics); err != nil {
+			fakeError(w, http.StatusBadRequest, "Unable to complete operation.", fmt.Sprintf("Invalid outStatistics: %v", err))
+			return
+		}
+		groupBy := make([]string, 0)
+		for _, name := range strings.Split(r.FormValue("groupByFieldsForStatistics"), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				groupBy = append(groupBy, name)
+			}
+		}
+		rows, err := fakeStatistics(matches, statistics, groupBy)
+		if err != nil {
+			fakeError(w, http.StatusBadRequest, "Unable to complete operation.", err.Error())
+			return
+		}
+		exceeded := schema.MaxRecordCount > 0 && len(rows) > schema.MaxRecordCount
+		if exceeded {
+			rows = rows[:schema.MaxRecordCount]
+		}
+		writeJSON(w, ArcGISQueryResponse{Features: rows, ExceededTransferLimit: exceeded})
+		return
+	}
+	if r.FormValue("returnCountOnly") == "true" {
+		writeJSON(w, map[string]any{"count": len(matches)})
+		return
+	}
+	if r.FormValue("returnIdsOnly") == "true" {
+		ids := make([]int64, len(matches))
+		for i, f := range matches {
+			ids[i] = layer.objectID(f)
+		}
+		writeJSON(w, map[string]any{"objectIdFieldName": schema.ObjectIDField, "objectIds": ids})
+		return
+	}
+	if orderBy := r.FormValue("orderByFields"); orderBy != "" {
+		sortFeatures(matches, orderBy)
+	}
+	offset, _ := strconv.Atoi(r.FormValue("resultOffset"))
+	count, _ := strconv.Atoi(r.FormValue("resultRecordCount"))
+	if count <= 0 || (schema.MaxRecordCount > 0 && count > schema.MaxRecordCount) {
+		count = schema.MaxRecordCount
+	}
+	offset = min(max(offset, 0), len(matches))
+	end := len(matches)
+	if count > 0 {
+		end = min(offset+count, len(matches))
+	}
+	page := matches[offset:end]
+
+	outFields := strings.Split(r.FormValue("outFields"), ",")
+	returnGeometry := r.FormValue("returnGeometry") != "false"
+	features := make([]ArcGISFeature, len(page))
+	for i, f := range page {
+		features[i] = ArcGISFeature{Attributes: selectAttributes(f.Attributes, outFields)}
+		if returnGeometry {
+			features[i].Geometry = f.Geometry
+		}
+	}
+	fields := make([]ArcGISField, 0)
+	for _, field := range schema.Fields {
+		if slices.Contains(outFields, "*") || slices.ContainsFunc(outFields, func(name string) bool {
+			return strings.EqualFold(strings.TrimSpace(name), field.Name)
+		}) {
+			fields = append(fields, field)
+		}
+	}
+	writeJSON(w, ArcGISQueryResponse{
+		ObjectIDFieldName:     schema.ObjectIDField,
+		GlobalIDFieldName:     schema.GlobalIDField,
+		GeometryType:          schema.GeometryType,
+		SpatialReference:      schema.Extent.SpatialReference,
+		HasZ:                  schema.HasZ,
+		HasM:                  schema.HasM,
+		Fields:                fields,
+		Features:              features,
+		ExceededTransferLimit: end < len(matches),
+	})
+}
+
+// Aggregate features like an outStatistics query, with a row for each group in the order they first appear
+func fakeStatistics(features []ArcGISFeature, statistics []ArcGISStatistic, groupBy []string) ([]ArcGISFeature, error) {
+	keys := make([]string, 0)
+	groups := make(map[string][]ArcGISFeature)
+	for _, f := range features {
+		values := make([]any, len(groupBy))
+		for i, name := range groupBy {
+			values[i] = attributeIgnoreCase(f.Attributes, name)
+		}
+		key := fmt.Sprint(values...)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], f)
+	}
+	rows := make([]ArcGISFeature, 0, len(keys))
+	for _, key := range keys {
+		members := groups[key]
+		attributes := make(map[string]any)
+		for _, name := range groupBy {
+			attributes[name] = attributeIgnoreCase(members[0].Attributes, name)
+		}
+		for _, s := range statistics {
+			values := make([]float64, 0, len(members))
+			count := 0
+			for _, f := range members {
+				v := attributeIgnoreCase(f.Attributes, s.OnStatisticField)
+				if v == nil {
+					continue
+				}
+				count++
+				if n, ok := toFloat(v); ok {
+					values = append(values, n)
+				}
+			}
+			value, err := fakeStatistic(s.StatisticType, count, values)
+			if err != nil {
+				return nil, err
+			}
+			attributes[s.OutStatisticFieldName] = value
+		}
+		rows = append(rows, ArcGISFeature{Attributes: attributes})
+	}
+	return rows, nil
+}
+
+// Work out one statistic over the non-null values of a field. Like a real
+// service, everything but the count is null when there are no values.
+func fakeStatistic(statisticType string, count int, values []float64) (any, error) {
+	if statisticType == StatisticCount {
+		return count, nil
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	sum, lowest, highest := 0.0, values[0], values[0]
+	for _, v := range values {
+		sum += v
+		lowest = math.Min(lowest, v)
+		highest = math.Max(highest, v)
+	}
+	mean := sum / float64(len(values))
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	if len(values) > 1 {
+		variance /= float64(len(values) - 1)
+	}
+	switch statisticType {
+	case StatisticSum:
+		return sum, nil
+	case StatisticMin:
+		return lowest, nil
+	case StatisticMax:
+		return highest, nil
+	case StatisticAvg:
+		return mean, nil
+	case StatisticVar:
+		return variance, nil
+	case StatisticStddev:
+		return math.Sqrt(variance), nil
+	}
+	return nil, fmt.Errorf("Unknown statistic type '%s'", statisticType)
+}
+
+func (l *fakeLayer) objectID(f ArcGISFeature) int64 {
+	id, _ := toFloat(attributeIgnoreCase(f.Attributes, l.schema.ObjectIDField))
+	return int64(id)
+}
+
+// Keep only the attributes asked for in outFields
+func selectAttributes(attributes map[string]any, outFields []string) map[string]any {
+	result := make(map[string]any)
+	for k, v := range attributes {
+		for _, name := range outFields {
+			name = strings.TrimSpace(name)
+			if name == "*" || strings.EqualFold(name, k) {
+				result[k] = v
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Sort features by an orderByFields clause like 'PRIORITY DESC, NAME'
+func sortFeatures(features []ArcGISFeature, orderBy string) {
+	type key struct {
+		field string
+		desc  bool
+	}
+	keys := make([]key, 0)
+	for _, part := range strings.Split(orderBy, ",") {
+		words := strings.Fields(part)
+		if len(words) == 0 {
+			continue
+		}
+		keys = append(keys, key{field: words[0], desc: len(words) > 1 && strings.EqualFold(words[1], "DESC")})
+	}
+	slices.SortStableFunc(features, func(a, b ArcGISFeature) int {
+		for _, k := range keys {
+			c := compareValues(attributeIgnoreCase(a.Attributes, k.field), attributeIgnoreCase(b.Attributes, k.field))
+			if k.desc {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+}
+
+func (p *FakePortal) postApplyEdits(w http.ResponseWriter, r *http.Request) {
+	user, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+	service, layer, ok := p.serviceLayer(w, r, user)
+	if !ok {
+		return
+	}
+	var adds, updates []ArcGISFeature
+	for name, dest := range map[string]*[]ArcGISFeature{"adds": &adds, "updates": &updates} {
+		if value := r.FormValue(name); value != "" {
+			if err := json.Unmarshal([]byte(value), dest); err != nil {
+				fakeError(w, http.StatusBadRequest, "Unable to complete operation.", fmt.Sprintf("Invalid %s: %v", name, err))
+				return
+			}
+		}
+	}
+	var deletes []int64
+	if value := strings.Trim(r.FormValue("deletes"), "[]"); value != "" {
+		var err error
+		deletes, err = parseObjectIDs(value)
+		if err != nil {
+			fakeError(w, http.StatusBadRequest, "Unable to complete operation.", err.Error())
+			return
+		}
+	}
+	rollback := r.FormValue("rollbackOnFailure") != "false"
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	schema := &layer.schema
+	// Work on a copy so a failure can roll everything back
+	features := slices.Clone(layer.features)
+	nextObjectID := layer.nextObjectID
+	now := time.Now().UnixMilli()
+	stamp := func(attributes map[string]any, created bool) {
+		if schema.EditFieldsInfo == nil {
+			return
+		}
+		info := schema.EditFieldsInfo
+		if created {
+			setIfNamed(attributes, info.CreationDateField, now)
+			setIfNamed(attributes, info.CreatorField, user.Username)
+		}
+		setIfNamed(attributes, info.EditDateField, now)
+		setIfNamed(attributes, info.EditorField, user.Username)
+	}
+	failed := false
+	results := ArcGISEditResults{
+		AddResults:    make([]ArcGISEditResult, 0),
+		UpdateResults: make([]ArcGISEditResult, 0),
+		DeleteResults: make([]ArcGISEditResult, 0),
+	}
+	for _, f := range adds {
+		attributes := make(map[string]any)
+		for k, v := range f.Attributes {
+			attributes[k] = v
+		}
+		attributes[schema.ObjectIDField] = nextObjectID
+		globalID := ""
+		if schema.GlobalIDField != "" {
+			globalID, _ = attributeIgnoreCase(attributes, schema.GlobalIDField).(string)
+			if globalID == "" {
+				globalID = newGlobalID()
+			}
+			attributes[schema.GlobalIDField] = globalID
+		}
+		stamp(attributes, true)
+		features = append(features, ArcGISFeature{Attributes: attributes, Geometry: f.Geometry})
+		results.AddResults = append(results.AddResults, ArcGISEditResult{ObjectID: nextObjectID, GlobalID: globalID, Success: true})
+		nextObjectID++
+	}
+	for _, f := range updates {
+		id := layer.objectID(f)
+		i := slices.IndexFunc(features, func(existing ArcGISFeature) bool { return layer.objectID(existing) == id })
+		if i < 0 {
+			failed = true
+			results.UpdateResults = append(results.UpdateResults, ArcGISEditResult{ObjectID: id, Error: &ArcGISError{Code: 1019, Message: "Object is missing."}})
+			continue
+		}
+		attributes := make(map[string]any)
+		for k, v := range features[i].Attributes {
+			attributes[k] = v
+		}
+		for k, v := range f.Attributes {
+			if strings.EqualFold(k, schema.ObjectIDField) || strings.EqualFold(k, schema.GlobalIDField) {
+				continue
+			}
+			attributes[k] = v
+		}
+		stamp(attributes, false)
+		updated := ArcGISFeature{Attributes: attributes, Geometry: features[i].Geometry}
+		if len(f.Geometry) > 0 {
+			updated.Geometry = f.Geometry
+		}
+		features[i] = updated
+		globalID, _ := attributeIgnoreCase(attributes, schema.GlobalIDField).(string)
+		results.UpdateResults = append(results.UpdateResults, ArcGISEditResult{ObjectID: id, GlobalID: globalID, Success: true})
+	}
+	for _, id := range deletes {
+		i := slices.IndexFunc(features, func(existing ArcGISFeature) bool { return layer.objectID(existing) == id })
+		if i < 0 {
+			failed = true
+			results.DeleteResults = append(results.DeleteResults, ArcGISEditResult{ObjectID: id, Error: &ArcGISError{Code: 1019, Message: "Object is missing."}})
+			continue
+		}
+		globalID, _ := attributeIgnoreCase(features[i].Attributes, schema.GlobalIDField).(string)
+		features = slices.Delete(features, i, i+1)
+		results.DeleteResults = append(results.DeleteResults, ArcGISEditResult{ObjectID: id, GlobalID: globalID, Success: true})
+	}
+	if failed && rollback {
+		for _, list := range [][]ArcGISEditResult{results.AddResults, results.UpdateResults, results.DeleteResults} {
+			for i := range list {
+				if list[i].Success {
+					list[i].Success = false
+					list[i].Error = &ArcGISError{Code: 1003, Message: "Operation rolled back."}
+				}
+			}
+		}
+		writeJSON(w, results)
+		return
+	}
+	layer.features = features
+	layer.nextObjectID = nextObjectID
+	service.lastEditDate = now
+	service.serverGen++
+	for _, list := range []struct {
+		results []ArcGISEditResult
+		change  fakeChange
+	}{
+		{results.AddResults, fakeChange{added: true}},
+		{results.UpdateResults, fakeChange{}},
+		{results.DeleteResults, fakeChange{deleted: true}},
+	} {
+		for _, result := range list.results {
+			change := list.change
+			change.serverGen = service.serverGen
+			change.objectID = result.ObjectID
+			layer.changes = append(layer.changes, change)
+		}
+	}
+	writeJSON(w, results)
+}
+
+// Forget every change made so far, so a client asking for changes since an
+// older generation has to pull everything again
+func (p *FakePortal) ForgetChanges() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, service := range p.services {
+		service.minServerGen = service.serverGen
+		for _, layer := range service.layers {
+			layer.changes = nil
+		}
+	}
+}
+
+func (p *FakePortal) postExtractChanges(w http.ResponseWriter, r *http.Request) {
+	user, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+	service, _, ok := p.serviceLayer(w, r, user)
+	if !ok {
+		return
+	}
+	var since []ArcGISLayerServerGen
+	if err := json.Unmarshal([]byte(r.FormValue("layerServerGens")), &since); err != nil {
+		fakeError(w, http.StatusBadRequest, "Unable to complete operation.", fmt.Sprintf("Invalid layerServerGens: %v", err))
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	response := ArcGISExtractChangesResponse{
+		LayerServerGens: make([]ArcGISLayerServerGen, 0),
+		Edits:           make([]ArcGISLayerChanges, 0),
+	}
+	for _, gen := range since {
+		layer, ok := service.layers[gen.ID]
+		if !ok {
+			fakeError(w, http.StatusBadRequest, "Unable to complete operation.", fmt.Sprintf("Layer %d not found", gen.ID))
+			return
+		}
+		if gen.ServerGen < service.minServerGen {
+			fakeError(w, http.StatusBadRequest, "Unable to complete operation.", fmt.Sprintf("The serverGen %d is no longer available", gen.ServerGen))
+			return
+		}
+		// Sum up what happened to each feature since then
+		added := make(map[int64]bool)
+		deleted := make(map[int64]bool)
+		ids := make([]int64, 0)
+		for _, c := range layer.changes {
+			if c.serverGen <= gen.ServerGen {
+				continue
+			}
+			if !slices.Contains(ids, c.objectID) {
+				ids = append(ids, c.objectID)
+			}
+			added[c.objectID] = added[c.objectID] || c.added
+			deleted[c.objectID] = c.deleted
+		}
+		changes := ArcGISLayerChanges{ID: gen.ID}
+		changes.Features.Adds = make([]ArcGISFeature, 0)
+		changes.Features.Updates = make([]ArcGISFeature, 0)
+		changes.Features.DeleteIDs = make([]int64, 0)
+		for _, id := range ids {
+			switch {
+			case deleted[id] && added[id]:
+			case deleted[id]:
+				changes.Features.DeleteIDs = append(changes.Features.DeleteIDs, id)
+			default:
+				i := slices.IndexFunc(layer.features, func(f ArcGISFeature) bool { return layer.objectID(f) == id })
+				if i < 0 {
+					continue
+				}
+				if added[id] {
+					changes.Features.Adds = append(changes.Features.Adds, layer.features[i])
+				} else {
+					changes.Features.Updates = append(changes.Features.Updates, layer.features[i])
+				}
+			}
+		}
+		response.Edits = append(response.Edits, changes)
+		response.LayerServerGens = append(response.LayerServerGens, ArcGISLayerServerGen{ID: gen.ID, MinServerGen: service.minServerGen, ServerGen: service.serverGen})
+	}
+	writeJSON(w, response)
+}
+
+// Set an attribute if the layer has a field for it
+func setIfNamed(attributes map[string]any, name string, value any) {
+	if name != "" {
+		attributes[name] = value
+	}
+}
+
+// The conditions fakeWhere understands
+var (
+	fakeWhereAnd        = regexp.MustCompile(`(?i)\s+and\s+`)
+	fakeWhereAlways     = regexp.MustCompile(`^1\s*=\s*1$`)
+	fakeWhereNull       = regexp.MustCompile(`(?i)^(\w+)\s+is\s+(not\s+)?null$`)
+	fakeWhereIn         = regexp.MustCompile(`(?i)^(\w+)\s+(not\s+)?in\s*\((.*)\)$`)
+	fakeWhereLike       = regexp.MustCompile(`(?i)^(\w+)\s+like\s+'((?:[^']|'')*)'$`)
+	fakeWhereComparison = regexp.MustCompile(`^(\w+)\s*(=|<>|!=|>=|<=|>|<)\s*(.+)$`)
+)
+
+// Turn a where clause into a function matching attributes. Only conditions
+// joined with AND are supported, which covers what the app sends.
+func fakeWhere(where string) (func(map[string]any) bool, error) {
+	conditions := make([]func(map[string]any) bool, 0)
+	for _, part := range fakeWhereAnd.Split(strings.TrimSpace(where), -1) {
+		part = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(part), "("), ")"))
+		condition, err := fakeCondition(part)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+	return func(attributes map[string]any) bool {
+		for _, condition := range conditions {
+			if !condition(attributes) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func fakeCondition(condition string) (func(map[string]any) bool, error) {
+	if fakeWhereAlways.MatchString(condition) {
+		return func(map[string]any) bool { return true }, nil
+	}
+	if m := fakeWhereNull.FindStringSubmatch(condition); m != nil {
+		field, not := m[1], m[2] != ""
+		return func(attributes map[string]any) bool {
+			return (attributeIgnoreCase(attributes, field) == nil) != not
+		}, nil
+	}
+	if m := fakeWhereIn.FindStringSubmatch(condition); m != nil {
+		field, not := m[1], m[2] != ""
+		values := make([]any, 0)
+		for _, literal := range strings.Split(m[3], ",") {
+			value, err := fakeLiteral(strings.TrimSpace(literal))
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return func(attributes map[string]any) bool {
+			v := attributeIgnoreCase(attributes, field)
+			found := slices.ContainsFunc(values, func(value any) bool { return compareValues(v, value) == 0 })
+			return found != not
+		}, nil
+	}
+	if m := fakeWhereLike.FindStringSubmatch(condition); m != nil {
+		field := m[1]
+		pattern := regexp.QuoteMeta(strings.ReplaceAll(m[2], "''", "'"))
+		pattern = strings.ReplaceAll(strings.ReplaceAll(pattern, "%", ".*"), "_", ".")
+		like := regexp.MustCompile("(?is)^" + pattern + "$")
+		return func(attributes map[string]any) bool {
+			s, ok := attributeIgnoreCase(attributes, field).(string)
+			return ok && like.MatchString(s)
+		}, nil
+	}
+	if m := fakeWhereComparison.FindStringSubmatch(condition); m != nil {
+		field, operator := m[1], m[2]
+		value, err := fakeLiteral(strings.TrimSpace(m[3]))
+		if err != nil {
+			return nil, err
+		}
+		return func(attributes map[string]any) bool {
+			v := attributeIgnoreCase(attributes, field)
+			if v == nil {
+				return false
+			}
+			c := compareValues(v, value)
+			switch operator {
+			case "=":
+				return c == 0
+			case "<>", "!=":
+				return c != 0
+			case ">":
+				return c > 0
+			case ">=":
+				return c >= 0
+			case "<":
+				return c < 0
+			}
+			return c <= 0
+		}, nil
+	}
+	return nil, fmt.Errorf("The fake portal doesn't understand the condition '%s'", condition)
+}
+
+// Parse a literal in a where clause: a quoted string, a number, or a
+// timestamp '...' or date '...' which becomes epoch milliseconds
+func fakeLiteral(literal string) (any, error) {
+	lower := strings.ToLower(literal)
+	for _, prefix := range []string{"timestamp ", "date "} {
+		if strings.HasPrefix(lower, prefix) {
+			text := strings.Trim(strings.TrimSpace(literal[len(prefix):]), "'")
+			for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+				if t, err := time.Parse(layout, text); err == nil {
+					return float64(t.UnixMilli()), nil
+				}
+			}
+			return nil, fmt.Errorf("Invalid date '%s'", text)
+		}
+	}
+	if len(literal) >= 2 && literal[0] == '\'' && literal[len(literal)-1] == '\'' {
+		return strings.ReplaceAll(literal[1:len(literal)-1], "''", "'"), nil
+	}
+	number, err := strconv.ParseFloat(literal, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid value '%s'", literal)
+	}
+	return number, nil
+}
+
+// Compare two attribute values, numbers numerically and everything else as text.
+// Missing values sort first.
+func compareValues(a any, b any) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		}
+		return 1
+	}
+	x, xok := toFloat(a)
+	y, yok := toFloat(b)
+	if xok && yok {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// Get a number out of an attribute, which is a float64 when it came from JSON
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+type ArcGISSpatialReference struct {
+	WKID       int    `json:"wkid,omitempty"`
+	LatestWKID int    `json:"latestWkid,omitempty"`
+	WKT        string `json:"wkt,omitempty"`
+}
+
+type ArcGISExtent struct {
+	XMin             float64                `json:"xmin"`
+	YMin             float64                `json:"ymin"`
+	XMax             float64                `json:"xmax"`
+	YMax             float64                `json:"ymax"`
+	SpatialReference ArcGISSpatialReference `json:"spatialReference"`
+}
+
+// ArcGISLayerReference is the short description of a layer or table in the service root
+type ArcGISLayerReference struct {
+	ID                int    `json:"id"`
+	Name              string `json:"name"`
+	ParentLayerID     int    `json:"parentLayerId"`
+	DefaultVisibility bool   `json:"defaultVisibility"`
+	SubLayerIDs       []int  `json:"subLayerIds"`
+	GeometryType      string `json:"geometryType"`
+	Type              string `json:"type"`
+}
+
+// ArcGISLayerSummary is the part of a layer's JSON we need to show the service tree
+type ArcGISLayerSummary struct {
+	ID             int    `json:"id"`
+	Name           string `json:"name"`
+	Type           string `json:"type"`
+	GeometryType   string `json:"geometryType"`
+	Capabilities   string `json:"capabilities"`
+	MaxRecordCount int    `json:"maxRecordCount"`
+	Description    string `json:"description"`
+}
+
+type ArcGISFeatureService struct {
+	// Not part of the service JSON, filled in from the item we discovered it from
+	URL    string `json:"-"`
+	ItemID string `json:"-"`
+	Title  string `json:"-"`
+	// The groups of the user's that the item is shared with
+	Groups []ArcGISGroup `json:"-"`
+
+	CurrentVersion        float64                `json:"currentVersion"`
+	ServiceDescription    string                 `json:"serviceDescription"`
+	Description           string                 `json:"description"`
+	Capabilities          string                 `json:"capabilities"`
+	MaxRecordCount        int                    `json:"maxRecordCount"`
+	SupportedQueryFormats string                 `json:"supportedQueryFormats"`
+	SpatialReference      ArcGISSpatialReference `json:"spatialReference"`
+	FullExtent            ArcGISExtent           `json:"fullExtent"`
+	SyncEnabled           bool                   `json:"syncEnabled"`
+	Layers                []ArcGISLayerReference `json:"layers"`
+	Tables                []ArcGISLayerReference `json:"tables"`
+
+	// Filled in from the /layers resource
+	LayerDetails []ArcGISLayerSummary `json:"-"`
+	TableDetails []ArcGISLayerSummary `json:"-"`
+}
+
+// Check if the service advertises a capability, like "Query" or "Sync"
+func (s *ArcGISFeatureService) HasCapability(capability string) bool {
+	return hasCapability(s.Capabilities, capability)
+}
+
+func hasCapability(capabilities string, capability string) bool {
+	for _, c := range strings.Split(capabilities, ",") {
+		if strings.EqualFold(strings.TrimSpace(c), capability) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetch the root of a feature service along with the details of each of its layers and tables
+func fetchFeatureService(ctx context.Context, access string, serviceURL string) (*ArcGISFeatureService, error) {
+	serviceURL = strings.TrimRight(serviceURL, "/")
+	var service ArcGISFeatureService
+	err := arcgisGet(ctx, access, serviceURL, nil, &service)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get feature service %s: %w", serviceURL, err)
+	}
+	service.URL = serviceURL
+
+	var layers struct {
+		Layers []ArcGISLayerSummary `json:"layers"`
+		Tables []ArcGISLayerSummary `json:"tables"`
+	}
+	err = arcgisGet(ctx, access, serviceURL+"/layers", nil, &layers)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get layers of %s: %w", serviceURL, err)
+	}
+	service.LayerDetails = layers.Layers
+	service.TableDetails = layers.Tables
+	return &service, nil
+}
+
+// Follow each Feature Service item in the search results to its service description
+func discoverFeatureServices(ctx context.Context, access string, search *ArcGISSearchResponse) []ArcGISFeatureService {
+	result := make([]ArcGISFeatureService, 0)
+	for _, item := range search.Results {
+		if item.Type != "Feature Service" || item.URL == "" {
+			continue
+		}
+		service, err := fetchFeatureService(ctx, access, item.URL)
+		if err != nil {
+			log.Printf("Skipping item %s: %v", item.ID, err)
+			continue
+		}
+		service.ItemID = item.ID
+		service.Title = item.Title
+		result = append(result, *service)
+	}
+	return result
+}
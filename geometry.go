@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Esri geometry types as they appear in layer and query JSON
+const (
+	GeometryTypePoint      = "esriGeometryPoint"
+	GeometryTypeMultipoint = "esriGeometryMultipoint"
+	GeometryTypePolyline   = "esriGeometryPolyline"
+	GeometryTypePolygon    = "esriGeometryPolygon"
+	GeometryTypeEnvelope   = "esriGeometryEnvelope"
+)
+
+// Each coordinate is x, y and then optionally z and/or m, depending on HasZ and HasM
+type Coordinate []float64
+
+// ArcGISGeometry is an Esri JSON geometry. Which fields are set depends on the type.
+type ArcGISGeometry struct {
+	Type string `json:"-"`
+
+	X *float64 `json:"x,omitempty"`
+	Y *float64 `json:"y,omitempty"`
+	Z *float64 `json:"z,omitempty"`
+	M *float64 `json:"m,omitempty"`
+
+	Points []Coordinate   `json:"points,omitempty"`
+	Paths  [][]Coordinate `json:"paths,omitempty"`
+	Rings  [][]Coordinate `json:"rings,omitempty"`
+
+	XMin *float64 `json:"xmin,omitempty"`
+	YMin *float64 `json:"ymin,omitempty"`
+	XMax *float64 `json:"xmax,omitempty"`
+	YMax *float64 `json:"ymax,omitempty"`
+
+	HasZ             bool                    `json:"hasZ,omitempty"`
+	HasM             bool                    `json:"hasM,omitempty"`
+	SpatialReference *ArcGISSpatialReference `json:"spatialReference,omitempty"`
+}
+
+// Decode an Esri JSON geometry. The type is guessed from the fields present
+// when geometryType is empty.
+func decodeGeometry(raw json.RawMessage, geometryType string) (*ArcGISGeometry, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var g ArcGISGeometry
+	err := json.Unmarshal(raw, &g)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal geometry: %v", err)
+	}
+	g.Type = geometryType
+	if g.Type == "" {
+		switch {
+		case g.X != nil:
+			g.Type = GeometryTypePoint
+		case g.Points != nil:
+			g.Type = GeometryTypeMultipoint
+		case g.Paths != nil:
+			g.Type = GeometryTypePolyline
+		case g.Rings != nil:
+			g.Type = GeometryTypePolygon
+		case g.XMin != nil:
+			g.Type = GeometryTypeEnvelope
+		default:
+			return nil, errors.New("Can't tell the type of the geometry")
+		}
+	}
+	if g.Z != nil {
+		g.HasZ = true
+	}
+	if g.M != nil {
+		g.HasM = true
+	}
+	return &g, nil
+}
+
+// Decode the geometry of a feature
+func (f *ArcGISFeature) DecodeGeometry(geometryType string) (*ArcGISGeometry, error) {
+	return decodeGeometry(f.Geometry, geometryType)
+}
+
+func (g *ArcGISGeometry) IsEmpty() bool {
+	switch g.Type {
+	case GeometryTypePoint:
+		return g.X == nil || g.Y == nil
+	case GeometryTypeMultipoint:
+		return len(g.Points) == 0
+	case GeometryTypePolyline:
+		return len(g.Paths) == 0
+	case GeometryTypePolygon:
+		return len(g.Rings) == 0
+	case GeometryTypeEnvelope:
+		return g.XMin == nil || g.YMin == nil || g.XMax == nil || g.YMax == nil
+	}
+	return true
+}
+
+// Call fn for every coordinate of the geometry
+func (g *ArcGISGeometry) eachCoordinate(fn func(c Coordinate)) {
+	g.transform(func(c Coordinate) Coordinate {
+		fn(c)
+		return c
+	})
+}
+
+// Make a copy of the geometry with fn applied to every coordinate
+func (g *ArcGISGeometry) transform(fn func(c Coordinate) Coordinate) *ArcGISGeometry {
+	result := *g
+	mapCoordinates := func(cs []Coordinate) []Coordinate {
+		if cs == nil {
+			return nil
+		}
+		mapped := make([]Coordinate, len(cs))
+		for i, c := range cs {
+			mapped[i] = fn(append(Coordinate(nil), c...))
+		}
+		return mapped
+	}
+	mapParts := func(parts [][]Coordinate) [][]Coordinate {
+		if parts == nil {
+			return nil
+		}
+		mapped := make([][]Coordinate, len(parts))
+		for i, part := range parts {
+			mapped[i] = mapCoordinates(part)
+		}
+		return mapped
+	}
+	if g.X != nil && g.Y != nil {
+		c := fn(Coordinate{*g.X, *g.Y})
+		result.X, result.Y = &c[0], &c[1]
+	}
+	if g.XMin != nil && g.YMin != nil && g.XMax != nil && g.YMax != nil {
+		lower := fn(Coordinate{*g.XMin, *g.YMin})
+		upper := fn(Coordinate{*g.XMax, *g.YMax})
+		result.XMin, result.YMin = &lower[0], &lower[1]
+		result.XMax, result.YMax = &upper[0], &upper[1]
+	}
+	result.Points = mapCoordinates(g.Points)
+	result.Paths = mapParts(g.Paths)
+	result.Rings = mapParts(g.Rings)
+	return &result
+}
+
+// Twice the signed area of a ring, positive when the ring is counterclockwise
+func ringArea(ring []Coordinate) float64 {
+	area := 0.0
+	for i := 0; i+1 < len(ring); i++ {
+		area += ring[i][0]*ring[i+1][1] - ring[i+1][0]*ring[i][1]
+	}
+	return area
+}
+
+func reverseRing(ring []Coordinate) []Coordinate {
+	result := make([]Coordinate, len(ring))
+	for i, c := range ring {
+		result[len(ring)-1-i] = c
+	}
+	return result
+}
+
+// Check if a point is inside a ring using the even-odd rule
+func ringContains(ring []Coordinate, c Coordinate) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a[1] > c[1]) != (b[1] > c[1]) && c[0] < (b[0]-a[0])*(c[1]-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// GeoJSONGeometry is a GeoJSON geometry object. Coordinates hold a position,
+// or nested arrays of positions, depending on the type.
+type GeoJSONGeometry struct {
+	Type        string `json:"type"`
+	Coordinates any    `json:"coordinates"`
+}
+
+type GeoJSONFeature struct {
+	Type       string           `json:"type"`
+	ID         any              `json:"id,omitempty"`
+	Geometry   *GeoJSONGeometry `json:"geometry"`
+	Properties map[string]any   `json:"properties"`
+}
+
+// Convert to GeoJSON. Esri polygons have clockwise outer rings followed by
+// their counterclockwise holes, in any order; GeoJSON wants each polygon's
+// counterclockwise outer ring first, so rings are regrouped and reversed.
+// GeoJSON has no M without Z, so M values are dropped from geometries without
+// Z rather than passing a made up Z off as real.
+func (g *ArcGISGeometry) ToGeoJSON() (*GeoJSONGeometry, error) {
+	if g == nil || g.IsEmpty() {
+		return nil, nil
+	}
+	if g.Type == GeometryTypePoint {
+		c := Coordinate{*g.X, *g.Y}
+		if g.Z != nil {
+			c = append(c, *g.Z)
+			if g.M != nil {
+				c = append(c, *g.M)
+			}
+		}
+		return &GeoJSONGeometry{Type: "Point", Coordinates: c}, nil
+	}
+	if g.HasM && !g.HasZ {
+		g = g.transform(func(c Coordinate) Coordinate {
+			return c[:min(len(c), 2)]
+		})
+	}
+	switch g.Type {
+	case GeometryTypeMultipoint:
+		return &GeoJSONGeometry{Type: "MultiPoint", Coordinates: g.Points}, nil
+	case GeometryTypePolyline:
+		if len(g.Paths) == 1 {
+			return &GeoJSONGeometry{Type: "LineString", Coordinates: g.Paths[0]}, nil
+		}
+		return &GeoJSONGeometry{Type: "MultiLineString", Coordinates: g.Paths}, nil
+	case GeometryTypePolygon:
+		polygons := groupRings(g.Rings)
+		if len(polygons) == 1 {
+			return &GeoJSONGeometry{Type: "Polygon", Coordinates: polygons[0]}, nil
+		}
+		return &GeoJSONGeometry{Type: "MultiPolygon", Coordinates: polygons}, nil
+	case GeometryTypeEnvelope:
+		ring := []Coordinate{
+			{*g.XMin, *g.YMin}, {*g.XMax, *g.YMin}, {*g.XMax, *g.YMax}, {*g.XMin, *g.YMax}, {*g.XMin, *g.YMin},
+		}
+		return &GeoJSONGeometry{Type: "Polygon", Coordinates: [][]Coordinate{ring}}, nil
+	}
+	return nil, fmt.Errorf("Can't convert geometry type '%s' to GeoJSON", g.Type)
+}
+
+// Split Esri rings into GeoJSON polygons, each a counterclockwise outer ring followed by clockwise holes
+func groupRings(rings [][]Coordinate) [][][]Coordinate {
+	polygons := make([][][]Coordinate, 0)
+	holes := make([][]Coordinate, 0)
+	for _, ring := range rings {
+		if ringArea(ring) <= 0 {
+			polygons = append(polygons, [][]Coordinate{reverseRing(ring)})
+		} else {
+			holes = append(holes, reverseRing(ring))
+		}
+	}
+	for _, hole := range holes {
+		// Islands sit inside holes of other polygons, so a hole can be inside
+		// several outer rings and belongs to the smallest of them
+		best := -1
+		for i := range polygons {
+			if len(hole) == 0 || !ringContains(polygons[i][0], hole[0]) {
+				continue
+			}
+			if best < 0 || math.Abs(ringArea(polygons[i][0])) < math.Abs(ringArea(polygons[best][0])) {
+				best = i
+			}
+		}
+		if best >= 0 {
+			polygons[best] = append(polygons[best], hole)
+		} else {
+			// Not inside any outer ring, so it must have been an outer ring wound the wrong way
+			polygons = append(polygons, [][]Coordinate{reverseRing(hole)})
+		}
+	}
+	return polygons
+}
+
+// Convert a GeoJSON geometry to Esri JSON. hasM says whether a third ordinate
+// without a fourth is an M rather than a Z value.
+func geometryFromGeoJSON(gj *GeoJSONGeometry, sr *ArcGISSpatialReference, hasM bool) (*ArcGISGeometry, error) {
+	if gj == nil {
+		return nil, nil
+	}
+	raw, err := json.Marshal(gj.Coordinates)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal coordinates: %v", err)
+	}
+	g := ArcGISGeometry{SpatialReference: sr}
+	switch gj.Type {
+	case "Point":
+		var c Coordinate
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return nil, fmt.Errorf("Invalid Point: %v", err)
+		}
+		if len(c) < 2 {
+			return nil, errors.New("Point needs at least two ordinates")
+		}
+		g.Type = GeometryTypePoint
+		g.X, g.Y = &c[0], &c[1]
+		switch {
+		case len(c) >= 4:
+			g.Z, g.M = &c[2], &c[3]
+		case len(c) == 3 && hasM:
+			g.M = &c[2]
+		case len(c) == 3:
+			g.Z = &c[2]
+		}
+	case "MultiPoint":
+		g.Type = GeometryTypeMultipoint
+		if err := json.Unmarshal(raw, &g.Points); err != nil {
+			return nil, fmt.Errorf("Invalid MultiPoint: %v", err)
+		}
+	case "LineString":
+		var path []Coordinate
+		if err := json.Unmarshal(raw, &path); err != nil {
+			return nil, fmt.Errorf("Invalid LineString: %v", err)
+		}
+		g.Type = GeometryTypePolyline
+		g.Paths = [][]Coordinate{path}
+	case "MultiLineString":
+		g.Type = GeometryTypePolyline
+		if err := json.Unmarshal(raw, &g.Paths); err != nil {
+			return nil, fmt.Errorf("Invalid MultiLineString: %v", err)
+		}
+	case "Polygon":
+		var rings [][]Coordinate
+		if err := json.Unmarshal(raw, &rings); err != nil {
+			return nil, fmt.Errorf("Invalid Polygon: %v", err)
+		}
+		g.Type = GeometryTypePolygon
+		g.Rings = esriRings([][][]Coordinate{rings})
+	case "MultiPolygon":
+		var polygons [][][]Coordinate
+		if err := json.Unmarshal(raw, &polygons); err != nil {
+			return nil, fmt.Errorf("Invalid MultiPolygon: %v", err)
+		}
+		g.Type = GeometryTypePolygon
+		g.Rings = esriRings(polygons)
+	default:
+		return nil, fmt.Errorf("Can't convert GeoJSON type '%s' to Esri JSON", gj.Type)
+	}
+	if g.Type != GeometryTypePoint {
+		dims := 2
+		g.eachCoordinate(func(c Coordinate) {
+			dims = max(dims, len(c))
+		})
+		g.HasZ = dims >= 4 || (dims == 3 && !hasM)
+		g.HasM = dims >= 4 || (dims == 3 && hasM)
+	}
+	return &g, nil
+}
+
+// Flatten GeoJSON polygons into Esri rings: clockwise outer rings, counterclockwise holes
+func esriRings(polygons [][][]Coordinate) [][]Coordinate {
+	result := make([][]Coordinate, 0)
+	for _, polygon := range polygons {
+		for i, ring := range polygon {
+			clockwise := ringArea(ring) < 0
+			if (i == 0) != clockwise {
+				ring = reverseRing(ring)
+			}
+			result = append(result, ring)
+		}
+	}
+	return result
+}
+
+// Convert a feature to a GeoJSON feature, using the object ID as the feature ID
+func (f *ArcGISFeature) ToGeoJSON(geometryType string, objectIDField string) (*GeoJSONFeature, error) {
+	g, err := f.DecodeGeometry(geometryType)
+	if err != nil {
+		return nil, err
+	}
+	gj, err := g.ToGeoJSON()
+	if err != nil {
+		return nil, err
+	}
+	result := GeoJSONFeature{
+		Type:       "Feature",
+		Geometry:   gj,
+		Properties: f.Attributes,
+	}
+	if objectIDField != "" {
+		result.ID = f.Attributes[objectIDField]
+	}
+	return &result, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// A square from (x, y) with sides of the given length, clockwise like an Esri outer ring
+func clockwiseSquare(x float64, y float64, size float64) []Coordinate {
+	return []Coordinate{{x, y}, {x, y + size}, {x + size, y + size}, {x + size, y}, {x, y}}
+}
+
+func toGeoJSON(t *testing.T, esri string, geometryType string) *GeoJSONGeometry {
+	t.Helper()
+	g, err := decodeGeometry(json.RawMessage(esri), geometryType)
+	if err != nil {
+		t.Fatalf("Failed to decode %s: %v", esri, err)
+	}
+	gj, err := g.ToGeoJSON()
+	if err != nil {
+		t.Fatalf("Failed to convert %s to GeoJSON: %v", esri, err)
+	}
+	return gj
+}
+
+func TestPolygonRingOrientation(t *testing.T) {
+	outer := clockwiseSquare(0, 0, 10)
+	hole := reverseRing(clockwiseSquare(2, 2, 2))
+	esri, _ := json.Marshal(ArcGISGeometry{Rings: [][]Coordinate{outer, hole}})
+	gj := toGeoJSON(t, string(esri), GeometryTypePolygon)
+	if gj.Type != "Polygon" {
+		t.Fatalf("Got a %s, want a Polygon", gj.Type)
+	}
+	rings := gj.Coordinates.([][]Coordinate)
+	if len(rings) != 2 {
+		t.Fatalf("Got %d rings, want the outer ring and its hole", len(rings))
+	}
+	if ringArea(rings[0]) <= 0 {
+		t.Error("The GeoJSON outer ring isn't counterclockwise")
+	}
+	if ringArea(rings[1]) >= 0 {
+		t.Error("The GeoJSON hole isn't clockwise")
+	}
+
+	// And back again, to the Esri winding
+	back, err := geometryFromGeoJSON(gj, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back.Rings, [][]Coordinate{outer, hole}) {
+		t.Errorf("Round trip gave rings %v, want %v", back.Rings, [][]Coordinate{outer, hole})
+	}
+}
+
+func TestMultipartPolygonWithIsland(t *testing.T) {
+	// A pond with an island in it that has a pool of its own, and a separate pond
+	pond := clockwiseSquare(0, 0, 100)
+	water := reverseRing(clockwiseSquare(10, 10, 80))
+	island := clockwiseSquare(20, 20, 60)
+	pool := reverseRing(clockwiseSquare(40, 40, 10))
+	other := clockwiseSquare(200, 0, 10)
+	esri, _ := json.Marshal(ArcGISGeometry{Rings: [][]Coordinate{pool, water, other, pond, island}})
+	gj := toGeoJSON(t, string(esri), GeometryTypePolygon)
+	if gj.Type != "MultiPolygon" {
+		t.Fatalf("Got a %s, want a MultiPolygon", gj.Type)
+	}
+	polygons := gj.Coordinates.([][][]Coordinate)
+	if len(polygons) != 3 {
+		t.Fatalf("Got %d polygons, want the pond, the island and the other pond", len(polygons))
+	}
+	holes := make(map[float64]float64)
+	for _, polygon := range polygons {
+		if len(polygon) > 2 {
+			t.Errorf("Polygon %v has %d holes, want at most 1", polygon[0], len(polygon)-1)
+		}
+		if len(polygon) == 2 {
+			holes[polygon[0][0][0]] = polygon[1][0][0]
+		}
+	}
+	if holes[0] != 10 {
+		t.Errorf("The pond's hole starts at x=%v, want 10", holes[0])
+	}
+	if holes[20] != 40 {
+		t.Errorf("The island's hole starts at x=%v, want 40, inside the smallest ring containing it", holes[20])
+	}
+}
+
+func TestGeometryZM(t *testing.T) {
+	tests := []struct {
+		name     string
+		esri     string
+		geojson  string
+		hasM     bool
+		wantHasZ bool
+		wantHasM bool
+	}{
+		{"point with z", `{"x":1,"y":2,"z":3}`, `{"type":"Point","coordinates":[1,2,3]}`, false, false, false},
+		{"point with z and m", `{"x":1,"y":2,"z":3,"m":4}`, `{"type":"Point","coordinates":[1,2,3,4]}`, true, false, false},
+		// GeoJSON has no M without Z, so it's dropped rather than passed off as a Z
+		{"point with only m", `{"x":1,"y":2,"m":4}`, `{"type":"Point","coordinates":[1,2]}`, true, false, false},
+		{"line with z", `{"hasZ":true,"paths":[[[1,2,3],[4,5,6]]]}`, `{"type":"LineString","coordinates":[[1,2,3],[4,5,6]]}`, false, true, false},
+		{"line with z and m", `{"hasZ":true,"hasM":true,"paths":[[[1,2,3,7],[4,5,6,8]]]}`, `{"type":"LineString","coordinates":[[1,2,3,7],[4,5,6,8]]}`, true, true, true},
+		{"line with only m", `{"hasM":true,"paths":[[[1,2,7],[4,5,8]]]}`, `{"type":"LineString","coordinates":[[1,2],[4,5]]}`, true, false, false},
+	}
+	for _, test := range tests {
+		geometryType := GeometryTypePolyline
+		if test.esri[2] == 'x' {
+			geometryType = GeometryTypePoint
+		}
+		gj := toGeoJSON(t, test.esri, geometryType)
+		content, _ := json.Marshal(gj)
+		if string(content) != test.geojson {
+			t.Errorf("%s: got %s, want %s", test.name, content, test.geojson)
+		}
+		back, err := geometryFromGeoJSON(gj, nil, test.hasM)
+		if err != nil {
+			t.Errorf("%s: failed to convert back: %v", test.name, err)
+			continue
+		}
+		if back.HasZ != test.wantHasZ || back.HasM != test.wantHasM {
+			t.Errorf("%s: converted back with hasZ %v and hasM %v, want %v and %v", test.name, back.HasZ, back.HasM, test.wantHasZ, test.wantHasM)
+		}
+	}
+
+	// A third ordinate is an M when the caller says the data has Ms
+	gj := &GeoJSONGeometry{Type: "Point", Coordinates: []float64{1, 2, 3}}
+	g, err := geometryFromGeoJSON(gj, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Z != nil || g.M == nil || *g.M != 3 {
+		t.Errorf("Got z %v and m %v, want only an m of 3", g.Z, g.M)
+	}
+}
+
+func TestChangedFormGeometry(t *testing.T) {
+	layer := &ArcGISLayer{}
+	layer.GeometryType = GeometryTypePoint
+	original := `{"type":"Point","coordinates":[-13627640.2,4548390.7]}`
+	form := url.Values{"originalGeometry": []string{original}, "geometry": []string{original}}
+	geometry, err := changedFormGeometry(layer, form)
+	if err != nil || geometry != nil {
+		t.Errorf("Got %s, %v for an unchanged geometry, want nothing", geometry, err)
+	}
+
+	form.Set("geometry", `{"type":"Point","coordinates":[-13627000,4548000]}`)
+	geometry, err = changedFormGeometry(layer, form)
+	if err != nil {
+		t.Fatalf("Failed to parse the changed geometry: %v", err)
+	}
+	if string(geometry) != `{"x":-13627000,"y":4548000}` {
+		t.Errorf("Got %s for the changed geometry", geometry)
+	}
+
+	form.Set("geometry", `{"type":"LineString","coordinates":[[0,0],[1,1]]}`)
+	if _, err := changedFormGeometry(layer, form); err == nil {
+		t.Error("Accepted a line for a point layer")
+	}
+
+	// Editing the geometry of an M-only layer as GeoJSON would lose the Ms
+	layer.HasM = true
+	if canEditGeometry(layer) {
+		t.Error("Geometry of an M-only layer is editable")
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GeoPackage identifies itself through the SQLite header
+const (
+	geoPackageApplicationID = 0x47504B47 // "GPKG"
+	geoPackageUserVersion   = 10200
+)
+
+// The tables every GeoPackage has, as defined in the GeoPackage specification
+const (
+	gpkgSpatialRefSysSQL = `CREATE TABLE gpkg_spatial_ref_sys (srs_name TEXT NOT NULL, srs_id INTEGER NOT NULL PRIMARY KEY, organization TEXT NOT NULL, organization_coordsys_id INTEGER NOT NULL, definition TEXT NOT NULL, description TEXT)`
+	gpkgContentsSQL      = `CREATE TABLE gpkg_contents (table_name TEXT NOT NULL PRIMARY KEY, data_type TEXT NOT NULL, identifier TEXT UNIQUE, description TEXT DEFAULT '', last_change DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')), min_x DOUBLE, min_y DOUBLE, max_x DOUBLE, max_y DOUBLE, srs_id INTEGER, CONSTRAINT fk_gc_r_srs_id FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys(srs_id))`
+	gpkgGeometryColsSQL  = `CREATE TABLE gpkg_geometry_columns (table_name TEXT NOT NULL, column_name TEXT NOT NULL, geometry_type_name TEXT NOT NULL, srs_id INTEGER NOT NULL, z TINYINT NOT NULL, m TINYINT NOT NULL, CONSTRAINT pk_geom_cols PRIMARY KEY (table_name, column_name), CONSTRAINT uk_gc_table_name UNIQUE (table_name), CONSTRAINT fk_gc_tn FOREIGN KEY (table_name) REFERENCES gpkg_contents(table_name), CONSTRAINT fk_gc_srs FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys (srs_id))`
+)
+
+// The OGC well known text of WGS84, which the specification requires
+const ogcWKTWGS84 = `GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,AUTHORITY["EPSG","7030"]],AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],AUTHORITY["EPSG","4326"]]`
+
+const geoPackageGeometryColumn = "geom"
+
+// WKB geometry type codes
+const (
+	wkbPoint           = 1
+	wkbLineString      = 2
+	wkbPolygon         = 3
+	wkbMultiPoint      = 4
+	wkbMultiLineString = 5
+	wkbMultiPolygon    = 6
+)
+
+type gpkgColumn struct {
+	field   ArcGISField
+	sqlType string
+}
+
+// geoPackageWriter writes features into a single feature table of a new
+// GeoPackage in a temporary file, then copies the whole file out at the end.
+type geoPackageWriter struct {
+	w         io.Writer
+	sr        ArcGISSpatialReference
+	srsID     int64
+	layer     *ArcGISLayer
+	file      *os.File
+	db        *sqliteWriter
+	features  *sqliteTable
+	tableName string
+	typeName  string
+	columns   []gpkgColumn
+	count     int64
+	box       boundingBox
+}
+
+func newGeoPackageWriter(w io.Writer, sr ArcGISSpatialReference) *geoPackageWriter {
+	return &geoPackageWriter{w: w, sr: sr, srsID: int64(normalizeWKID(sr)), box: newBoundingBox()}
+}
+
+func geoPackageTypeName(geometryType string) (string, error) {
+	switch geometryType {
+	case GeometryTypePoint:
+		return "POINT", nil
+	case GeometryTypeMultipoint:
+		return "MULTIPOINT", nil
+	case GeometryTypePolyline:
+		return "MULTILINESTRING", nil
+	case GeometryTypePolygon, GeometryTypeEnvelope:
+		return "MULTIPOLYGON", nil
+	}
+	return "", fmt.Errorf("Can't write geometry type '%s' to a GeoPackage", geometryType)
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func gpkgColumnFor(f ArcGISField) (gpkgColumn, bool) {
+	c := gpkgColumn{field: f}
+	switch f.Type {
+	case "esriFieldTypeOID", "esriFieldTypeSmallInteger", "esriFieldTypeInteger", "esriFieldTypeBigInteger":
+		c.sqlType = "INTEGER"
+	case "esriFieldTypeSingle", "esriFieldTypeDouble":
+		c.sqlType = "REAL"
+	case "esriFieldTypeDate":
+		c.sqlType = "DATETIME"
+	case "esriFieldTypeString", "esriFieldTypeGUID", "esriFieldTypeGlobalID":
+		c.sqlType = "TEXT"
+	default:
+		return c, false
+	}
+	return c, true
+}
+
+func (g *geoPackageWriter) Begin(layer *ArcGISLayer) error {
+	g.layer = layer
+	g.tableName = exportFilename(layer.Name)
+	if layer.GeometryType != "" {
+		var err error
+		g.typeName, err = geoPackageTypeName(layer.GeometryType)
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range layer.Fields {
+		if strings.EqualFold(f.Name, "fid") || strings.EqualFold(f.Name, geoPackageGeometryColumn) {
+			continue
+		}
+		if c, ok := gpkgColumnFor(f); ok {
+			g.columns = append(g.columns, c)
+		}
+	}
+	var err error
+	g.file, err = os.CreateTemp("", "geopackage")
+	if err != nil {
+		return fmt.Errorf("Failed to create temporary file: %v", err)
+	}
+	g.db = newSQLiteWriter(g.file)
+	g.features = newSQLiteTable(g.db)
+	return nil
+}
+
+func (g *geoPackageWriter) Write(f ArcGISFeature) error {
+	values := make([]any, 0, len(g.columns)+2)
+	// fid is an alias for the rowid, so SQLite stores it as null
+	values = append(values, nil)
+	if g.typeName != "" {
+		blob, err := g.geometryBlob(f)
+		if err != nil {
+			return err
+		}
+		if blob == nil {
+			// A nil []byte would be stored as an empty blob rather than null
+			values = append(values, nil)
+		} else {
+			values = append(values, blob)
+		}
+	}
+	for _, c := range g.columns {
+		values = append(values, gpkgValue(c, f.Attributes[c.field.Name]))
+	}
+	g.count++
+	return g.features.add(g.count, sqliteRecord(values...))
+}
+
+func gpkgValue(c gpkgColumn, v any) any {
+	switch t := v.(type) {
+	case float64:
+		switch c.sqlType {
+		case "INTEGER":
+			return int64(t)
+		case "DATETIME":
+			return time.UnixMilli(int64(t)).UTC().Format("2006-01-02T15:04:05.000Z")
+		case "TEXT":
+			return formatAttribute(t)
+		}
+		return t
+	case string:
+		return t
+	case bool:
+		if t {
+			return int64(1)
+		}
+		return int64(0)
+	}
+	return nil
+}
+
+// Encode a feature's geometry as a GeoPackage geometry blob: a small header
+// with the envelope followed by little endian WKB
+func (g *geoPackageWriter) geometryBlob(f ArcGISFeature) ([]byte, error) {
+	geometry, err := f.DecodeGeometry(g.layer.GeometryType)
+	if err != nil {
+		return nil, err
+	}
+	gj, err := geometry.ToGeoJSON()
+	if err != nil {
+		return nil, err
+	}
+	if gj == nil {
+		return nil, nil
+	}
+	box := newBoundingBox()
+	var wkb []byte
+	switch gj.Type {
+	case "Point":
+		c := gj.Coordinates.(Coordinate)
+		box.add(c[0], c[1])
+		wkb = appendWKBPoint(nil, c)
+	case "MultiPoint":
+		points := gj.Coordinates.([]Coordinate)
+		wkb = appendWKBHeader(nil, wkbMultiPoint, len(points))
+		for _, c := range points {
+			box.add(c[0], c[1])
+			wkb = appendWKBPoint(wkb, c)
+		}
+	case "LineString", "MultiLineString":
+		lines, ok := gj.Coordinates.([][]Coordinate)
+		if !ok {
+			lines = [][]Coordinate{gj.Coordinates.([]Coordinate)}
+		}
+		wkb = appendWKBHeader(nil, wkbMultiLineString, len(lines))
+		for _, line := range lines {
+			wkb = appendWKBHeader(wkb, wkbLineString, len(line))
+			wkb = appendWKBCoordinates(wkb, line, &box)
+		}
+	case "Polygon", "MultiPolygon":
+		polygons, ok := gj.Coordinates.([][][]Coordinate)
+		if !ok {
+			polygons = [][][]Coordinate{gj.Coordinates.([][]Coordinate)}
+		}
+		wkb = appendWKBHeader(nil, wkbMultiPolygon, len(polygons))
+		for _, polygon := range polygons {
+			wkb = appendWKBHeader(wkb, wkbPolygon, len(polygon))
+			for _, ring := range polygon {
+				wkb = binary.LittleEndian.AppendUint32(wkb, uint32(len(ring)))
+				wkb = appendWKBCoordinates(wkb, ring, &box)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Can't write GeoJSON type '%s' to a GeoPackage", gj.Type)
+	}
+	if !box.empty {
+		g.box.add(box.xmin, box.ymin)
+		g.box.add(box.xmax, box.ymax)
+	}
+
+	blob := []byte{'G', 'P', 0}
+	// Little endian, with an xy envelope
+	blob = append(blob, 0x01|0x02)
+	blob = binary.LittleEndian.AppendUint32(blob, uint32(int32(g.srsID)))
+	for _, v := range []float64{box.xmin, box.xmax, box.ymin, box.ymax} {
+		blob = binary.LittleEndian.AppendUint64(blob, math.Float64bits(v))
+	}
+	return append(blob, wkb...), nil
+}
+
+func appendWKBHeader(b []byte, wkbType uint32, count int) []byte {
+	b = append(b, 1)
+	b = binary.LittleEndian.AppendUint32(b, wkbType)
+	return binary.LittleEndian.AppendUint32(b, uint32(count))
+}
+
+func appendWKBPoint(b []byte, c Coordinate) []byte {
+	b = append(b, 1)
+	b = binary.LittleEndian.AppendUint32(b, wkbPoint)
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(c[0]))
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(c[1]))
+}
+
+func appendWKBCoordinates(b []byte, cs []Coordinate, box *boundingBox) []byte {
+	for _, c := range cs {
+		box.add(c[0], c[1])
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(c[0]))
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(c[1]))
+	}
+	return b
+}
+
+func (g *geoPackageWriter) featureTableSQL() string {
+	columns := []string{"fid INTEGER PRIMARY KEY"}
+	if g.typeName != "" {
+		columns = append(columns, quoteIdentifier(geoPackageGeometryColumn)+" "+g.typeName)
+	}
+	for _, c := range g.columns {
+		columns = append(columns, quoteIdentifier(c.field.Name)+" "+c.sqlType)
+	}
+	return fmt.Sprintf("CREATE TABLE %s (%s)", quoteIdentifier(g.tableName), strings.Join(columns, ", "))
+}
+
+// Remove the temporary file
+func (g *geoPackageWriter) Close() error {
+	if g.file != nil {
+		g.file.Close()
+		os.Remove(g.file.Name())
+		g.file = nil
+	}
+	return nil
+}
+
+func (g *geoPackageWriter) End() error {
+	featuresRoot, err := g.features.finish()
+	if err != nil {
+		return err
+	}
+
+	// The three definitions the specification requires, plus ours if it's another one
+	srs := newSQLiteTable(g.db)
+	srsRows := []struct {
+		id     int64
+		record []byte
+	}{
+		{-1, sqliteRecord("Undefined cartesian SRS", nil, "NONE", int64(-1), "undefined", "undefined cartesian coordinate reference system")},
+		{0, sqliteRecord("Undefined geographic SRS", nil, "NONE", int64(0), "undefined", "undefined geographic coordinate reference system")},
+		{WKIDWGS84, sqliteRecord("WGS 84 geodetic", nil, "EPSG", int64(WKIDWGS84), ogcWKTWGS84, "longitude/latitude coordinates in decimal degrees on the WGS 84 spheroid")},
+	}
+	if g.srsID != WKIDWGS84 {
+		definition, err := projectionWKT(g.sr)
+		if err != nil {
+			definition = "undefined"
+		}
+		organization := "EPSG"
+		if g.srsID >= 100000 {
+			organization = "ESRI"
+		}
+		srsRows = append(srsRows, struct {
+			id     int64
+			record []byte
+		}{g.srsID, sqliteRecord(fmt.Sprintf("%d", g.srsID), nil, organization, g.srsID, definition, nil)})
+	}
+	// Rows have to go in in rowid order
+	sort.Slice(srsRows, func(i, j int) bool { return srsRows[i].id < srsRows[j].id })
+	for _, row := range srsRows {
+		err := srs.add(row.id, row.record)
+		if err != nil {
+			return err
+		}
+	}
+	srsRoot, err := srs.finish()
+	if err != nil {
+		return err
+	}
+
+	dataType := "attributes"
+	var minX, minY, maxX, maxY any
+	if g.typeName != "" {
+		dataType = "features"
+		if !g.box.empty {
+			minX, minY, maxX, maxY = g.box.xmin, g.box.ymin, g.box.xmax, g.box.ymax
+		}
+	}
+	lastChange := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	contents := newSQLiteTable(g.db)
+	err = contents.add(1, sqliteRecord(g.tableName, dataType, g.layer.Name, g.layer.Description, lastChange, minX, minY, maxX, maxY, g.srsID))
+	if err != nil {
+		return err
+	}
+	contentsRoot, err := contents.finish()
+	if err != nil {
+		return err
+	}
+	contentsPK, err := g.db.writeSmallIndex([][]byte{sqliteRecord(g.tableName, int64(1))})
+	if err != nil {
+		return err
+	}
+	contentsIdentifier, err := g.db.writeSmallIndex([][]byte{sqliteRecord(g.layer.Name, int64(1))})
+	if err != nil {
+		return err
+	}
+
+	geometryColumns := newSQLiteTable(g.db)
+	var geometryPK, geometryTable []byte
+	if g.typeName != "" {
+		err = geometryColumns.add(1, sqliteRecord(g.tableName, geoPackageGeometryColumn, g.typeName, g.srsID, int64(0), int64(0)))
+		if err != nil {
+			return err
+		}
+		geometryPK = sqliteRecord(g.tableName, geoPackageGeometryColumn, int64(1))
+		geometryTable = sqliteRecord(g.tableName, int64(1))
+	}
+	geometryColumnsRoot, err := geometryColumns.finish()
+	if err != nil {
+		return err
+	}
+	geometryIndexes := make([]uint32, 0, 2)
+	for _, record := range [][]byte{geometryPK, geometryTable} {
+		records := [][]byte{}
+		if record != nil {
+			records = append(records, record)
+		}
+		root, err := g.db.writeSmallIndex(records)
+		if err != nil {
+			return err
+		}
+		geometryIndexes = append(geometryIndexes, root)
+	}
+
+	err = g.db.writeSchema([]SQLiteSchemaEntry{
+		{"table", "gpkg_spatial_ref_sys", "gpkg_spatial_ref_sys", srsRoot, gpkgSpatialRefSysSQL},
+		{"table", "gpkg_contents", "gpkg_contents", contentsRoot, gpkgContentsSQL},
+		{"index", "sqlite_autoindex_gpkg_contents_1", "gpkg_contents", contentsPK, ""},
+		{"index", "sqlite_autoindex_gpkg_contents_2", "gpkg_contents", contentsIdentifier, ""},
+		{"table", "gpkg_geometry_columns", "gpkg_geometry_columns", geometryColumnsRoot, gpkgGeometryColsSQL},
+		{"index", "sqlite_autoindex_gpkg_geometry_columns_1", "gpkg_geometry_columns", geometryIndexes[0], ""},
+		{"index", "sqlite_autoindex_gpkg_geometry_columns_2", "gpkg_geometry_columns", geometryIndexes[1], ""},
+		{"table", g.tableName, g.tableName, featuresRoot, g.featureTableSQL()},
+	}, geoPackageApplicationID, geoPackageUserVersion)
+	if err != nil {
+		return err
+	}
+	_, err = g.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(g.w, g.file)
+	return err
+}
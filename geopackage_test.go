@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// A layer with an object ID, a name and the given geometry type
+func exportTestLayer(geometryType string) *ArcGISLayer {
+	layer := &ArcGISLayer{
+		ObjectIDField: "OBJECTID",
+		Fields: []ArcGISField{
+			{Name: "OBJECTID", Type: "esriFieldTypeOID"},
+			{Name: "NAME", Type: "esriFieldTypeString", Length: 50},
+		},
+	}
+	layer.Name = "Test Sites"
+	layer.GeometryType = geometryType
+	return layer
+}
+
+func exportTestFeature(objectID int, name string, geometry string) ArcGISFeature {
+	f := ArcGISFeature{Attributes: map[string]any{"OBJECTID": float64(objectID), "NAME": name}}
+	if geometry != "" {
+		f.Geometry = json.RawMessage(geometry)
+	}
+	return f
+}
+
+// Run features through the writer for a format and return what it wrote
+func exportTestFeatures(t *testing.T, format string, layer *ArcGISLayer, features []ArcGISFeature) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	writer, err := newFeatureWriter(format, &out, ArcGISSpatialReference{WKID: WKIDWGS84})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	if err := writer.Begin(layer); err != nil {
+		t.Fatalf("Failed to begin %s: %v", format, err)
+	}
+	for _, f := range features {
+		if err := writer.Write(f); err != nil {
+			t.Fatalf("Failed to write %s: %v", format, err)
+		}
+	}
+	if err := writer.End(); err != nil {
+		t.Fatalf("Failed to end %s: %v", format, err)
+	}
+	return out.Bytes()
+}
+
+// The WKB type and number of parts of a GeoPackage geometry blob
+func geoPackageGeometry(t *testing.T, blob []byte) (uint32, uint32) {
+	t.Helper()
+	if len(blob) < 49 || blob[0] != 'G' || blob[1] != 'P' {
+		t.Fatalf("Not a GeoPackage geometry: %x", blob)
+	}
+	if blob[3] != 0x03 {
+		t.Fatalf("Flags are %#x, want little endian with an xy envelope", blob[3])
+	}
+	wkb := blob[8+32:]
+	if wkb[0] != 1 {
+		t.Fatalf("WKB isn't little endian")
+	}
+	return binary.LittleEndian.Uint32(wkb[1:]), binary.LittleEndian.Uint32(wkb[5:])
+}
+
+// Read back the feature table of a GeoPackage
+func readGeoPackage(t *testing.T, data []byte, layer *ArcGISLayer) (SQLiteSchemaEntry, [][]any) {
+	t.Helper()
+	r := newSQLiteReader(t, data)
+	if id := binary.BigEndian.Uint32(data[68:]); id != geoPackageApplicationID {
+		t.Errorf("Application ID is %#x, want GPKG", id)
+	}
+	schema := r.schema()
+	for _, name := range []string{"gpkg_spatial_ref_sys", "gpkg_contents", "gpkg_geometry_columns"} {
+		if _, ok := schema[name]; !ok {
+			t.Errorf("GeoPackage has no %s table", name)
+		}
+	}
+	table, ok := schema[exportFilename(layer.Name)]
+	if !ok {
+		t.Fatalf("GeoPackage has no table for the layer in %v", schema)
+	}
+	_, rows := r.rows(table.RootPage)
+	return table, rows
+}
+
+func TestGeoPackageGeometries(t *testing.T) {
+	tests := []struct {
+		geometryType string
+		geometry     string
+		wkbType      uint32
+		parts        uint32
+	}{
+		{GeometryTypePoint, `{"x":-121.5,"y":38.5}`, wkbPoint, 0},
+		{GeometryTypePolygon, `{"rings":[[[0,0],[0,1],[1,1],[1,0],[0,0]],[[5,5],[5,6],[6,6],[6,5],[5,5]]]}`, wkbMultiPolygon, 2},
+		{GeometryTypePolyline, `{"paths":[[[0,0],[1,1]],[[5,5],[6,6],[7,5]]]}`, wkbMultiLineString, 2},
+		{GeometryTypeMultipoint, `{"points":[[0,0],[1,1],[2,2]]}`, wkbMultiPoint, 3},
+	}
+	for _, test := range tests {
+		layer := exportTestLayer(test.geometryType)
+		data := exportTestFeatures(t, ExportGeoPackage, layer, []ArcGISFeature{
+			exportTestFeature(1, "Has a geometry", test.geometry),
+			exportTestFeature(2, "Has none", ""),
+		})
+		_, rows := readGeoPackage(t, data, layer)
+		if len(rows) != 2 {
+			t.Fatalf("%s: got %d rows, want 2", test.geometryType, len(rows))
+		}
+		blob, ok := rows[0][1].([]byte)
+		if !ok {
+			t.Fatalf("%s: geometry is %T, want a blob", test.geometryType, rows[0][1])
+		}
+		wkbType, parts := geoPackageGeometry(t, blob)
+		if wkbType != test.wkbType {
+			t.Errorf("%s: WKB type is %d, want %d", test.geometryType, wkbType, test.wkbType)
+		}
+		if test.parts != 0 && parts != test.parts {
+			t.Errorf("%s: geometry has %d parts, want %d", test.geometryType, parts, test.parts)
+		}
+		if rows[0][2] != int64(1) || rows[0][3] != "Has a geometry" {
+			t.Errorf("%s: attributes are %v", test.geometryType, rows[0][2:])
+		}
+		// A missing geometry is a null, not an empty blob
+		if rows[1][1] != nil {
+			t.Errorf("%s: missing geometry was stored as %#v, want null", test.geometryType, rows[1][1])
+		}
+	}
+}
+
+func TestGeoPackageWideSchema(t *testing.T) {
+	// Enough long field names that the table definition is larger than a page
+	layer := exportTestLayer(GeometryTypePoint)
+	attributes := map[string]any{"OBJECTID": float64(1), "NAME": "Wide"}
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("INSPECTION_RESULT_FIELD_WITH_A_LONG_NAME_%03d", i)
+		layer.Fields = append(layer.Fields, ArcGISField{Name: name, Type: "esriFieldTypeDouble"})
+		attributes[name] = float64(i) + 0.5
+	}
+	f := ArcGISFeature{Attributes: attributes, Geometry: json.RawMessage(`{"x":1,"y":2}`)}
+	data := exportTestFeatures(t, ExportGeoPackage, layer, []ArcGISFeature{f})
+	table, rows := readGeoPackage(t, data, layer)
+	if len(table.SQL) <= sqlitePageSize {
+		t.Fatalf("Table definition is only %d bytes, the test needs it larger than a page", len(table.SQL))
+	}
+	if !strings.Contains(table.SQL, `"INSPECTION_RESULT_FIELD_WITH_A_LONG_NAME_299" REAL`) {
+		t.Errorf("Table definition is missing the last field: %.100s...", table.SQL)
+	}
+	if len(rows) != 1 || len(rows[0]) != 304 {
+		t.Fatalf("Got rows %v, want one with fid, geometry and 302 fields", rows)
+	}
+	if rows[0][303] != 299.5 {
+		t.Errorf("Last field is %v, want 299.5", rows[0][303])
+	}
+}
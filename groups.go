@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+)
+
+type ArcGISGroup struct {
+	ID          string   `json:"id"`
+	Title       string   `json:"title"`
+	Owner       string   `json:"owner"`
+	Description string   `json:"description"`
+	Snippet     string   `json:"snippet"`
+	Access      string   `json:"access"`
+	Tags        []string `json:"tags"`
+	Created     int64    `json:"created"`
+	Modified    int64    `json:"modified"`
+	IsViewOnly  bool     `json:"isViewOnly"`
+}
+
+// ArcGISCommunityUser is the signed in user as community/self describes them
+type ArcGISCommunityUser struct {
+	Username string        `json:"username"`
+	FullName string        `json:"fullName"`
+	Email    string        `json:"email"`
+	Role     string        `json:"role"`
+	OrgID    string        `json:"orgId"`
+	Groups   []ArcGISGroup `json:"groups"`
+}
+
+type ArcGISGroupContent struct {
+	Total     int          `json:"total"`
+	Start     int          `json:"start"`
+	Num       int          `json:"num"`
+	NextStart int          `json:"nextStart"`
+	Items     []ArcGISItem `json:"items"`
+}
+
+// Fetch the signed in user, including the groups they're a member of
+func fetchCommunitySelf(ctx context.Context, access string) (*ArcGISCommunityUser, error) {
+	var user ArcGISCommunityUser
+	err := arcgisGet(ctx, access, PortalURL+"/sharing/rest/community/self", nil, &user)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get user: %w", err)
+	}
+	return &user, nil
+}
+
+// Fetch the groups the signed in user is a member of
+func fetchUserGroups(ctx context.Context, access string) ([]ArcGISGroup, error) {
+	user, err := fetchCommunitySelf(ctx, access)
+	if err != nil {
+		return nil, err
+	}
+	if user.Groups == nil {
+		return make([]ArcGISGroup, 0), nil
+	}
+	return user.Groups, nil
+}
+
+// Fetch the description of a single group
+func fetchGroup(ctx context.Context, access string, groupID string) (*ArcGISGroup, error) {
+	var group ArcGISGroup
+	err := arcgisGet(ctx, access, PortalURL+"/sharing/rest/community/groups/"+url.PathEscape(groupID), nil, &group)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get group %s: %w", groupID, err)
+	}
+	return &group, nil
+}
+
+// Fetch every item shared with a group
+func fetchGroupContent(ctx context.Context, access string, groupID string) ([]ArcGISItem, error) {
+	baseURL := PortalURL + "/sharing/rest/content/groups/" + url.PathEscape(groupID)
+	items := make([]ArcGISItem, 0)
+	start := 1
+	for {
+		params := url.Values{
+			"start": []string{strconv.Itoa(start)},
+			"num":   []string{strconv.Itoa(contentPageSize)},
+		}
+		var content ArcGISGroupContent
+		err := arcgisGet(ctx, access, baseURL, params, &content)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get content of group %s: %w", groupID, err)
+		}
+		items = append(items, content.Items...)
+		if content.NextStart <= 0 || len(content.Items) == 0 {
+			break
+		}
+		start = content.NextStart
+	}
+	return items, nil
+}
+
+// Note which of the user's groups each service is shared with
+func assignServiceGroups(ctx context.Context, access string, services []ArcGISFeatureService, groups []ArcGISGroup) error {
+	for _, group := range groups {
+		items, err := fetchGroupContent(ctx, access, group.ID)
+		if err != nil {
+			return err
+		}
+		for i := range services {
+			if slices.ContainsFunc(items, func(item ArcGISItem) bool { return item.ID == services[i].ItemID }) {
+				services[i].Groups = append(services[i].Groups, group)
+			}
+		}
+	}
+	return nil
+}
+
+// Keep the services shared with a group
+func filterServicesByGroup(services []ArcGISFeatureService, groupID string) []ArcGISFeatureService {
+	result := make([]ArcGISFeatureService, 0)
+	for _, service := range services {
+		if slices.ContainsFunc(service.Groups, func(g ArcGISGroup) bool { return g.ID == groupID }) {
+			result = append(result, service)
+		}
+	}
+	return result
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const (
+	fieldOperationsGroup = "9c8b7a6d5e4f30211f0e9d8c7b6a5f40"
+	surveillanceLabGroup = "1d2c3b4a5f6e7d8c9b0a1f2e3d4c5b6a"
+)
+
+func TestUserGroupsAndServices(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	technician := signIn(t, portal, "fake.technician")
+	admin := signIn(t, portal, "fake.admin")
+	ctx := context.Background()
+
+	groups, err := fetchUserGroups(ctx, technician.AccessToken)
+	if err != nil {
+		t.Fatalf("Failed to get groups: %v", err)
+	}
+	if len(groups) != 2 {
+		t.Errorf("Technician is in %d groups, want 2", len(groups))
+	}
+	// The administrator owns the field operations group but isn't in the private lab group
+	groups, err = fetchUserGroups(ctx, admin.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0].ID != fieldOperationsGroup {
+		t.Errorf("Administrator is in %+v, want just the field operations group", groups)
+	}
+	if _, err := fetchGroup(ctx, admin.AccessToken, surveillanceLabGroup); err == nil {
+		t.Error("Got a private group the user isn't in")
+	}
+
+	items, err := fetchGroupContent(ctx, technician.AccessToken, fieldOperationsGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Title != "FieldseekerGIS" {
+		t.Errorf("Group has %+v, want the FieldseekerGIS service", items)
+	}
+
+	search, err := findFieldseeker(ctx, technician.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services := discoverFeatureServices(ctx, technician.AccessToken, search)
+	groups, err = fetchUserGroups(ctx, technician.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assignServiceGroups(ctx, technician.AccessToken, services, groups); err != nil {
+		t.Fatalf("Failed to assign groups: %v", err)
+	}
+	if len(filterServicesByGroup(services, fieldOperationsGroup)) != 1 {
+		t.Errorf("The service isn't in the field operations group: %+v", services)
+	}
+	if len(filterServicesByGroup(services, surveillanceLabGroup)) != 0 {
+		t.Errorf("The service is in the lab group: %+v", services)
+	}
+}
+
+func TestGroupPage(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	signIn(t, portal, "fake.technician")
+	signIn(t, portal, "fake.admin")
+
+	w := callAs(t, "fake.technician", http.MethodGet, "/groups/{id}", getGroup, "/groups/"+fieldOperationsGroup, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d: %s", w.Code, w.Body)
+	}
+	for _, s := range []string{"Mosquito Control Field Operations", "FieldseekerGIS"} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("Group page doesn't have %s", s)
+		}
+	}
+
+	w = callAs(t, "fake.admin", http.MethodGet, "/groups/{id}", getGroup, "/groups/"+surveillanceLabGroup, nil)
+	if w.Code == http.StatusOK || strings.Contains(w.Body.String(), "Trap counts") {
+		t.Errorf("Got status %d for a private group the user isn't in", w.Code)
+	}
+}
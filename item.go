@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+)
+
+// ArcGISItemDetails is everything the portal says about an item, beyond what search returns
+type ArcGISItemDetails struct {
+	ArcGISItem
+	// In WGS84, as [[xmin, ymin], [xmax, ymax]]
+	Extent            [][]float64    `json:"extent"`
+	SpatialReference  string         `json:"spatialReference"`
+	Culture           string         `json:"culture"`
+	Properties        map[string]any `json:"properties"`
+	AccessInformation string         `json:"accessInformation"`
+	LicenseInfo       string         `json:"licenseInfo"`
+	Thumbnail         string         `json:"thumbnail"`
+	NumViews          int            `json:"numViews"`
+	NumRatings        int            `json:"numRatings"`
+	AvgRating         float64        `json:"avgRating"`
+	Size              int64          `json:"size"`
+	Protected         bool           `json:"protected"`
+}
+
+// ArcGISWebMap is the data of a Web Map item
+type ArcGISWebMap struct {
+	Version           string                 `json:"version"`
+	AuthoringApp      string                 `json:"authoringApp"`
+	OperationalLayers []ArcGISWebMapLayer    `json:"operationalLayers"`
+	Tables            []ArcGISWebMapLayer    `json:"tables"`
+	BaseMap           ArcGISWebMapBaseMap    `json:"baseMap"`
+	SpatialReference  ArcGISSpatialReference `json:"spatialReference"`
+}
+
+type ArcGISWebMapBaseMap struct {
+	Title         string              `json:"title"`
+	BaseMapLayers []ArcGISWebMapLayer `json:"baseMapLayers"`
+}
+
+type ArcGISWebMapLayer struct {
+	ID              string  `json:"id"`
+	Title           string  `json:"title"`
+	URL             string  `json:"url"`
+	ItemID          string  `json:"itemId"`
+	LayerType       string  `json:"layerType"`
+	Visibility      bool    `json:"visibility"`
+	Opacity         float64 `json:"opacity"`
+	LayerDefinition *struct {
+		DefinitionExpression string `json:"definitionExpression"`
+	} `json:"layerDefinition"`
+	// Set on group layers
+	Layers []ArcGISWebMapLayer `json:"layers"`
+}
+
+// Fetch the full description of an item
+func fetchItem(ctx context.Context, access string, itemID string) (*ArcGISItemDetails, error) {
+	var item ArcGISItemDetails
+	err := arcgisGet(ctx, access, PortalURL+"/sharing/rest/content/items/"+url.PathEscape(itemID), nil, &item)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get item %s: %w", itemID, err)
+	}
+	return &item, nil
+}
+
+// Fetch the data of an item, like the JSON of a web map or the file that was
+// uploaded for a CSV item
+func fetchItemData(ctx context.Context, access string, itemID string) ([]byte, error) {
+	baseURL := PortalURL + "/sharing/rest/content/items/" + url.PathEscape(itemID) + "/data"
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+"?f=json", nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create request: %v", err)
+	}
+	data, err := arcgisDoRaw(req, access)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get data of item %s: %w", itemID, err)
+	}
+	var envelope struct {
+		Error *ArcGISError `json:"error"`
+	}
+	if err := json.Unmarshal(data, &envelope); err == nil && envelope.Error != nil {
+		return nil, fmt.Errorf("Failed to get data of item %s: %w", itemID, envelope.Error)
+	}
+	return data, nil
+}
+
+func decodeWebMap(data []byte) (*ArcGISWebMap, error) {
+	var webMap ArcGISWebMap
+	err := json.Unmarshal(data, &webMap)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal web map: %v", err)
+	}
+	return &webMap, nil
+}
+
+// List every operational layer and table in the map, with the ones inside group
+// layers brought up to the top level
+func (m *ArcGISWebMap) AllOperationalLayers() []ArcGISWebMapLayer {
+	result := make([]ArcGISWebMapLayer, 0)
+	var add func(layers []ArcGISWebMapLayer)
+	add = func(layers []ArcGISWebMapLayer) {
+		for _, layer := range layers {
+			if len(layer.Layers) > 0 {
+				add(layer.Layers)
+				continue
+			}
+			result = append(result, layer)
+		}
+	}
+	add(m.OperationalLayers)
+	add(m.Tables)
+	return result
+}
+
+var featureLayerURL = regexp.MustCompile(`^(https://.+/FeatureServer)/(\d+)/?$`)
+
+// Split the URL of a layer in a feature service into the service URL and the layer ID
+func splitLayerURL(layerURL string) (string, int, bool) {
+	m := featureLayerURL.FindStringSubmatch(layerURL)
+	if m == nil {
+		return "", 0, false
+	}
+	layerID, err := strconv.Atoi(m[2])
+	if err != nil {
+		return "", 0, false
+	}
+	return m[1], layerID, true
+}
+
+// Get the link to our page for a web map layer, if it's a layer in a feature service
+func (l ArcGISWebMapLayer) LayerPage() string {
+	serviceURL, layerID, ok := splitLayerURL(l.URL)
+	if !ok {
+		return ""
+	}
+	params := url.Values{
+		"service": []string{serviceURL},
+		"layer":   []string{strconv.Itoa(layerID)},
+	}
+	return "/layer?" + params.Encode()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const (
+	fieldSeekerServiceItem = "0f1e5eedf1e1d5ee4e70000000000001"
+	treatmentAreasMapItem  = "0f1e5eedf1e1d5ee4e70000000000002"
+	trapCountsItem         = "0f1e5eedf1e1d5ee4e70000000000003"
+)
+
+func TestFetchItemAndData(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	technician := signIn(t, portal, "fake.technician")
+	admin := signIn(t, portal, "fake.admin")
+	ctx := context.Background()
+
+	item, err := fetchItem(ctx, technician.AccessToken, treatmentAreasMapItem)
+	if err != nil {
+		t.Fatalf("Failed to get item: %v", err)
+	}
+	if item.Title != "Treatment Areas Map" || item.Type != "Web Map" {
+		t.Errorf("Got item %s (%s), want the Treatment Areas Map web map", item.Title, item.Type)
+	}
+	data, err := fetchItemData(ctx, technician.AccessToken, item.ID)
+	if err != nil {
+		t.Fatalf("Failed to get item data: %v", err)
+	}
+	webMap, err := decodeWebMap(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The treatments layer is inside a group layer
+	layers := webMap.AllOperationalLayers()
+	titles := make([]string, 0)
+	for _, l := range layers {
+		titles = append(titles, l.Title)
+	}
+	if strings.Join(titles, ",") != "Point locations,Treatments" {
+		t.Errorf("Got layers %v, want the point locations and treatments", titles)
+	}
+	if page := layers[1].LayerPage(); !strings.Contains(page, "layer=1") || !strings.Contains(page, "FieldseekerGIS%2FFeatureServer") {
+		t.Errorf("Treatments link to %s, want layer 1 of the service", page)
+	}
+
+	// Uploaded files come back as they are
+	data, err = fetchItemData(ctx, technician.AccessToken, trapCountsItem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "week,trap,species,count") {
+		t.Errorf("Got data %.40s, want the trap counts CSV", data)
+	}
+
+	// Private items are only for their owner
+	if _, err := fetchItem(ctx, admin.AccessToken, treatmentAreasMapItem); err == nil {
+		t.Error("Got another user's private item")
+	}
+	if _, err := fetchItemData(ctx, admin.AccessToken, treatmentAreasMapItem); err == nil {
+		t.Error("Got the data of another user's private item")
+	}
+}
+
+func TestSplitLayerURL(t *testing.T) {
+	tests := []struct {
+		url        string
+		serviceURL string
+		layerID    int
+		ok         bool
+	}{
+		{"https://services.arcgis.com/abc/arcgis/rest/services/Fieldseeker/FeatureServer/3", "https://services.arcgis.com/abc/arcgis/rest/services/Fieldseeker/FeatureServer", 3, true},
+		{"https://services.arcgis.com/abc/arcgis/rest/services/Fieldseeker/FeatureServer/12/", "https://services.arcgis.com/abc/arcgis/rest/services/Fieldseeker/FeatureServer", 12, true},
+		{"https://services.arcgis.com/abc/arcgis/rest/services/Fieldseeker/FeatureServer", "", 0, false},
+		{"https://services.arcgisonline.com/ArcGIS/rest/services/World_Topo_Map/MapServer/0", "", 0, false},
+		{"http://services.arcgis.com/abc/arcgis/rest/services/Fieldseeker/FeatureServer/3", "", 0, false},
+	}
+	for _, test := range tests {
+		serviceURL, layerID, ok := splitLayerURL(test.url)
+		if serviceURL != test.serviceURL || layerID != test.layerID || ok != test.ok {
+			t.Errorf("%s split into %s, %d, %v, want %s, %d, %v", test.url, serviceURL, layerID, ok, test.serviceURL, test.layerID, test.ok)
+		}
+	}
+}
+
+func TestItemPage(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	signIn(t, portal, "fake.technician")
+	signIn(t, portal, "fake.admin")
+
+	w := callAs(t, "fake.technician", http.MethodGet, "/items/{id}", getItem, "/items/"+treatmentAreasMapItem, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d: %s", w.Code, w.Body)
+	}
+	for _, s := range []string{"Treatment Areas Map", "Point locations", "/layer?"} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("Item page doesn't have %s", s)
+		}
+	}
+
+	// A service has no data, which isn't an error
+	w = callAs(t, "fake.technician", http.MethodGet, "/items/{id}", getItem, "/items/"+fieldSeekerServiceItem, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "FieldseekerGIS") {
+		t.Errorf("Got status %d for the service item", w.Code)
+	}
+
+	w = callAs(t, "fake.admin", http.MethodGet, "/items/{id}", getItem, "/items/"+treatmentAreasMapItem, nil)
+	if w.Code == http.StatusOK {
+		t.Error("Showed another user's private item")
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/alexedwards/scs/v2"
@@ -15,7 +17,50 @@ var sessionManager *scs.SessionManager
 
 var BaseURL, ClientID, ClientSecret string
 
+// The portal everything is requested from, which is the fake one when FAKE_PORTAL is set
+var PortalURL = "https://www.arcgis.com"
+
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+	fakePortal := os.Getenv("FAKE_PORTAL")
+	if fakePortal != "" {
+		if fakePortal == "true" {
+			fakePortal = FakePortalFixtures
+		}
+		portal, err := newFakePortal(fakePortal)
+		if err != nil {
+			log.Printf("Failed to start fake portal: %v", err)
+			os.Exit(1)
+		}
+		defer portal.Close()
+		PortalURL = portal.Server.URL
+		useBaseTransport(portal.Server.Client().Transport)
+		// The fake portal takes any client, so there's nothing to configure
+		for name, value := range map[string]string{
+			"BASE_URL":      "http://localhost:9001",
+			"CLIENT_ID":     "fake-client",
+			"CLIENT_SECRET": "fake-secret",
+		} {
+			if os.Getenv(name) == "" {
+				os.Setenv(name, value)
+			}
+		}
+	}
+	err := setupCassette()
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	// A recording is only written out when the server stops
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		stopCassette()
+		os.Exit(0)
+	}()
 	BaseURL = os.Getenv("BASE_URL")
 	if BaseURL == "" {
 		log.Println("You must specify a non-empty BASE_URL")
@@ -32,6 +77,20 @@ func main() {
 		os.Exit(1)
 	}
 
+	ServerHosts = parseServerHosts(os.Getenv("ARCGIS_SERVER_HOSTS"))
+
+	WebhookSignatureKey = os.Getenv("WEBHOOK_SIGNATURE_KEY")
+	WebhookUsername = os.Getenv("WEBHOOK_USERNAME")
+	if WebhookSignatureKey == "" {
+		log.Println("WEBHOOK_SIGNATURE_KEY isn't set, webhooks will be rejected")
+	}
+
+	err = loadProjections(projectionsFile())
+	if err != nil {
+		log.Printf("Failed to load projections: %v", err)
+		os.Exit(1)
+	}
+
 	log.Println("Starting...")
 	go loadBabbler()
 	initTokenDatabase()
@@ -43,13 +102,38 @@ func main() {
 	r.Use(sessionManager.LoadAndSave)
 
 	r.Get("/", getRoot)
+	r.Get("/admin/usage", getUsage)
+	r.Get("/admin/usage.csv", getUsageCSV)
+	r.Get("/attachment", getAttachment)
+	r.Get("/attachments", getAttachments)
 	r.Post("/authenticate", postAuthenticate)
 	r.Get("/babble/*", handleBabbleRequest)
+	r.Get("/content", getContent)
 	r.Get("/dashboard", getDashboard)
+	r.Get("/diagnostics", getDiagnostics)
+	r.Get("/export", getExport)
 	r.Get("/favicon.ico", getFavicon)
+	r.Get("/feature", getFeature)
+	r.Post("/feature", postFeature)
+	r.Get("/fieldseeker", getFieldSeeker)
+	r.Post("/fieldseeker", postFieldSeeker)
+	r.Get("/fieldseeker/data", getFieldSeekerData)
+	r.Post("/fieldseeker/sync", postFieldSeekerSync)
+	r.Get("/groups/{id}", getGroup)
+	r.Get("/items/{id}", getItem)
+	r.Get("/layer", getLayer)
 	r.Post("/login", postAuthenticate)
 	r.Get("/oauth-begin", getOAuthBegin)
 	r.Get("/oauth-callback", getOAuthCallback)
+	r.Post("/replicas", postReplica)
+	r.Get("/replicas/{id}", getReplica)
+	r.Post("/replicas/{id}/conflicts/{layer}/{globalID}", postReplicaConflict)
+	r.Post("/replicas/{id}/edits", postReplicaEdits)
+	r.Post("/replicas/{id}/sync", postReplicaSync)
+	r.Post("/sync", postSync)
+	r.Post("/webhooks/arcgis", postWebhook)
 	log.Println("Serving on :9001")
-	http.ListenAndServe(":9001", r)
+	err = http.ListenAndServe(":9001", r)
+	log.Println(err)
+	stopCassette()
 }
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FieldSeekerLayerMatch is the layer of a service that best matches a logical FieldSeeker layer
+type FieldSeekerLayerMatch struct {
+	Name FieldSeekerLayerName `json:"name"`
+	// -1 when the service has nothing that matches
+	LayerID   int     `json:"layerId"`
+	LayerName string  `json:"layerName,omitempty"`
+	Score     float64 `json:"score"`
+	// How many of the model's fields the layer has
+	Fields  int      `json:"fields"`
+	Total   int      `json:"total"`
+	Missing []string `json:"missing,omitempty"`
+}
+
+// FieldSeekerCandidate is a service that might hold FieldSeeker data and how much it looks like it
+type FieldSeekerCandidate struct {
+	Service *ArcGISFeatureService
+	// From 0 for nothing like FieldSeeker to 1 for every layer and field present
+	Score  float64
+	Layers []FieldSeekerLayerMatch
+}
+
+func (c FieldSeekerCandidate) ScorePercent() float64 {
+	return c.Score * 100
+}
+
+// FieldSeekerMapping is the service an organization keeps its FieldSeeker data
+// in and which of its layers and tables are which
+type FieldSeekerMapping struct {
+	OrgID      string                       `json:"orgId"`
+	ItemID     string                       `json:"itemId"`
+	Title      string                       `json:"title"`
+	ServiceURL string                       `json:"serviceUrl"`
+	Layers     map[FieldSeekerLayerName]int `json:"layers"`
+	Score      float64                      `json:"score"`
+	// Whether someone confirmed or changed the mapping, rather than it only being detected
+	Confirmed   bool      `json:"confirmed"`
+	ConfirmedBy string    `json:"confirmedBy,omitempty"`
+	Updated     time.Time `json:"updated"`
+}
+
+// The layer ID of a logical layer, if the service has it
+func (m *FieldSeekerMapping) LayerID(name FieldSeekerLayerName) (int, bool) {
+	if m == nil {
+		return 0, false
+	}
+	id, ok := m.Layers[name]
+	return id, ok
+}
+
+// Every FieldSeeker layer and table, in the order they're shown
+var FieldSeekerLayerNames = []FieldSeekerLayerName{
+	FieldSeekerPointLocation,
+	FieldSeekerLineLocation,
+	FieldSeekerPolygonLocation,
+	FieldSeekerTrapLocation,
+	FieldSeekerSampleLocation,
+	FieldSeekerMosquitoInspection,
+	FieldSeekerTreatment,
+	FieldSeekerTrapData,
+	FieldSeekerSpeciesAbundance,
+	FieldSeekerPool,
+	FieldSeekerPoolDetail,
+	FieldSeekerServiceRequest,
+}
+
+// Other names districts give FieldSeeker layers
+var fieldSeekerLayerAliases = map[FieldSeekerLayerName][]string{
+	FieldSeekerPointLocation:      {"PointLocations", "Point Sites", "Larval Sites"},
+	FieldSeekerLineLocation:       {"LineLocations", "Line Sites"},
+	FieldSeekerPolygonLocation:    {"PolygonLocations", "Polygon Sites", "AreaLocation"},
+	FieldSeekerTrapLocation:       {"TrapLocations", "Traps", "Trap Sites"},
+	FieldSeekerSampleLocation:     {"SampleLocations", "Sample Sites"},
+	FieldSeekerMosquitoInspection: {"MosquitoInspections", "Inspection", "Inspections", "LarvalInspection"},
+	FieldSeekerTreatment:          {"Treatments", "Applications"},
+	FieldSeekerTrapData:           {"TrapCollection", "TrapCollections"},
+	FieldSeekerSpeciesAbundance:   {"Abundance", "TrapSpecies"},
+	FieldSeekerPool:               {"Pools", "MosquitoPool", "LabResults", "PoolResults"},
+	FieldSeekerPoolDetail:         {"PoolDetails", "PoolSpecies"},
+	FieldSeekerServiceRequest:     {"ServiceRequests", "Requests", "ServiceCalls"},
+}
+
+// Location layers can only be told apart by their geometry
+var fieldSeekerGeometryTypes = map[FieldSeekerLayerName]string{
+	FieldSeekerPointLocation:   "esriGeometryPoint",
+	FieldSeekerLineLocation:    "esriGeometryPolyline",
+	FieldSeekerPolygonLocation: "esriGeometryPolygon",
+	FieldSeekerTrapLocation:    "esriGeometryPoint",
+	FieldSeekerSampleLocation:  "esriGeometryPoint",
+}
+
+// A layer matches a logical layer with a score of at least this
+const minFieldSeekerLayerScore = 0.4
+
+// File the mappings of every organization are kept in
+var FieldSeekerMappingsFile = "fieldseeker.mappings"
+
+var fieldSeekerMappingsLock sync.Mutex
+
+// How much a layer's name looks like a logical layer's, from 0 to 1
+func fieldSeekerNameScore(name FieldSeekerLayerName, layerName string) float64 {
+	layerName = normalizeFieldName(layerName)
+	if layerName == normalizeFieldName(string(name)) {
+		return 1
+	}
+	for _, alias := range fieldSeekerLayerAliases[name] {
+		if layerName == normalizeFieldName(alias) {
+			return 0.9
+		}
+	}
+	if strings.Contains(layerName, normalizeFieldName(string(name))) {
+		return 0.6
+	}
+	return 0
+}
+
+// Score how well a layer fits a logical layer on its name and fields
+func scoreFieldSeekerLayer(name FieldSeekerLayerName, layer *ArcGISLayer) FieldSeekerLayerMatch {
+	match := FieldSeekerLayerMatch{Name: name, LayerID: layer.ID, LayerName: layer.Name}
+	if geometryType, ok := fieldSeekerGeometryTypes[name]; ok && layer.GeometryType != geometryType {
+		return match
+	}
+	fields, err := mapFieldSeekerLayer(name, layer)
+	if err != nil {
+		return match
+	}
+	match.Total = fields.Total
+	match.Fields = fields.Total - len(fields.Missing)
+	match.Missing = fields.Missing
+	coverage := float64(match.Fields) / float64(match.Total)
+	match.Score = (fieldSeekerNameScore(name, layer.Name) + coverage) / 2
+	return match
+}
+
+// Fetch every layer and table of a service and match them to the logical
+// FieldSeeker layers, best matches first, so each layer is used once
+func scoreFieldSeekerService(ctx context.Context, access string, service *ArcGISFeatureService) FieldSeekerCandidate {
+	candidate := FieldSeekerCandidate{Service: service}
+	summaries := append(append([]ArcGISLayerSummary(nil), service.LayerDetails...), service.TableDetails...)
+	matches := make([]FieldSeekerLayerMatch, 0)
+	for _, summary := range summaries {
+		layer, err := fetchLayer(ctx, access, service.URL, summary.ID)
+		if err != nil {
+			log.Printf("Not scoring %s/%d: %v", service.URL, summary.ID, err)
+			continue
+		}
+		for _, name := range FieldSeekerLayerNames {
+			match := scoreFieldSeekerLayer(name, layer)
+			if match.Score >= minFieldSeekerLayerScore {
+				matches = append(matches, match)
+			}
+		}
+	}
+	slices.SortStableFunc(matches, func(a, b FieldSeekerLayerMatch) int {
+		switch {
+		case a.Score > b.Score:
+			return -1
+		case a.Score < b.Score:
+			return 1
+		}
+		return 0
+	})
+	byName := make(map[FieldSeekerLayerName]FieldSeekerLayerMatch)
+	usedLayers := make(map[int]bool)
+	for _, match := range matches {
+		if _, ok := byName[match.Name]; ok || usedLayers[match.LayerID] {
+			continue
+		}
+		byName[match.Name] = match
+		usedLayers[match.LayerID] = true
+	}
+	for _, name := range FieldSeekerLayerNames {
+		match, ok := byName[name]
+		if !ok {
+			match = FieldSeekerLayerMatch{Name: name, LayerID: -1}
+		}
+		candidate.Layers = append(candidate.Layers, match)
+		candidate.Score += match.Score
+	}
+	candidate.Score /= float64(len(FieldSeekerLayerNames))
+	return candidate
+}
+
+// Score each feature service in the FieldSeeker search results, most likely first
+func detectFieldSeeker(ctx context.Context, access string, search *ArcGISSearchResponse) []FieldSeekerCandidate {
+	services := discoverFeatureServices(ctx, access, search)
+	candidates := make([]FieldSeekerCandidate, 0, len(services))
+	for i := range services {
+		candidate := scoreFieldSeekerService(ctx, access, &services[i])
+		if candidate.Score > 0 {
+			candidates = append(candidates, candidate)
+		}
+	}
+	slices.SortStableFunc(candidates, func(a, b FieldSeekerCandidate) int {
+		switch {
+		case a.Score > b.Score:
+			return -1
+		case a.Score < b.Score:
+			return 1
+		}
+		return 0
+	})
+	return candidates
+}
+
+// Find the candidate for a service URL, or nil
+func findFieldSeekerCandidate(candidates []FieldSeekerCandidate, serviceURL string) *FieldSeekerCandidate {
+	for i := range candidates {
+		if candidates[i].Service.URL == strings.TrimRight(serviceURL, "/") {
+			return &candidates[i]
+		}
+	}
+	return nil
+}
+
+// Turn a candidate's matches into a mapping for an organization
+func newFieldSeekerMapping(orgID string, candidate FieldSeekerCandidate) FieldSeekerMapping {
+	mapping := FieldSeekerMapping{
+		OrgID:      orgID,
+		ItemID:     candidate.Service.ItemID,
+		Title:      candidate.Service.Title,
+		ServiceURL: candidate.Service.URL,
+		Layers:     make(map[FieldSeekerLayerName]int),
+		Score:      candidate.Score,
+		Updated:    time.Now(),
+	}
+	for _, match := range candidate.Layers {
+		if match.LayerID >= 0 {
+			mapping.Layers[match.Name] = match.LayerID
+		}
+	}
+	return mapping
+}
+
+func loadFieldSeekerMappings() (map[string]FieldSeekerMapping, error) {
+	mappings := make(map[string]FieldSeekerMapping)
+	content, err := os.ReadFile(FieldSeekerMappingsFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return mappings, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read FieldSeeker mappings: %v", err)
+	}
+	err = json.Unmarshal(content, &mappings)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal FieldSeeker mappings: %v", err)
+	}
+	return mappings, nil
+}
+
+// Get the saved mapping of an organization, or nil if there isn't one
+func getFieldSeekerMapping(orgID string) (*FieldSeekerMapping, error) {
+	fieldSeekerMappingsLock.Lock()
+	defer fieldSeekerMappingsLock.Unlock()
+	mappings, err := loadFieldSeekerMappings()
+	if err != nil {
+		return nil, err
+	}
+	mapping, ok := mappings[orgID]
+	if !ok {
+		return nil, nil
+	}
+	return &mapping, nil
+}
+
+// Save the mapping of an organization, replacing any it had
+func putFieldSeekerMapping(mapping FieldSeekerMapping) error {
+	fieldSeekerMappingsLock.Lock()
+	defer fieldSeekerMappingsLock.Unlock()
+	mappings, err := loadFieldSeekerMappings()
+	if err != nil {
+		return err
+	}
+	mappings[mapping.OrgID] = mapping
+	content, err := json.MarshalIndent(mappings, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to marshal FieldSeeker mappings: %v", err)
+	}
+	err = os.WriteFile(FieldSeekerMappingsFile+".tmp", content, 0o600)
+	if err != nil {
+		return fmt.Errorf("Failed to write FieldSeeker mappings: %v", err)
+	}
+	return os.Rename(FieldSeekerMappingsFile+".tmp", FieldSeekerMappingsFile)
+}
+
+// Get the mapping of the signed in user's organization, detecting one if nobody has yet
+func resolveFieldSeekerMapping(ctx context.Context, access string) (*FieldSeekerMapping, error) {
+	user, err := fetchCommunitySelf(ctx, access)
+	if err != nil {
+		return nil, err
+	}
+	mapping, err := getFieldSeekerMapping(user.OrgID)
+	if err != nil || mapping != nil {
+		return mapping, err
+	}
+	search, err := findFieldseeker(ctx, access)
+	if err != nil {
+		return nil, err
+	}
+	return detectedFieldSeekerMapping(user, detectFieldSeeker(ctx, access, search))
+}
+
+// Use the most likely candidate as an organization's mapping until someone
+// confirms one. It's only saved for everyone when an administrator detected
+// it, since other users may not be able to see every service. It's nil when
+// no service looks like FieldSeeker.
+func detectedFieldSeekerMapping(user *ArcGISCommunityUser, candidates []FieldSeekerCandidate) (*FieldSeekerMapping, error) {
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	detected := newFieldSeekerMapping(user.OrgID, candidates[0])
+	if user.Role != "org_admin" {
+		return &detected, nil
+	}
+	err := putFieldSeekerMapping(detected)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Mapped FieldSeeker for %s to %s with score %.2f", user.OrgID, detected.ServiceURL, detected.Score)
+	return &detected, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestResolveFieldSeekerMapping(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	technician := signIn(t, portal, "fake.technician")
+	admin := signIn(t, portal, "fake.admin")
+	ctx := context.Background()
+	user, err := fetchCommunitySelf(ctx, technician.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A technician gets the best match, but it isn't saved for the organization
+	mapping, err := resolveFieldSeekerMapping(ctx, technician.AccessToken)
+	if err != nil {
+		t.Fatalf("Failed to resolve the mapping: %v", err)
+	}
+	if mapping == nil || mapping.ServiceURL != fakeServiceURL() || mapping.Confirmed {
+		t.Fatalf("Got mapping %+v, want an unconfirmed one for the fake service", mapping)
+	}
+	if id, ok := mapping.LayerID(FieldSeekerPointLocation); !ok || id != 0 {
+		t.Errorf("PointLocation is mapped to %d, want layer 0", id)
+	}
+	if saved, err := getFieldSeekerMapping(user.OrgID); err != nil || saved != nil {
+		t.Errorf("A technician's detection was saved as %+v (%v)", saved, err)
+	}
+	w := callAs(t, "fake.technician", http.MethodGet, "/fieldseeker", getFieldSeeker, "/fieldseeker", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "FieldseekerGIS") {
+		t.Errorf("Got status %d without the fake service from the FieldSeeker page", w.Code)
+	}
+	if saved, _ := getFieldSeekerMapping(user.OrgID); saved != nil {
+		t.Error("The FieldSeeker page saved a technician's detection")
+	}
+
+	// An administrator's is
+	if _, err := resolveFieldSeekerMapping(ctx, admin.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := getFieldSeekerMapping(user.OrgID)
+	if err != nil || saved == nil || saved.ServiceURL != fakeServiceURL() {
+		t.Errorf("Saved mapping is %+v (%v), want the administrator's detection", saved, err)
+	}
+
+	// Only administrators can confirm one
+	w = callAs(t, "fake.technician", http.MethodPost, "/fieldseeker", postFieldSeeker, "/fieldseeker", nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Got status %d when a technician confirmed the mapping, want %d", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Directory where local copies of layers are kept
+var MirrorDirectory = "mirror"
+
+// The largest mirror file kept for a layer. Each is read whole into memory to
+// be shown or synced, so layers bigger than this need a real database.
+const maxMirrorBytes = 64 << 20
+
+// LayerMirror is a local copy of every feature in a layer
+type LayerMirror struct {
+	ServiceURL    string `json:"serviceUrl"`
+	LayerID       int    `json:"layerId"`
+	ObjectIDField string `json:"objectIdField"`
+	// The server generation the mirror is current as of
+	ServerGen int64                   `json:"serverGen"`
+	Updated   time.Time               `json:"updated"`
+	Features  map[int64]ArcGISFeature `json:"features"`
+}
+
+// Guards reading and writing each mirror file, keyed by its path. Syncs only
+// hold it while loading and saving, not while pulling from ArcGIS. Two syncs of
+// the same layer can then both save, but either mirror is consistent with the
+// generation it records, and the next sync pulls what changed since.
+var (
+	mirrorLocks     = make(map[string]*sync.Mutex)
+	mirrorLocksLock sync.Mutex
+)
+
+func mirrorFileLock(path string) *sync.Mutex {
+	mirrorLocksLock.Lock()
+	defer mirrorLocksLock.Unlock()
+	lock, ok := mirrorLocks[path]
+	if !ok {
+		lock = &sync.Mutex{}
+		mirrorLocks[path] = lock
+	}
+	return lock
+}
+
+func newLayerMirror(serviceURL string, layerID int, objectIDField string) *LayerMirror {
+	return &LayerMirror{
+		ServiceURL:    serviceURL,
+		LayerID:       layerID,
+		ObjectIDField: objectIDField,
+		Features:      make(map[int64]ArcGISFeature),
+	}
+}
+
+func mirrorPath(serviceURL string, layerID int) string {
+	hash := sha256.Sum256([]byte(serviceURL))
+	return filepath.Join(MirrorDirectory, fmt.Sprintf("%s-%d.json", hex.EncodeToString(hash[:8]), layerID))
+}
+
+// Load the mirror of a layer, or nil if there isn't one yet
+func loadLayerMirror(serviceURL string, layerID int) (*LayerMirror, error) {
+	path := mirrorPath(serviceURL, layerID)
+	lock := mirrorFileLock(path)
+	lock.Lock()
+	content, err := readMirrorFile(path)
+	lock.Unlock()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read mirror: %w", err)
+	}
+	var mirror LayerMirror
+	err = json.Unmarshal(content, &mirror)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal mirror: %v", err)
+	}
+	if mirror.Features == nil {
+		mirror.Features = make(map[int64]ArcGISFeature)
+	}
+	return &mirror, nil
+}
+
+// Read a mirror file, refusing one too big to hold in memory
+func readMirrorFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > maxMirrorBytes {
+		return nil, fmt.Errorf("%s is %d bytes, more than the %d a mirror can have", path, info.Size(), maxMirrorBytes)
+	}
+	return os.ReadFile(path)
+}
+
+// Write the mirror to disk, replacing the previous copy atomically
+func saveLayerMirror(mirror *LayerMirror) error {
+	err := os.MkdirAll(MirrorDirectory, 0o700)
+	if err != nil {
+		return fmt.Errorf("Failed to create mirror directory: %v", err)
+	}
+	content, err := json.Marshal(mirror)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal mirror: %v", err)
+	}
+	if len(content) > maxMirrorBytes {
+		return fmt.Errorf("Mirror of %s/%d is %d bytes, more than the %d a mirror can have", mirror.ServiceURL, mirror.LayerID, len(content), maxMirrorBytes)
+	}
+	path := mirrorPath(mirror.ServiceURL, mirror.LayerID)
+	lock := mirrorFileLock(path)
+	lock.Lock()
+	defer lock.Unlock()
+	err = os.WriteFile(path+".tmp", content, 0o600)
+	if err != nil {
+		return fmt.Errorf("Failed to write mirror: %v", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Add or replace a feature in the mirror
+func (m *LayerMirror) Put(f ArcGISFeature) error {
+	id, ok := f.Attributes[m.ObjectIDField].(float64)
+	if !ok {
+		return fmt.Errorf("Feature has no object ID in %s", m.ObjectIDField)
+	}
+	m.Features[int64(id)] = f
+	return nil
+}
+
+func (m *LayerMirror) Delete(objectID int64) {
+	delete(m.Features, objectID)
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// FieldSeekerLayerName is the logical name of a layer or table in a FieldSeeker service
+type FieldSeekerLayerName string
+
+const (
+	FieldSeekerPointLocation      FieldSeekerLayerName = "PointLocation"
+	FieldSeekerLineLocation       FieldSeekerLayerName = "LineLocation"
+	FieldSeekerPolygonLocation    FieldSeekerLayerName = "PolygonLocation"
+	FieldSeekerTrapLocation       FieldSeekerLayerName = "TrapLocation"
+	FieldSeekerSampleLocation     FieldSeekerLayerName = "SampleLocation"
+	FieldSeekerTrapData           FieldSeekerLayerName = "TrapData"
+	FieldSeekerMosquitoInspection FieldSeekerLayerName = "MosquitoInspection"
+	FieldSeekerTreatment          FieldSeekerLayerName = "Treatment"
+	FieldSeekerServiceRequest     FieldSeekerLayerName = "ServiceRequest"
+	FieldSeekerSpeciesAbundance   FieldSeekerLayerName = "SpeciesAbundance"
+	FieldSeekerPool               FieldSeekerLayerName = "Pool"
+	FieldSeekerPoolDetail         FieldSeekerLayerName = "PoolDetail"
+)
+
+// The model each FieldSeeker layer and table decodes into
+var fieldSeekerModels = map[FieldSeekerLayerName]reflect.Type{
+	FieldSeekerPointLocation:      reflect.TypeFor[PointLocation](),
+	FieldSeekerLineLocation:       reflect.TypeFor[LineLocation](),
+	FieldSeekerPolygonLocation:    reflect.TypeFor[PolygonLocation](),
+	FieldSeekerTrapLocation:       reflect.TypeFor[TrapLocation](),
+	FieldSeekerSampleLocation:     reflect.TypeFor[SampleLocation](),
+	FieldSeekerTrapData:           reflect.TypeFor[TrapData](),
+	FieldSeekerMosquitoInspection: reflect.TypeFor[MosquitoInspection](),
+	FieldSeekerTreatment:          reflect.TypeFor[Treatment](),
+	FieldSeekerServiceRequest:     reflect.TypeFor[ServiceRequest](),
+	FieldSeekerSpeciesAbundance:   reflect.TypeFor[SpeciesAbundance](),
+	FieldSeekerPool:               reflect.TypeFor[Pool](),
+	FieldSeekerPoolDetail:         reflect.TypeFor[PoolDetail](),
+}
+
+// The fields of the models are tagged with the names FieldSeeker usually gives
+// the attribute, the standard one first. Districts rename and re-case fields,
+// so names are compared without case or punctuation, and against aliases too.
+// Fields tagged "-" aren't attributes.
+
+// FieldSeekerRecord has what every FieldSeeker layer and table has
+type FieldSeekerRecord struct {
+	ObjectID int64     `fs:"OBJECTID,FID,OID"`
+	GlobalID string    `fs:"GLOBALID,GLOBAL_ID"`
+	Created  time.Time `fs:"CREATIONDATE,CREATED_DATE,CREATEDATE"`
+	Creator  string    `fs:"CREATOR,CREATED_USER"`
+	Edited   time.Time `fs:"EDITDATE,LAST_EDITED_DATE,EDITEDDATE"`
+	Editor   string    `fs:"EDITOR,LAST_EDITED_USER"`
+	// The geometry as ArcGIS sent it, empty for tables
+	Geometry json.RawMessage `fs:"-"`
+	// Every attribute, including ones the district added
+	Attributes map[string]any `fs:"-"`
+}
+
+// FieldSeekerLocation is a place that gets inspected, trapped or sampled
+type FieldSeekerLocation struct {
+	FieldSeekerRecord
+	Name                string    `fs:"NAME,LOCATIONNAME,LOCNAME"`
+	LocationNumber      string    `fs:"LOCATIONNUMBER,LOCNUMBER,LOCATIONNUM"`
+	Zone                string    `fs:"ZONE,ZONE1"`
+	Zone2               string    `fs:"ZONE2"`
+	Habitat             string    `fs:"HABITAT,HABITATTYPE"`
+	Priority            string    `fs:"PRIORITY"`
+	UseType             string    `fs:"USETYPE"`
+	Active              bool      `fs:"ACTIVE,ISACTIVE"`
+	Description         string    `fs:"DESCRIPTION,DESCR,DESC"`
+	AccessDescription   string    `fs:"ACCESSDESC,ACCESSDESCRIPTION"`
+	Comments            string    `fs:"COMMENTS,COMMENT,NOTES"`
+	LastInspected       time.Time `fs:"LASTINSPECTDATE,LASTINSPDATE"`
+	NextActionScheduled time.Time `fs:"NEXTACTIONDATESCHEDULED,NEXTACTIONDATE"`
+}
+
+type PointLocation struct {
+	FieldSeekerLocation
+}
+
+type LineLocation struct {
+	FieldSeekerLocation
+	Acres      float64 `fs:"ACRES"`
+	LengthFeet float64 `fs:"LENGTH_FT,LENGTHFEET,LENGTH"`
+}
+
+type PolygonLocation struct {
+	FieldSeekerLocation
+	Acres float64 `fs:"ACRES,AREA_ACRES"`
+}
+
+type TrapLocation struct {
+	FieldSeekerLocation
+}
+
+type SampleLocation struct {
+	FieldSeekerLocation
+}
+
+// FieldSeekerVisit is a technician's visit to a point, line or polygon location
+type FieldSeekerVisit struct {
+	FieldSeekerRecord
+	PointLocationID   string    `fs:"POINTLOCID,POINTLOCATIONID,PTLOCID"`
+	LineLocationID    string    `fs:"LINELOCID,LINELOCATIONID"`
+	PolygonLocationID string    `fs:"POLYGONLOCID,POLYGONLOCATIONID,POLYLOCID"`
+	Start             time.Time `fs:"STARTDATETIME,STARTDATE,STARTTIME"`
+	End               time.Time `fs:"ENDDATETIME,ENDDATE,ENDTIME"`
+	FieldTech         string    `fs:"FIELDTECH,TECH,TECHNICIAN"`
+	Zone              string    `fs:"ZONE,ZONE1"`
+	Zone2             string    `fs:"ZONE2"`
+	Comments          string    `fs:"COMMENTS,COMMENT,NOTES"`
+}
+
+// The global ID of the location visited, whichever kind it is
+func (v *FieldSeekerVisit) LocationID() string {
+	switch {
+	case v.PointLocationID != "":
+		return v.PointLocationID
+	case v.LineLocationID != "":
+		return v.LineLocationID
+	}
+	return v.PolygonLocationID
+}
+
+type MosquitoInspection struct {
+	FieldSeekerVisit
+	Dips          int64   `fs:"NUMDIPS,DIPS"`
+	PositiveDips  int64   `fs:"POSDIPS,POSITIVEDIPS"`
+	AverageLarvae float64 `fs:"AVGLARVAE,AVERAGELARVAE"`
+	AveragePupae  float64 `fs:"AVGPUPAE,AVERAGEPUPAE"`
+	LarvalStages  string  `fs:"LSTAGES,LARVALSTAGES"`
+	DominantStage string  `fs:"DOMSTAGE,DOMINANTSTAGE"`
+	Species       string  `fs:"FIELDSPECIES,SPECIES"`
+	SiteCondition string  `fs:"SITECOND,SITECONDITION"`
+	ActionTaken   string  `fs:"ACTIONTAKEN,ACTION"`
+}
+
+type Treatment struct {
+	FieldSeekerVisit
+	InspectionID string  `fs:"INSP_ID,INSPID,INSPECTIONID"`
+	Product      string  `fs:"PRODUCT,MATERIAL"`
+	Quantity     float64 `fs:"QTY,QUANTITY"`
+	QuantityUnit string  `fs:"QTYUNIT,UNIT,UNITS"`
+	Method       string  `fs:"METHOD,APPMETHOD"`
+	Equipment    string  `fs:"EQUIPTYPE,EQUIPMENT"`
+	Activity     string  `fs:"ACTIVITY"`
+	Habitat      string  `fs:"HABITAT"`
+	TreatedArea  float64 `fs:"TREATAREA,TREATEDAREA"`
+	TreatedAcres float64 `fs:"TREATACRES,TREATEDACRES"`
+}
+
+// TrapData is one setting and collection of a trap
+type TrapData struct {
+	FieldSeekerRecord
+	TrapLocationID string    `fs:"LOC_ID,LOCID,TRAPLOCID"`
+	Start          time.Time `fs:"STARTDATETIME,STARTDATE,SETDATE"`
+	End            time.Time `fs:"ENDDATETIME,ENDDATE,COLLECTDATE"`
+	FieldTech      string    `fs:"FIELDTECH,TECH,TECHNICIAN"`
+	TrapType       string    `fs:"TRAPTYPE"`
+	Activity       string    `fs:"TRAPACTIVITYTYPE,TRAPACTIVITY"`
+	TrapNights     float64   `fs:"TRAPNIGHTS"`
+	TrapCondition  string    `fs:"TRAPCONDITION,TRAPCOND"`
+	SiteCondition  string    `fs:"SITECOND,SITECONDITION"`
+	Processed      bool      `fs:"PROCESSED"`
+	Zone           string    `fs:"ZONE,ZONE1"`
+	Zone2          string    `fs:"ZONE2"`
+	Comments       string    `fs:"COMMENTS,COMMENT,NOTES"`
+}
+
+// SpeciesAbundance is how many of one species a trap caught
+type SpeciesAbundance struct {
+	FieldSeekerRecord
+	TrapDataID string `fs:"TRAPDATA_ID,TRAPDATAID"`
+	Species    string `fs:"SPECIES"`
+	Males      int64  `fs:"MALES"`
+	Females    int64  `fs:"FEMALES"`
+	// Ones that couldn't be sexed, kept apart so they aren't counted as females
+	Unknown         int64 `fs:"UNKNOWN,UNKNOWNSEX"`
+	BloodFed        int64 `fs:"BLOODEDFEM,BLOODFED"`
+	Gravid          int64 `fs:"GRAVIDFEM,GRAVID"`
+	Larvae          int64 `fs:"LARVAE"`
+	Pupae           int64 `fs:"PUPAE"`
+	Eggs            int64 `fs:"EGGS"`
+	PoolsToGenerate int64 `fs:"POOLSTOGEN"`
+	Processed       bool  `fs:"PROCESSED"`
+}
+
+// Pool is a pool of mosquitoes sent to a lab and the result of testing it
+type Pool struct {
+	FieldSeekerRecord
+	TrapDataID       string    `fs:"TRAPDATA_ID,TRAPDATAID"`
+	SampleID         string    `fs:"SAMPLEID,POOLNUMBER"`
+	Sent             time.Time `fs:"DATESENT,SENTDATE"`
+	SurveillanceTech string    `fs:"SURVTECH"`
+	Tested           time.Time `fs:"DATETESTED,TESTDATE"`
+	TestTech         string    `fs:"TESTTECH"`
+	Lab              string    `fs:"LAB,LABNAME"`
+	TestMethod       string    `fs:"TESTMETHOD"`
+	Disease          string    `fs:"DISEASETESTED,DISEASE"`
+	Positive         bool      `fs:"DISEASEPOS,POSITIVE,RESULT"`
+	Processed        bool      `fs:"PROCESSED"`
+	Comments         string    `fs:"COMMENTS,COMMENT,NOTES"`
+}
+
+// PoolDetail is how many of one species went into a pool
+type PoolDetail struct {
+	FieldSeekerRecord
+	PoolID     string `fs:"POOL_ID,POOLID"`
+	TrapDataID string `fs:"TRAPDATA_ID,TRAPDATAID"`
+	Species    string `fs:"SPECIES"`
+	Females    int64  `fs:"FEMALES,COUNT"`
+}
+
+type ServiceRequest struct {
+	FieldSeekerRecord
+	Received        time.Time `fs:"RECDATETIME,RECEIVEDDATE,REQDATE"`
+	Source          string    `fs:"SOURCE,REQSOURCE"`
+	Status          string    `fs:"STATUS"`
+	Priority        string    `fs:"PRIORITY"`
+	AssignedTech    string    `fs:"ASSIGNEDTECH,TECH"`
+	Name            string    `fs:"REQNAME,NAME"`
+	Company         string    `fs:"REQCOMPANY,COMPANY"`
+	Address         string    `fs:"REQADDR1,REQADDRESS,ADDRESS"`
+	Address2        string    `fs:"REQADDR2"`
+	City            string    `fs:"REQCITY,CITY"`
+	State           string    `fs:"REQSTATE,STATE"`
+	ZIP             string    `fs:"REQZIP,ZIP,ZIPCODE"`
+	Phone           string    `fs:"REQPHONE,REQPHONE1,PHONE"`
+	Email           string    `fs:"REQEMAIL,EMAIL"`
+	Target          string    `fs:"REQTARGET,TARGET"`
+	Description     string    `fs:"REQDESCR,DESCRIPTION"`
+	NotesForTech    string    `fs:"REQNOTESFORTECH"`
+	Closed          time.Time `fs:"DATETIMECLOSED,CLOSEDDATE"`
+	PointLocationID string    `fs:"POINTLOCID,POINTLOCATIONID"`
+	Zone            string    `fs:"ZONE,ZONE1"`
+	Zone2           string    `fs:"ZONE2"`
+}
+
+func (s *ServiceRequest) IsOpen() bool {
+	return s.Closed.IsZero()
+}
+
+// fieldSeekerField is where one attribute goes in a model
+type fieldSeekerField struct {
+	index     []int
+	attribute string
+}
+
+// FieldSeekerFields maps the fields of a model to the attributes of one layer
+type FieldSeekerFields struct {
+	model  reflect.Type
+	fields []fieldSeekerField
+	// The standard names of the model's fields the layer doesn't have
+	Missing []string
+	// How many of the model's fields there are, found or not
+	Total int
+}
+
+// Compare field names the way districts vary them: any case, with or without underscores and spaces
+func normalizeFieldName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToUpper(r))
+		}
+	}
+	return b.String()
+}
+
+// Work out which attribute each field of a model comes from. The object ID and
+// global ID fields are taken from the layer when it says what they are.
+func mapFieldSeekerFields(model reflect.Type, fields []ArcGISField, objectIDField string, globalIDField string) *FieldSeekerFields {
+	byName := make(map[string]string)
+	byAlias := make(map[string]string)
+	for _, f := range fields {
+		byName[normalizeFieldName(f.Name)] = f.Name
+		if f.Alias != "" {
+			if _, ok := byAlias[normalizeFieldName(f.Alias)]; !ok {
+				byAlias[normalizeFieldName(f.Alias)] = f.Name
+			}
+		}
+	}
+	result := &FieldSeekerFields{model: model}
+	for _, sf := range reflect.VisibleFields(model) {
+		tag, ok := sf.Tag.Lookup("fs")
+		if !ok || tag == "-" || sf.Anonymous {
+			continue
+		}
+		candidates := strings.Split(tag, ",")
+		attribute := ""
+		switch {
+		case sf.Name == "ObjectID" && objectIDField != "":
+			attribute = objectIDField
+		case sf.Name == "GlobalID" && globalIDField != "":
+			attribute = globalIDField
+		}
+		for _, c := range candidates {
+			if attribute != "" {
+				break
+			}
+			attribute = byName[normalizeFieldName(c)]
+		}
+		for _, c := range candidates {
+			if attribute != "" {
+				break
+			}
+			attribute = byAlias[normalizeFieldName(c)]
+		}
+		result.Total++
+		if attribute == "" {
+			result.Missing = append(result.Missing, candidates[0])
+			continue
+		}
+		result.fields = append(result.fields, fieldSeekerField{index: sf.Index, attribute: attribute})
+	}
+	return result
+}
+
+// Fill in a model from a feature, which must be a pointer to the mapped model
+func (m *FieldSeekerFields) decode(f ArcGISFeature, model any) error {
+	v := reflect.ValueOf(model).Elem()
+	if v.Type() != m.model {
+		return fmt.Errorf("Fields are mapped for %s, not %s", m.model, v.Type())
+	}
+	record := v.FieldByName("FieldSeekerRecord").Addr().Interface().(*FieldSeekerRecord)
+	record.Geometry = f.Geometry
+	record.Attributes = f.Attributes
+	for _, field := range m.fields {
+		value, ok := f.Attributes[field.attribute]
+		if !ok || value == nil {
+			continue
+		}
+		err := setFieldSeekerValue(v.FieldByIndex(field.index), value)
+		if err != nil {
+			return fmt.Errorf("Failed to decode %s: %v", field.attribute, err)
+		}
+	}
+	return nil
+}
+
+// Set a model field from an attribute, converting the way FieldSeeker data needs
+func setFieldSeekerValue(field reflect.Value, value any) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(formatAttribute(value))
+	case reflect.Int64:
+		n, err := attributeFloat(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Float64:
+		n, err := attributeFloat(value)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(n)
+	case reflect.Bool:
+		b, err := attributeBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Struct:
+		t, err := attributeTime(value)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(t))
+	default:
+		return fmt.Errorf("Can't decode into %s", field.Type())
+	}
+	return nil
+}
+
+// Numbers come as JSON numbers, except in districts that stored them as text
+func attributeFloat(value any) (float64, error) {
+	if n, ok := toFloat(value); ok {
+		return n, nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return 0, fmt.Errorf("'%v' isn't a number", value)
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' isn't a number", s)
+	}
+	return n, nil
+}
+
+// Flags are small integers in the standard schema, and yes/no text or
+// coded values in others
+func attributeBool(value any) (bool, error) {
+	if n, ok := toFloat(value); ok {
+		return n != 0, nil
+	}
+	if b, ok := value.(bool); ok {
+		return b, nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return false, fmt.Errorf("'%v' isn't true or false", value)
+	}
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "y", "yes", "t", "true", "pos", "positive":
+		return true, nil
+	case "", "0", "n", "no", "f", "false", "neg", "negative":
+		return false, nil
+	}
+	return false, fmt.Errorf("'%s' isn't true or false", s)
+}
+
+// Dates are epoch milliseconds, or text when the layer was loaded from a spreadsheet
+func attributeTime(value any) (time.Time, error) {
+	if n, ok := toFloat(value); ok {
+		return time.UnixMilli(int64(n)).UTC(), nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("'%v' isn't a date", value)
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly, "1/2/2006 3:04:05 PM", "1/2/2006"} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("'%s' isn't a date", s)
+}
+
+// The fields a query response has, or the attribute names of its features when
+// the response doesn't list them
+func queryResponseFields(response *ArcGISQueryResponse) []ArcGISField {
+	if len(response.Fields) > 0 {
+		return response.Fields
+	}
+	seen := make(map[string]bool)
+	fields := make([]ArcGISField, 0)
+	for _, f := range response.Features {
+		for name := range f.Attributes {
+			if !seen[name] {
+				seen[name] = true
+				fields = append(fields, ArcGISField{Name: name})
+			}
+		}
+	}
+	return fields
+}
+
+// Map the fields of a FieldSeeker layer's model to the layer's schema
+func mapFieldSeekerLayer(name FieldSeekerLayerName, layer *ArcGISLayer) (*FieldSeekerFields, error) {
+	model, ok := fieldSeekerModels[name]
+	if !ok {
+		return nil, fmt.Errorf("'%s' isn't a FieldSeeker layer", name)
+	}
+	return mapFieldSeekerFields(model, layer.Fields, layer.ObjectIDField, layer.GlobalIDField), nil
+}
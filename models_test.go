@@ -0,0 +1,134 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Decode one feature into a model, with fields mapped from the given schema
+func decodeTestRecord[T any](t *testing.T, fields []ArcGISField, objectIDField string, attributes map[string]any) (T, *FieldSeekerFields) {
+	t.Helper()
+	var model T
+	mapped := mapFieldSeekerFields(reflect.TypeFor[T](), fields, objectIDField, "")
+	if err := mapped.decode(ArcGISFeature{Attributes: attributes}, &model); err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	return model, mapped
+}
+
+func namedFields(names ...string) []ArcGISField {
+	fields := make([]ArcGISField, 0, len(names))
+	for _, name := range names {
+		fields = append(fields, ArcGISField{Name: name})
+	}
+	return fields
+}
+
+func TestSpeciesAbundanceStandardSchema(t *testing.T) {
+	fields := namedFields("OBJECTID", "GLOBALID", "TRAPDATA_ID", "SPECIES", "MALES", "FEMALES", "UNKNOWN", "BLOODEDFEM", "GRAVIDFEM", "LARVAE", "PUPAE", "EGGS", "POOLSTOGEN", "PROCESSED", "CREATIONDATE", "CREATOR", "EDITDATE", "EDITOR")
+	attributes := map[string]any{
+		"OBJECTID": float64(7), "GLOBALID": "{A1}", "TRAPDATA_ID": "{T1}", "SPECIES": "Culex tarsalis",
+		"MALES": float64(4), "FEMALES": float64(12), "UNKNOWN": float64(3), "BLOODEDFEM": float64(2),
+		"PROCESSED": float64(1), "CREATIONDATE": float64(1717200000000),
+	}
+	got, mapped := decodeTestRecord[SpeciesAbundance](t, fields, "OBJECTID", attributes)
+	if len(mapped.Missing) != 0 {
+		t.Errorf("Standard schema is missing %v", mapped.Missing)
+	}
+	// Unsexed mosquitoes aren't females
+	if got.Males != 4 || got.Females != 12 || got.Unknown != 3 || got.BloodFed != 2 {
+		t.Errorf("Got %d males, %d females, %d unknown and %d blood fed, want 4, 12, 3 and 2", got.Males, got.Females, got.Unknown, got.BloodFed)
+	}
+	if got.ObjectID != 7 || got.GlobalID != "{A1}" || got.TrapDataID != "{T1}" || got.Species != "Culex tarsalis" || !got.Processed {
+		t.Errorf("Got %+v", got)
+	}
+	if !got.Created.Equal(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Created %s, want 2024-06-01", got.Created)
+	}
+	if got.Attributes["BLOODEDFEM"] != float64(2) {
+		t.Error("The raw attributes weren't kept")
+	}
+}
+
+func TestFieldSeekerSchemaVariations(t *testing.T) {
+	// Renamed, re-cased and aliased fields, numbers and flags stored as text,
+	// dates from a spreadsheet and an object ID field with another name
+	fields := []ArcGISField{
+		{Name: "FID_1"},
+		{Name: "trap_data_id"},
+		{Name: "Species"},
+		{Name: "Males"},
+		{Name: "F_COUNT", Alias: "Females"},
+		{Name: "unknown_sex"},
+		{Name: "Processed"},
+		{Name: "created_date"},
+	}
+	attributes := map[string]any{
+		"FID_1": float64(3), "trap_data_id": "{T2}", "Species": "Aedes aegypti", "Males": " 5 ",
+		"F_COUNT": "9", "unknown_sex": nil, "Processed": "Yes", "created_date": "6/3/2024",
+	}
+	got, mapped := decodeTestRecord[SpeciesAbundance](t, fields, "FID_1", attributes)
+	if got.ObjectID != 3 || got.TrapDataID != "{T2}" || got.Species != "Aedes aegypti" || got.Males != 5 || got.Females != 9 || got.Unknown != 0 || !got.Processed {
+		t.Errorf("Got %+v", got)
+	}
+	if !got.Created.Equal(time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Created %s, want 2024-06-03", got.Created)
+	}
+	// What the layer doesn't have is listed by its standard name
+	for _, name := range []string{"BLOODEDFEM", "EGGS", "GLOBALID", "EDITDATE"} {
+		if !slices.Contains(mapped.Missing, name) {
+			t.Errorf("Missing fields %v don't include %s", mapped.Missing, name)
+		}
+	}
+	if slices.Contains(mapped.Missing, "UNKNOWN") {
+		t.Error("UNKNOWNSEX wasn't used for the unknown count")
+	}
+	if mapped.Total-len(mapped.Missing) != 8 {
+		t.Errorf("Mapped %d of %d fields, want 8", mapped.Total-len(mapped.Missing), mapped.Total)
+	}
+
+	// The same field names mean different things in different tables
+	detail, _ := decodeTestRecord[PoolDetail](t, namedFields("POOLID", "SPECIES", "COUNT"), "", map[string]any{"POOLID": "{P1}", "SPECIES": "Culex pipiens", "COUNT": float64(50)})
+	if detail.PoolID != "{P1}" || detail.Females != 50 {
+		t.Errorf("Got pool detail %+v, want 50 females in {P1}", detail)
+	}
+}
+
+func TestFieldSeekerDecodeErrors(t *testing.T) {
+	fields := namedFields("MALES", "PROCESSED", "CREATIONDATE")
+	mapped := mapFieldSeekerFields(reflect.TypeFor[SpeciesAbundance](), fields, "", "")
+	for _, attributes := range []map[string]any{
+		{"MALES": "a few"},
+		{"PROCESSED": "maybe"},
+		{"CREATIONDATE": "last Tuesday"},
+	} {
+		var got SpeciesAbundance
+		if err := mapped.decode(ArcGISFeature{Attributes: attributes}, &got); err == nil {
+			t.Errorf("Decoded %v without an error", attributes)
+		}
+	}
+	var wrong Pool
+	if err := mapped.decode(ArcGISFeature{Attributes: map[string]any{}}, &wrong); err == nil {
+		t.Error("Decoded into a model the fields weren't mapped for")
+	}
+}
+
+func TestMapFieldSeekerLayer(t *testing.T) {
+	layer := &ArcGISLayer{ObjectIDField: "OBJECTID", Fields: namedFields("OBJECTID", "SPECIES")}
+	if _, err := mapFieldSeekerLayer("Birds", layer); err == nil {
+		t.Error("Mapped a layer FieldSeeker doesn't have")
+	}
+	// Every model can be mapped, and has fields beyond the common ones
+	for name, model := range fieldSeekerModels {
+		mapped, err := mapFieldSeekerLayer(name, layer)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if mapped.model != model || mapped.Total <= 6 {
+			t.Errorf("%s has %d fields", name, mapped.Total)
+		}
+	}
+}
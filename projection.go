@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"sync"
+)
+
+// Well known IDs of the coordinate systems we always know about
+const (
+	WKIDWGS84        = 4326
+	WKIDWebMercator  = 3857
+	WKIDEsriMercator = 102100
+)
+
+// GRS80, which NAD83 State Plane zones use. The difference from WGS84 is well
+// under a millimeter, and we ignore the datum shift between NAD83 and WGS84,
+// which is around a meter in the continental US.
+const (
+	grs80SemiMajor  = 6378137.0
+	grs80Flattening = 1 / 298.257222101
+)
+
+// Projection methods for ProjectionDefinition
+const (
+	ProjectionLambertConformalConic = "lcc"
+	ProjectionTransverseMercator    = "tm"
+)
+
+// The length of a US survey foot in meters, for State Plane zones in feet
+const USSurveyFoot = 1200.0 / 3937.0
+
+// ProjectionDefinition describes a State Plane style projected coordinate
+// system. Angles are in degrees, false easting and northing in the
+// coordinate system's units.
+type ProjectionDefinition struct {
+	WKID              int     `json:"wkid"`
+	Name              string  `json:"name"`
+	Method            string  `json:"method"`
+	CentralMeridian   float64 `json:"centralMeridian"`
+	LatitudeOfOrigin  float64 `json:"latitudeOfOrigin"`
+	StandardParallel1 float64 `json:"standardParallel1"`
+	StandardParallel2 float64 `json:"standardParallel2"`
+	ScaleFactor       float64 `json:"scaleFactor"`
+	FalseEasting      float64 `json:"falseEasting"`
+	FalseNorthing     float64 `json:"falseNorthing"`
+	// Meters per unit, 1 for meters or USSurveyFoot for US feet
+	UnitToMeter float64 `json:"unitToMeter"`
+	// Other WKIDs for the same coordinate system, like Esri's 1026xx codes
+	Aliases []int `json:"aliases"`
+	// Esri well known text, written to .prj files
+	WKT string `json:"wkt"`
+}
+
+// Projection converts between geographic WGS84 coordinates and a projected coordinate system
+type Projection interface {
+	// Longitude and latitude in degrees to projected x and y
+	Forward(lon float64, lat float64) (float64, float64)
+	// Projected x and y to longitude and latitude in degrees
+	Inverse(x float64, y float64) (float64, float64)
+}
+
+// Configured projections and their well known text, keyed by WKID
+var (
+	projections     = make(map[int]Projection)
+	projectionWKTs  = make(map[int]string)
+	projectionsLock sync.RWMutex
+)
+
+// Esri well known text of the coordinate systems we always know about
+const (
+	wktWGS84       = `GEOGCS["GCS_WGS_1984",DATUM["D_WGS_1984",SPHEROID["WGS_1984",6378137.0,298.257223563]],PRIMEM["Greenwich",0.0],UNIT["Degree",0.0174532925199433]]`
+	wktWebMercator = `PROJCS["WGS_1984_Web_Mercator_Auxiliary_Sphere",` + wktWGS84 + `,PROJECTION["Mercator_Auxiliary_Sphere"],PARAMETER["False_Easting",0.0],PARAMETER["False_Northing",0.0],PARAMETER["Central_Meridian",0.0],PARAMETER["Standard_Parallel_1",0.0],PARAMETER["Auxiliary_Sphere_Type",0.0],UNIT["Meter",1.0]]`
+)
+
+// The file loadProjections reads, from PROJECTIONS_FILE
+func projectionsFile() string {
+	path := os.Getenv("PROJECTIONS_FILE")
+	if path == "" {
+		path = "projections.json"
+	}
+	return path
+}
+
+// Load State Plane definitions from a JSON file holding a list of ProjectionDefinition.
+// It's fine for the file not to exist.
+func loadProjections(path string) error {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read projections: %v", err)
+	}
+	var definitions []ProjectionDefinition
+	err = json.Unmarshal(content, &definitions)
+	if err != nil {
+		return fmt.Errorf("Failed to unmarshal projections: %v", err)
+	}
+	for _, d := range definitions {
+		err := addProjection(d)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Loaded %d projections from %s", len(definitions), path)
+	return nil
+}
+
+func addProjection(d ProjectionDefinition) error {
+	if d.UnitToMeter == 0 {
+		d.UnitToMeter = 1
+	}
+	var p Projection
+	switch d.Method {
+	case ProjectionLambertConformalConic:
+		if d.StandardParallel1 == 0 && d.StandardParallel2 == 0 {
+			// One standard parallel definitions only give the latitude of origin
+			d.StandardParallel1, d.StandardParallel2 = d.LatitudeOfOrigin, d.LatitudeOfOrigin
+		}
+		if d.StandardParallel1 == -d.StandardParallel2 {
+			// The cone would be flat, which takes a different projection
+			return fmt.Errorf("Lambert Conformal Conic %d needs its standard parallels on the same side of the equator", d.WKID)
+		}
+		p = newLambertConformalConic(d)
+	case ProjectionTransverseMercator:
+		if d.ScaleFactor == 0 {
+			d.ScaleFactor = 1
+		}
+		p = newTransverseMercator(d)
+	default:
+		return fmt.Errorf("Unknown projection method '%s' for %d", d.Method, d.WKID)
+	}
+	projectionsLock.Lock()
+	defer projectionsLock.Unlock()
+	projections[d.WKID] = p
+	for _, alias := range d.Aliases {
+		projections[alias] = p
+	}
+	if d.WKT != "" {
+		projectionWKTs[d.WKID] = d.WKT
+		for _, alias := range d.Aliases {
+			projectionWKTs[alias] = d.WKT
+		}
+	}
+	return nil
+}
+
+// Get the Esri well known text of a spatial reference, for .prj files
+func projectionWKT(sr ArcGISSpatialReference) (string, error) {
+	if sr.WKT != "" {
+		return sr.WKT, nil
+	}
+	wkid := normalizeWKID(sr)
+	switch wkid {
+	case WKIDWGS84:
+		return wktWGS84, nil
+	case WKIDWebMercator:
+		return wktWebMercator, nil
+	}
+	projectionsLock.RLock()
+	defer projectionsLock.RUnlock()
+	wkt, ok := projectionWKTs[wkid]
+	if !ok {
+		return "", fmt.Errorf("No well known text for WKID %d", wkid)
+	}
+	return wkt, nil
+}
+
+func normalizeWKID(sr ArcGISSpatialReference) int {
+	wkid := sr.LatestWKID
+	if wkid == 0 {
+		wkid = sr.WKID
+	}
+	switch wkid {
+	case WKIDEsriMercator, 102113, 900913:
+		return WKIDWebMercator
+	case 0:
+		// ArcGIS leaves it out when the data is in geographic coordinates
+		return WKIDWGS84
+	}
+	return wkid
+}
+
+func findProjection(wkid int) (Projection, error) {
+	switch wkid {
+	case WKIDWGS84:
+		return nil, nil
+	case WKIDWebMercator:
+		return webMercator{}, nil
+	}
+	projectionsLock.RLock()
+	defer projectionsLock.RUnlock()
+	p, ok := projections[wkid]
+	if !ok {
+		return nil, fmt.Errorf("Don't know how to project WKID %d", wkid)
+	}
+	return p, nil
+}
+
+// Make a function that converts coordinates between two spatial references,
+// leaving any z and m values alone
+func coordinateTransform(from ArcGISSpatialReference, to ArcGISSpatialReference) (func(Coordinate) Coordinate, error) {
+	fromWKID := normalizeWKID(from)
+	toWKID := normalizeWKID(to)
+	if fromWKID == toWKID {
+		return func(c Coordinate) Coordinate { return c }, nil
+	}
+	source, err := findProjection(fromWKID)
+	if err != nil {
+		return nil, err
+	}
+	destination, err := findProjection(toWKID)
+	if err != nil {
+		return nil, err
+	}
+	return func(c Coordinate) Coordinate {
+		x, y := c[0], c[1]
+		if source != nil {
+			x, y = source.Inverse(x, y)
+		}
+		if destination != nil {
+			x, y = destination.Forward(x, y)
+		}
+		c[0], c[1] = x, y
+		return c
+	}, nil
+}
+
+// Make a copy of the geometry in another spatial reference
+func projectGeometry(g *ArcGISGeometry, from ArcGISSpatialReference, to ArcGISSpatialReference) (*ArcGISGeometry, error) {
+	if g == nil {
+		return nil, nil
+	}
+	if g.SpatialReference != nil {
+		from = *g.SpatialReference
+	}
+	transform, err := coordinateTransform(from, to)
+	if err != nil {
+		return nil, err
+	}
+	result := g.transform(transform)
+	result.SpatialReference = &to
+	return result, nil
+}
+
+// Reproject the geometry of a feature in place
+func (f *ArcGISFeature) Project(geometryType string, from ArcGISSpatialReference, to ArcGISSpatialReference) error {
+	g, err := f.DecodeGeometry(geometryType)
+	if err != nil || g == nil {
+		return err
+	}
+	projected, err := projectGeometry(g, from, to)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(projected)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal geometry: %v", err)
+	}
+	f.Geometry = raw
+	return nil
+}
+
+func radians(d float64) float64 {
+	return d * math.Pi / 180
+}
+
+func degrees(r float64) float64 {
+	return r * 180 / math.Pi
+}
+
+// Spherical Web Mercator, as used by 3857 and 102100
+type webMercator struct{}
+
+// Web Mercator can't show the poles
+const maxWebMercatorLatitude = 85.05112877980659
+
+func (webMercator) Forward(lon float64, lat float64) (float64, float64) {
+	lat = math.Max(-maxWebMercatorLatitude, math.Min(maxWebMercatorLatitude, lat))
+	x := grs80SemiMajor * radians(lon)
+	y := grs80SemiMajor * math.Log(math.Tan(math.Pi/4+radians(lat)/2))
+	return x, y
+}
+
+func (webMercator) Inverse(x float64, y float64) (float64, float64) {
+	lon := degrees(x / grs80SemiMajor)
+	lat := degrees(math.Pi/2 - 2*math.Atan(math.Exp(-y/grs80SemiMajor)))
+	return lon, lat
+}
+
+// Ellipsoidal Lambert Conformal Conic with one or two standard parallels,
+// following Snyder's "Map Projections: A Working Manual"
+type lambertConformalConic struct {
+	d    ProjectionDefinition
+	e    float64
+	n    float64
+	f    float64
+	rho0 float64
+}
+
+func newLambertConformalConic(d ProjectionDefinition) *lambertConformalConic {
+	e := math.Sqrt(2*grs80Flattening - grs80Flattening*grs80Flattening)
+	m := func(phi float64) float64 {
+		return math.Cos(phi) / math.Sqrt(1-e*e*math.Sin(phi)*math.Sin(phi))
+	}
+	t := func(phi float64) float64 {
+		es := e * math.Sin(phi)
+		return math.Tan(math.Pi/4-phi/2) / math.Pow((1-es)/(1+es), e/2)
+	}
+	phi1 := radians(d.StandardParallel1)
+	phi2 := radians(d.StandardParallel2)
+	phi0 := radians(d.LatitudeOfOrigin)
+	var n float64
+	if d.StandardParallel1 == d.StandardParallel2 {
+		n = math.Sin(phi1)
+	} else {
+		n = (math.Log(m(phi1)) - math.Log(m(phi2))) / (math.Log(t(phi1)) - math.Log(t(phi2)))
+	}
+	f := m(phi1) / (n * math.Pow(t(phi1), n))
+	p := lambertConformalConic{d: d, e: e, n: n, f: f}
+	p.rho0 = grs80SemiMajor * f * math.Pow(t(phi0), n)
+	if d.StandardParallel1 == d.StandardParallel2 && d.ScaleFactor != 0 {
+		// One standard parallel with a scale factor, as in some older zones
+		p.f *= d.ScaleFactor
+		p.rho0 *= d.ScaleFactor
+	}
+	return &p
+}
+
+func (p *lambertConformalConic) t(phi float64) float64 {
+	es := p.e * math.Sin(phi)
+	return math.Tan(math.Pi/4-phi/2) / math.Pow((1-es)/(1+es), p.e/2)
+}
+
+func (p *lambertConformalConic) Forward(lon float64, lat float64) (float64, float64) {
+	rho := grs80SemiMajor * p.f * math.Pow(p.t(radians(lat)), p.n)
+	theta := p.n * radians(lon-p.d.CentralMeridian)
+	x := rho * math.Sin(theta)
+	y := p.rho0 - rho*math.Cos(theta)
+	return x/p.d.UnitToMeter + p.d.FalseEasting, y/p.d.UnitToMeter + p.d.FalseNorthing
+}
+
+func (p *lambertConformalConic) Inverse(x float64, y float64) (float64, float64) {
+	x = (x - p.d.FalseEasting) * p.d.UnitToMeter
+	y = (y - p.d.FalseNorthing) * p.d.UnitToMeter
+	sign := 1.0
+	if p.n < 0 {
+		sign = -1
+	}
+	rho := sign * math.Hypot(x, p.rho0-y)
+	theta := math.Atan2(sign*x, sign*(p.rho0-y))
+	t := math.Pow(rho/(grs80SemiMajor*p.f), 1/p.n)
+	lon := degrees(theta/p.n) + p.d.CentralMeridian
+	phi := math.Pi/2 - 2*math.Atan(t)
+	for range 15 {
+		es := p.e * math.Sin(phi)
+		next := math.Pi/2 - 2*math.Atan(t*math.Pow((1-es)/(1+es), p.e/2))
+		if math.Abs(next-phi) < 1e-12 {
+			phi = next
+			break
+		}
+		phi = next
+	}
+	return lon, degrees(phi)
+}
+
+// Ellipsoidal Transverse Mercator, also from Snyder
+type transverseMercator struct {
+	d   ProjectionDefinition
+	e2  float64
+	ep2 float64
+	m0  float64
+}
+
+func newTransverseMercator(d ProjectionDefinition) *transverseMercator {
+	e2 := 2*grs80Flattening - grs80Flattening*grs80Flattening
+	p := transverseMercator{d: d, e2: e2, ep2: e2 / (1 - e2)}
+	p.m0 = p.meridianArc(radians(d.LatitudeOfOrigin))
+	return &p
+}
+
+// Distance along the meridian from the equator to a latitude
+func (p *transverseMercator) meridianArc(phi float64) float64 {
+	e2 := p.e2
+	e4 := e2 * e2
+	e6 := e4 * e2
+	return grs80SemiMajor * ((1-e2/4-3*e4/64-5*e6/256)*phi -
+		(3*e2/8+3*e4/32+45*e6/1024)*math.Sin(2*phi) +
+		(15*e4/256+45*e6/1024)*math.Sin(4*phi) -
+		(35*e6/3072)*math.Sin(6*phi))
+}
+
+func (p *transverseMercator) Forward(lon float64, lat float64) (float64, float64) {
+	phi := radians(lat)
+	k0 := p.d.ScaleFactor
+	sin, cos, tan := math.Sin(phi), math.Cos(phi), math.Tan(phi)
+	n := grs80SemiMajor / math.Sqrt(1-p.e2*sin*sin)
+	t := tan * tan
+	c := p.ep2 * cos * cos
+	a := radians(lon-p.d.CentralMeridian) * cos
+	m := p.meridianArc(phi)
+	x := k0 * n * (a + (1-t+c)*math.Pow(a, 3)/6 + (5-18*t+t*t+72*c-58*p.ep2)*math.Pow(a, 5)/120)
+	y := k0 * (m - p.m0 + n*tan*(a*a/2+(5-t+9*c+4*c*c)*math.Pow(a, 4)/24+(61-58*t+t*t+600*c-330*p.ep2)*math.Pow(a, 6)/720))
+	return x/p.d.UnitToMeter + p.d.FalseEasting, y/p.d.UnitToMeter + p.d.FalseNorthing
+}
+
+func (p *transverseMercator) Inverse(x float64, y float64) (float64, float64) {
+	x = (x - p.d.FalseEasting) * p.d.UnitToMeter
+	y = (y - p.d.FalseNorthing) * p.d.UnitToMeter
+	k0 := p.d.ScaleFactor
+	e2 := p.e2
+	e4 := e2 * e2
+	e6 := e4 * e2
+	m := p.m0 + y/k0
+	mu := m / (grs80SemiMajor * (1 - e2/4 - 3*e4/64 - 5*e6/256))
+	e1 := (1 - math.Sqrt(1-e2)) / (1 + math.Sqrt(1-e2))
+	phi1 := mu + (3*e1/2-27*math.Pow(e1, 3)/32)*math.Sin(2*mu) +
+		(21*e1*e1/16-55*math.Pow(e1, 4)/32)*math.Sin(4*mu) +
+		(151*math.Pow(e1, 3)/96)*math.Sin(6*mu) +
+		(1097*math.Pow(e1, 4)/512)*math.Sin(8*mu)
+	sin, cos, tan := math.Sin(phi1), math.Cos(phi1), math.Tan(phi1)
+	c1 := p.ep2 * cos * cos
+	t1 := tan * tan
+	n1 := grs80SemiMajor / math.Sqrt(1-e2*sin*sin)
+	r1 := grs80SemiMajor * (1 - e2) / math.Pow(1-e2*sin*sin, 1.5)
+	d := x / (n1 * k0)
+	phi := phi1 - (n1*tan/r1)*(d*d/2-
+		(5+3*t1+10*c1-4*c1*c1-9*p.ep2)*math.Pow(d, 4)/24+
+		(61+90*t1+298*c1+45*t1*t1-252*p.ep2-3*c1*c1)*math.Pow(d, 6)/720)
+	lon := (d - (1+2*t1+c1)*math.Pow(d, 3)/6 +
+		(5-2*c1+28*t1-3*c1*c1+8*p.ep2+24*t1*t1)*math.Pow(d, 5)/120) / cos
+	return degrees(lon) + p.d.CentralMeridian, degrees(phi)
+}
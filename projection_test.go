@@ -0,0 +1,135 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// NAD83 zones in the Central Valley, as EPSG defines them
+var (
+	utmZone11 = ProjectionDefinition{
+		WKID: 26911, Name: "NAD83 / UTM zone 11N", Method: ProjectionTransverseMercator,
+		CentralMeridian: -117, ScaleFactor: 0.9996, FalseEasting: 500000,
+	}
+	californiaZone3 = ProjectionDefinition{
+		WKID: 26943, Name: "NAD83 / California zone 3", Method: ProjectionLambertConformalConic,
+		CentralMeridian: -120.5, LatitudeOfOrigin: 36.5,
+		StandardParallel1: 38 + 26.0/60, StandardParallel2: 37 + 4.0/60,
+		FalseEasting: 2000000, FalseNorthing: 500000,
+	}
+	californiaZone3Feet = ProjectionDefinition{
+		WKID: 2227, Name: "NAD83 / California zone 3 (ftUS)", Method: ProjectionLambertConformalConic,
+		CentralMeridian: -120.5, LatitudeOfOrigin: 36.5,
+		StandardParallel1: 38 + 26.0/60, StandardParallel2: 37 + 4.0/60,
+		FalseEasting: 6561666.667, FalseNorthing: 1640416.667, UnitToMeter: USSurveyFoot,
+	}
+	// Lambert with one standard parallel, given only as the latitude of origin
+	lambertOneParallel = ProjectionDefinition{
+		WKID: 999001, Name: "Test 1SP", Method: ProjectionLambertConformalConic,
+		CentralMeridian: -120, LatitudeOfOrigin: 37, ScaleFactor: 0.9999,
+		FalseEasting: 500000, FalseNorthing: 200000,
+	}
+)
+
+func testProjection(t *testing.T, d ProjectionDefinition) Projection {
+	t.Helper()
+	err := addProjection(d)
+	if err != nil {
+		t.Fatalf("Failed to add %s: %v", d.Name, err)
+	}
+	p, err := findProjection(d.WKID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func near(a float64, b float64, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance
+}
+
+func TestProjectionKnownPoints(t *testing.T) {
+	tests := []struct {
+		d    ProjectionDefinition
+		lon  float64
+		lat  float64
+		x    float64
+		y    float64
+		unit float64
+	}{
+		// The origin of each zone is at its false easting and northing
+		{utmZone11, -117, 0, 500000, 0, 0.001},
+		{californiaZone3, -120.5, 36.5, 2000000, 500000, 0.001},
+		{californiaZone3Feet, -120.5, 36.5, 6561666.667, 1640416.667, 0.001},
+		{lambertOneParallel, -120, 37, 500000, 200000, 0.001},
+		// The GRS80 meridian arc to 45°N is 4984944.378m, scaled by 0.9996
+		{utmZone11, -117, 45, 500000, 4982950.400, 0.001},
+	}
+	for _, test := range tests {
+		p := testProjection(t, test.d)
+		x, y := p.Forward(test.lon, test.lat)
+		if !near(x, test.x, test.unit) || !near(y, test.y, test.unit) {
+			t.Errorf("%s: (%v, %v) projected to (%.4f, %.4f), want (%.4f, %.4f)", test.d.Name, test.lon, test.lat, x, y, test.x, test.y)
+		}
+		lon, lat := p.Inverse(test.x, test.y)
+		if !near(lon, test.lon, 1e-8) || !near(lat, test.lat, 1e-8) {
+			t.Errorf("%s: (%v, %v) unprojected to (%v, %v), want (%v, %v)", test.d.Name, test.x, test.y, lon, lat, test.lon, test.lat)
+		}
+	}
+
+	x, y := webMercator{}.Forward(180, 0)
+	if !near(x, 20037508.342789244, 1e-6) || y != 0 {
+		t.Errorf("Web Mercator put the antimeridian at (%v, %v), want (20037508.342789244, 0)", x, y)
+	}
+}
+
+// The scale along the meridian at a latitude, from the projected distance of a short step north
+func meridianScale(p Projection, lon float64, lat float64) float64 {
+	const step = 1e-5
+	_, y1 := p.Forward(lon, lat-step/2)
+	_, y2 := p.Forward(lon, lat+step/2)
+	e2 := 2*grs80Flattening - grs80Flattening*grs80Flattening
+	sin := math.Sin(radians(lat))
+	radius := grs80SemiMajor * (1 - e2) / math.Pow(1-e2*sin*sin, 1.5)
+	return (y2 - y1) / (radius * radians(step))
+}
+
+func TestLambertScale(t *testing.T) {
+	// A secant cone is true to scale along both standard parallels
+	p := testProjection(t, californiaZone3)
+	for _, lat := range []float64{californiaZone3.StandardParallel1, californiaZone3.StandardParallel2} {
+		if k := meridianScale(p, -120.5, lat); !near(k, 1, 1e-6) {
+			t.Errorf("Scale at %v is %v, want 1", lat, k)
+		}
+	}
+	// A tangent cone has its scale factor along the latitude of origin
+	p = testProjection(t, lambertOneParallel)
+	if k := meridianScale(p, -120, lambertOneParallel.LatitudeOfOrigin); !near(k, 0.9999, 1e-6) {
+		t.Errorf("Scale at the latitude of origin is %v, want 0.9999", k)
+	}
+}
+
+// Points in the Central Valley, all inside UTM zone 11 where its series are accurate
+func TestProjectionRoundTrip(t *testing.T) {
+	for _, d := range []ProjectionDefinition{utmZone11, californiaZone3, californiaZone3Feet, lambertOneParallel} {
+		p := testProjection(t, d)
+		for _, point := range [][2]float64{{-119.9, 37.3}, {-119.7, 36.7}, {-118.2, 38.9}} {
+			x, y := p.Forward(point[0], point[1])
+			lon, lat := p.Inverse(x, y)
+			if math.IsNaN(x) || math.IsNaN(y) || !near(lon, point[0], 1e-8) || !near(lat, point[1], 1e-8) {
+				t.Errorf("%s: %v went to (%v, %v) and came back as (%v, %v)", d.Name, point, x, y, lon, lat)
+			}
+		}
+	}
+}
+
+func TestLambertFlatCone(t *testing.T) {
+	d := ProjectionDefinition{WKID: 999002, Method: ProjectionLambertConformalConic, StandardParallel1: 30, StandardParallel2: -30}
+	if err := addProjection(d); err == nil {
+		t.Error("Added a Lambert projection with parallels either side of the equator")
+	}
+	d = ProjectionDefinition{WKID: 999003, Method: ProjectionLambertConformalConic}
+	if err := addProjection(d); err == nil {
+		t.Error("Added a Lambert projection with no standard parallel or latitude of origin")
+	}
+}
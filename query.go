@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"log"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArcGISQuery describes a query against a layer's /query endpoint
+type ArcGISQuery struct {
+	// SQL where clause, defaults to "1=1"
+	Where string
+	// Fields to return, defaults to all of them
+	OutFields []string
+	// Esri JSON geometry to filter by
+	Geometry     json.RawMessage
+	GeometryType string
+	// Defaults to esriSpatialRelIntersects
+	SpatialRel string
+	InSR       int
+	OutSR      int
+	// Only features whose time falls between these, if set
+	TimeStart time.Time
+	TimeEnd   time.Time
+	// Fields to sort by, with optional ASC/DESC. Defaults to the object ID field so paging is stable.
+	OrderByFields  []string
+	ReturnGeometry bool
+	// Number of records to request per page. Capped at the layer's maxRecordCount.
+	PageSize int
+	// Reproject geometries locally to this spatial reference, if set
+	ProjectTo *ArcGISSpatialReference
+
+	// Server-side statistics, see queryStatistics
+	OutStatistics              []ArcGISStatistic
+	GroupByFieldsForStatistics []string
+	Having                     string
+}
+
+// Statistic types supported by outStatistics
+const (
+	StatisticCount  = "count"
+	StatisticSum    = "sum"
+	StatisticMin    = "min"
+	StatisticMax    = "max"
+	StatisticAvg    = "avg"
+	StatisticStddev = "stddev"
+	StatisticVar    = "var"
+)
+
+type ArcGISStatistic struct {
+	StatisticType         string `json:"statisticType"`
+	OnStatisticField      string `json:"onStatisticField"`
+	OutStatisticFieldName string `json:"outStatisticFieldName"`
+}
+
+// ArcGISStatisticsRow is one row of a statistics query: the values of the
+// group-by fields and the value of each requested statistic
+type ArcGISStatisticsRow struct {
+	Groups     map[string]any
+	Statistics map[string]float64
+}
+
+type ArcGISFeature struct {
+	Attributes map[string]any  `json:"attributes"`
+	Geometry   json.RawMessage `json:"geometry,omitempty"`
+}
+
+type ArcGISQueryResponse struct {
+	ObjectIDFieldName     string                 `json:"objectIdFieldName"`
+	GlobalIDFieldName     string                 `json:"globalIdFieldName"`
+	GeometryType          string                 `json:"geometryType"`
+	SpatialReference      ArcGISSpatialReference `json:"spatialReference"`
+	HasZ                  bool                   `json:"hasZ"`
+	HasM                  bool                   `json:"hasM"`
+	Fields                []ArcGISField          `json:"fields"`
+	Features              []ArcGISFeature        `json:"features"`
+	ExceededTransferLimit bool                   `json:"exceededTransferLimit"`
+}
+
+func (q *ArcGISQuery) params() url.Values {
+	params := url.Values{}
+	where := q.Where
+	if where == "" {
+		where = "1=1"
+	}
+	params.Set("where", where)
+	if len(q.OutFields) > 0 {
+		params.Set("outFields", strings.Join(q.OutFields, ","))
+	} else {
+		params.Set("outFields", "*")
+	}
+	if len(q.Geometry) > 0 {
+		params.Set("geometry", string(q.Geometry))
+		params.Set("geometryType", q.GeometryType)
+		spatialRel := q.SpatialRel
+		if spatialRel == "" {
+			spatialRel = "esriSpatialRelIntersects"
+		}
+		params.Set("spatialRel", spatialRel)
+	}
+	if q.InSR != 0 {
+		params.Set("inSR", strconv.Itoa(q.InSR))
+	}
+	if q.OutSR != 0 {
+		params.Set("outSR", strconv.Itoa(q.OutSR))
+	}
+	if !q.TimeStart.IsZero() || !q.TimeEnd.IsZero() {
+		params.Set("time", formatTimeExtent(q.TimeStart, q.TimeEnd))
+	}
+	if len(q.OrderByFields) > 0 {
+		params.Set("orderByFields", strings.Join(q.OrderByFields, ","))
+	}
+	params.Set("returnGeometry", strconv.FormatBool(q.ReturnGeometry))
+	if len(q.OutStatistics) > 0 {
+		stats, _ := json.Marshal(q.OutStatistics)
+		params.Set("outStatistics", string(stats))
+		params.Del("outFields")
+		params.Set("returnGeometry", "false")
+	}
+	if len(q.GroupByFieldsForStatistics) > 0 {
+		params.Set("groupByFieldsForStatistics", strings.Join(q.GroupByFieldsForStatistics, ","))
+	}
+	if q.Having != "" {
+		params.Set("having", q.Having)
+	}
+	return params
+}
+
+// ArcGIS takes time extents as epoch milliseconds, with "null" for an open end
+func formatTimeExtent(start time.Time, end time.Time) string {
+	s := "null"
+	if !start.IsZero() {
+		s = strconv.FormatInt(start.UnixMilli(), 10)
+	}
+	e := "null"
+	if !end.IsZero() {
+		e = strconv.FormatInt(end.UnixMilli(), 10)
+	}
+	return s + "," + e
+}
+
+// Reproject the features of a page if the query asks for it
+func (q *ArcGISQuery) project(page *ArcGISQueryResponse) error {
+	if q.ProjectTo == nil || !q.ReturnGeometry {
+		return nil
+	}
+	for i := range page.Features {
+		err := page.Features[i].Project(page.GeometryType, page.SpatialReference, *q.ProjectTo)
+		if err != nil {
+			return fmt.Errorf("Failed to project feature: %w", err)
+		}
+	}
+	page.SpatialReference = *q.ProjectTo
+	return nil
+}
+
+// Run a query against a layer and get back one page of results
+func queryPage(ctx context.Context, access string, layer *ArcGISLayer, params url.Values) (*ArcGISQueryResponse, error) {
+	var response ArcGISQueryResponse
+	err := arcgisPost(ctx, access, layer.URL+"/query", params, &response)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query %s: %w", layer.URL, err)
+	}
+	return &response, nil
+}
+
+// Query a layer, transparently paging through the results until the server
+// says there are no more. If the layer can't page and the results don't fit in
+// one response, the rest are fetched by object ID and come back in no
+// particular order.
+func queryFeatures(ctx context.Context, access string, layer *ArcGISLayer, q ArcGISQuery) iter.Seq2[ArcGISFeature, error] {
+	return func(yield func(ArcGISFeature, error) bool) {
+		pageSize := q.PageSize
+		if pageSize <= 0 || (layer.MaxRecordCount > 0 && pageSize > layer.MaxRecordCount) {
+			pageSize = layer.MaxRecordCount
+		}
+		paging := layer.AdvancedQueryCapabilities.SupportsPagination && pageSize > 0
+		if !paging && len(q.OutFields) > 0 && layer.ObjectIDField != "" && !slices.Contains(q.OutFields, layer.ObjectIDField) {
+			// Needed to tell which features the first page already had if it doesn't hold them all
+			q.OutFields = append(slices.Clone(q.OutFields), layer.ObjectIDField)
+		}
+		params := q.params()
+		if paging && len(q.OrderByFields) == 0 && layer.ObjectIDField != "" {
+			params.Set("orderByFields", layer.ObjectIDField)
+		}
+		offset := 0
+		for {
+			if paging {
+				params.Set("resultOffset", strconv.Itoa(offset))
+				params.Set("resultRecordCount", strconv.Itoa(pageSize))
+			}
+			page, err := queryPage(ctx, access, layer, params)
+			if err != nil {
+				yield(ArcGISFeature{}, err)
+				return
+			}
+			err = q.project(page)
+			if err != nil {
+				yield(ArcGISFeature{}, err)
+				return
+			}
+			for _, f := range page.Features {
+				if !yield(f, nil) {
+					return
+				}
+			}
+			if !page.ExceededTransferLimit || len(page.Features) == 0 {
+				return
+			}
+			if !paging {
+				fetchRemainingFeatures(ctx, access, layer, q, page.Features, yield)
+				return
+			}
+			offset += len(page.Features)
+		}
+	}
+}
+
+// Fetch the features of a query that the first page didn't have room for, on
+// layers that can't page
+func fetchRemainingFeatures(ctx context.Context, access string, layer *ArcGISLayer, q ArcGISQuery, first []ArcGISFeature, yield func(ArcGISFeature, error) bool) {
+	log.Printf("Query of %s exceeded the transfer limit but the layer doesn't support pagination, fetching the rest by object ID", layer.URL)
+	seen := make(map[int64]bool, len(first))
+	for _, f := range first {
+		if id, ok := f.Attributes[layer.ObjectIDField].(float64); ok {
+			seen[int64(id)] = true
+		}
+	}
+	opts := BulkFetchOptions{Progress: logBulkProgress(layer.URL)}
+	for f, err := range fetchAllFeatures(ctx, access, layer, q, opts) {
+		if err != nil {
+			yield(ArcGISFeature{}, err)
+			return
+		}
+		if id, ok := f.Attributes[layer.ObjectIDField].(float64); ok && seen[int64(id)] {
+			continue
+		}
+		if !yield(f, nil) {
+			return
+		}
+	}
+}
+
+// Run a statistics query. The server does the aggregation so only one row per
+// group comes back, and it's an error for there to be more groups than fit in
+// one response.
+func queryStatistics(ctx context.Context, access string, layer *ArcGISLayer, q ArcGISQuery) ([]ArcGISStatisticsRow, error) {
+	if len(q.OutStatistics) == 0 {
+		return nil, fmt.Errorf("A statistics query needs at least one statistic")
+	}
+	q.OutStatistics = append([]ArcGISStatistic(nil), q.OutStatistics...)
+	for i, s := range q.OutStatistics {
+		switch s.StatisticType {
+		case StatisticCount, StatisticSum, StatisticMin, StatisticMax, StatisticAvg, StatisticStddev, StatisticVar:
+		default:
+			return nil, fmt.Errorf("Unknown statistic type '%s'", s.StatisticType)
+		}
+		if s.OutStatisticFieldName == "" {
+			q.OutStatistics[i].OutStatisticFieldName = s.StatisticType + "_" + s.OnStatisticField
+		}
+	}
+	if q.Having != "" && !layer.AdvancedQueryCapabilities.SupportsHavingClause {
+		return nil, fmt.Errorf("Layer %s doesn't support having clauses", layer.URL)
+	}
+	page, err := queryPage(ctx, access, layer, q.params())
+	if err != nil {
+		return nil, err
+	}
+	if page.ExceededTransferLimit {
+		return nil, fmt.Errorf("Statistics query of %s returned more groups than the layer's limit of %d", layer.URL, layer.MaxRecordCount)
+	}
+	result := make([]ArcGISStatisticsRow, 0, len(page.Features))
+	for _, f := range page.Features {
+		row := ArcGISStatisticsRow{
+			Groups:     make(map[string]any),
+			Statistics: make(map[string]float64),
+		}
+		for _, g := range q.GroupByFieldsForStatistics {
+			row.Groups[g] = attributeIgnoreCase(f.Attributes, g)
+		}
+		for _, s := range q.OutStatistics {
+			// Nulls, like the sum over an empty group, end up as zero
+			v, _ := attributeIgnoreCase(f.Attributes, s.OutStatisticFieldName).(float64)
+			row.Statistics[s.OutStatisticFieldName] = v
+		}
+		result = append(result, row)
+	}
+	return result, nil
+}
+
+// Some servers change the case of output field names, so look them up without it
+func attributeIgnoreCase(attributes map[string]any, name string) any {
+	if v, ok := attributes[name]; ok {
+		return v
+	}
+	for k, v := range attributes {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
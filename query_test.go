@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestQueryStatistics(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	token := signIn(t, portal, "fake.technician")
+	ctx := context.Background()
+	layer, err := fetchLayer(ctx, token.AccessToken, fakeServiceURL(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := ArcGISQuery{
+		OutStatistics: []ArcGISStatistic{
+			{StatisticType: StatisticCount, OnStatisticField: "OBJECTID"},
+			{StatisticType: StatisticSum, OnStatisticField: "QTY", OutStatisticFieldName: "total"},
+		},
+		GroupByFieldsForStatistics: []string{"FIELDTECH"},
+	}
+	rows, err := queryStatistics(ctx, token.AccessToken, layer, q)
+	if err != nil {
+		t.Fatalf("Statistics query failed: %v", err)
+	}
+	want := map[string][2]float64{"fake.technician": {2, 3.5}, "fake.admin": {1, 4}}
+	if len(rows) != len(want) {
+		t.Fatalf("Got %d groups, want %d: %+v", len(rows), len(want), rows)
+	}
+	for _, row := range rows {
+		tech, _ := row.Groups["FIELDTECH"].(string)
+		w, ok := want[tech]
+		if !ok {
+			t.Errorf("Unexpected group %v", row.Groups)
+			continue
+		}
+		// Without a name the statistic is named after its type and field
+		if row.Statistics["count_OBJECTID"] != w[0] || row.Statistics["total"] != w[1] {
+			t.Errorf("%s has statistics %v, want a count of %v and a total of %v", tech, row.Statistics, w[0], w[1])
+		}
+	}
+
+	if _, err := queryStatistics(ctx, token.AccessToken, layer, ArcGISQuery{OutStatistics: []ArcGISStatistic{{StatisticType: "median", OnStatisticField: "QTY"}}}); err == nil {
+		t.Error("Ran a statistic of an unknown type")
+	}
+
+	// More groups than fit in a response are an error rather than a partial answer
+	limitFakeLayer(portal, 1, 1, true)
+	if _, err := queryStatistics(ctx, token.AccessToken, layer, q); err == nil || !strings.Contains(err.Error(), "more groups") {
+		t.Errorf("Got %v for more groups than the limit, want an error", err)
+	}
+}
+
+func TestLayerPageStatistics(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	signIn(t, portal, "fake.technician")
+
+	target := "/layer?service=" + fakeServiceURL() + "&layer=1&statistic=sum&field=QTY&groupBy=FIELDTECH"
+	w := callAs(t, "fake.technician", http.MethodGet, "/layer", getLayer, target, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d: %s", w.Code, w.Body)
+	}
+	for _, s := range []string{"fake.technician", "3.5", "fake.admin"} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("Statistics table doesn't have %s", s)
+		}
+	}
+
+	w = callAs(t, "fake.technician", http.MethodGet, "/layer", getLayer, "/layer?service="+fakeServiceURL()+"&layer=1&statistic=sum&field=NOPE", nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d for a field the layer doesn't have, want %d", w.Code, http.StatusBadRequest)
+	}
+}
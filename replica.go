@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directory where offline replicas are kept
+var ReplicaDirectory = "replicas"
+
+// ReplicaLayer is the offline copy of one layer of a replica along with the
+// edits made to it locally that haven't been sent to the server yet.
+type ReplicaLayer struct {
+	ID            int    `json:"id"`
+	GlobalIDField string `json:"globalIdField"`
+	// Features as of the last sync, keyed by global ID
+	Features map[string]ArcGISFeature `json:"features"`
+	// Local edits, keyed by global ID
+	PendingAdds    map[string]ArcGISFeature `json:"pendingAdds"`
+	PendingUpdates map[string]ArcGISFeature `json:"pendingUpdates"`
+	PendingDeletes map[string]bool          `json:"pendingDeletes"`
+	// Features edited both locally and on the server since the last sync
+	Conflicts map[string]ReplicaConflict `json:"conflicts"`
+}
+
+type ReplicaConflict struct {
+	Local  *ArcGISFeature `json:"local"`
+	Server *ArcGISFeature `json:"server"`
+}
+
+type Replica struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	ServiceURL string `json:"serviceUrl"`
+	// The user who created it, nobody else can see or sync it
+	Owner     string                `json:"owner"`
+	ServerGen int64                 `json:"serverGen"`
+	Created   time.Time             `json:"created"`
+	Synced    time.Time             `json:"synced"`
+	Layers    map[int]*ReplicaLayer `json:"layers"`
+}
+
+// The features of a layer as they come back from createReplica and synchronizeReplica
+type arcgisReplicaLayerEdits struct {
+	ID       int `json:"id"`
+	Features struct {
+		Adds      []ArcGISFeature `json:"adds"`
+		Updates   []ArcGISFeature `json:"updates"`
+		DeleteIDs []string        `json:"deleteIds"`
+	} `json:"features"`
+}
+
+type arcgisReplicaLayerResults struct {
+	ID            int                `json:"id"`
+	AddResults    []ArcGISEditResult `json:"addResults"`
+	UpdateResults []ArcGISEditResult `json:"updateResults"`
+	DeleteResults []ArcGISEditResult `json:"deleteResults"`
+}
+
+// Serializes changes to each replica. A sync holds its replica's lock across
+// the calls to the server so two syncs can't upload the same edits, but other
+// replicas aren't held up. Readers don't lock since files are replaced whole.
+var (
+	replicaLocks     = make(map[string]*sync.Mutex)
+	replicaLocksLock sync.Mutex
+)
+
+func replicaFileLock(id string) *sync.Mutex {
+	replicaLocksLock.Lock()
+	defer replicaLocksLock.Unlock()
+	path := replicaPath(id)
+	lock, ok := replicaLocks[path]
+	if !ok {
+		lock = &sync.Mutex{}
+		replicaLocks[path] = lock
+	}
+	return lock
+}
+
+// Returned for replicas that don't exist and for other users' replicas alike
+var ErrNoReplica = errors.New("No such replica")
+
+func replicaPath(id string) string {
+	return filepath.Join(ReplicaDirectory, strings.Trim(id, "{}")+".json")
+}
+
+func loadReplica(id string) (*Replica, error) {
+	if strings.ContainsAny(id, `/\.`) {
+		return nil, fmt.Errorf("Invalid replica ID '%s'", id)
+	}
+	content, err := os.ReadFile(replicaPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w '%s'", ErrNoReplica, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read replica: %v", err)
+	}
+	var replica Replica
+	err = json.Unmarshal(content, &replica)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal replica: %v", err)
+	}
+	return &replica, nil
+}
+
+// Load a replica only if it belongs to the user
+func loadOwnedReplica(id string, username string) (*Replica, error) {
+	replica, err := loadReplica(id)
+	if err != nil {
+		return nil, err
+	}
+	if replica.Owner != username {
+		return nil, fmt.Errorf("%w '%s'", ErrNoReplica, id)
+	}
+	return replica, nil
+}
+
+func saveReplica(replica *Replica) error {
+	err := os.MkdirAll(ReplicaDirectory, 0o700)
+	if err != nil {
+		return fmt.Errorf("Failed to create replica directory: %v", err)
+	}
+	content, err := json.Marshal(replica)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal replica: %v", err)
+	}
+	path := replicaPath(replica.ID)
+	err = os.WriteFile(path+".tmp", content, 0o600)
+	if err != nil {
+		return fmt.Errorf("Failed to write replica: %v", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Create a sync-enabled replica of some layers of a service and store it locally
+func createReplica(ctx context.Context, access string, owner string, serviceURL string, name string, layerIDs []int) (*Replica, error) {
+	serviceURL = strings.TrimRight(serviceURL, "/")
+	service, err := fetchFeatureService(ctx, access, serviceURL)
+	if err != nil {
+		return nil, err
+	}
+	if !service.SyncEnabled || !service.HasCapability("Sync") {
+		return nil, fmt.Errorf("Service %s isn't sync-enabled", serviceURL)
+	}
+	// Check the layers first so nothing fails once the server has made the replica
+	replicaLayers := make(map[int]*ReplicaLayer)
+	for _, id := range layerIDs {
+		layer, err := fetchLayer(ctx, access, serviceURL, id)
+		if err != nil {
+			return nil, err
+		}
+		if layer.GlobalIDField == "" {
+			return nil, fmt.Errorf("Layer %s has no global ID field", layer.URL)
+		}
+		replicaLayers[id] = newReplicaLayer(id, layer.GlobalIDField)
+	}
+	layers, _ := json.Marshal(layerIDs)
+	form := url.Values{
+		"replicaName":       []string{name},
+		"layers":            []string{string(layers)},
+		"returnAttachments": []string{"false"},
+		"syncModel":         []string{"perReplica"},
+		"syncDirection":     []string{"bidirectional"},
+		"dataFormat":        []string{"json"},
+		"transportType":     []string{"esriTransportTypeEmbedded"},
+		"async":             []string{"false"},
+	}
+	var response struct {
+		ReplicaID        string                    `json:"replicaID"`
+		ReplicaName      string                    `json:"replicaName"`
+		ReplicaServerGen int64                     `json:"replicaServerGen"`
+		Layers           []arcgisReplicaLayerEdits `json:"layers"`
+	}
+	err = arcgisPost(ctx, access, serviceURL+"/createReplica", form, &response)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create replica of %s: %w", serviceURL, err)
+	}
+	replica := Replica{
+		ID:         response.ReplicaID,
+		Name:       response.ReplicaName,
+		ServiceURL: serviceURL,
+		Owner:      owner,
+		ServerGen:  response.ReplicaServerGen,
+		Created:    time.Now(),
+		Synced:     time.Now(),
+		Layers:     replicaLayers,
+	}
+	for _, l := range response.Layers {
+		rl, ok := replica.Layers[l.ID]
+		if !ok {
+			continue
+		}
+		for _, f := range append(l.Features.Adds, l.Features.Updates...) {
+			rl.Features[rl.globalID(f)] = f
+		}
+	}
+
+	lock := replicaFileLock(replica.ID)
+	lock.Lock()
+	defer lock.Unlock()
+	err = saveReplica(&replica)
+	if err != nil {
+		unRegisterReplica(ctx, access, serviceURL, replica.ID)
+		return nil, err
+	}
+	log.Printf("Created replica %s of %s at generation %d", replica.ID, serviceURL, replica.ServerGen)
+	return &replica, nil
+}
+
+// Remove a replica from the server, for when we couldn't keep it locally
+func unRegisterReplica(ctx context.Context, access string, serviceURL string, replicaID string) {
+	form := url.Values{"replicaID": []string{replicaID}}
+	var response map[string]any
+	err := arcgisPost(ctx, access, serviceURL+"/unRegisterReplica", form, &response)
+	if err != nil {
+		log.Printf("Failed to unregister replica %s of %s: %v", replicaID, serviceURL, err)
+	}
+}
+
+func newReplicaLayer(id int, globalIDField string) *ReplicaLayer {
+	return &ReplicaLayer{
+		ID:             id,
+		GlobalIDField:  globalIDField,
+		Features:       make(map[string]ArcGISFeature),
+		PendingAdds:    make(map[string]ArcGISFeature),
+		PendingUpdates: make(map[string]ArcGISFeature),
+		PendingDeletes: make(map[string]bool),
+		Conflicts:      make(map[string]ReplicaConflict),
+	}
+}
+
+func (rl *ReplicaLayer) globalID(f ArcGISFeature) string {
+	return strings.ToUpper(formatAttribute(attributeIgnoreCase(f.Attributes, rl.GlobalIDField)))
+}
+
+func (rl *ReplicaLayer) isPending(globalID string) bool {
+	_, updated := rl.PendingUpdates[globalID]
+	return updated || rl.PendingDeletes[globalID]
+}
+
+// Make a new global ID in the braced, upper case form ArcGIS uses
+func newGlobalID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return strings.ToUpper(fmt.Sprintf("{%x-%x-%x-%x-%x}", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]))
+}
+
+// Record edits made offline. Added features get a new global ID if they don't have one.
+func recordReplicaEdits(username string, replicaID string, layerID int, edits ArcGISEdits, deleteGlobalIDs []string) error {
+	lock := replicaFileLock(replicaID)
+	lock.Lock()
+	defer lock.Unlock()
+	replica, err := loadOwnedReplica(replicaID, username)
+	if err != nil {
+		return err
+	}
+	rl, ok := replica.Layers[layerID]
+	if !ok {
+		return fmt.Errorf("Replica %s doesn't include layer %d", replicaID, layerID)
+	}
+	for _, f := range edits.Adds {
+		if f.Attributes == nil {
+			f.Attributes = make(map[string]any)
+		}
+		id := rl.globalID(f)
+		if id == "" {
+			id = newGlobalID()
+			f.Attributes[rl.GlobalIDField] = id
+		}
+		rl.PendingAdds[id] = f
+	}
+	for _, f := range edits.Updates {
+		id := rl.globalID(f)
+		if add, ok := rl.PendingAdds[id]; ok {
+			// Still local only, so fold the update into the add
+			rl.PendingAdds[id] = mergeFeature(add, f)
+			continue
+		}
+		if _, ok := rl.Features[id]; !ok {
+			return fmt.Errorf("No feature %s in layer %d of replica %s", id, layerID, replicaID)
+		}
+		if previous, ok := rl.PendingUpdates[id]; ok {
+			f = mergeFeature(previous, f)
+		}
+		rl.PendingUpdates[id] = f
+	}
+	for _, id := range deleteGlobalIDs {
+		id = strings.ToUpper(id)
+		if _, ok := rl.PendingAdds[id]; ok {
+			delete(rl.PendingAdds, id)
+			continue
+		}
+		delete(rl.PendingUpdates, id)
+		rl.PendingDeletes[id] = true
+	}
+	return saveReplica(replica)
+}
+
+// Synchronize a replica in both directions. Changes from the server are
+// downloaded first; any feature that was also edited locally becomes a
+// conflict and its local edit is held back until the conflict is resolved.
+// The remaining local edits are then uploaded.
+func synchronizeReplica(ctx context.Context, access string, username string, replicaID string) (*Replica, error) {
+	lock := replicaFileLock(replicaID)
+	lock.Lock()
+	defer lock.Unlock()
+	replica, err := loadOwnedReplica(replicaID, username)
+	if err != nil {
+		return nil, err
+	}
+
+	download, err := callSynchronizeReplica(ctx, access, replica, "download", nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, edits := range download.Edits {
+		rl, ok := replica.Layers[edits.ID]
+		if !ok {
+			continue
+		}
+		for _, f := range append(edits.Features.Adds, edits.Features.Updates...) {
+			id := rl.globalID(f)
+			if rl.isPending(id) {
+				server := f
+				conflict := rl.Conflicts[id]
+				conflict.Server = &server
+				if local, ok := rl.PendingUpdates[id]; ok {
+					conflict.Local = &local
+				}
+				rl.Conflicts[id] = conflict
+			}
+			rl.Features[id] = f
+		}
+		for _, id := range edits.Features.DeleteIDs {
+			id = strings.ToUpper(id)
+			if rl.isPending(id) {
+				conflict := rl.Conflicts[id]
+				conflict.Server = nil
+				if local, ok := rl.PendingUpdates[id]; ok {
+					// Keep the whole feature since it can only come back as an add
+					merged := mergeFeature(rl.Features[id], local)
+					conflict.Local = &merged
+				}
+				rl.Conflicts[id] = conflict
+			}
+			delete(rl.Features, id)
+		}
+	}
+	replica.ServerGen = download.ReplicaServerGen
+
+	uploads := make([]arcgisReplicaLayerEdits, 0)
+	for _, rl := range replica.Layers {
+		upload := arcgisReplicaLayerEdits{ID: rl.ID}
+		for _, f := range rl.PendingAdds {
+			upload.Features.Adds = append(upload.Features.Adds, f)
+		}
+		for id, f := range rl.PendingUpdates {
+			if _, conflict := rl.Conflicts[id]; !conflict {
+				upload.Features.Updates = append(upload.Features.Updates, f)
+			}
+		}
+		for id := range rl.PendingDeletes {
+			if _, conflict := rl.Conflicts[id]; !conflict {
+				upload.Features.DeleteIDs = append(upload.Features.DeleteIDs, id)
+			}
+		}
+		if len(upload.Features.Adds)+len(upload.Features.Updates)+len(upload.Features.DeleteIDs) > 0 {
+			uploads = append(uploads, upload)
+		}
+	}
+	if len(uploads) > 0 {
+		result, err := callSynchronizeReplica(ctx, access, replica, "upload", uploads)
+		if err != nil {
+			// Keep the downloaded changes, the local edits are still pending
+			saveReplica(replica)
+			return nil, err
+		}
+		for _, upload := range uploads {
+			rl := replica.Layers[upload.ID]
+			for _, f := range append(upload.Features.Adds, upload.Features.Updates...) {
+				id := rl.globalID(f)
+				if !uploadSucceeded(result.EditResults, upload.ID, id) {
+					continue
+				}
+				if existing, ok := rl.Features[id]; ok {
+					f = mergeFeature(existing, f)
+				}
+				rl.Features[id] = f
+				delete(rl.PendingAdds, id)
+				delete(rl.PendingUpdates, id)
+			}
+			for _, id := range upload.Features.DeleteIDs {
+				if !uploadSucceeded(result.EditResults, upload.ID, id) {
+					continue
+				}
+				delete(rl.Features, id)
+				delete(rl.PendingDeletes, id)
+			}
+		}
+		replica.ServerGen = result.ReplicaServerGen
+	}
+	replica.Synced = time.Now()
+	err = saveReplica(replica)
+	if err != nil {
+		return nil, err
+	}
+	return replica, nil
+}
+
+type arcgisSynchronizeReplicaResponse struct {
+	ReplicaServerGen int64                       `json:"replicaServerGen"`
+	Edits            []arcgisReplicaLayerEdits   `json:"edits"`
+	EditResults      []arcgisReplicaLayerResults `json:"editResults"`
+}
+
+func callSynchronizeReplica(ctx context.Context, access string, replica *Replica, direction string, edits []arcgisReplicaLayerEdits) (*arcgisSynchronizeReplicaResponse, error) {
+	form := url.Values{
+		"replicaID":         []string{replica.ID},
+		"replicaServerGen":  []string{strconv.FormatInt(replica.ServerGen, 10)},
+		"syncDirection":     []string{direction},
+		"transportType":     []string{"esriTransportTypeEmbedded"},
+		"dataFormat":        []string{"json"},
+		"rollbackOnFailure": []string{"false"},
+		"async":             []string{"false"},
+	}
+	if edits != nil {
+		content, err := json.Marshal(edits)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal edits: %v", err)
+		}
+		form.Set("edits", string(content))
+	}
+	var response arcgisSynchronizeReplicaResponse
+	err := arcgisPost(ctx, access, replica.ServiceURL+"/synchronizeReplica", form, &response)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to %s replica %s: %w", direction, replica.ID, err)
+	}
+	return &response, nil
+}
+
+func uploadSucceeded(results []arcgisReplicaLayerResults, layerID int, globalID string) bool {
+	for _, layer := range results {
+		if layer.ID != layerID {
+			continue
+		}
+		for _, rs := range [][]ArcGISEditResult{layer.AddResults, layer.UpdateResults, layer.DeleteResults} {
+			for _, r := range rs {
+				if strings.EqualFold(r.GlobalID, globalID) {
+					if !r.Success {
+						log.Printf("Upload of %s to layer %d failed: %v", globalID, layerID, r.Error)
+					}
+					return r.Success
+				}
+			}
+		}
+	}
+	// Without a result we can't tell whether it was applied, so keep it
+	// pending and send it again on the next sync
+	log.Printf("No result for upload of %s to layer %d, keeping it pending", globalID, layerID)
+	return false
+}
+
+// Resolve a conflict by either keeping the local edit, which is uploaded on
+// the next sync, or dropping it in favor of the server's version.
+func resolveReplicaConflict(username string, replicaID string, layerID int, globalID string, keepLocal bool) error {
+	lock := replicaFileLock(replicaID)
+	lock.Lock()
+	defer lock.Unlock()
+	replica, err := loadOwnedReplica(replicaID, username)
+	if err != nil {
+		return err
+	}
+	rl, ok := replica.Layers[layerID]
+	if !ok {
+		return fmt.Errorf("Replica %s doesn't include layer %d", replicaID, layerID)
+	}
+	globalID = strings.ToUpper(globalID)
+	conflict, ok := rl.Conflicts[globalID]
+	if !ok {
+		return fmt.Errorf("No conflict for %s", globalID)
+	}
+	delete(rl.Conflicts, globalID)
+	if !keepLocal {
+		delete(rl.PendingUpdates, globalID)
+		delete(rl.PendingDeletes, globalID)
+	} else if conflict.Server == nil {
+		// The server deleted it too, so a local delete is moot and a local
+		// update has to come back as an add
+		delete(rl.PendingDeletes, globalID)
+		delete(rl.PendingUpdates, globalID)
+		if conflict.Local != nil {
+			rl.PendingAdds[globalID] = *conflict.Local
+		}
+	}
+	return saveReplica(replica)
+}
+
+// Apply the attributes and geometry of an edit on top of a feature
+func mergeFeature(base ArcGISFeature, edit ArcGISFeature) ArcGISFeature {
+	result := ArcGISFeature{
+		Attributes: make(map[string]any, len(base.Attributes)),
+		Geometry:   base.Geometry,
+	}
+	for k, v := range base.Attributes {
+		result.Attributes[k] = v
+	}
+	for k, v := range edit.Attributes {
+		result.Attributes[k] = v
+	}
+	if edit.Geometry != nil {
+		result.Geometry = edit.Geometry
+	}
+	return result
+}
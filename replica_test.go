@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	replicaTestID = "{6C3F2D4A-0000-4000-8000-000000000001}"
+	elmStreet     = "{00000000-0000-4000-8000-000000000001}"
+	oakStreet     = "{00000000-0000-4000-8000-000000000002}"
+	pineStreet    = "{00000000-0000-4000-8000-000000000003}"
+)
+
+func replicaFeature(globalID string, name string) ArcGISFeature {
+	return ArcGISFeature{Attributes: map[string]any{"GlobalID": globalID, "NAME": name}}
+}
+
+// Save a replica of one layer with three features, owned by fake.technician
+func saveTestReplica(t *testing.T, serviceURL string) {
+	t.Helper()
+	previous := ReplicaDirectory
+	ReplicaDirectory = t.TempDir()
+	t.Cleanup(func() { ReplicaDirectory = previous })
+	rl := newReplicaLayer(0, "GlobalID")
+	for _, f := range []ArcGISFeature{
+		replicaFeature(elmStreet, "Elm Street"),
+		replicaFeature(oakStreet, "Oak Street"),
+		replicaFeature(pineStreet, "Pine Street"),
+	} {
+		rl.Features[rl.globalID(f)] = f
+	}
+	replica := &Replica{
+		ID:         replicaTestID,
+		ServiceURL: serviceURL,
+		Owner:      "fake.technician",
+		ServerGen:  10,
+		Layers:     map[int]*ReplicaLayer{0: rl},
+	}
+	if err := saveReplica(replica); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A stub synchronizeReplica that reports the download given and accepts every upload
+func replicaServer(t *testing.T, download []arcgisReplicaLayerEdits) (string, *[]arcgisReplicaLayerEdits) {
+	t.Helper()
+	uploaded := make([]arcgisReplicaLayerEdits, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/FeatureServer/synchronizeReplica" || r.FormValue("replicaID") != replicaTestID {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.FormValue("syncDirection") == "download" {
+			json.NewEncoder(w).Encode(arcgisSynchronizeReplicaResponse{ReplicaServerGen: 11, Edits: download})
+			return
+		}
+		var edits []arcgisReplicaLayerEdits
+		if err := json.Unmarshal([]byte(r.FormValue("edits")), &edits); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		uploaded = append(uploaded, edits...)
+		response := arcgisSynchronizeReplicaResponse{ReplicaServerGen: 12}
+		for _, l := range edits {
+			results := arcgisReplicaLayerResults{ID: l.ID}
+			rl := newReplicaLayer(l.ID, "GlobalID")
+			for _, f := range l.Features.Adds {
+				results.AddResults = append(results.AddResults, ArcGISEditResult{GlobalID: rl.globalID(f), Success: true})
+			}
+			for _, f := range l.Features.Updates {
+				results.UpdateResults = append(results.UpdateResults, ArcGISEditResult{GlobalID: rl.globalID(f), Success: true})
+			}
+			for _, id := range l.Features.DeleteIDs {
+				results.DeleteResults = append(results.DeleteResults, ArcGISEditResult{GlobalID: id, Success: true})
+			}
+			response.EditResults = append(response.EditResults, results)
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/FeatureServer", &uploaded
+}
+
+func TestRecordReplicaEditsMergesIntoPendingAdds(t *testing.T) {
+	saveTestReplica(t, "https://example.com/arcgis/rest/services/Test/FeatureServer")
+	add := ArcGISFeature{Attributes: map[string]any{"NAME": "Maple Street"}}
+	err := recordReplicaEdits("fake.technician", replicaTestID, 0, ArcGISEdits{Adds: []ArcGISFeature{add}}, nil)
+	if err != nil {
+		t.Fatalf("Failed to record add: %v", err)
+	}
+	replica, err := loadReplica(replicaTestID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := replica.Layers[0]
+	if len(rl.PendingAdds) != 1 {
+		t.Fatalf("Got %d pending adds, want 1", len(rl.PendingAdds))
+	}
+	var added string
+	for id := range rl.PendingAdds {
+		added = id
+	}
+
+	update := ArcGISFeature{Attributes: map[string]any{"GlobalID": added, "ZONE": "North"}}
+	err = recordReplicaEdits("fake.technician", replicaTestID, 0, ArcGISEdits{Updates: []ArcGISFeature{update}}, nil)
+	if err != nil {
+		t.Fatalf("Failed to record update: %v", err)
+	}
+	replica, _ = loadReplica(replicaTestID)
+	rl = replica.Layers[0]
+	if len(rl.PendingUpdates) != 0 {
+		t.Errorf("An update of a local add is pending on its own: %v", rl.PendingUpdates)
+	}
+	merged := rl.PendingAdds[added]
+	if merged.Attributes["NAME"] != "Maple Street" || merged.Attributes["ZONE"] != "North" {
+		t.Errorf("Pending add is %v, want the add with the update on top", merged.Attributes)
+	}
+
+	err = recordReplicaEdits("fake.technician", replicaTestID, 0, ArcGISEdits{}, []string{added})
+	if err != nil {
+		t.Fatalf("Failed to record delete: %v", err)
+	}
+	replica, _ = loadReplica(replicaTestID)
+	rl = replica.Layers[0]
+	if len(rl.PendingAdds) != 0 || len(rl.PendingDeletes) != 0 {
+		t.Errorf("Deleting a local add left adds %v and deletes %v", rl.PendingAdds, rl.PendingDeletes)
+	}
+
+	err = recordReplicaEdits("fake.admin", replicaTestID, 0, ArcGISEdits{Adds: []ArcGISFeature{add}}, nil)
+	if !errors.Is(err, ErrNoReplica) {
+		t.Errorf("Got %v recording edits to another user's replica, want %v", err, ErrNoReplica)
+	}
+}
+
+func TestSynchronizeReplicaConflicts(t *testing.T) {
+	// The server changed Elm Street and deleted Pine Street since the last sync
+	var download arcgisReplicaLayerEdits
+	download.ID = 0
+	download.Features.Updates = []ArcGISFeature{replicaFeature(elmStreet, "Elm Street (server)")}
+	download.Features.DeleteIDs = []string{pineStreet}
+	serviceURL, uploaded := replicaServer(t, []arcgisReplicaLayerEdits{download})
+	saveTestReplica(t, serviceURL)
+
+	// Locally, all three were edited
+	updates := []ArcGISFeature{
+		replicaFeature(elmStreet, "Elm Street (local)"),
+		replicaFeature(oakStreet, "Oak Street (local)"),
+		replicaFeature(pineStreet, "Pine Street (local)"),
+	}
+	err := recordReplicaEdits("fake.technician", replicaTestID, 0, ArcGISEdits{Updates: updates}, nil)
+	if err != nil {
+		t.Fatalf("Failed to record edits: %v", err)
+	}
+
+	replica, err := synchronizeReplica(context.Background(), "", "fake.technician", replicaTestID)
+	if err != nil {
+		t.Fatalf("Failed to synchronize: %v", err)
+	}
+	if replica.ServerGen != 12 {
+		t.Errorf("Replica is at generation %d, want 12", replica.ServerGen)
+	}
+	rl := replica.Layers[0]
+	if len(*uploaded) != 1 || len((*uploaded)[0].Features.Updates) != 1 || rl.globalID((*uploaded)[0].Features.Updates[0]) != oakStreet {
+		t.Fatalf("Uploaded %+v, want only the update of Oak Street", *uploaded)
+	}
+	if _, ok := rl.PendingUpdates[oakStreet]; ok {
+		t.Error("Oak Street is still pending after uploading it")
+	}
+	if rl.Features[oakStreet].Attributes["NAME"] != "Oak Street (local)" {
+		t.Errorf("Oak Street is %v after the upload", rl.Features[oakStreet].Attributes)
+	}
+
+	elm, ok := rl.Conflicts[elmStreet]
+	if !ok || elm.Server == nil || elm.Local == nil {
+		t.Fatalf("Elm Street conflict is %+v, want both versions", elm)
+	}
+	if elm.Server.Attributes["NAME"] != "Elm Street (server)" || elm.Local.Attributes["NAME"] != "Elm Street (local)" {
+		t.Errorf("Elm Street conflict has server %v and local %v", elm.Server.Attributes, elm.Local.Attributes)
+	}
+	pine, ok := rl.Conflicts[pineStreet]
+	if !ok || pine.Server != nil || pine.Local == nil {
+		t.Fatalf("Pine Street conflict is %+v, want a server delete and the local feature", pine)
+	}
+
+	// Keep the server's Elm Street and bring back Pine Street
+	err = resolveReplicaConflict("fake.technician", replicaTestID, 0, elmStreet, false)
+	if err != nil {
+		t.Fatalf("Failed to resolve Elm Street: %v", err)
+	}
+	err = resolveReplicaConflict("fake.technician", replicaTestID, 0, pineStreet, true)
+	if err != nil {
+		t.Fatalf("Failed to resolve Pine Street: %v", err)
+	}
+	replica, _ = loadReplica(replicaTestID)
+	rl = replica.Layers[0]
+	if len(rl.Conflicts) != 0 {
+		t.Errorf("Conflicts %v are left after resolving them", rl.Conflicts)
+	}
+	if _, ok := rl.PendingUpdates[elmStreet]; ok {
+		t.Error("The local edit of Elm Street is still pending after dropping it")
+	}
+	if rl.Features[elmStreet].Attributes["NAME"] != "Elm Street (server)" {
+		t.Errorf("Elm Street is %v, want the server's version", rl.Features[elmStreet].Attributes)
+	}
+	if add, ok := rl.PendingAdds[pineStreet]; !ok || add.Attributes["NAME"] != "Pine Street (local)" {
+		t.Errorf("Pine Street is pending as %v, want the local version added back", add.Attributes)
+	}
+	err = resolveReplicaConflict("fake.technician", replicaTestID, 0, elmStreet, true)
+	if err == nil {
+		t.Error("Resolved a conflict that was already resolved")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type ArcGISCodedValue struct {
+	Name string `json:"name"`
+	Code any    `json:"code"`
+}
+
+// ArcGISDomain is either a coded-value domain or a range domain, depending on Type
+type ArcGISDomain struct {
+	Type        string             `json:"type"`
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	CodedValues []ArcGISCodedValue `json:"codedValues"`
+	Range       []float64          `json:"range"`
+	MergePolicy string             `json:"mergePolicy"`
+	SplitPolicy string             `json:"splitPolicy"`
+}
+
+// Get the label for a coded value, or the code itself if it isn't part of the domain
+func (d *ArcGISDomain) Label(code any) string {
+	if d == nil || code == nil {
+		return formatAttribute(code)
+	}
+	s := formatAttribute(code)
+	for _, cv := range d.CodedValues {
+		if formatAttribute(cv.Code) == s {
+			return cv.Name
+		}
+	}
+	return s
+}
+
+// Get the code for a label in a coded-value domain
+func (d *ArcGISDomain) Code(label string) (any, bool) {
+	if d == nil {
+		return nil, false
+	}
+	for _, cv := range d.CodedValues {
+		if strings.EqualFold(cv.Name, label) {
+			return cv.Code, true
+		}
+	}
+	return nil, false
+}
+
+func (d *ArcGISDomain) IsCodedValue() bool {
+	return d != nil && d.Type == "codedValue"
+}
+
+func (d *ArcGISDomain) IsRange() bool {
+	return d != nil && d.Type == "range" && len(d.Range) == 2
+}
+
+type ArcGISField struct {
+	Name         string        `json:"name"`
+	Type         string        `json:"type"`
+	Alias        string        `json:"alias"`
+	SQLType      string        `json:"sqlType"`
+	Length       int           `json:"length"`
+	Nullable     bool          `json:"nullable"`
+	Editable     bool          `json:"editable"`
+	DefaultValue any           `json:"defaultValue"`
+	Domain       *ArcGISDomain `json:"domain"`
+}
+
+// ArcGISSubtype covers both the subtypes and the feature types of a layer
+type ArcGISSubtype struct {
+	ID            any                      `json:"id"`
+	Code          any                      `json:"code"`
+	Name          string                   `json:"name"`
+	DefaultValues map[string]any           `json:"defaultValues"`
+	Domains       map[string]*ArcGISDomain `json:"domains"`
+}
+
+type ArcGISRelationship struct {
+	ID                      int    `json:"id"`
+	Name                    string `json:"name"`
+	RelatedTableID          int    `json:"relatedTableId"`
+	Cardinality             string `json:"cardinality"`
+	Role                    string `json:"role"`
+	KeyField                string `json:"keyField"`
+	Composite               bool   `json:"composite"`
+	RelationshipTableID     int    `json:"relationshipTableId"`
+	KeyFieldInRelationTable string `json:"keyFieldInRelationshipTable"`
+}
+
+type ArcGISAdvancedQueryCapabilities struct {
+	SupportsPagination         bool `json:"supportsPagination"`
+	SupportsStatistics         bool `json:"supportsStatistics"`
+	SupportsOrderBy            bool `json:"supportsOrderBy"`
+	SupportsDistinct           bool `json:"supportsDistinct"`
+	SupportsQueryAttachments   bool `json:"supportsQueryAttachments"`
+	SupportsHavingClause       bool `json:"supportsHavingClause"`
+	SupportsReturningQueryGeom bool `json:"supportsReturningQueryGeometry"`
+}
+
+type ArcGISEditingInfo struct {
+	LastEditDate       int64 `json:"lastEditDate"`
+	SchemaLastEditDate int64 `json:"schemaLastEditDate"`
+	DataLastEditDate   int64 `json:"dataLastEditDate"`
+}
+
+type ArcGISEditFieldsInfo struct {
+	CreationDateField string `json:"creationDateField"`
+	CreatorField      string `json:"creatorField"`
+	EditDateField     string `json:"editDateField"`
+	EditorField       string `json:"editorField"`
+}
+
+// ArcGISLayer is the full JSON description of a single feature layer or table
+type ArcGISLayer struct {
+	ArcGISLayerSummary
+	URL string `json:"-"`
+
+	ObjectIDField  string                `json:"objectIdField"`
+	GlobalIDField  string                `json:"globalIdField"`
+	DisplayField   string                `json:"displayField"`
+	TypeIDField    string                `json:"typeIdField"`
+	SubtypeField   string                `json:"subtypeField"`
+	HasAttachments bool                  `json:"hasAttachments"`
+	HasZ           bool                  `json:"hasZ"`
+	HasM           bool                  `json:"hasM"`
+	Extent         ArcGISExtent          `json:"extent"`
+	Fields         []ArcGISField         `json:"fields"`
+	Types          []ArcGISSubtype       `json:"types"`
+	Subtypes       []ArcGISSubtype       `json:"subtypes"`
+	Relationships  []ArcGISRelationship  `json:"relationships"`
+	EditingInfo    ArcGISEditingInfo     `json:"editingInfo"`
+	EditFieldsInfo *ArcGISEditFieldsInfo `json:"editFieldsInfo"`
+
+	AdvancedQueryCapabilities ArcGISAdvancedQueryCapabilities `json:"advancedQueryCapabilities"`
+}
+
+// Find a field by name, ignoring case
+func (l *ArcGISLayer) Field(name string) *ArcGISField {
+	for i := range l.Fields {
+		if strings.EqualFold(l.Fields[i].Name, name) {
+			return &l.Fields[i]
+		}
+	}
+	return nil
+}
+
+// Get the domain that applies to a field, taking the subtype of the feature into account
+func (l *ArcGISLayer) Domain(field string, attributes map[string]any) *ArcGISDomain {
+	subtypeField := l.SubtypeField
+	if subtypeField == "" {
+		subtypeField = l.TypeIDField
+	}
+	if subtypeField != "" && attributes != nil {
+		code := formatAttribute(attributes[subtypeField])
+		// The layer is shared through the cache, so don't append to its slices
+		for _, subtypes := range [][]ArcGISSubtype{l.Subtypes, l.Types} {
+			for _, s := range subtypes {
+				id := s.Code
+				if id == nil {
+					id = s.ID
+				}
+				if formatAttribute(id) != code {
+					continue
+				}
+				if d, ok := s.Domains[field]; ok && d != nil && d.Type != "inherited" {
+					return d
+				}
+			}
+		}
+	}
+	f := l.Field(field)
+	if f == nil {
+		return nil
+	}
+	return f.Domain
+}
+
+func (l *ArcGISLayer) HasCapability(capability string) bool {
+	return hasCapability(l.Capabilities, capability)
+}
+
+// Format an attribute value as decoded from JSON for display
+func formatAttribute(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case string:
+		return t
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+type schemaCacheEntry struct {
+	lastEditDate int64
+	layers       map[int]*ArcGISLayer
+}
+
+// Layer schemas, keyed by the service URL. Entries are dropped when the
+// service reports a different editingInfo.lastEditDate.
+var (
+	schemaCache     = make(map[string]*schemaCacheEntry)
+	schemaCacheLock sync.Mutex
+)
+
+// Fetch the full description of a layer, using the cache if the service hasn't been edited since
+func fetchLayer(ctx context.Context, access string, serviceURL string, layerID int) (*ArcGISLayer, error) {
+	serviceURL = strings.TrimRight(serviceURL, "/")
+	var root struct {
+		EditingInfo ArcGISEditingInfo `json:"editingInfo"`
+	}
+	err := arcgisGet(ctx, access, serviceURL, nil, &root)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get feature service %s: %w", serviceURL, err)
+	}
+
+	schemaCacheLock.Lock()
+	entry, ok := schemaCache[serviceURL]
+	if !ok || entry.lastEditDate != root.EditingInfo.LastEditDate {
+		entry = &schemaCacheEntry{
+			lastEditDate: root.EditingInfo.LastEditDate,
+			layers:       make(map[int]*ArcGISLayer),
+		}
+		schemaCache[serviceURL] = entry
+	}
+	layer, ok := entry.layers[layerID]
+	schemaCacheLock.Unlock()
+	if ok {
+		return layer, nil
+	}
+
+	// The metadata cache could have it from before the last edit
+	layerURL := fmt.Sprintf("%s/%d", serviceURL, layerID)
+	layer = &ArcGISLayer{}
+	err = arcgisGet(skipCache(ctx), access, layerURL, nil, layer)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get layer %s: %w", layerURL, err)
+	}
+	layer.URL = layerURL
+
+	schemaCacheLock.Lock()
+	entry.layers[layerID] = layer
+	schemaCacheLock.Unlock()
+	return layer, nil
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Shape types in the .shp file. We only write 2D shapes.
+const (
+	shapeNull       = 0
+	shapePoint      = 1
+	shapePolyLine   = 3
+	shapePolygon    = 5
+	shapeMultiPoint = 8
+)
+
+const shapefileHeaderSize = 100
+
+// DBF field names can be at most this long
+const dbfFieldNameLength = 10
+
+// A field of the .dbf file and the layer field it comes from
+type dbfField struct {
+	source   ArcGISField
+	name     string
+	kind     byte
+	length   int
+	decimals int
+}
+
+// boundingBox tracks the extent of everything written so far
+type boundingBox struct {
+	empty                  bool
+	xmin, ymin, xmax, ymax float64
+}
+
+func newBoundingBox() boundingBox {
+	return boundingBox{empty: true}
+}
+
+func (b *boundingBox) add(x float64, y float64) {
+	if b.empty {
+		b.xmin, b.ymin, b.xmax, b.ymax = x, y, x, y
+		b.empty = false
+		return
+	}
+	b.xmin = math.Min(b.xmin, x)
+	b.ymin = math.Min(b.ymin, y)
+	b.xmax = math.Max(b.xmax, x)
+	b.ymax = math.Max(b.ymax, y)
+}
+
+// shapefileWriter writes the .shp, .shx and .dbf files to temporary files as
+// features come in, then zips them up with the .prj when it's done.
+type shapefileWriter struct {
+	w        io.Writer
+	layer    *ArcGISLayer
+	sr       ArcGISSpatialReference
+	name     string
+	shp      *os.File
+	shx      *os.File
+	dbf      *os.File
+	shpOut   *bufio.Writer
+	shxOut   *bufio.Writer
+	dbfOut   *bufio.Writer
+	shpType  int32
+	fields   []dbfField
+	records  int
+	offset   int
+	box      boundingBox
+	dbfWidth int
+}
+
+func newShapefileWriter(w io.Writer, sr ArcGISSpatialReference) *shapefileWriter {
+	return &shapefileWriter{w: w, sr: sr, box: newBoundingBox()}
+}
+
+func shapeTypeFor(geometryType string) (int32, error) {
+	switch geometryType {
+	case GeometryTypePoint:
+		return shapePoint, nil
+	case GeometryTypeMultipoint:
+		return shapeMultiPoint, nil
+	case GeometryTypePolyline:
+		return shapePolyLine, nil
+	case GeometryTypePolygon, GeometryTypeEnvelope:
+		return shapePolygon, nil
+	case "":
+		return shapeNull, nil
+	}
+	return 0, fmt.Errorf("Can't write geometry type '%s' to a shapefile", geometryType)
+}
+
+// Truncate field names to what DBF allows, keeping them unique
+func dbfFieldNames(fields []ArcGISField) []string {
+	used := make(map[string]bool)
+	result := make([]string, len(fields))
+	for i, f := range fields {
+		name := truncateBytes(f.Name, dbfFieldNameLength)
+		for n := 1; used[strings.ToUpper(name)]; n++ {
+			suffix := "_" + strconv.Itoa(n)
+			name = truncateBytes(f.Name, dbfFieldNameLength-len(suffix)) + suffix
+		}
+		used[strings.ToUpper(name)] = true
+		result[i] = name
+	}
+	return result
+}
+
+// Cut a string to at most n bytes without splitting a UTF-8 character
+func truncateBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func dbfFieldFor(f ArcGISField) (dbfField, bool) {
+	d := dbfField{source: f}
+	switch f.Type {
+	case "esriFieldTypeOID", "esriFieldTypeInteger":
+		d.kind, d.length = 'N', 11
+	case "esriFieldTypeSmallInteger":
+		d.kind, d.length = 'N', 6
+	case "esriFieldTypeBigInteger":
+		d.kind, d.length = 'N', 20
+	case "esriFieldTypeSingle":
+		d.kind, d.length, d.decimals = 'N', 13, 6
+	case "esriFieldTypeDouble":
+		d.kind, d.length, d.decimals = 'N', 19, 8
+	case "esriFieldTypeDate":
+		d.kind, d.length = 'D', 8
+	case "esriFieldTypeString":
+		// Services don't always give a length, so use the most DBF allows then
+		d.kind, d.length = 'C', f.Length
+		if d.length <= 0 || d.length > 254 {
+			d.length = 254
+		}
+	case "esriFieldTypeGUID", "esriFieldTypeGlobalID":
+		d.kind, d.length = 'C', 38
+	default:
+		return d, false
+	}
+	return d, true
+}
+
+func (s *shapefileWriter) Begin(layer *ArcGISLayer) error {
+	s.layer = layer
+	s.name = exportFilename(layer.Name)
+	var err error
+	s.shpType, err = shapeTypeFor(layer.GeometryType)
+	if err != nil {
+		return err
+	}
+	fields := make([]ArcGISField, 0)
+	for _, f := range layer.Fields {
+		d, ok := dbfFieldFor(f)
+		if !ok {
+			continue
+		}
+		fields = append(fields, f)
+		s.fields = append(s.fields, d)
+	}
+	for i, name := range dbfFieldNames(fields) {
+		s.fields[i].name = name
+	}
+	s.dbfWidth = 1
+	for _, f := range s.fields {
+		s.dbfWidth += f.length
+	}
+	// The .dbf header stores its own size and the record width in 16 bits
+	if s.dbfWidth > math.MaxUint16 || 32+32*len(s.fields)+1 > math.MaxUint16 {
+		return fmt.Errorf("Layer has too many fields for a shapefile (%d)", len(s.fields))
+	}
+	for _, f := range []**os.File{&s.shp, &s.shx, &s.dbf} {
+		*f, err = os.CreateTemp("", "shapefile")
+		if err != nil {
+			return fmt.Errorf("Failed to create temporary file: %v", err)
+		}
+	}
+	s.shpOut = bufio.NewWriter(s.shp)
+	s.shxOut = bufio.NewWriter(s.shx)
+	s.dbfOut = bufio.NewWriter(s.dbf)
+	// Headers are rewritten with the right sizes at the end
+	s.shpOut.Write(make([]byte, shapefileHeaderSize))
+	s.shxOut.Write(make([]byte, shapefileHeaderSize))
+	s.offset = shapefileHeaderSize
+	return s.writeDBFHeader()
+}
+
+// Remove the temporary files
+func (s *shapefileWriter) Close() error {
+	for _, f := range []**os.File{&s.shp, &s.shx, &s.dbf} {
+		if *f != nil {
+			(*f).Close()
+			os.Remove((*f).Name())
+			*f = nil
+		}
+	}
+	return nil
+}
+
+func (s *shapefileWriter) Write(f ArcGISFeature) error {
+	g, err := f.DecodeGeometry(s.layer.GeometryType)
+	if err != nil {
+		return err
+	}
+	content := s.shapeContent(g)
+	s.records++
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:], uint32(s.records))
+	binary.BigEndian.PutUint32(header[4:], uint32(len(content)/2))
+	s.shpOut.Write(header[:])
+	s.shpOut.Write(content)
+	var index [8]byte
+	binary.BigEndian.PutUint32(index[0:], uint32(s.offset/2))
+	binary.BigEndian.PutUint32(index[4:], uint32(len(content)/2))
+	s.shxOut.Write(index[:])
+	s.offset += len(header) + len(content)
+	return s.writeDBFRecord(f.Attributes)
+}
+
+// Encode the shape record content, a null shape if there's no geometry
+func (s *shapefileWriter) shapeContent(g *ArcGISGeometry) []byte {
+	var b []byte
+	putInt := func(v int32) {
+		b = binary.LittleEndian.AppendUint32(b, uint32(v))
+	}
+	putFloat := func(v float64) {
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+	}
+	if g == nil || g.IsEmpty() || s.shpType == shapeNull {
+		putInt(shapeNull)
+		return b
+	}
+	if g.Type == GeometryTypeEnvelope {
+		gj, _ := g.ToGeoJSON()
+		g = &ArcGISGeometry{Type: GeometryTypePolygon, Rings: gj.Coordinates.([][]Coordinate)}
+	}
+	putInt(s.shpType)
+	if s.shpType == shapePoint {
+		putFloat(*g.X)
+		putFloat(*g.Y)
+		s.box.add(*g.X, *g.Y)
+		return b
+	}
+	parts := g.Paths
+	if s.shpType == shapePolygon {
+		parts = g.Rings
+	}
+	if s.shpType == shapeMultiPoint {
+		parts = [][]Coordinate{g.Points}
+	}
+	box := newBoundingBox()
+	count := 0
+	for _, part := range parts {
+		for _, c := range part {
+			box.add(c[0], c[1])
+			s.box.add(c[0], c[1])
+			count++
+		}
+	}
+	putFloat(box.xmin)
+	putFloat(box.ymin)
+	putFloat(box.xmax)
+	putFloat(box.ymax)
+	if s.shpType != shapeMultiPoint {
+		putInt(int32(len(parts)))
+	}
+	putInt(int32(count))
+	if s.shpType != shapeMultiPoint {
+		start := 0
+		for _, part := range parts {
+			putInt(int32(start))
+			start += len(part)
+		}
+	}
+	for _, part := range parts {
+		for _, c := range part {
+			putFloat(c[0])
+			putFloat(c[1])
+		}
+	}
+	return b
+}
+
+func (s *shapefileWriter) writeDBFHeader() error {
+	now := time.Now()
+	header := make([]byte, 32)
+	header[0] = 0x03
+	header[1] = byte(now.Year() - 1900)
+	header[2] = byte(now.Month())
+	header[3] = byte(now.Day())
+	// The record count at offset 4 is filled in at the end
+	binary.LittleEndian.PutUint16(header[8:], uint16(32+32*len(s.fields)+1))
+	binary.LittleEndian.PutUint16(header[10:], uint16(s.dbfWidth))
+	s.dbfOut.Write(header)
+	for _, f := range s.fields {
+		descriptor := make([]byte, 32)
+		copy(descriptor[0:11], f.name)
+		descriptor[11] = f.kind
+		descriptor[16] = byte(f.length)
+		descriptor[17] = byte(f.decimals)
+		s.dbfOut.Write(descriptor)
+	}
+	return s.dbfOut.WriteByte(0x0D)
+}
+
+func (s *shapefileWriter) writeDBFRecord(attributes map[string]any) error {
+	record := make([]byte, 0, s.dbfWidth)
+	record = append(record, ' ')
+	for _, f := range s.fields {
+		record = append(record, dbfValue(f, attributes[f.source.Name])...)
+	}
+	_, err := s.dbfOut.Write(record)
+	return err
+}
+
+// Format a value as a fixed width DBF field
+func dbfValue(f dbfField, v any) []byte {
+	value := ""
+	switch f.kind {
+	case 'N':
+		if n, ok := v.(float64); ok {
+			value = strconv.FormatFloat(n, 'f', f.decimals, 64)
+			if len(value) > f.length {
+				// dBase fills numbers that don't fit with asterisks
+				value = strings.Repeat("*", f.length)
+			}
+		}
+		return []byte(fmt.Sprintf("%*s", f.length, value))
+	case 'D':
+		if ms, ok := v.(float64); ok {
+			value = time.UnixMilli(int64(ms)).UTC().Format("20060102")
+		}
+	case 'C':
+		value = truncateBytes(formatAttribute(v), f.length)
+	}
+	return []byte(value + strings.Repeat(" ", f.length-len(value)))
+}
+
+// Write the file header of a .shp or .shx file
+func (s *shapefileWriter) shapeHeader(length int) []byte {
+	header := make([]byte, shapefileHeaderSize)
+	binary.BigEndian.PutUint32(header[0:], 9994)
+	binary.BigEndian.PutUint32(header[24:], uint32(length/2))
+	binary.LittleEndian.PutUint32(header[28:], 1000)
+	binary.LittleEndian.PutUint32(header[32:], uint32(s.shpType))
+	if !s.box.empty {
+		for i, v := range []float64{s.box.xmin, s.box.ymin, s.box.xmax, s.box.ymax} {
+			binary.LittleEndian.PutUint64(header[36+8*i:], math.Float64bits(v))
+		}
+	}
+	return header
+}
+
+func (s *shapefileWriter) End() error {
+	s.dbfOut.WriteByte(0x1A)
+	for _, out := range []*bufio.Writer{s.shpOut, s.shxOut, s.dbfOut} {
+		if err := out.Flush(); err != nil {
+			return fmt.Errorf("Failed to write temporary file: %v", err)
+		}
+	}
+	_, err := s.shp.WriteAt(s.shapeHeader(s.offset), 0)
+	if err != nil {
+		return fmt.Errorf("Failed to write shp header: %v", err)
+	}
+	_, err = s.shx.WriteAt(s.shapeHeader(shapefileHeaderSize+8*s.records), 0)
+	if err != nil {
+		return fmt.Errorf("Failed to write shx header: %v", err)
+	}
+	var count [4]byte
+	binary.LittleEndian.PutUint32(count[:], uint32(s.records))
+	_, err = s.dbf.WriteAt(count[:], 4)
+	if err != nil {
+		return fmt.Errorf("Failed to write dbf header: %v", err)
+	}
+
+	archive := zip.NewWriter(s.w)
+	now := time.Now()
+	create := func(name string) (io.Writer, error) {
+		return archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now})
+	}
+	for _, part := range []struct {
+		extension string
+		file      *os.File
+	}{{"shp", s.shp}, {"shx", s.shx}, {"dbf", s.dbf}} {
+		dest, err := create(s.name + "." + part.extension)
+		if err != nil {
+			return fmt.Errorf("Failed to add %s to zip: %v", part.extension, err)
+		}
+		_, err = part.file.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(dest, part.file)
+		if err != nil {
+			return fmt.Errorf("Failed to add %s to zip: %v", part.extension, err)
+		}
+	}
+	if wkt, err := projectionWKT(s.sr); err == nil {
+		dest, err := create(s.name + ".prj")
+		if err != nil {
+			return fmt.Errorf("Failed to add prj to zip: %v", err)
+		}
+		io.WriteString(dest, wkt)
+	}
+	dest, err := create(s.name + ".cpg")
+	if err != nil {
+		return fmt.Errorf("Failed to add cpg to zip: %v", err)
+	}
+	io.WriteString(dest, "UTF-8")
+	return archive.Close()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// The files in an exported shapefile zip, by extension
+func unzipShapefile(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Failed to open zip: %v", err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name[strings.LastIndex(f.Name, ".")+1:]] = content
+	}
+	for _, extension := range []string{"shp", "shx", "dbf", "prj", "cpg"} {
+		if _, ok := files[extension]; !ok {
+			t.Fatalf("Zip has no .%s file", extension)
+		}
+	}
+	return files
+}
+
+type shapeRecord struct {
+	shapeType int32
+	parts     int32
+	points    int32
+}
+
+// Read the records of a .shp file, checking them against the .shx index
+func readShapes(t *testing.T, shp []byte, shx []byte) []shapeRecord {
+	t.Helper()
+	for _, file := range [][]byte{shp, shx} {
+		if code := binary.BigEndian.Uint32(file); code != 9994 {
+			t.Fatalf("File code is %d, want 9994", code)
+		}
+		if length := binary.BigEndian.Uint32(file[24:]); int(length)*2 != len(file) {
+			t.Fatalf("Header says the file is %d bytes, it's %d", length*2, len(file))
+		}
+	}
+	records := make([]shapeRecord, 0)
+	for offset := shapefileHeaderSize; offset < len(shp); {
+		index := shx[shapefileHeaderSize+8*len(records):]
+		if int(binary.BigEndian.Uint32(index))*2 != offset {
+			t.Fatalf("Index has record %d at %d, it's at %d", len(records)+1, binary.BigEndian.Uint32(index)*2, offset)
+		}
+		if number := binary.BigEndian.Uint32(shp[offset:]); int(number) != len(records)+1 {
+			t.Fatalf("Record %d is numbered %d", len(records)+1, number)
+		}
+		length := int(binary.BigEndian.Uint32(shp[offset+4:])) * 2
+		content := shp[offset+8 : offset+8+length]
+		r := shapeRecord{shapeType: int32(binary.LittleEndian.Uint32(content))}
+		switch r.shapeType {
+		case shapePolyLine, shapePolygon:
+			r.parts = int32(binary.LittleEndian.Uint32(content[36:]))
+			r.points = int32(binary.LittleEndian.Uint32(content[40:]))
+			if want := 44 + 4*int(r.parts) + 16*int(r.points); length != want {
+				t.Errorf("Record %d is %d bytes, want %d for its parts and points", len(records)+1, length, want)
+			}
+		case shapeMultiPoint:
+			r.points = int32(binary.LittleEndian.Uint32(content[36:]))
+		}
+		records = append(records, r)
+		offset += 8 + length
+	}
+	return records
+}
+
+// Read the field names and records of a .dbf file
+func readDBF(t *testing.T, dbf []byte) ([]string, [][]string) {
+	t.Helper()
+	count := int(binary.LittleEndian.Uint32(dbf[4:]))
+	headerSize := int(binary.LittleEndian.Uint16(dbf[8:]))
+	width := int(binary.LittleEndian.Uint16(dbf[10:]))
+	if len(dbf) != headerSize+count*width+1 {
+		t.Fatalf("File is %d bytes, want %d for %d records of %d", len(dbf), headerSize+count*width+1, count, width)
+	}
+	names := make([]string, 0)
+	lengths := make([]int, 0)
+	for offset := 32; dbf[offset] != 0x0D; offset += 32 {
+		names = append(names, strings.TrimRight(string(dbf[offset:offset+11]), "\x00"))
+		lengths = append(lengths, int(dbf[offset+16]))
+	}
+	records := make([][]string, 0, count)
+	for i := 0; i < count; i++ {
+		record := dbf[headerSize+i*width+1:]
+		values := make([]string, 0, len(names))
+		for _, length := range lengths {
+			values = append(values, strings.TrimSpace(string(record[:length])))
+			record = record[length:]
+		}
+		records = append(records, values)
+	}
+	return names, records
+}
+
+func TestShapefileGeometries(t *testing.T) {
+	tests := []struct {
+		geometryType string
+		geometry     string
+		want         shapeRecord
+	}{
+		{GeometryTypePoint, `{"x":-121.5,"y":38.5}`, shapeRecord{shapePoint, 0, 0}},
+		{GeometryTypePolygon, `{"rings":[[[0,0],[0,1],[1,1],[1,0],[0,0]],[[5,5],[5,6],[6,6],[6,5],[5,5]]]}`, shapeRecord{shapePolygon, 2, 10}},
+		{GeometryTypePolyline, `{"paths":[[[0,0],[1,1]],[[5,5],[6,6],[7,5]]]}`, shapeRecord{shapePolyLine, 2, 5}},
+		{GeometryTypeMultipoint, `{"points":[[0,0],[1,1],[2,2]]}`, shapeRecord{shapeMultiPoint, 0, 3}},
+	}
+	for _, test := range tests {
+		layer := exportTestLayer(test.geometryType)
+		files := unzipShapefile(t, exportTestFeatures(t, ExportShapefile, layer, []ArcGISFeature{
+			exportTestFeature(1, "Has a geometry", test.geometry),
+			exportTestFeature(2, "Has none", ""),
+		}))
+		shapes := readShapes(t, files["shp"], files["shx"])
+		if len(shapes) != 2 {
+			t.Fatalf("%s: got %d shapes, want 2", test.geometryType, len(shapes))
+		}
+		if shapes[0] != test.want {
+			t.Errorf("%s: got shape %+v, want %+v", test.geometryType, shapes[0], test.want)
+		}
+		if shapes[1].shapeType != shapeNull {
+			t.Errorf("%s: missing geometry was written as shape type %d, want a null shape", test.geometryType, shapes[1].shapeType)
+		}
+		names, records := readDBF(t, files["dbf"])
+		if strings.Join(names, ",") != "OBJECTID,NAME" {
+			t.Errorf("%s: got fields %v", test.geometryType, names)
+		}
+		if len(records) != 2 || records[1][0] != "2" || records[1][1] != "Has none" {
+			t.Errorf("%s: got records %v", test.geometryType, records)
+		}
+	}
+}
+
+func TestShapefileWideSchema(t *testing.T) {
+	layer := exportTestLayer(GeometryTypePoint)
+	attributes := map[string]any{"OBJECTID": float64(1), "NAME": "Wide"}
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("INSPECTION_%03d", i)
+		layer.Fields = append(layer.Fields, ArcGISField{Name: name, Type: "esriFieldTypeInteger"})
+		attributes[name] = float64(i)
+	}
+	f := ArcGISFeature{Attributes: attributes}
+	files := unzipShapefile(t, exportTestFeatures(t, ExportShapefile, layer, []ArcGISFeature{f}))
+	names, records := readDBF(t, files["dbf"])
+	if len(names) != 302 {
+		t.Fatalf("Got %d fields, want 302", len(names))
+	}
+	// The names are cut to ten characters, so most get a suffix to tell them apart
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if len(name) > dbfFieldNameLength || seen[name] {
+			t.Errorf("Field name %s is too long or used twice", name)
+		}
+		seen[name] = true
+	}
+	if len(records) != 1 || records[0][301] != "299" {
+		t.Errorf("Got records %v, want the last field to be 299", records)
+	}
+
+	// Wider records than the header can describe are refused rather than written wrong
+	for i := 0; i < 300; i++ {
+		layer.Fields = append(layer.Fields, ArcGISField{Name: fmt.Sprintf("NOTES_%03d", i), Type: "esriFieldTypeString"})
+	}
+	writer := newShapefileWriter(io.Discard, ArcGISSpatialReference{WKID: WKIDWGS84})
+	defer writer.Close()
+	if err := writer.Begin(layer); err == nil || !strings.Contains(err.Error(), "too many fields") {
+		t.Errorf("Got %v for records wider than a .dbf allows, want too many fields", err)
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+)
+
+// A minimal writer for SQLite database files, just enough to produce a
+// GeoPackage without cgo. It only creates new files, writing each table's
+// b-tree bottom up as rows come in, in rowid order. Pages are numbered from 1,
+// and page 1 is reserved for the schema until the very end.
+
+const sqlitePageSize = 4096
+
+const (
+	sqliteIndexLeaf     = 0x0A
+	sqliteTableInterior = 0x05
+	sqliteTableLeaf     = 0x0D
+)
+
+type sqliteWriter struct {
+	file  *os.File
+	pages uint32
+}
+
+func newSQLiteWriter(file *os.File) *sqliteWriter {
+	// Page 1 is written last, once we know the schema
+	return &sqliteWriter{file: file, pages: 1}
+}
+
+func (s *sqliteWriter) allocatePage() uint32 {
+	s.pages++
+	return s.pages
+}
+
+func (s *sqliteWriter) writePage(number uint32, page []byte) error {
+	_, err := s.file.WriteAt(page, int64(number-1)*sqlitePageSize)
+	if err != nil {
+		return fmt.Errorf("Failed to write database page %d: %v", number, err)
+	}
+	return nil
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	if v>>56 != 0 {
+		var buf [9]byte
+		buf[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			buf[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return append(b, buf[:]...)
+	}
+	var buf [8]byte
+	n := 0
+	for {
+		buf[n] = byte(v & 0x7f)
+		n++
+		v >>= 7
+		if v == 0 {
+			break
+		}
+	}
+	for i := n - 1; i >= 0; i-- {
+		c := buf[i]
+		if i != 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+func varintLength(v uint64) int {
+	return len(appendVarint(nil, v))
+}
+
+// Encode a row in SQLite's record format. Values can be nil, int64, float64, string or []byte.
+func sqliteRecord(values ...any) []byte {
+	types := make([]byte, 0, len(values))
+	body := make([]byte, 0)
+	for _, v := range values {
+		switch t := v.(type) {
+		case nil:
+			types = appendVarint(types, 0)
+		case int64:
+			switch {
+			case t == 0:
+				types = appendVarint(types, 8)
+			case t == 1:
+				types = appendVarint(types, 9)
+			case t >= math.MinInt8 && t <= math.MaxInt8:
+				types = appendVarint(types, 1)
+				body = append(body, byte(t))
+			case t >= math.MinInt16 && t <= math.MaxInt16:
+				types = appendVarint(types, 2)
+				body = binary.BigEndian.AppendUint16(body, uint16(t))
+			case t >= -1<<23 && t < 1<<23:
+				types = appendVarint(types, 3)
+				body = append(body, byte(t>>16), byte(t>>8), byte(t))
+			case t >= math.MinInt32 && t <= math.MaxInt32:
+				types = appendVarint(types, 4)
+				body = binary.BigEndian.AppendUint32(body, uint32(t))
+			case t >= -1<<47 && t < 1<<47:
+				types = appendVarint(types, 5)
+				body = append(body, byte(t>>40), byte(t>>32), byte(t>>24), byte(t>>16), byte(t>>8), byte(t))
+			default:
+				types = appendVarint(types, 6)
+				body = binary.BigEndian.AppendUint64(body, uint64(t))
+			}
+		case float64:
+			types = appendVarint(types, 7)
+			body = binary.BigEndian.AppendUint64(body, math.Float64bits(t))
+		case string:
+			types = appendVarint(types, uint64(len(t))*2+13)
+			body = append(body, t...)
+		case []byte:
+			types = appendVarint(types, uint64(len(t))*2+12)
+			body = append(body, t...)
+		default:
+			panic(fmt.Sprintf("Can't store %T in a SQLite record", v))
+		}
+	}
+	headerSize := len(types) + 1
+	if varintLength(uint64(headerSize)) > 1 {
+		headerSize = len(types) + varintLength(uint64(len(types)+2))
+	}
+	record := appendVarint(nil, uint64(headerSize))
+	record = append(record, types...)
+	return append(record, body...)
+}
+
+type sqliteChild struct {
+	page   uint32
+	maxKey int64
+}
+
+// sqliteTable builds the b-tree of a table from rows added in increasing rowid order
+type sqliteTable struct {
+	db       *sqliteWriter
+	cells    [][]byte
+	used     int
+	children []sqliteChild
+	lastKey  int64
+	started  bool
+}
+
+func newSQLiteTable(db *sqliteWriter) *sqliteTable {
+	return &sqliteTable{db: db, used: 8}
+}
+
+// Add a row. Payloads too large for a page spill into overflow pages.
+func (t *sqliteTable) add(rowid int64, record []byte) error {
+	if t.started && rowid <= t.lastKey {
+		return fmt.Errorf("Rows must be added in increasing rowid order, got %d after %d", rowid, t.lastKey)
+	}
+	cell := appendVarint(nil, uint64(len(record)))
+	cell = appendVarint(cell, uint64(rowid))
+	local := tableLeafLocalSize(len(record))
+	cell = append(cell, record[:local]...)
+	if local < len(record) {
+		first, err := t.db.writeOverflow(record[local:])
+		if err != nil {
+			return err
+		}
+		cell = binary.BigEndian.AppendUint32(cell, first)
+	}
+	if t.used+2+len(cell) > sqlitePageSize {
+		err := t.flushLeaf()
+		if err != nil {
+			return err
+		}
+	}
+	t.cells = append(t.cells, cell)
+	t.used += 2 + len(cell)
+	t.lastKey = rowid
+	t.started = true
+	return nil
+}
+
+// How much of a payload is stored in the table leaf cell itself, per the SQLite file format
+func tableLeafLocalSize(payload int) int {
+	usable := sqlitePageSize
+	maxLocal := usable - 35
+	if payload <= maxLocal {
+		return payload
+	}
+	minLocal := (usable-12)*32/255 - 23
+	k := minLocal + (payload-minLocal)%(usable-4)
+	if k <= maxLocal {
+		return k
+	}
+	return minLocal
+}
+
+// Write content to a chain of overflow pages, returning the first page
+func (s *sqliteWriter) writeOverflow(content []byte) (uint32, error) {
+	first := s.allocatePage()
+	page := first
+	for len(content) > 0 {
+		n := min(len(content), sqlitePageSize-4)
+		var next uint32
+		if n < len(content) {
+			next = s.allocatePage()
+		}
+		buf := make([]byte, sqlitePageSize)
+		binary.BigEndian.PutUint32(buf, next)
+		copy(buf[4:], content[:n])
+		err := s.writePage(page, buf)
+		if err != nil {
+			return 0, err
+		}
+		content = content[n:]
+		page = next
+	}
+	return first, nil
+}
+
+func (t *sqliteTable) flushLeaf() error {
+	number := t.db.allocatePage()
+	err := t.db.writePage(number, btreePage(sqliteTableLeaf, t.cells, 0, 0))
+	if err != nil {
+		return err
+	}
+	t.children = append(t.children, sqliteChild{page: number, maxKey: t.lastKey})
+	t.cells = nil
+	t.used = 8
+	return nil
+}
+
+// Write the remaining rows and the interior pages above them, returning the root page
+func (t *sqliteTable) finish() (uint32, error) {
+	if len(t.cells) > 0 || len(t.children) == 0 {
+		err := t.flushLeaf()
+		if err != nil {
+			return 0, err
+		}
+	}
+	level := t.children
+	for len(level) > 1 {
+		var err error
+		level, err = t.writeInteriorLevel(level)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return level[0].page, nil
+}
+
+// Like finish, but with the root on page 1 after the database header, where
+// the schema table has to be. Page 1 is returned for the caller to fill in the
+// header and write.
+func (t *sqliteTable) finishOnFirstPage() ([]byte, error) {
+	const offset = 100
+	if len(t.children) == 0 && offset+t.used <= sqlitePageSize {
+		return btreePage(sqliteTableLeaf, t.cells, 0, offset), nil
+	}
+	if len(t.cells) > 0 {
+		err := t.flushLeaf()
+		if err != nil {
+			return nil, err
+		}
+	}
+	level := t.children
+	for {
+		last := len(level) - 1
+		cells := interiorCells(level[:last])
+		used := offset + 12
+		for _, cell := range cells {
+			used += 2 + len(cell)
+		}
+		if used <= sqlitePageSize {
+			return btreePage(sqliteTableInterior, cells, level[last].page, offset), nil
+		}
+		var err error
+		level, err = t.writeInteriorLevel(level)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Write the interior pages for one level of the b-tree, returning the level above
+func (t *sqliteTable) writeInteriorLevel(level []sqliteChild) ([]sqliteChild, error) {
+	next := make([]sqliteChild, 0)
+	for start := 0; start < len(level); {
+		// Each interior page holds cells for all its children but the last, which is the right pointer
+		used := 12
+		end := start
+		for end+1 < len(level) {
+			size := 2 + 4 + varintLength(uint64(level[end].maxKey))
+			if used+size > sqlitePageSize {
+				break
+			}
+			used += size
+			end++
+		}
+		number := t.db.allocatePage()
+		err := t.db.writePage(number, btreePage(sqliteTableInterior, interiorCells(level[start:end]), level[end].page, 0))
+		if err != nil {
+			return nil, err
+		}
+		next = append(next, sqliteChild{page: number, maxKey: level[end].maxKey})
+		start = end + 1
+	}
+	return next, nil
+}
+
+func interiorCells(children []sqliteChild) [][]byte {
+	cells := make([][]byte, 0, len(children))
+	for _, child := range children {
+		cell := binary.BigEndian.AppendUint32(nil, child.page)
+		cells = append(cells, appendVarint(cell, uint64(child.maxKey)))
+	}
+	return cells
+}
+
+// Write a single page index holding the given records, which must already be sorted
+func (s *sqliteWriter) writeSmallIndex(records [][]byte) (uint32, error) {
+	cells := make([][]byte, 0, len(records))
+	used := 8
+	for _, r := range records {
+		cell := appendVarint(nil, uint64(len(r)))
+		cell = append(cell, r...)
+		used += 2 + len(cell)
+		cells = append(cells, cell)
+	}
+	if used > sqlitePageSize {
+		return 0, errors.New("Index doesn't fit in a single page")
+	}
+	number := s.allocatePage()
+	return number, s.writePage(number, btreePage(sqliteIndexLeaf, cells, 0, 0))
+}
+
+// Lay out a b-tree page. offset is 100 on page 1 to leave room for the database header.
+func btreePage(kind byte, cells [][]byte, rightPointer uint32, offset int) []byte {
+	page := make([]byte, sqlitePageSize)
+	header := page[offset:]
+	header[0] = kind
+	binary.BigEndian.PutUint16(header[3:], uint16(len(cells)))
+	headerSize := 8
+	if kind == sqliteTableInterior {
+		headerSize = 12
+		binary.BigEndian.PutUint32(header[8:], rightPointer)
+	}
+	content := sqlitePageSize
+	for i, cell := range cells {
+		content -= len(cell)
+		copy(page[content:], cell)
+		binary.BigEndian.PutUint16(header[headerSize+2*i:], uint16(content))
+	}
+	binary.BigEndian.PutUint16(header[5:], uint16(content))
+	return page
+}
+
+// SQLiteSchemaEntry is a row of the sqlite_schema table
+type SQLiteSchemaEntry struct {
+	Type      string
+	Name      string
+	TableName string
+	RootPage  uint32
+	SQL       string
+}
+
+// Write page 1: the database header and the root of the schema table, whose
+// other pages go at the end of the file if it doesn't fit. applicationID and
+// userVersion identify the kind of file, like GeoPackage does.
+func (s *sqliteWriter) writeSchema(entries []SQLiteSchemaEntry, applicationID uint32, userVersion uint32) error {
+	schema := newSQLiteTable(s)
+	for i, e := range entries {
+		var sql any
+		if e.SQL != "" {
+			sql = e.SQL
+		}
+		err := schema.add(int64(i+1), sqliteRecord(e.Type, e.Name, e.TableName, int64(e.RootPage), sql))
+		if err != nil {
+			return err
+		}
+	}
+	page, err := schema.finishOnFirstPage()
+	if err != nil {
+		return err
+	}
+	copy(page, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(page[16:], sqlitePageSize)
+	page[18] = 1 // Legacy journal mode for writing
+	page[19] = 1 // and reading
+	page[20] = 0 // No reserved space at the end of pages
+	page[21] = 64
+	page[22] = 32
+	page[23] = 32
+	binary.BigEndian.PutUint32(page[24:], 1) // File change counter
+	binary.BigEndian.PutUint32(page[28:], s.pages)
+	binary.BigEndian.PutUint32(page[40:], 1) // Schema cookie
+	binary.BigEndian.PutUint32(page[44:], 4) // Schema format
+	binary.BigEndian.PutUint32(page[56:], 1) // UTF-8
+	binary.BigEndian.PutUint32(page[60:], userVersion)
+	binary.BigEndian.PutUint32(page[68:], applicationID)
+	binary.BigEndian.PutUint32(page[92:], 1) // Version valid for the change counter
+	binary.BigEndian.PutUint32(page[96:], 3045000)
+	return s.writePage(1, page)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sqliteReader reads back the files sqliteWriter makes, independently of it,
+// following the SQLite file format: table b-trees, overflow pages and records.
+type sqliteReader struct {
+	t    *testing.T
+	data []byte
+}
+
+func newSQLiteReader(t *testing.T, data []byte) *sqliteReader {
+	t.Helper()
+	if !bytes.HasPrefix(data, []byte("SQLite format 3\x00")) {
+		t.Fatal("Not a SQLite database")
+	}
+	if size := binary.BigEndian.Uint16(data[16:]); size != sqlitePageSize {
+		t.Fatalf("Page size is %d, want %d", size, sqlitePageSize)
+	}
+	if len(data)%sqlitePageSize != 0 {
+		t.Fatalf("File is %d bytes, which isn't a whole number of pages", len(data))
+	}
+	if pages := binary.BigEndian.Uint32(data[28:]); int(pages) != len(data)/sqlitePageSize {
+		t.Fatalf("Header says there are %d pages, the file has %d", pages, len(data)/sqlitePageSize)
+	}
+	return &sqliteReader{t: t, data: data}
+}
+
+func (r *sqliteReader) page(number uint32) []byte {
+	r.t.Helper()
+	if number < 1 || int(number)*sqlitePageSize > len(r.data) {
+		r.t.Fatalf("Page %d is outside the file", number)
+	}
+	return r.data[int(number-1)*sqlitePageSize : int(number)*sqlitePageSize]
+}
+
+func readVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 8; i++ {
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return v<<8 | uint64(b[8]), 9
+}
+
+// The rows of the table with its root on the given page, in the order they're stored
+func (r *sqliteReader) rows(root uint32) ([]int64, [][]any) {
+	r.t.Helper()
+	rowids := make([]int64, 0)
+	rows := make([][]any, 0)
+	var walk func(number uint32)
+	walk = func(number uint32) {
+		page := r.page(number)
+		header := page
+		if number == 1 {
+			header = page[100:]
+		}
+		cells := int(binary.BigEndian.Uint16(header[3:]))
+		switch header[0] {
+		case sqliteTableInterior:
+			for i := 0; i < cells; i++ {
+				cell := page[binary.BigEndian.Uint16(header[12+2*i:]):]
+				walk(binary.BigEndian.Uint32(cell))
+			}
+			walk(binary.BigEndian.Uint32(header[8:]))
+		case sqliteTableLeaf:
+			for i := 0; i < cells; i++ {
+				cell := page[binary.BigEndian.Uint16(header[8+2*i:]):]
+				size, n := readVarint(cell)
+				rowid, m := readVarint(cell[n:])
+				rowids = append(rowids, int64(rowid))
+				rows = append(rows, r.record(r.payload(cell[n+m:], int(size))))
+			}
+		default:
+			r.t.Fatalf("Page %d has type %#x, want a table b-tree page", number, header[0])
+		}
+	}
+	walk(root)
+	return rowids, rows
+}
+
+// Put a payload back together from its cell and overflow pages
+func (r *sqliteReader) payload(cell []byte, size int) []byte {
+	r.t.Helper()
+	maxLocal := sqlitePageSize - 35
+	local := size
+	if size > maxLocal {
+		minLocal := (sqlitePageSize-12)*32/255 - 23
+		local = minLocal + (size-minLocal)%(sqlitePageSize-4)
+		if local > maxLocal {
+			local = minLocal
+		}
+	}
+	payload := append([]byte(nil), cell[:local]...)
+	next := uint32(0)
+	if local < size {
+		next = binary.BigEndian.Uint32(cell[local:])
+	}
+	for next != 0 {
+		page := r.page(next)
+		payload = append(payload, page[4:min(sqlitePageSize, 4+size-len(payload))]...)
+		next = binary.BigEndian.Uint32(page)
+	}
+	if len(payload) != size {
+		r.t.Fatalf("Payload is %d bytes, want %d", len(payload), size)
+	}
+	return payload
+}
+
+func (r *sqliteReader) record(payload []byte) []any {
+	r.t.Helper()
+	headerSize, n := readVarint(payload)
+	types := make([]uint64, 0)
+	for n < int(headerSize) {
+		serial, m := readVarint(payload[n:])
+		types = append(types, serial)
+		n += m
+	}
+	body := payload[headerSize:]
+	values := make([]any, 0, len(types))
+	for _, serial := range types {
+		switch {
+		case serial == 0:
+			values = append(values, nil)
+		case serial <= 6:
+			size := []int{0, 1, 2, 3, 4, 6, 8}[serial]
+			v := int64(int8(body[0]))
+			for _, b := range body[1:size] {
+				v = v<<8 | int64(b)
+			}
+			values = append(values, v)
+			body = body[size:]
+		case serial == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(body)))
+			body = body[8:]
+		case serial == 8 || serial == 9:
+			values = append(values, int64(serial-8))
+		case serial >= 12 && serial%2 == 0:
+			size := int(serial-12) / 2
+			values = append(values, append([]byte{}, body[:size]...))
+			body = body[size:]
+		case serial >= 13:
+			size := int(serial-13) / 2
+			values = append(values, string(body[:size]))
+			body = body[size:]
+		default:
+			r.t.Fatalf("Unknown serial type %d", serial)
+		}
+	}
+	if len(body) != 0 {
+		r.t.Fatalf("%d bytes left over after the record", len(body))
+	}
+	return values
+}
+
+// The schema table on page 1, by name
+func (r *sqliteReader) schema() map[string]SQLiteSchemaEntry {
+	_, rows := r.rows(1)
+	entries := make(map[string]SQLiteSchemaEntry)
+	for _, row := range rows {
+		e := SQLiteSchemaEntry{Type: row[0].(string), Name: row[1].(string), TableName: row[2].(string), RootPage: uint32(row[3].(int64))}
+		if sql, ok := row[4].(string); ok {
+			e.SQL = sql
+		}
+		entries[e.Name] = e
+	}
+	return entries
+}
+
+// Make a database with the given tables and schema written by build
+func writeTestDatabase(t *testing.T, build func(db *sqliteWriter) error) *sqliteReader {
+	t.Helper()
+	file, err := os.Create(filepath.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := build(newSQLiteWriter(file)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newSQLiteReader(t, data)
+}
+
+func TestSQLiteRecord(t *testing.T) {
+	values := []any{nil, int64(0), int64(1), int64(-100), int64(1000), int64(-1 << 20), int64(1 << 30), int64(-1 << 40), int64(math.MaxInt64), 2.5, "text", []byte{1, 2, 3}, ""}
+	r := &sqliteReader{t: t}
+	got := r.record(sqliteRecord(values...))
+	if fmt.Sprint(got) != fmt.Sprint(values) {
+		t.Errorf("Record came back as %v, want %v", got, values)
+	}
+	// Enough columns that the header size takes two bytes
+	wide := make([]any, 200)
+	for i := range wide {
+		wide[i] = fmt.Sprintf("column %d", i)
+	}
+	if got := r.record(sqliteRecord(wide...)); fmt.Sprint(got) != fmt.Sprint(wide) {
+		t.Errorf("Wide record came back as %v", got)
+	}
+}
+
+func TestSQLiteTableRoundTrip(t *testing.T) {
+	// Enough rows for interior pages, with some larger than a page
+	const count = 3000
+	value := func(rowid int64) string {
+		if rowid%500 == 0 {
+			return strings.Repeat(fmt.Sprint(rowid), 4000)
+		}
+		return fmt.Sprintf("row %d", rowid)
+	}
+	// And enough tables that the schema doesn't fit on page 1
+	const tables = 100
+	r := writeTestDatabase(t, func(db *sqliteWriter) error {
+		entries := make([]SQLiteSchemaEntry, 0, tables)
+		for i := 0; i < tables; i++ {
+			table := newSQLiteTable(db)
+			rows := int64(1)
+			if i == 0 {
+				rows = count
+			}
+			for rowid := int64(1); rowid <= rows; rowid++ {
+				if err := table.add(rowid*2, sqliteRecord(value(rowid), rowid)); err != nil {
+					return err
+				}
+			}
+			root, err := table.finish()
+			if err != nil {
+				return err
+			}
+			name := fmt.Sprintf("table_%d", i)
+			entries = append(entries, SQLiteSchemaEntry{"table", name, name, root, fmt.Sprintf("CREATE TABLE %s (name TEXT, n INTEGER)", name)})
+		}
+		return db.writeSchema(entries, 1, 2)
+	})
+
+	schema := r.schema()
+	if len(schema) != tables {
+		t.Fatalf("Schema has %d entries, want %d", len(schema), tables)
+	}
+	rowids, rows := r.rows(schema["table_0"].RootPage)
+	if len(rows) != count {
+		t.Fatalf("Got %d rows, want %d", len(rows), count)
+	}
+	for i, row := range rows {
+		rowid := int64(i + 1)
+		if rowids[i] != rowid*2 || row[0] != value(rowid) || row[1] != rowid {
+			t.Fatalf("Row %d is %d: %.40v, want %d: %.40v", i, rowids[i], row, rowid*2, []any{value(rowid), rowid})
+		}
+	}
+	if _, rows := r.rows(schema["table_99"].RootPage); len(rows) != 1 {
+		t.Errorf("The last table has %d rows, want 1", len(rows))
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fieldSeekerIndexed is what the store indexes a FieldSeeker record by: the
+// date it's about, its zone and the location it belongs to
+type fieldSeekerIndexed interface {
+	indexKeys() (time.Time, string, string)
+	record() *FieldSeekerRecord
+}
+
+func (r *FieldSeekerRecord) indexKeys() (time.Time, string, string) {
+	return r.Created, "", r.GlobalID
+}
+
+func (r *FieldSeekerRecord) record() *FieldSeekerRecord {
+	return r
+}
+
+// Locations are filed under themselves, by when they were last inspected
+func (l *FieldSeekerLocation) indexKeys() (time.Time, string, string) {
+	if l.LastInspected.IsZero() {
+		return l.Created, l.Zone, l.GlobalID
+	}
+	return l.LastInspected, l.Zone, l.GlobalID
+}
+
+func (v *FieldSeekerVisit) indexKeys() (time.Time, string, string) {
+	return v.Start, v.Zone, v.LocationID()
+}
+
+func (t *TrapData) indexKeys() (time.Time, string, string) {
+	return t.Start, t.Zone, t.TrapLocationID
+}
+
+func (s *SpeciesAbundance) indexKeys() (time.Time, string, string) {
+	return s.Created, "", s.TrapDataID
+}
+
+func (p *Pool) indexKeys() (time.Time, string, string) {
+	if p.Tested.IsZero() {
+		return p.Sent, "", p.TrapDataID
+	}
+	return p.Tested, "", p.TrapDataID
+}
+
+func (p *PoolDetail) indexKeys() (time.Time, string, string) {
+	return p.Created, "", p.PoolID
+}
+
+func (s *ServiceRequest) indexKeys() (time.Time, string, string) {
+	return s.Received, s.Zone, s.PointLocationID
+}
+
+type fieldSeekerDateEntry struct {
+	date     time.Time
+	objectID int64
+}
+
+// FieldSeekerTable is the local mirror of one mapped FieldSeeker layer, decoded and indexed
+type FieldSeekerTable struct {
+	Name       FieldSeekerLayerName
+	ServiceURL string
+	LayerID    int
+	ServerGen  int64
+	Updated    time.Time
+
+	records    map[int64]fieldSeekerIndexed
+	byDate     []fieldSeekerDateEntry
+	byZone     map[string][]int64
+	byLocation map[string][]int64
+	// The mirror file as of when the table was built
+	modTime time.Time
+	size    int64
+}
+
+func (t *FieldSeekerTable) Count() int {
+	return len(t.records)
+}
+
+// Every zone in the table, sorted
+func (t *FieldSeekerTable) Zones() []string {
+	zones := make([]string, 0, len(t.byZone))
+	for zone := range t.byZone {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// Decoded tables, keyed by their mirror file. They're rebuilt when the file
+// has been written since, which is after a sync.
+var (
+	fieldSeekerTables     = make(map[string]*FieldSeekerTable)
+	fieldSeekerTablesLock sync.Mutex
+)
+
+// Decode and index a mirror
+func newFieldSeekerTable(name FieldSeekerLayerName, mirror *LayerMirror) (*FieldSeekerTable, error) {
+	model, ok := fieldSeekerModels[name]
+	if !ok {
+		return nil, fmt.Errorf("'%s' isn't a FieldSeeker layer", name)
+	}
+	table := &FieldSeekerTable{
+		Name:       name,
+		ServiceURL: mirror.ServiceURL,
+		LayerID:    mirror.LayerID,
+		ServerGen:  mirror.ServerGen,
+		Updated:    mirror.Updated,
+		records:    make(map[int64]fieldSeekerIndexed, len(mirror.Features)),
+		byZone:     make(map[string][]int64),
+		byLocation: make(map[string][]int64),
+	}
+	response := ArcGISQueryResponse{ObjectIDFieldName: mirror.ObjectIDField}
+	for _, f := range mirror.Features {
+		response.Features = append(response.Features, f)
+	}
+	fields := mapFieldSeekerFields(model, queryResponseFields(&response), mirror.ObjectIDField, "")
+	for objectID, f := range mirror.Features {
+		value := reflect.New(model).Interface()
+		err := fields.decode(f, value)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode %s %d: %v", name, objectID, err)
+		}
+		record := value.(fieldSeekerIndexed)
+		table.records[objectID] = record
+		date, zone, location := record.indexKeys()
+		if !date.IsZero() {
+			table.byDate = append(table.byDate, fieldSeekerDateEntry{date: date, objectID: objectID})
+		}
+		if zone != "" {
+			table.byZone[zone] = append(table.byZone[zone], objectID)
+		}
+		if location != "" {
+			table.byLocation[location] = append(table.byLocation[location], objectID)
+		}
+	}
+	slices.SortFunc(table.byDate, func(a, b fieldSeekerDateEntry) int {
+		return a.date.Compare(b.date)
+	})
+	return table, nil
+}
+
+// Get the mirror of a mapped layer, or nil if it hasn't been pulled yet
+func loadFieldSeekerTable(mapping *FieldSeekerMapping, name FieldSeekerLayerName) (*FieldSeekerTable, error) {
+	layerID, ok := mapping.LayerID(name)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't mapped to a layer of %s", name, mapping.ServiceURL)
+	}
+	// Only read and decode the mirror when it changed since the table was built
+	key := mirrorPath(mapping.ServiceURL, layerID)
+	info, err := os.Stat(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read mirror: %v", err)
+	}
+	fieldSeekerTablesLock.Lock()
+	table, ok := fieldSeekerTables[key]
+	fieldSeekerTablesLock.Unlock()
+	if ok && table.Name == name && table.modTime.Equal(info.ModTime()) && table.size == info.Size() {
+		return table, nil
+	}
+
+	mirror, err := loadLayerMirror(mapping.ServiceURL, layerID)
+	if err != nil || mirror == nil {
+		return nil, err
+	}
+	table, err = newFieldSeekerTable(name, mirror)
+	if err != nil {
+		return nil, err
+	}
+	table.modTime, table.size = info.ModTime(), info.Size()
+	fieldSeekerTablesLock.Lock()
+	fieldSeekerTables[key] = table
+	fieldSeekerTablesLock.Unlock()
+	return table, nil
+}
+
+// Pull every mapped layer into the local mirror, only what changed for layers already mirrored
+func syncFieldSeeker(ctx context.Context, access string, mapping *FieldSeekerMapping) (map[FieldSeekerLayerName]*SyncResult, error) {
+	results := make(map[FieldSeekerLayerName]*SyncResult)
+	var errs []error
+	for _, name := range FieldSeekerLayerNames {
+		layerID, ok := mapping.LayerID(name)
+		if !ok {
+			continue
+		}
+		result, err := syncLayer(ctx, access, mapping.ServiceURL, layerID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Failed to sync %s: %w", name, err))
+			continue
+		}
+		results[name] = result
+	}
+	return results, errors.Join(errs...)
+}
+
+// FieldSeekerQuery picks records out of a mirrored layer. Empty fields match everything.
+type FieldSeekerQuery struct {
+	Layer      FieldSeekerLayerName
+	Zone       string
+	LocationID string
+	// Dates from From up to but not including To
+	From  time.Time
+	To    time.Time
+	Limit int
+}
+
+// The most records a query returns when it doesn't say
+const defaultFieldSeekerLimit = 100
+
+// FieldSeekerResult is a record matched by a query
+type FieldSeekerResult struct {
+	ObjectID   int64
+	Date       time.Time
+	Zone       string
+	LocationID string
+	Record     any
+	Attributes []FieldSeekerAttribute
+}
+
+type FieldSeekerAttribute struct {
+	Name  string
+	Value string
+}
+
+// Read a query from the 'layer', 'zone', 'location', 'from', 'to' and 'limit' parameters
+func parseFieldSeekerQuery(values url.Values) (FieldSeekerQuery, error) {
+	q := FieldSeekerQuery{
+		Layer:      FieldSeekerLayerName(values.Get("layer")),
+		Zone:       values.Get("zone"),
+		LocationID: values.Get("location"),
+		Limit:      defaultFieldSeekerLimit,
+	}
+	if _, ok := fieldSeekerModels[q.Layer]; !ok && q.Layer != "" {
+		return q, fmt.Errorf("'%s' isn't a FieldSeeker layer", q.Layer)
+	}
+	var err error
+	if from := values.Get("from"); from != "" {
+		q.From, err = time.Parse(time.DateOnly, from)
+		if err != nil {
+			return q, fmt.Errorf("Invalid from date '%s'", from)
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		q.To, err = time.Parse(time.DateOnly, to)
+		if err != nil {
+			return q, fmt.Errorf("Invalid to date '%s'", to)
+		}
+		// The to date is included
+		q.To = q.To.AddDate(0, 0, 1)
+	}
+	if limit := values.Get("limit"); limit != "" {
+		q.Limit, err = strconv.Atoi(limit)
+		if err != nil || q.Limit <= 0 {
+			return q, fmt.Errorf("Invalid limit '%s'", limit)
+		}
+	}
+	return q, nil
+}
+
+// Find the records matching a query, newest first. The most selective index
+// picks the candidates and the rest of the query filters them.
+func (t *FieldSeekerTable) Query(q FieldSeekerQuery) []FieldSeekerResult {
+	var candidates []int64
+	switch {
+	case q.LocationID != "":
+		candidates = t.byLocation[q.LocationID]
+	case q.Zone != "":
+		candidates = t.byZone[q.Zone]
+	case !q.From.IsZero() || !q.To.IsZero():
+		start := 0
+		if !q.From.IsZero() {
+			start = sort.Search(len(t.byDate), func(i int) bool { return !t.byDate[i].date.Before(q.From) })
+		}
+		end := len(t.byDate)
+		if !q.To.IsZero() {
+			end = sort.Search(len(t.byDate), func(i int) bool { return !t.byDate[i].date.Before(q.To) })
+		}
+		for _, entry := range t.byDate[start:max(start, end)] {
+			candidates = append(candidates, entry.objectID)
+		}
+	default:
+		for objectID := range t.records {
+			candidates = append(candidates, objectID)
+		}
+	}
+	results := make([]FieldSeekerResult, 0)
+	for _, objectID := range candidates {
+		record := t.records[objectID]
+		date, zone, location := record.indexKeys()
+		if q.Zone != "" && zone != q.Zone {
+			continue
+		}
+		if q.LocationID != "" && location != q.LocationID {
+			continue
+		}
+		if !q.From.IsZero() && (date.IsZero() || date.Before(q.From)) {
+			continue
+		}
+		if !q.To.IsZero() && (date.IsZero() || !date.Before(q.To)) {
+			continue
+		}
+		results = append(results, FieldSeekerResult{
+			ObjectID:   objectID,
+			Date:       date,
+			Zone:       zone,
+			LocationID: location,
+			Record:     record,
+			Attributes: fieldSeekerAttributes(record.record().Attributes),
+		})
+	}
+	slices.SortFunc(results, func(a, b FieldSeekerResult) int {
+		if c := b.Date.Compare(a.Date); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.ObjectID, a.ObjectID)
+	})
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultFieldSeekerLimit
+	}
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// The attributes of a record that have values, sorted by name
+func fieldSeekerAttributes(attributes map[string]any) []FieldSeekerAttribute {
+	result := make([]FieldSeekerAttribute, 0, len(attributes))
+	for name, value := range attributes {
+		if value == nil {
+			continue
+		}
+		result = append(result, FieldSeekerAttribute{Name: name, Value: formatAttribute(value)})
+	}
+	slices.SortFunc(result, func(a, b FieldSeekerAttribute) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return result
+}
+
+// Load every mapped layer that has been mirrored, in the usual order. The
+// mirror is shared by everyone in the organization, so it's only shown to
+// users ArcGIS still lets see the service it was copied from.
+func loadFieldSeekerTables(ctx context.Context, access string, mapping *FieldSeekerMapping) ([]*FieldSeekerTable, error) {
+	_, err := fetchFeatureService(ctx, access, mapping.ServiceURL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to check access to %s: %w", mapping.ServiceURL, err)
+	}
+	tables := make([]*FieldSeekerTable, 0)
+	for _, name := range FieldSeekerLayerNames {
+		if _, ok := mapping.LayerID(name); !ok {
+			continue
+		}
+		table, err := loadFieldSeekerTable(mapping, name)
+		if err != nil {
+			log.Printf("Not showing the mirror of %s: %v", name, err)
+			continue
+		}
+		if table != nil {
+			tables = append(tables, table)
+		}
+	}
+	return tables, nil
+}
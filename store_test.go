@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFieldSeekerDataAccess(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	technician := signIn(t, portal, "fake.technician")
+	admin := signIn(t, portal, "fake.admin")
+	ctx := context.Background()
+	mapping, err := resolveFieldSeekerMapping(ctx, admin.AccessToken)
+	if err != nil || mapping == nil {
+		t.Fatalf("Failed to resolve the mapping: %v", err)
+	}
+	if _, err := syncFieldSeeker(ctx, admin.AccessToken, mapping); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+
+	tables, err := loadFieldSeekerTables(ctx, technician.AccessToken, mapping)
+	if err != nil || len(tables) == 0 {
+		t.Fatalf("Got %d tables (%v) for a technician who can see the service", len(tables), err)
+	}
+	w := callAs(t, "fake.technician", http.MethodGet, "/fieldseeker/data", getFieldSeekerData, "/fieldseeker/data", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Mill pond") {
+		t.Errorf("Got status %d without the mirrored point locations", w.Code)
+	}
+	w = callAs(t, "fake.technician", http.MethodGet, "/", getDashboard, "/", nil)
+	if !strings.Contains(w.Body.String(), "records, synced") {
+		t.Errorf("Got status %d without the mirror on the dashboard", w.Code)
+	}
+
+	// Once the service isn't shared with them, neither is its copy
+	portal.lock.Lock()
+	for i := range portal.items {
+		if portal.items[i].ID == fieldSeekerServiceItem {
+			portal.items[i].Access = "private"
+		}
+	}
+	portal.lock.Unlock()
+	if _, err := loadFieldSeekerTables(ctx, technician.AccessToken, mapping); err == nil {
+		t.Error("Loaded the mirror for a technician who can't see the service")
+	}
+	w = callAs(t, "fake.technician", http.MethodGet, "/fieldseeker/data", getFieldSeekerData, "/fieldseeker/data", nil)
+	if w.Code != http.StatusForbidden || strings.Contains(w.Body.String(), "Mill pond") {
+		t.Errorf("Got status %d for a technician who can't see the service, want %d", w.Code, http.StatusForbidden)
+	}
+	w = callAs(t, "fake.technician", http.MethodGet, "/", getDashboard, "/", nil)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "records, synced") {
+		t.Errorf("Got status %d with the mirror on the dashboard", w.Code)
+	}
+	if tables, err := loadFieldSeekerTables(ctx, admin.AccessToken, mapping); err != nil || len(tables) == 0 {
+		t.Errorf("Got %d tables (%v) for the owner of the service", len(tables), err)
+	}
+}
+
+func TestMirrorSizeLimit(t *testing.T) {
+	startFakePortal(t)
+	mirror := newLayerMirror(fakeServiceURL(), 0, "OBJECTID")
+	if err := saveLayerMirror(mirror); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(mirrorPath(fakeServiceURL(), 0), maxMirrorBytes+1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadLayerMirror(fakeServiceURL(), 0); err == nil {
+		t.Error("Loaded a mirror over the size limit")
+	}
+}
@@ -1,16 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"html/template"
 	"io"
 	"log"
 	"os"
+	"strings"
 )
 
 var (
-	root      = newBuiltTemplate("root", "base")
-	dashboard = newBuiltTemplate("dashboard", "base")
+	attachments = newBuiltTemplate("attachments", "base")
+	content     = newBuiltTemplate("content", "base")
+	dashboard   = newBuiltTemplate("dashboard", "base")
+	feature     = newBuiltTemplate("feature", "base")
+	fieldseeker = newBuiltTemplate("fieldseeker", "base")
+	mirrordata  = newBuiltTemplate("mirrordata", "base")
+	group       = newBuiltTemplate("group", "base")
+	item        = newBuiltTemplate("item", "base")
+	layer       = newBuiltTemplate("layer", "base")
+	root        = newBuiltTemplate("root", "base")
+	usage       = newBuiltTemplate("usage", "base")
 )
 
 type BuiltTemplate struct {
@@ -22,14 +34,106 @@ type Link struct {
 	Href  string
 	Title string
 }
+type ContentAttachments struct {
+	BabbleLinks []Link
+	Groups      []ArcGISAttachmentGroup
+	Layer       *ArcGISLayer
+	ServiceURL  string
+	Username    string
+}
+type ContentContent struct {
+	BabbleLinks []Link
+	Folders     []ContentFolder
+	Username    string
+}
 type ContentDashboard struct {
 	BabbleLinks []Link
+	Changes     []WebhookRecord
+	Group       string
+	Groups      []ArcGISGroup
+	Mapping     *FieldSeekerMapping
+	Services    []ArcGISFeatureService
+	Tables      []*FieldSeekerTable
+	Username    string
+}
+type ContentFeature struct {
+	BabbleLinks []Link
+	Feature     *ArcGISFeature
+	Fields      []FormField
+	Geometry    string
+	Layer       *ArcGISLayer
+	Message     string
+	ObjectID    int64
+	Original    string
+	ServiceURL  string
+	Username    string
+}
+type ContentFieldSeeker struct {
+	BabbleLinks []Link
+	CanEdit     bool
+	Candidate   *FieldSeekerCandidate
+	Candidates  []FieldSeekerCandidate
+	Layers      []ArcGISLayerSummary
+	Mapping     *FieldSeekerMapping
+	Rows        []FieldSeekerRow
+	Username    string
+}
+
+// FieldSeekerRow is a logical layer and the layer picked for it on the mapping page
+type FieldSeekerRow struct {
+	Match   FieldSeekerLayerMatch
+	LayerID int
+}
+type ContentGroup struct {
+	BabbleLinks []Link
+	Group       *ArcGISGroup
+	Items       []ArcGISItem
+	Username    string
+}
+type ContentItem struct {
+	BabbleLinks []Link
+	// The item's data when it's JSON but not a web map
+	Data     string
+	DataSize int
+	Item     *ArcGISItemDetails
+	Username string
+	WebMap   *ArcGISWebMap
+}
+type ContentLayer struct {
+	BabbleLinks []Link
+	Layer       *ArcGISLayer
+	ServiceURL  string
+	Statistics  *LayerStatistics
+	Username    string
+}
+
+// The results of the statistics form on the layer page
+type LayerStatistics struct {
+	GroupBy   []string
+	Name      string
+	Rows      []ArcGISStatisticsRow
+	Statistic ArcGISStatistic
+	Where     string
+}
+type ContentMirrorData struct {
+	BabbleLinks []Link
+	Mapping     *FieldSeekerMapping
+	Query       FieldSeekerQuery
+	Results     []FieldSeekerResult
+	Table       *FieldSeekerTable
+	Tables      []*FieldSeekerTable
 	Username    string
 }
 type ContentRoot struct {
 	BabbleLinks []Link
 }
 
+type ContentUsage struct {
+	BabbleLinks []Link
+	Report      *UsageReport
+	Username    string
+}
+
 func (bt *BuiltTemplate) ExecuteTemplate(w io.Writer, data any) error {
 	name := bt.files[0] + ".html"
 	if bt.template == nil {
@@ -44,14 +148,100 @@ func (bt *BuiltTemplate) ExecuteTemplate(w io.Writer, data any) error {
 	}
 }
 
-func htmlDashboard(w io.Writer, path string, username string) error {
+func htmlAttachments(w io.Writer, path string, username string, serviceURL string, l *ArcGISLayer, groups []ArcGISAttachmentGroup) error {
+	data := ContentAttachments{
+		BabbleLinks: babbleLinks(path),
+		Groups:      groups,
+		Layer:       l,
+		ServiceURL:  serviceURL,
+		Username:    username,
+	}
+	return attachments.ExecuteTemplate(w, data)
+}
+
+func htmlContent(w io.Writer, path string, username string, folders []ContentFolder) error {
+	data := ContentContent{
+		BabbleLinks: babbleLinks(path),
+		Folders:     folders,
+		Username:    username,
+	}
+	return content.ExecuteTemplate(w, data)
+}
+
+func htmlDashboard(w io.Writer, path string, username string, services []ArcGISFeatureService, groups []ArcGISGroup, groupID string, mapping *FieldSeekerMapping, tables []*FieldSeekerTable) error {
 	data := ContentDashboard{
 		BabbleLinks: babbleLinks(path),
+		Changes:     recentWebhooks(10),
+		Group:       groupID,
+		Groups:      groups,
+		Mapping:     mapping,
+		Services:    services,
+		Tables:      tables,
 		Username:    username,
 	}
 	return dashboard.ExecuteTemplate(w, data)
 }
 
+func htmlFeature(w io.Writer, path string, username string, serviceURL string, l *ArcGISLayer, objectID int64, f *ArcGISFeature, message string) error {
+	original, err := json.Marshal(f.Attributes)
+	if err != nil {
+		return err
+	}
+	geometry, err := formGeometry(l, f)
+	if err != nil {
+		return err
+	}
+	data := ContentFeature{
+		BabbleLinks: babbleLinks(path),
+		Feature:     f,
+		Fields:      featureFormFields(l, f),
+		Geometry:    geometry,
+		Layer:       l,
+		Message:     message,
+		ObjectID:    objectID,
+		Original:    string(original),
+		ServiceURL:  serviceURL,
+		Username:    username,
+	}
+	return feature.ExecuteTemplate(w, data)
+}
+
+func htmlGroup(w io.Writer, path string, username string, g *ArcGISGroup, items []ArcGISItem) error {
+	data := ContentGroup{
+		BabbleLinks: babbleLinks(path),
+		Group:       g,
+		Items:       items,
+		Username:    username,
+	}
+	return group.ExecuteTemplate(w, data)
+}
+
+func htmlItem(w io.Writer, path string, username string, details *ArcGISItemDetails, webMap *ArcGISWebMap, data []byte) error {
+	content := ContentItem{
+		BabbleLinks: babbleLinks(path),
+		DataSize:    len(data),
+		Item:        details,
+		Username:    username,
+		WebMap:      webMap,
+	}
+	var pretty bytes.Buffer
+	if webMap == nil && json.Indent(&pretty, data, "", "  ") == nil {
+		content.Data = pretty.String()
+	}
+	return item.ExecuteTemplate(w, content)
+}
+
+func htmlLayer(w io.Writer, path string, username string, serviceURL string, l *ArcGISLayer, statistics *LayerStatistics) error {
+	data := ContentLayer{
+		BabbleLinks: babbleLinks(path),
+		Layer:       l,
+		ServiceURL:  serviceURL,
+		Statistics:  statistics,
+		Username:    username,
+	}
+	return layer.ExecuteTemplate(w, data)
+}
+
 func htmlRoot(w io.Writer, path string) error {
 	data := ContentRoot{
 		BabbleLinks: babbleLinks(path),
@@ -59,8 +249,58 @@ func htmlRoot(w io.Writer, path string) error {
 	return root.ExecuteTemplate(w, data)
 }
 
+func htmlFieldSeeker(w io.Writer, path string, username string, candidates []FieldSeekerCandidate, candidate *FieldSeekerCandidate, mapping *FieldSeekerMapping, canEdit bool) error {
+	data := ContentFieldSeeker{
+		BabbleLinks: babbleLinks(path),
+		CanEdit:     canEdit,
+		Candidate:   candidate,
+		Candidates:  candidates,
+		Mapping:     mapping,
+		Username:    username,
+	}
+	if candidate != nil {
+		data.Layers = append(append(data.Layers, candidate.Service.LayerDetails...), candidate.Service.TableDetails...)
+		for _, match := range candidate.Layers {
+			row := FieldSeekerRow{Match: match, LayerID: match.LayerID}
+			if mapping != nil && mapping.ServiceURL == candidate.Service.URL {
+				row.LayerID = -1
+				if id, ok := mapping.LayerID(match.Name); ok {
+					row.LayerID = id
+				}
+			}
+			data.Rows = append(data.Rows, row)
+		}
+	}
+	return fieldseeker.ExecuteTemplate(w, data)
+}
+
+func htmlMirrorData(w io.Writer, path string, username string, mapping *FieldSeekerMapping, tables []*FieldSeekerTable, table *FieldSeekerTable, q FieldSeekerQuery, results []FieldSeekerResult) error {
+	data := ContentMirrorData{
+		BabbleLinks: babbleLinks(path),
+		Mapping:     mapping,
+		Query:       q,
+		Results:     results,
+		Table:       table,
+		Tables:      tables,
+		Username:    username,
+	}
+	return mirrordata.ExecuteTemplate(w, data)
+}
+
+func htmlUsage(w io.Writer, path string, username string, report *UsageReport) error {
+	data := ContentUsage{
+		BabbleLinks: babbleLinks(path),
+		Report:      report,
+		Username:    username,
+	}
+	return usage.ExecuteTemplate(w, data)
+}
+
 func makeFuncMap() template.FuncMap {
-	funcMap := template.FuncMap{}
+	funcMap := template.FuncMap{
+		"epoch":     formatEpoch,
+		"hasPrefix": strings.HasPrefix,
+	}
 	return funcMap
 }
 func newBuiltTemplate(files ...string) BuiltTemplate {
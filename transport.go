@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptrace"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How many times a throttled or failed request is retried
+const (
+	maxRetries     = 4
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+)
+
+// ArcGIS error codes for a token that is invalid or expired, and missing
+const (
+	arcgisInvalidToken  = 498
+	arcgisTokenRequired = 499
+)
+
+// RequestAttempt is one try at an ArcGIS request, kept for diagnostics
+type RequestAttempt struct {
+	Time     time.Time     `json:"time"`
+	Username string        `json:"-"`
+	Method   string        `json:"method"`
+	URL      string        `json:"url"`
+	Attempt  int           `json:"attempt"`
+	Status   int           `json:"status"`
+	Error    string        `json:"error,omitempty"`
+	Action   string        `json:"action,omitempty"`
+	Delay    time.Duration `json:"delay,omitempty"`
+}
+
+// The most recent attempts, oldest first
+const maxRecordedAttempts = 500
+
+var (
+	recordedAttempts     = make([]RequestAttempt, 0, maxRecordedAttempts)
+	recordedAttemptsLock sync.Mutex
+)
+
+func recordAttempt(a RequestAttempt) {
+	recordedAttemptsLock.Lock()
+	defer recordedAttemptsLock.Unlock()
+	if len(recordedAttempts) == maxRecordedAttempts {
+		recordedAttempts = append(recordedAttempts[:0], recordedAttempts[1:]...)
+	}
+	recordedAttempts = append(recordedAttempts, a)
+}
+
+// The recorded attempts made with a user's token
+func requestAttempts(username string) []RequestAttempt {
+	recordedAttemptsLock.Lock()
+	defer recordedAttemptsLock.Unlock()
+	result := make([]RequestAttempt, 0)
+	for _, a := range recordedAttempts {
+		if a.Username == username {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+// retryTransport refreshes the token once when ArcGIS says it's invalid or
+// expired, and backs off and retries when it throttles or fails.
+type retryTransport struct {
+	next http.RoundTripper
+	// Access tokens that have been replaced by a refresh, keyed by the old one,
+	// and refreshes in progress, so requests rejected together refresh once
+	refreshed     map[string]refreshedToken
+	refreshing    map[string]*tokenRefresh
+	refreshedLock sync.Mutex
+}
+
+// The token that replaced another, kept until it expires itself
+type refreshedToken struct {
+	access  string
+	expires time.Time
+}
+
+type tokenRefresh struct {
+	done   chan struct{}
+	access string
+	err    error
+}
+
+// How long a replacement is kept when the refresh doesn't say when it expires,
+// and how long a refresh may take
+const (
+	defaultRefreshedLifetime = 2 * time.Hour
+	refreshTimeout           = 30 * time.Second
+)
+
+func newRetryTransport(next http.RoundTripper) *retryTransport {
+	return &retryTransport{
+		next:       next,
+		refreshed:  make(map[string]refreshedToken),
+		refreshing: make(map[string]*tokenRefresh),
+	}
+}
+
+// Matches the error envelope ArcGIS sends with a 200 status
+var arcgisErrorCode = regexp.MustCompile(`^\s*\{\s*"error"\s*:\s*\{[^}]*"code"\s*:\s*(\d+)`)
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	access := bearerToken(req)
+	refreshedToken := false
+	for attempt := 1; ; attempt++ {
+		if replacement := t.replacement(access); replacement != "" {
+			access = replacement
+		}
+		try, err := cloneRequest(req, access)
+		if err != nil {
+			return nil, err
+		}
+		try = traceWrites(try)
+		record := RequestAttempt{
+			Time:    time.Now(),
+			Method:  req.Method,
+			URL:     req.URL.Scheme + "://" + req.URL.Host + req.URL.Path,
+			Attempt: attempt,
+		}
+		if token, ok := findTokenByAccess(access); ok {
+			record.Username = token.Username
+		}
+		resp, err := t.next.RoundTrip(try)
+		code := 0
+		if err != nil {
+			record.Error = err.Error()
+		} else {
+			record.Status = resp.StatusCode
+			code = resp.StatusCode
+			if code == http.StatusOK {
+				code, err = peekErrorCode(resp)
+				if err != nil {
+					resp.Body.Close()
+					record.Error = err.Error()
+					recordAttempt(record)
+					return nil, err
+				}
+			}
+		}
+
+		switch {
+		case (code == arcgisInvalidToken || code == arcgisTokenRequired) && access != "" && !refreshedToken:
+			resp.Body.Close()
+			refreshedToken = true
+			record.Action = "refresh token"
+			recordAttempt(record)
+			replacement, err := t.refresh(ctx, access)
+			if err != nil {
+				return nil, fmt.Errorf("Token was rejected and refreshing it failed: %w", err)
+			}
+			access = replacement
+			continue
+		case isRetryable(req, try, err, code) && attempt <= maxRetries:
+			delay := retryDelay(attempt, resp)
+			if resp != nil {
+				resp.Body.Close()
+			}
+			record.Action = "retry"
+			record.Delay = delay
+			recordAttempt(record)
+			log.Printf("Retrying %s %s in %s after attempt %d", req.Method, record.URL, delay, attempt)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		recordAttempt(record)
+		return resp, err
+	}
+}
+
+func bearerToken(req *http.Request) string {
+	return strings.TrimPrefix(req.Header.Get("X-ESRI-Authorization"), "Bearer ")
+}
+
+// Copy a request for another attempt, with its own body and the given token
+func cloneRequest(req *http.Request, access string) (*http.Request, error) {
+	try := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, errors.New("Can't retry a request whose body can't be read again")
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get request body: %v", err)
+		}
+		try.Body = body
+	}
+	if access != "" {
+		try.Header.Set("X-ESRI-Authorization", "Bearer "+access)
+	}
+	return try, nil
+}
+
+// Look at the start of a JSON response for an ArcGIS error code, leaving the body intact
+func peekErrorCode(resp *http.Response) (int, error) {
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "json") && !strings.Contains(contentType, "text/plain") {
+		return resp.StatusCode, nil
+	}
+	start := make([]byte, 256)
+	n, err := io.ReadFull(resp.Body, start)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return 0, fmt.Errorf("Failed to read response body: %v", err)
+	}
+	start = start[:n]
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(start), resp.Body), resp.Body}
+	match := arcgisErrorCode.FindSubmatch(start)
+	if match == nil {
+		return resp.StatusCode, nil
+	}
+	code, _ := strconv.Atoi(string(match[1]))
+	return code, nil
+}
+
+type requestWrittenKey struct{}
+
+// Note on the request when any of it goes out, so we know whether the server
+// could have seen it
+func traceWrites(req *http.Request) *http.Request {
+	written := new(atomic.Bool)
+	trace := &httptrace.ClientTrace{
+		WroteHeaderField: func(string, []string) { written.Store(true) },
+		WroteHeaders:     func() { written.Store(true) },
+	}
+	ctx := context.WithValue(req.Context(), requestWrittenKey{}, written)
+	return req.WithContext(httptrace.WithClientTrace(ctx, trace))
+}
+
+func requestWritten(req *http.Request) bool {
+	written, ok := req.Context().Value(requestWrittenKey{}).(*atomic.Bool)
+	return !ok || written.Load()
+}
+
+// Whether to try a request again. A throttled request wasn't carried out, so
+// any method can be retried then. Otherwise only GET and HEAD are safe to
+// repeat once the server may have seen them; anything else, like applyEdits,
+// is only retried when it failed before a byte of it was sent.
+func isRetryable(req *http.Request, try *http.Request, err error, code int) bool {
+	if err == nil && code == http.StatusTooManyRequests {
+		return true
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return err != nil && !requestWritten(try) && isNetworkError(err)
+	}
+	if err != nil {
+		return isNetworkError(err)
+	}
+	return code >= http.StatusInternalServerError && code <= 599
+}
+
+// Cancellation is the caller's choice, and neither a bad certificate nor a
+// request missing from a cassette will get better. Anything else is likely the
+// network.
+func isNetworkError(err error) bool {
+	var certificateErr *tls.CertificateVerificationError
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) &&
+		!errors.As(err, &certificateErr) && !errors.Is(err, ErrNotRecorded)
+}
+
+// Exponential backoff with full jitter, unless the server says how long to wait
+func retryDelay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if after := resp.Header.Get("Retry-After"); after != "" {
+			if seconds, err := strconv.Atoi(after); err == nil {
+				return min(time.Duration(seconds)*time.Second, retryMaxDelay)
+			}
+			if at, err := http.ParseTime(after); err == nil {
+				return min(max(time.Until(at), 0), retryMaxDelay)
+			}
+		}
+	}
+	ceiling := min(retryBaseDelay<<(attempt-1), retryMaxDelay)
+	return time.Duration(rand.Int64N(int64(ceiling))) + retryBaseDelay/2
+}
+
+func (t *retryTransport) replacement(access string) string {
+	t.refreshedLock.Lock()
+	defer t.refreshedLock.Unlock()
+	return t.replacementLocked(access)
+}
+
+func (t *retryTransport) replacementLocked(access string) string {
+	r, ok := t.refreshed[access]
+	if !ok || time.Now().After(r.expires) {
+		return ""
+	}
+	return r.access
+}
+
+// Refresh the token of whichever user has the given access token. Requests
+// rejected with the same token share one refresh, and one rejected after the
+// token was already replaced just uses the replacement.
+func (t *retryTransport) refresh(ctx context.Context, access string) (string, error) {
+	t.refreshedLock.Lock()
+	if replacement := t.replacementLocked(access); replacement != "" {
+		t.refreshedLock.Unlock()
+		return replacement, nil
+	}
+	call, running := t.refreshing[access]
+	if !running {
+		call = &tokenRefresh{done: make(chan struct{})}
+		t.refreshing[access] = call
+	}
+	t.refreshedLock.Unlock()
+
+	if running {
+		select {
+		case <-call.done:
+			return call.access, call.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	// Other requests are waiting on it, so it shouldn't stop when this one does
+	refreshCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), refreshTimeout)
+	refreshed, err := t.refreshToken(refreshCtx, access)
+	cancel()
+	t.refreshedLock.Lock()
+	delete(t.refreshing, access)
+	if err == nil {
+		t.pruneRefreshed()
+		lifetime := time.Duration(refreshed.ExpiresIn) * time.Second
+		if lifetime <= 0 {
+			lifetime = defaultRefreshedLifetime
+		}
+		t.refreshed[access] = refreshedToken{access: refreshed.AccessToken, expires: time.Now().Add(lifetime)}
+		call.access = refreshed.AccessToken
+	}
+	call.err = err
+	t.refreshedLock.Unlock()
+	close(call.done)
+	return call.access, call.err
+}
+
+func (t *retryTransport) refreshToken(ctx context.Context, access string) (*OAuthTokenResponse, error) {
+	token, ok := findTokenByAccess(access)
+	if !ok {
+		return nil, errors.New("The token doesn't belong to any user we know")
+	}
+	if token.RefreshToken == "" {
+		return nil, fmt.Errorf("No refresh token for '%s'", token.Username)
+	}
+	return refreshAccessToken(ctx, &http.Client{Transport: t.next}, token)
+}
+
+// Forget replacements that have expired. Must be called with refreshedLock held.
+func (t *retryTransport) pruneRefreshed() {
+	now := time.Now()
+	for old, r := range t.refreshed {
+		if now.After(r.expires) {
+			delete(t.refreshed, old)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubTransport answers requests with a function instead of the network
+type stubTransport func(*http.Request) (*http.Response, error)
+
+func (s stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return s(req)
+}
+
+func stubResponse(status int, retryAfter string, body string) *http.Response {
+	header := http.Header{"Content-Type": []string{"application/json"}}
+	if retryAfter != "" {
+		header.Set("Retry-After", retryAfter)
+	}
+	return &http.Response{StatusCode: status, Header: header, Body: io.NopCloser(strings.NewReader(body))}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempt := 1; attempt <= 8; attempt++ {
+		ceiling := min(retryBaseDelay<<(attempt-1), retryMaxDelay)
+		for i := 0; i < 100; i++ {
+			delay := retryDelay(attempt, nil)
+			if delay < retryBaseDelay/2 || delay >= retryBaseDelay/2+ceiling {
+				t.Fatalf("Attempt %d waits %s, want between %s and %s", attempt, delay, retryBaseDelay/2, retryBaseDelay/2+ceiling)
+			}
+		}
+	}
+
+	tests := []struct {
+		retryAfter string
+		min        time.Duration
+		max        time.Duration
+	}{
+		{"3", 3 * time.Second, 3 * time.Second},
+		// The server doesn't get to stall us for longer than we'd wait anyway
+		{"3600", retryMaxDelay, retryMaxDelay},
+		{time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat), 8 * time.Second, 10 * time.Second},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+	}
+	for _, test := range tests {
+		delay := retryDelay(1, stubResponse(http.StatusTooManyRequests, test.retryAfter, ""))
+		if delay < test.min || delay > test.max {
+			t.Errorf("Retry-After %s waits %s, want between %s and %s", test.retryAfter, delay, test.min, test.max)
+		}
+	}
+}
+
+func TestRetryThrottledAndFailed(t *testing.T) {
+	tests := []struct {
+		method   string
+		statuses []int
+		attempts int
+		status   int
+	}{
+		{http.MethodGet, []int{503, 502, 200}, 3, 200},
+		{http.MethodGet, []int{503, 503, 503, 503, 503, 503}, maxRetries + 1, 503},
+		// A throttled request wasn't carried out, so even a POST is tried again
+		{http.MethodPost, []int{429, 200}, 2, 200},
+		// But one that failed might have been, so it isn't
+		{http.MethodPost, []int{503, 200}, 1, 503},
+		{http.MethodGet, []int{404, 200}, 1, 404},
+	}
+	for _, test := range tests {
+		attempts := 0
+		transport := newRetryTransport(stubTransport(func(req *http.Request) (*http.Response, error) {
+			if req.Method == http.MethodPost {
+				if body, _ := io.ReadAll(req.Body); string(body) != "f=json" {
+					t.Errorf("Attempt %d has body '%s'", attempts+1, body)
+				}
+			}
+			status := test.statuses[attempts]
+			attempts++
+			return stubResponse(status, "0", "{}"), nil
+		}))
+		var body io.Reader
+		if test.method == http.MethodPost {
+			body = strings.NewReader("f=json")
+		}
+		req, _ := http.NewRequest(test.method, "https://example.com/arcgis/rest/services", body)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s %v: %v", test.method, test.statuses, err)
+		}
+		resp.Body.Close()
+		if attempts != test.attempts || resp.StatusCode != test.status {
+			t.Errorf("%s %v: got %d after %d attempts, want %d after %d", test.method, test.statuses, resp.StatusCode, attempts, test.status, test.attempts)
+		}
+	}
+}
+
+func TestSharedTokenRefresh(t *testing.T) {
+	t.Chdir(t.TempDir())
+	initTokenDatabase()
+	err := putToken(OAuthTokenResponse{Username: "fake.technician", AccessToken: "expired", RefreshToken: "refresh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the refresh until every request has been rejected, so they all want one at once
+	const requests = 5
+	var rejected, refreshes, served atomic.Int32
+	allRejected := make(chan struct{})
+	transport := newRetryTransport(stubTransport(func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/oauth2/token/") {
+			refreshes.Add(1)
+			select {
+			case <-allRejected:
+			case <-time.After(5 * time.Second):
+				t.Error("Not every request was rejected before the refresh finished")
+			}
+			return stubResponse(http.StatusOK, "", `{"access_token":"refreshed","expires_in":1800}`), nil
+		}
+		switch bearerToken(req) {
+		case "expired":
+			if rejected.Add(1) == requests {
+				close(allRejected)
+			}
+			return stubResponse(http.StatusOK, "", `{"error":{"code":498,"message":"Invalid token."}}`), nil
+		case "refreshed":
+			served.Add(1)
+			return stubResponse(http.StatusOK, "", `{"currentVersion":11.3}`), nil
+		}
+		return stubResponse(http.StatusUnauthorized, "", "{}"), nil
+	}))
+	get := func() error {
+		req, _ := http.NewRequest(http.MethodGet, "https://example.com/arcgis/rest/services", nil)
+		req.Header.Set("X-ESRI-Authorization", "Bearer expired")
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != `{"currentVersion":11.3}` {
+			return fmt.Errorf("Got %s", body)
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := get(); err != nil {
+				t.Errorf("Request failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := refreshes.Load(); n != 1 {
+		t.Errorf("Refreshed the token %d times, want once", n)
+	}
+	if token, _ := getToken("fake.technician"); token.AccessToken != "refreshed" || token.RefreshToken != "refresh" {
+		t.Errorf("Token database has %+v, want the refreshed access token", token)
+	}
+
+	// A request still holding the old token goes straight out with the new one
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+	if rejected.Load() != requests || refreshes.Load() != 1 || served.Load() != requests+1 {
+		t.Errorf("Got %d rejections, %d refreshes and %d served, want %d, 1 and %d", rejected.Load(), refreshes.Load(), served.Load(), requests, requests+1)
+	}
+
+	// Diagnostics only show a user their own requests
+	if len(requestAttempts("fake.technician")) == 0 {
+		t.Error("No attempts were recorded for the user")
+	}
+	for _, a := range requestAttempts("someone.else") {
+		if a.URL == "https://example.com/arcgis/rest/services" {
+			t.Errorf("Another user can see %+v", a)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArcGISUsageEntry is the usage of one kind of service by one user on one item,
+// as a series of [epoch milliseconds, value] points
+type ArcGISUsageEntry struct {
+	EType    string  `json:"etype"`
+	SType    string  `json:"stype"`
+	Username string  `json:"username"`
+	ItemID   string  `json:"itemid"`
+	Credits  [][]any `json:"credits"`
+	Num      [][]any `json:"num"`
+}
+
+type ArcGISUsageResponse struct {
+	StartTime int64              `json:"startTime"`
+	EndTime   int64              `json:"endTime"`
+	Period    string             `json:"period"`
+	Data      []ArcGISUsageEntry `json:"data"`
+}
+
+// UsageTotal is the usage added up for one item, user or service type
+type UsageTotal struct {
+	Key     string
+	Credits float64
+	Count   float64
+}
+
+// UsageReport is the usage over a range of dates, added up a few ways
+type UsageReport struct {
+	Start   time.Time
+	End     time.Time
+	Credits float64
+	ByItem  []UsageTotal
+	ByType  []UsageTotal
+	ByUser  []UsageTotal
+}
+
+// Ways usage can be added up
+const (
+	UsageByItem = "item"
+	UsageByType = "type"
+	UsageByUser = "user"
+)
+
+// The longest range ArcGIS will report daily usage for in one request
+const usageWindow = 30 * 24 * time.Hour
+
+var ErrNotAdmin = errors.New("Only organization administrators can do that")
+
+// Check that the signed in user administers their organization, returning its ID
+func requireOrgAdmin(ctx context.Context, access string) (string, error) {
+	user, err := fetchCommunitySelf(ctx, access)
+	if err != nil {
+		return "", err
+	}
+	if user.Role != "org_admin" {
+		return "", ErrNotAdmin
+	}
+	return user.OrgID, nil
+}
+
+// Fetch daily usage for an organization between two times, a window at a time
+func fetchUsage(ctx context.Context, access string, orgID string, start time.Time, end time.Time) ([]ArcGISUsageEntry, error) {
+	baseURL := PortalURL + "/sharing/rest/portals/" + url.PathEscape(orgID) + "/usage"
+	entries := make([]ArcGISUsageEntry, 0)
+	for windowStart := start; windowStart.Before(end); windowStart = windowStart.Add(usageWindow) {
+		windowEnd := windowStart.Add(usageWindow)
+		if windowEnd.After(end) {
+			windowEnd = end
+		}
+		params := url.Values{
+			"startTime": []string{strconv.FormatInt(windowStart.UnixMilli(), 10)},
+			"endTime":   []string{strconv.FormatInt(windowEnd.UnixMilli(), 10)},
+			"period":    []string{"1d"},
+			"vars":      []string{"credits,num"},
+			"groupby":   []string{"etype,stype,username,itemid"},
+		}
+		var response ArcGISUsageResponse
+		err := arcgisGet(ctx, access, baseURL, params, &response)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get usage of %s: %w", orgID, err)
+		}
+		entries = append(entries, response.Data...)
+	}
+	return entries, nil
+}
+
+// Add up the values in a usage series, which ArcGIS sends as strings
+func sumUsageSeries(series [][]any) float64 {
+	total := 0.0
+	for _, point := range series {
+		if len(point) < 2 {
+			continue
+		}
+		switch v := point[1].(type) {
+		case string:
+			n, err := strconv.ParseFloat(v, 64)
+			if err == nil {
+				total += n
+			}
+		case float64:
+			total += v
+		}
+	}
+	return total
+}
+
+// Add up usage by item, service type or user, most credits first
+func aggregateUsage(entries []ArcGISUsageEntry, by string) []UsageTotal {
+	totals := make(map[string]*UsageTotal)
+	for _, entry := range entries {
+		var key string
+		switch by {
+		case UsageByItem:
+			key = entry.ItemID
+		case UsageByType:
+			key = entry.SType
+		default:
+			key = entry.Username
+		}
+		total, ok := totals[key]
+		if !ok {
+			total = &UsageTotal{Key: key}
+			totals[key] = total
+		}
+		total.Credits += sumUsageSeries(entry.Credits)
+		total.Count += sumUsageSeries(entry.Num)
+	}
+	result := make([]UsageTotal, 0, len(totals))
+	for _, total := range totals {
+		result = append(result, *total)
+	}
+	slices.SortFunc(result, func(a, b UsageTotal) int {
+		switch {
+		case a.Credits > b.Credits:
+			return -1
+		case a.Credits < b.Credits:
+			return 1
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	return result
+}
+
+// Fetch an organization's usage between two dates and add it up. The end date is included.
+func usageReport(ctx context.Context, access string, start time.Time, end time.Time) (*UsageReport, error) {
+	orgID, err := requireOrgAdmin(ctx, access)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fetchUsage(ctx, access, orgID, start, end.AddDate(0, 0, 1))
+	if err != nil {
+		return nil, err
+	}
+	report := &UsageReport{
+		Start:  start,
+		End:    end,
+		ByItem: aggregateUsage(entries, UsageByItem),
+		ByType: aggregateUsage(entries, UsageByType),
+		ByUser: aggregateUsage(entries, UsageByUser),
+	}
+	for _, total := range report.ByUser {
+		report.Credits += total.Credits
+	}
+	return report, nil
+}
+
+// Parse the start and end dates of a usage report, defaulting to the last 30 days
+func parseUsageRange(start string, end string) (time.Time, time.Time, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	endDate := today
+	if end != "" {
+		var err error
+		endDate, err = time.Parse(time.DateOnly, end)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("Invalid end date '%s'", end)
+		}
+	}
+	startDate := endDate.AddDate(0, 0, -29)
+	if start != "" {
+		var err error
+		startDate, err = time.Parse(time.DateOnly, start)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("Invalid start date '%s'", start)
+		}
+	}
+	if endDate.Before(startDate) {
+		return time.Time{}, time.Time{}, errors.New("The end date is before the start date")
+	}
+	return startDate, endDate, nil
+}
+
+// Write usage added up one way as CSV
+func writeUsageCSV(w io.Writer, report *UsageReport, by string) error {
+	totals := report.ByUser
+	header := "username"
+	switch by {
+	case UsageByItem:
+		totals = report.ByItem
+		header = "itemid"
+	case UsageByType:
+		totals = report.ByType
+		header = "stype"
+	}
+	writer := csv.NewWriter(w)
+	writer.Write([]string{header, "credits", "count", "start", "end"})
+	for _, total := range totals {
+		writer.Write([]string{
+			total.Key,
+			strconv.FormatFloat(total.Credits, 'f', 3, 64),
+			strconv.FormatFloat(total.Count, 'f', -1, 64),
+			report.Start.Format(time.DateOnly),
+			report.End.Format(time.DateOnly),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageReport(t *testing.T) {
+	portal, counter := startFakePortal(t)
+	technician := signIn(t, portal, "fake.technician")
+	admin := signIn(t, portal, "fake.admin")
+	ctx := context.Background()
+
+	// 45 days takes two requests, since ArcGIS reports at most 30 at a time
+	start, end, err := parseUsageRange("2024-06-01", "2024-07-15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := usageReport(ctx, admin.AccessToken, start, end)
+	if err != nil {
+		t.Fatalf("Failed to get usage: %v", err)
+	}
+	if n := counter.count("GET /sharing/rest/portals/" + portal.portal["id"].(string) + "/usage"); n != 2 {
+		t.Errorf("Made %d usage requests, want 2", n)
+	}
+	// The fake charges the same every day
+	const days = 45
+	want := map[string][2]float64{"fake.admin": {0.8 * days, days}, "fake.technician": {0.174 * days, 46 * days}}
+	if len(report.ByUser) != len(want) {
+		t.Fatalf("Got usage for %+v, want both users", report.ByUser)
+	}
+	for _, total := range report.ByUser {
+		w := want[total.Key]
+		if math.Abs(total.Credits-w[0]) > 1e-6 || total.Count != w[1] {
+			t.Errorf("%s used %v credits on %v requests, want %v on %v", total.Key, total.Credits, total.Count, w[0], w[1])
+		}
+	}
+	if report.ByUser[0].Key != "fake.admin" || math.Abs(report.Credits-0.974*days) > 1e-6 {
+		t.Errorf("Got %v credits led by %s, want %v led by fake.admin", report.Credits, report.ByUser[0].Key, 0.974*days)
+	}
+	if len(report.ByItem) != 4 || len(report.ByType) != 3 {
+		t.Errorf("Got %d items and %d types, want 4 and 3", len(report.ByItem), len(report.ByType))
+	}
+
+	if _, err := usageReport(ctx, technician.AccessToken, start, end); !errors.Is(err, ErrNotAdmin) {
+		t.Errorf("Got %v for a technician, want ErrNotAdmin", err)
+	}
+}
+
+func TestParseUsageRange(t *testing.T) {
+	start, end, err := parseUsageRange("", "2024-07-15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end.Sub(start) != 29*24*time.Hour {
+		t.Errorf("Default range is %s to %s, want 30 days", start, end)
+	}
+	if _, _, err := parseUsageRange("2024-07-15", "2024-06-01"); err == nil {
+		t.Error("Accepted an end date before the start date")
+	}
+	if _, _, err := parseUsageRange("June 1st", ""); err == nil {
+		t.Error("Accepted a start date that isn't YYYY-MM-DD")
+	}
+}
+
+func TestUsagePages(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	signIn(t, portal, "fake.technician")
+	signIn(t, portal, "fake.admin")
+	const query = "?start=2024-06-01&end=2024-06-10"
+
+	// Only administrators see the organization's usage
+	w := callAs(t, "fake.technician", http.MethodGet, "/admin/usage", getUsage, "/admin/usage"+query, nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Got status %d for a technician, want %d", w.Code, http.StatusForbidden)
+	}
+	w = callAs(t, "fake.technician", http.MethodGet, "/admin/usage.csv", getUsageCSV, "/admin/usage.csv"+query+"&by=user", nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Got status %d for a technician's CSV, want %d", w.Code, http.StatusForbidden)
+	}
+
+	w = callAs(t, "fake.admin", http.MethodGet, "/admin/usage", getUsage, "/admin/usage"+query, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "fake.technician") {
+		t.Errorf("Got status %d without the technician's usage", w.Code)
+	}
+
+	w = callAs(t, "fake.admin", http.MethodGet, "/admin/usage.csv", getUsageCSV, "/admin/usage.csv"+query+"&by=type", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d: %s", w.Code, w.Body)
+	}
+	if disposition := w.Header().Get("Content-Disposition"); !strings.Contains(disposition, "usage-by-type-2024-06-01-2024-06-10.csv") {
+		t.Errorf("Got Content-Disposition %s", disposition)
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || strings.Join(records[0], ",") != "stype,credits,count,start,end" || records[1][0] != "features" || records[1][1] != "8.040" {
+		t.Errorf("Got %v, want a header and three types led by features at 8.040 credits", records)
+	}
+
+	w = callAs(t, "fake.admin", http.MethodGet, "/admin/usage.csv", getUsageCSV, "/admin/usage.csv"+query+"&by=day", nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d for an unknown grouping, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestUsageCommand(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	signIn(t, portal, "fake.technician")
+	signIn(t, portal, "fake.admin")
+
+	code := runCommand("usage", []string{"-user", "fake.admin", "-start", "2024-06-01", "-end", "2024-06-10", "-by", "item", "-out", "usage.csv"})
+	if code != 0 {
+		t.Fatalf("Usage exited with %d", code)
+	}
+	content, err := os.ReadFile("usage.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(content), "itemid,credits,count,start,end\n0f1e5eedf1e1d5ee4e70000000000001,8.000,10,2024-06-01,2024-06-10\n") {
+		t.Errorf("Got %s, want the service item first", content)
+	}
+
+	if code := runCommand("usage", []string{"-user", "fake.technician"}); code != 1 {
+		t.Errorf("Usage for a technician exited with %d, want 1", code)
+	}
+	if code := runCommand("usage", []string{"-user", "fake.admin", "-by", "day"}); code != 2 {
+		t.Errorf("Usage by an unknown grouping exited with %d, want 2", code)
+	}
+}
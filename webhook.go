@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArcGISWebhookEvent is one notification ArcGIS sends when a hosted feature
+// service is edited
+type ArcGISWebhookEvent struct {
+	Name            string   `json:"name"`
+	LayerID         int      `json:"layerId"`
+	OrgID           string   `json:"orgId"`
+	ServiceName     string   `json:"serviceName"`
+	LastUpdatedTime int64    `json:"lastUpdatedTime"`
+	ChangesURL      string   `json:"changesUrl"`
+	Events          []string `json:"events"`
+}
+
+// WebhookRecord is a webhook event we received and what we did about it
+type WebhookRecord struct {
+	Received   time.Time          `json:"received"`
+	Event      ArcGISWebhookEvent `json:"event"`
+	ServiceURL string             `json:"serviceUrl,omitempty"`
+	Error      string             `json:"error,omitempty"`
+}
+
+// The header ArcGIS puts the signature of the payload in, as 'sha256=<hex HMAC>'
+const webhookSignatureHeader = "X-EsriHook-Signature"
+
+// The largest payload we'll read from a webhook
+const maxWebhookBytes = 1 << 20
+
+// How long a sync started by a webhook may take
+const webhookSyncTimeout = 5 * time.Minute
+
+// The signature key configured on the webhook in ArcGIS, and the user whose
+// token syncs the layers it reports changes to
+var WebhookSignatureKey, WebhookUsername string
+
+// File the events we receive are appended to
+var WebhookLogFile = "webhooks.log"
+
+// The most recent events, oldest first
+const maxRecordedWebhooks = 100
+
+var (
+	recordedWebhooks     = make([]WebhookRecord, 0, maxRecordedWebhooks)
+	recordedWebhooksLock sync.Mutex
+)
+
+// Layers with a sync running, and whether another change came in during it
+var (
+	webhookSyncs     = make(map[string]bool)
+	webhookSyncsLock sync.Mutex
+)
+
+func recordWebhook(record WebhookRecord) {
+	recordedWebhooksLock.Lock()
+	defer recordedWebhooksLock.Unlock()
+	if len(recordedWebhooks) == maxRecordedWebhooks {
+		recordedWebhooks = append(recordedWebhooks[:0], recordedWebhooks[1:]...)
+	}
+	recordedWebhooks = append(recordedWebhooks, record)
+
+	content, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Failed to marshal webhook event: %v", err)
+		return
+	}
+	f, err := os.OpenFile(WebhookLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("Failed to open webhook log: %v", err)
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(append(content, '\n'))
+	if err != nil {
+		log.Printf("Failed to write webhook log: %v", err)
+	}
+}
+
+// The most recent webhook events, newest first
+func recentWebhooks(limit int) []WebhookRecord {
+	recordedWebhooksLock.Lock()
+	defer recordedWebhooksLock.Unlock()
+	result := make([]WebhookRecord, 0, min(limit, len(recordedWebhooks)))
+	for i := len(recordedWebhooks) - 1; i >= 0 && len(result) < limit; i-- {
+		result = append(result, recordedWebhooks[i])
+	}
+	return result
+}
+
+// Check the payload was signed with the configured key
+func verifyWebhookSignature(key string, body []byte, signature string) error {
+	if key == "" {
+		return errors.New("No webhook signature key is configured")
+	}
+	digest, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return errors.New("Missing or unsupported webhook signature")
+	}
+	expected, err := hex.DecodeString(digest)
+	if err != nil {
+		return fmt.Errorf("Invalid webhook signature: %v", err)
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return errors.New("Webhook signature doesn't match")
+	}
+	return nil
+}
+
+// ArcGIS sends a list of events, but accept a single one too
+func decodeWebhookEvents(body []byte) ([]ArcGISWebhookEvent, error) {
+	var events []ArcGISWebhookEvent
+	err := json.Unmarshal(body, &events)
+	if err == nil {
+		return events, nil
+	}
+	var event ArcGISWebhookEvent
+	err = json.Unmarshal(body, &event)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal webhook payload: %v", err)
+	}
+	return []ArcGISWebhookEvent{event}, nil
+}
+
+// Work out which feature service an event is about from its changes URL, which
+// ArcGIS sometimes sends percent-encoded
+func webhookServiceURL(event ArcGISWebhookEvent) (string, error) {
+	changesURL := event.ChangesURL
+	if !strings.Contains(changesURL, "://") {
+		decoded, err := url.QueryUnescape(changesURL)
+		if err != nil {
+			return "", fmt.Errorf("Invalid changes URL '%s': %v", event.ChangesURL, err)
+		}
+		changesURL = decoded
+	}
+	u, err := url.Parse(changesURL)
+	if err != nil {
+		return "", fmt.Errorf("Invalid changes URL '%s': %v", event.ChangesURL, err)
+	}
+	u.RawQuery = ""
+	u.Path = strings.TrimSuffix(strings.TrimRight(u.Path, "/"), "/extractChanges")
+	serviceURL := u.String()
+	err = validateServiceURL(serviceURL)
+	if err != nil {
+		return "", err
+	}
+	return serviceURL, nil
+}
+
+// Sync a layer in the background. Changes that come in while it's syncing are
+// picked up by one more sync once it's done, rather than a sync each.
+func queueWebhookSync(serviceURL string, layerID int) {
+	key := fmt.Sprintf("%s/%d", serviceURL, layerID)
+	webhookSyncsLock.Lock()
+	_, running := webhookSyncs[key]
+	webhookSyncs[key] = running
+	webhookSyncsLock.Unlock()
+	if running {
+		return
+	}
+	go func() {
+		for {
+			runWebhookSync(serviceURL, layerID)
+			webhookSyncsLock.Lock()
+			again := webhookSyncs[key]
+			if !again {
+				delete(webhookSyncs, key)
+			} else {
+				webhookSyncs[key] = false
+			}
+			webhookSyncsLock.Unlock()
+			if !again {
+				return
+			}
+		}
+	}()
+}
+
+func runWebhookSync(serviceURL string, layerID int) {
+	token, ok := getToken(WebhookUsername)
+	if !ok {
+		log.Printf("Not syncing %s/%d, there's no token for webhook user '%s'", serviceURL, layerID, WebhookUsername)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookSyncTimeout)
+	defer cancel()
+	// The service was just edited, so what's cached about it may be out of date
+	arcgisCache.invalidateService(serviceURL)
+	_, err := syncLayer(ctx, token.AccessToken, serviceURL, layerID)
+	if err != nil {
+		log.Printf("Failed to sync %s/%d after webhook: %v", serviceURL, layerID, err)
+	}
+}
+
+func postWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBytes))
+	if err != nil {
+		http.Error(w, "Failed to read payload", http.StatusBadRequest)
+		return
+	}
+	err = verifyWebhookSignature(WebhookSignatureKey, body, r.Header.Get(webhookSignatureHeader))
+	if err != nil {
+		log.Printf("Rejecting webhook: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	events, err := decodeWebhookEvents(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, event := range events {
+		record := WebhookRecord{Received: time.Now(), Event: event}
+		serviceURL, err := webhookServiceURL(event)
+		if err != nil {
+			record.Error = err.Error()
+		} else {
+			record.ServiceURL = serviceURL
+			if WebhookUsername != "" {
+				queueWebhookSync(serviceURL, event.LayerID)
+			}
+		}
+		log.Printf("Webhook '%s' reported %s on %s layer %d", event.Name, strings.Join(event.Events, ", "), event.ServiceName, event.LayerID)
+		recordWebhook(record)
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testWebhookKey = "webhook-secret"
+
+func signWebhook(key string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	body := []byte(`[{"name":"edits"}]`)
+	tests := []struct {
+		key       string
+		signature string
+		valid     bool
+	}{
+		{testWebhookKey, signWebhook(testWebhookKey, body), true},
+		{testWebhookKey, signWebhook("another key", body), false},
+		{testWebhookKey, signWebhook(testWebhookKey, []byte(`[{"name":"other"}]`)), false},
+		{testWebhookKey, "", false},
+		{testWebhookKey, strings.TrimPrefix(signWebhook(testWebhookKey, body), "sha256="), false},
+		{testWebhookKey, "sha256=not-hex", false},
+		// Without a key nothing can be checked, so nothing is accepted
+		{"", signWebhook("", body), false},
+	}
+	for _, test := range tests {
+		err := verifyWebhookSignature(test.key, body, test.signature)
+		if (err == nil) != test.valid {
+			t.Errorf("Signature '%s' with key '%s' gave %v, want valid %v", test.signature, test.key, err, test.valid)
+		}
+	}
+}
+
+func TestWebhookServiceURL(t *testing.T) {
+	previousHosts := ServerHosts
+	t.Cleanup(func() { ServerHosts = previousHosts })
+	ServerHosts = nil
+	changes := "https://services3.arcgis.com/abc/arcgis/rest/services/FieldseekerGIS/FeatureServer/extractChanges?serverGens=[1,2]"
+	want := "https://services3.arcgis.com/abc/arcgis/rest/services/FieldseekerGIS/FeatureServer"
+	for _, changesURL := range []string{changes, url.QueryEscape(changes)} {
+		serviceURL, err := webhookServiceURL(ArcGISWebhookEvent{ChangesURL: changesURL})
+		if err != nil || serviceURL != want {
+			t.Errorf("%s is for %s (%v), want %s", changesURL, serviceURL, err, want)
+		}
+	}
+	// We'd be sending a token there to sync it
+	if _, err := webhookServiceURL(ArcGISWebhookEvent{ChangesURL: "https://example.com/arcgis/rest/services/X/FeatureServer/extractChanges"}); err == nil {
+		t.Error("Accepted a service on a host we don't trust")
+	}
+}
+
+func TestPostWebhook(t *testing.T) {
+	portal, _ := startFakePortal(t)
+	signIn(t, portal, "fake.technician")
+	previousKey, previousUser := WebhookSignatureKey, WebhookUsername
+	t.Cleanup(func() {
+		WebhookSignatureKey, WebhookUsername = previousKey, previousUser
+		recordedWebhooksLock.Lock()
+		recordedWebhooks = recordedWebhooks[:0]
+		recordedWebhooksLock.Unlock()
+	})
+	WebhookSignatureKey, WebhookUsername = testWebhookKey, "fake.technician"
+	recordedWebhooksLock.Lock()
+	recordedWebhooks = recordedWebhooks[:0]
+	recordedWebhooksLock.Unlock()
+
+	body, _ := json.Marshal([]ArcGISWebhookEvent{
+		{Name: "edits", LayerID: 0, ServiceName: "FieldseekerGIS", ChangesURL: url.QueryEscape(fakeServiceURL() + "/extractChanges?serverGens=[1,2]"), Events: []string{"FeaturesUpdated"}},
+		{Name: "edits", LayerID: 0, ServiceName: "Elsewhere", ChangesURL: "https://example.com/arcgis/rest/services/Elsewhere/FeatureServer/extractChanges", Events: []string{"FeaturesCreated"}},
+	})
+	post := func(signature string) int {
+		req := httptest.NewRequest(http.MethodPost, "/webhooks/arcgis", strings.NewReader(string(body)))
+		if signature != "" {
+			req.Header.Set(webhookSignatureHeader, signature)
+		}
+		w := httptest.NewRecorder()
+		postWebhook(w, req)
+		return w.Code
+	}
+
+	for _, signature := range []string{"", signWebhook("another key", body)} {
+		if code := post(signature); code != http.StatusUnauthorized {
+			t.Errorf("Got status %d for signature '%s', want %d", code, signature, http.StatusUnauthorized)
+		}
+	}
+	if records := recentWebhooks(10); len(records) != 0 {
+		t.Fatalf("Recorded %d events from unsigned payloads", len(records))
+	}
+
+	if code := post(signWebhook(testWebhookKey, body)); code != http.StatusOK {
+		t.Fatalf("Got status %d for a signed payload", code)
+	}
+	records := recentWebhooks(10)
+	if len(records) != 2 {
+		t.Fatalf("Recorded %d events, want 2", len(records))
+	}
+	// Newest first
+	if records[0].Error == "" || records[0].ServiceURL != "" {
+		t.Errorf("Event for an untrusted host was recorded as %+v, want an error", records[0])
+	}
+	if records[1].ServiceURL != fakeServiceURL() || records[1].Error != "" {
+		t.Errorf("Event was recorded as %+v, want it for the fake service", records[1])
+	}
+	content, err := os.ReadFile(WebhookLogFile)
+	if err != nil || strings.Count(string(content), "\n") != 2 {
+		t.Errorf("Webhook log has %q (%v), want two lines", content, err)
+	}
+
+	// The layer it was about gets synced in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		webhookSyncsLock.Lock()
+		running := len(webhookSyncs)
+		webhookSyncsLock.Unlock()
+		if running == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The sync started by the webhook didn't finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mirror, err := loadLayerMirror(fakeServiceURL(), 0)
+	if err != nil || mirror == nil || len(mirror.Features) != 4 {
+		t.Errorf("Mirror is %+v (%v), want the 4 features of the layer", mirror, err)
+	}
+}